@@ -1,3 +1,6 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
 /*
  * Copyright 2021 NAVER Corp.
  *
@@ -1,3 +1,6 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
 
 /*
  * Copyright 2021 NAVER Corp.
@@ -70,6 +73,10 @@ void inst_str(Inst* inst,char* buf,int buf_size)
         buf_size -= done;
 	}
 
-	//rollback suffix_str
-	*(pbuf - strlen(SUFFIX_STR))= '\0';
+	//rollback suffix_str, or the space after op if there is no arg
+	if (i == 0) {
+		*(pbuf - 1) = '\0';
+	} else {
+		*(pbuf - strlen(SUFFIX_STR))= '\0';
+	}
 }
\ No newline at end of file
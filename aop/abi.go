@@ -0,0 +1,136 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"reflect"
+	"runtime"
+	"unsafe"
+)
+
+const ptrSize = int(unsafe.Sizeof(uintptr(0)))
+
+// integer and floating-point registers of ABIInternal
+func abiRegs() (ints, floats int) {
+	if runtime.GOARCH == "arm64" {
+		return 16, 16
+	}
+	return 9, 15
+}
+
+func alignUp(n, align int) int {
+	return (n + align - 1) &^ (align - 1)
+}
+
+/**
+ * @description: registers taking a value of `t`: a struct takes the registers of its fields,
+ *  an array of one element those of the element, a longer array is never in registers
+ * @param {reflect.Type} t
+ * @return {*} false if `t` goes to the stack
+ */
+func regsOf(t reflect.Type) (ints, floats int, ok bool) {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return 0, 1, true
+	case reflect.Complex64, reflect.Complex128:
+		return 0, 2, true
+	case reflect.String, reflect.Interface:
+		return 2, 0, true
+	case reflect.Slice:
+		return 3, 0, true
+	case reflect.Array:
+		switch t.Len() {
+		case 0:
+			return 0, 0, true
+		case 1:
+			return regsOf(t.Elem())
+		}
+		return 0, 0, false
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			fieldInts, fieldFloats, fieldOk := regsOf(t.Field(i).Type)
+			if !fieldOk {
+				return 0, 0, false
+			}
+			ints += fieldInts
+			floats += fieldFloats
+		}
+		return ints, floats, true
+	default:
+		return 1, 0, true
+	}
+}
+
+/**
+ * @description: the integer register after the arguments of a function of type `typ`,
+ *  where one more pointer parameter goes
+ * @param {reflect.Type} typ
+ * @return {*} false if the arguments are on the stack, or no integer register is left
+ */
+func nextIntReg(typ reflect.Type) (int, bool) {
+	if !regABI {
+		return 0, false
+	}
+	maxInts, maxFloats := abiRegs()
+	used, usedFloats := 0, 0
+	for i := 0; i < typ.NumIn(); i++ {
+		if ints, floats, ok := regsOf(typ.In(i)); ok && used+ints <= maxInts && usedFloats+floats <= maxFloats {
+			used += ints
+			usedFloats += floats
+		}
+	}
+	return used, used < maxInts
+}
+
+/**
+ * @description: `args` of the runtime _func of a function of type `typ`.
+ *  ABI0: the arguments and results on the stack.
+ *  ABIInternal: the arguments and results not in registers, and the spill space of the arguments in registers
+ * @param {reflect.Type} typ
+ * @return {*}
+ */
+func argFrameSize(typ reflect.Type) int {
+	params := make([]reflect.Type, typ.NumIn())
+	for i := range params {
+		params[i] = typ.In(i)
+	}
+	results := make([]reflect.Type, typ.NumOut())
+	for i := range results {
+		results[i] = typ.Out(i)
+	}
+
+	stack, spill := 0, 0
+	// assign registers to `types` in order, the one not fitting goes to the stack
+	assign := func(types []reflect.Type, spilled bool) {
+		maxInts, maxFloats := abiRegs()
+		for _, t := range types {
+			if ints, floats, ok := regsOf(t); regABI && ok && ints <= maxInts && floats <= maxFloats {
+				maxInts -= ints
+				maxFloats -= floats
+				if spilled {
+					spill = alignUp(spill, t.Align()) + int(t.Size())
+				}
+				continue
+			}
+			stack = alignUp(stack, t.Align()) + int(t.Size())
+		}
+		stack = alignUp(stack, ptrSize)
+	}
+	assign(params, true)
+	assign(results, false)
+	return stack + alignUp(spill, ptrSize)
+}
@@ -0,0 +1,24 @@
+//go:build !((go1.17 && amd64) || (go1.18 && arm64))
+// +build !go1.17 !amd64
+// +build !go1.18 !arm64
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+// arguments are passed on the stack, go functions are ABI0
+const regABI = false
@@ -0,0 +1,390 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#include "arm64.h"
+#include <stdio.h>
+
+#define X17 17
+#define XZR 31
+
+static inline int64_t sign_extend(uint64_t v, int bits)
+{
+    uint64_t m = 1ULL << (bits - 1);
+    v &= (1ULL << bits) - 1;
+    return (int64_t)((v ^ m) - m);
+}
+
+// offset fits in a signed `bits` field scaled by 4
+static inline int fits(int64_t offset, int bits)
+{
+    int64_t words = offset >> 2;
+    return (offset & 3) == 0 && words >= -(1LL << (bits - 1)) && words < (1LL << (bits - 1));
+}
+
+ARM64_INST_TYPE arm64_inst_type(uint32_t inst)
+{
+    if ((inst & 0xFC000000) == 0x14000000)
+        return ARM64_B;
+    if ((inst & 0xFC000000) == 0x94000000)
+        return ARM64_BL;
+    if ((inst & 0xFF000010) == 0x54000000)
+        return ARM64_B_COND;
+    if ((inst & 0x7E000000) == 0x34000000)
+        return ARM64_CBZ;
+    if ((inst & 0x7E000000) == 0x36000000)
+        return ARM64_TBZ;
+    if ((inst & 0x9F000000) == 0x10000000)
+        return ARM64_ADR;
+    if ((inst & 0x9F000000) == 0x90000000)
+        return ARM64_ADRP;
+    if ((inst & 0x3B000000) == 0x18000000)
+    {
+        if (inst & (1 << 26))
+            return ARM64_LDR_LIT_V;
+        return (inst >> 30) == 3 ? ARM64_PRFM_LIT : ARM64_LDR_LIT;
+    }
+    return ARM64_OTHER;
+}
+
+uint64_t arm64_inst_target(uint32_t inst, uint64_t pc)
+{
+    switch (arm64_inst_type(inst))
+    {
+    case ARM64_B:
+    case ARM64_BL:
+        return pc + (sign_extend(inst, 26) << 2);
+    case ARM64_B_COND:
+    case ARM64_CBZ:
+    case ARM64_LDR_LIT:
+    case ARM64_LDR_LIT_V:
+    case ARM64_PRFM_LIT:
+        return pc + (sign_extend(inst >> 5, 19) << 2);
+    case ARM64_TBZ:
+        return pc + (sign_extend(inst >> 5, 14) << 2);
+    case ARM64_ADR:
+        return pc + sign_extend(((inst >> 5) & 0x7FFFF) << 2 | ((inst >> 29) & 3), 21);
+    case ARM64_ADRP:
+        return (pc & ~0xFFFULL) + (sign_extend(((inst >> 5) & 0x7FFFF) << 2 | ((inst >> 29) & 3), 21) << 12);
+    default:
+        return 0;
+    }
+}
+
+int arm64_b_in_range(uint64_t pc, uint64_t target)
+{
+    return fits((int64_t)(target - pc), 26);
+}
+
+uint32_t arm64_b(uint64_t pc, uint64_t target)
+{
+    return 0x14000000 | (((int64_t)(target - pc) >> 2) & 0x3FFFFFF);
+}
+
+uint32_t arm64_bl(uint64_t pc, uint64_t target)
+{
+    return 0x94000000 | (((int64_t)(target - pc) >> 2) & 0x3FFFFFF);
+}
+
+// ldr xt, #offset
+uint32_t arm64_ldr_lit(uint32_t rt, int32_t offset)
+{
+    return 0x58000000 | (((uint32_t)(offset >> 2) & 0x7FFFF) << 5) | rt;
+}
+
+static inline int32_t place_quad(uint32_t *out, uint64_t v)
+{
+    out[0] = (uint32_t)v;
+    out[1] = (uint32_t)(v >> 32);
+    return 2;
+}
+
+int32_t arm64_place_abs_jmp(uint32_t *out, uint64_t target)
+{
+    out[0] = arm64_ldr_lit(X17, 8);
+    out[1] = ARM64_BR_X17;
+    place_quad(out + 2, target);
+    return ARM64_ABS_JMP_WORDS;
+}
+
+// replace the imm19 (bits 5..23) of b.cond/cbz/ldr literal
+static inline uint32_t set_imm19(uint32_t inst, int64_t offset)
+{
+    return (inst & ~(0x7FFFFu << 5)) | (((uint32_t)(offset >> 2) & 0x7FFFF) << 5);
+}
+
+// replace the imm14 (bits 5..18) of tbz
+static inline uint32_t set_imm14(uint32_t inst, int64_t offset)
+{
+    return (inst & ~(0x3FFFu << 5)) | (((uint32_t)(offset >> 2) & 0x3FFF) << 5);
+}
+
+static inline uint32_t set_adr_imm(uint32_t inst, int64_t imm)
+{
+    return (inst & 0x9F00001F) | (((uint32_t)imm & 3) << 29) | ((((uint32_t)imm >> 2) & 0x7FFFF) << 5);
+}
+
+/**
+ * @brief conditional branch out of range:
+ *  inverted branch over the stub; ldr x17, #8; br x17; .quad target
+ */
+static int32_t place_far_cond(uint32_t inverted, uint64_t target, uint32_t *out)
+{
+    out[0] = inverted;
+    arm64_place_abs_jmp(out + 1, target);
+    return 1 + ARM64_ABS_JMP_WORDS;
+}
+
+int32_t arm64_relocate_inst(uint32_t inst, uint64_t pc, uint64_t newPc, uint32_t *out)
+{
+    uint64_t target = arm64_inst_target(inst, pc);
+    int64_t offset = (int64_t)(target - newPc);
+    uint32_t rt = inst & 0x1F;
+
+    switch (arm64_inst_type(inst))
+    {
+    case ARM64_OTHER:
+        out[0] = inst;
+        return 1;
+
+    case ARM64_B:
+        if (fits(offset, 26))
+        {
+            out[0] = arm64_b(newPc, target);
+            return 1;
+        }
+        return arm64_place_abs_jmp(out, target);
+
+    case ARM64_BL:
+        if (fits(offset, 26))
+        {
+            out[0] = arm64_bl(newPc, target);
+            return 1;
+        }
+        // ldr x17, #12; blr x17; b #12; .quad target
+        out[0] = arm64_ldr_lit(X17, 12);
+        out[1] = ARM64_BLR_X17;
+        out[2] = 0x14000003;
+        place_quad(out + 3, target);
+        return 5;
+
+    case ARM64_B_COND:
+        if (fits(offset, 19))
+        {
+            out[0] = set_imm19(inst, offset);
+            return 1;
+        }
+        if ((inst & 0xE) == 0xE)
+        {
+            // al/nv: always taken
+            return arm64_place_abs_jmp(out, target);
+        }
+        return place_far_cond(set_imm19(inst ^ 1, 5 * ARM64_INST_SIZE), target, out);
+
+    case ARM64_CBZ:
+        if (fits(offset, 19))
+        {
+            out[0] = set_imm19(inst, offset);
+            return 1;
+        }
+        // cbz <-> cbnz
+        return place_far_cond(set_imm19(inst ^ (1 << 24), 5 * ARM64_INST_SIZE), target, out);
+
+    case ARM64_TBZ:
+        if (fits(offset, 14))
+        {
+            out[0] = set_imm14(inst, offset);
+            return 1;
+        }
+        // tbz <-> tbnz
+        return place_far_cond(set_imm14(inst ^ (1 << 24), 5 * ARM64_INST_SIZE), target, out);
+
+    case ARM64_ADR:
+    case ARM64_ADRP:
+        if (rt == XZR)
+        {
+            out[0] = ARM64_NOP;
+            return 1;
+        }
+        if (arm64_inst_type(inst) == ARM64_ADR && offset >= -(1LL << 20) && offset < (1LL << 20))
+        {
+            out[0] = set_adr_imm(inst, offset);
+            return 1;
+        }
+        if (arm64_inst_type(inst) == ARM64_ADRP)
+        {
+            int64_t pages = (int64_t)(target >> 12) - (int64_t)(newPc >> 12);
+            if (pages >= -(1LL << 20) && pages < (1LL << 20))
+            {
+                out[0] = set_adr_imm(inst, pages);
+                return 1;
+            }
+        }
+        // ldr xd, #8; b #12; .quad target
+        out[0] = arm64_ldr_lit(rt, 8);
+        out[1] = 0x14000003;
+        place_quad(out + 2, target);
+        return 4;
+
+    case ARM64_LDR_LIT:
+    case ARM64_LDR_LIT_V:
+    {
+        if (fits(offset, 19))
+        {
+            out[0] = set_imm19(inst, offset);
+            return 1;
+        }
+        uint32_t opc = inst >> 30;
+        uint32_t load;
+        uint32_t base = rt;
+        if (arm64_inst_type(inst) == ARM64_LDR_LIT)
+        {
+            if (rt == XZR)
+            {
+                out[0] = ARM64_NOP;
+                return 1;
+            }
+            // ldr wt/xt, ldrsw xt: [xt]
+            static const uint32_t gpr[] = {0xB9400000, 0xF9400000, 0xB9800000};
+            load = gpr[opc];
+        }
+        else
+        {
+            // ldr st/dt/qt: [x17]
+            static const uint32_t simd[] = {0xBD400000, 0xFD400000, 0x3DC00000};
+            if (opc > 2)
+            {
+                return -1;
+            }
+            load = simd[opc];
+            base = X17;
+        }
+        // ldr base, #12; ldr rt, [base]; b #12; .quad target
+        out[0] = arm64_ldr_lit(base, 12);
+        out[1] = load | (base << 5) | rt;
+        out[2] = 0x14000003;
+        place_quad(out + 3, target);
+        return 5;
+    }
+
+    case ARM64_PRFM_LIT:
+        // a hint, nothing lost
+        out[0] = ARM64_NOP;
+        return 1;
+    }
+    return -1;
+}
+
+void arm64_inst_str(uint32_t inst, char *buf, int size)
+{
+    static const char *names[] = {"", "b", "bl", "b.cond", "cbz/cbnz", "tbz/tbnz", "adr", "adrp", "ldr literal", "ldr literal simd", "prfm literal"};
+    snprintf(buf, size, "%08X %s", inst, names[arm64_inst_type(inst)]);
+}
+
+#ifdef UTEST_ARM64
+#include <assert.h>
+#include <string.h>
+
+typedef struct
+{
+    const char *name;
+    uint32_t inst;
+    uint64_t pc;
+    uint64_t newPc;
+    int32_t words;
+    uint32_t want[ARM64_MAX_RELOC_WORDS];
+} RelocCase;
+
+#define PC 0x400000ULL
+#define NEAR (PC + 0x1000)
+#define FAR (PC + 0x40000000ULL)
+
+static const RelocCase cases[] = {
+    // add x0, x1, x2
+    {"other", 0x8B020020, PC, FAR, 1, {0x8B020020}},
+    // b #+0x100
+    {"b near", 0x14000040, PC, NEAR, 1, {0x14000000 | ((0x100 - 0x1000) >> 2 & 0x3FFFFFF)}},
+    {"b far", 0x14000040, PC, FAR, 4, {0x58000051, ARM64_BR_X17, (uint32_t)(PC + 0x100), 0}},
+    // bl #-0x8
+    {"bl near", 0x97FFFFFE, PC, NEAR, 1, {0x94000000 | ((-0x8 - 0x1000) >> 2 & 0x3FFFFFF)}},
+    {"bl far", 0x97FFFFFE, PC, FAR, 5, {0x58000071, ARM64_BLR_X17, 0x14000003, (uint32_t)(PC - 8), 0}},
+    // b.ls #+0x20
+    {"b.cond near", 0x54000109, PC, PC + 0x10, 1, {0x54000089}},
+    // b.ls far: b.hi #+20 over the stub
+    {"b.cond far", 0x54000109, PC, FAR, 5, {0x540000A8, 0x58000051, ARM64_BR_X17, (uint32_t)(PC + 0x20), 0}},
+    // b.al far
+    {"b.al far", 0x5400010E, PC, FAR, 4, {0x58000051, ARM64_BR_X17, (uint32_t)(PC + 0x20), 0}},
+    // cbz x3, #+0x40
+    {"cbz far", 0xB4000203, PC, FAR, 5, {0xB50000A3, 0x58000051, ARM64_BR_X17, (uint32_t)(PC + 0x40), 0}},
+    // tbnz w4, #3, #+0x10
+    {"tbz near", 0x37180084, PC, PC + 8, 1, {0x37180044}},
+    {"tbz far", 0x37180084, PC, PC + 0x10000, 5, {0x361800A4, 0x58000051, ARM64_BR_X17, (uint32_t)(PC + 0x10), 0}},
+    // adr x5, #+0x10
+    {"adr near", 0x10000085, PC, PC + 4, 1, {0x10000065}},
+    {"adr far", 0x10000085, PC, FAR, 4, {0x58000045, 0x14000003, (uint32_t)(PC + 0x10), 0}},
+    // adrp x6, #+0x2000
+    {"adrp near", 0x90000006 | (2 << 29), PC, PC + 0x1000, 1, {0xB0000006}},
+    {"adrp far", 0x90000006 | (2 << 29), PC, 0x7FF000000000ULL, 4, {0x58000046, 0x14000003, (uint32_t)(PC + 0x2000), 0}},
+    // ldr x7, #+0x40
+    {"ldr x near", 0x58000207, PC, PC + 0x20, 1, {0x58000107}},
+    {"ldr x far", 0x58000207, PC, FAR, 5, {0x58000067, 0xF94000E7, 0x14000003, (uint32_t)(PC + 0x40), 0}},
+    // ldr w8, #+0x40
+    {"ldr w far", 0x18000208, PC, FAR, 5, {0x58000068, 0xB9400108, 0x14000003, (uint32_t)(PC + 0x40), 0}},
+    // ldrsw x9, #+0x40
+    {"ldrsw far", 0x98000209, PC, FAR, 5, {0x58000069, 0xB9800129, 0x14000003, (uint32_t)(PC + 0x40), 0}},
+    // ldr d0, #+0x40
+    {"ldr d far", 0x5C000200, PC, FAR, 5, {0x58000071, 0xFD400220, 0x14000003, (uint32_t)(PC + 0x40), 0}},
+    // prfm pldl1keep, #+0x40
+    {"prfm", 0xD8000200, PC, FAR, 1, {ARM64_NOP}},
+};
+
+static void test_relocate()
+{
+    for (unsigned i = 0; i < sizeof(cases) / sizeof(cases[0]); i++)
+    {
+        const RelocCase *c = &cases[i];
+        uint32_t out[ARM64_MAX_RELOC_WORDS] = {0};
+        int32_t n = arm64_relocate_inst(c->inst, c->pc, c->newPc, out);
+        if (n != c->words || memcmp(out, c->want, n * sizeof(uint32_t)) != 0)
+        {
+            fprintf(stderr, "%s: got %d words:", c->name, n);
+            for (int j = 0; j < n; j++)
+                fprintf(stderr, " %08X", out[j]);
+            fprintf(stderr, "\n");
+            assert(0);
+        }
+    }
+}
+
+static void test_target()
+{
+    assert(arm64_inst_target(0x14000040, PC) == PC + 0x100);
+    assert(arm64_inst_target(0x97FFFFFE, PC) == PC - 8);
+    assert(arm64_inst_target(0x90000006 | (2 << 29), PC + 0x123) == PC + 0x2000);
+    assert(arm64_b_in_range(PC, PC + 0x7FFFFFC));
+    assert(!arm64_b_in_range(PC, PC + 0x8000000));
+    assert(arm64_b(PC, PC + 0x100) == 0x14000040);
+}
+
+int main()
+{
+    test_target();
+    test_relocate();
+    printf("arm64 relocator passed\n");
+    return 0;
+}
+#endif
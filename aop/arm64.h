@@ -0,0 +1,76 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+#include <stdint.h>
+
+/**
+ * AArch64 encoder and relocator.
+ * Only computes instruction words, never touches code memory,
+ * so it builds and tests on any host.
+ */
+
+#define ARM64_INST_SIZE 4
+// the longest sequence arm64_relocate_inst emits
+#define ARM64_MAX_RELOC_WORDS 5
+// ldr x17, #8; br x17; .quad target
+#define ARM64_ABS_JMP_WORDS 4
+
+#define ARM64_NOP 0xD503201F
+#define ARM64_RET 0xD65F03C0
+// x17(IP1) is the scratch register of the stubs
+#define ARM64_BR_X17 0xD61F0220
+#define ARM64_BLR_X17 0xD63F0220
+
+typedef enum {
+    ARM64_OTHER = 0, // not pc-relative, copy as it is
+    ARM64_B,
+    ARM64_BL,
+    ARM64_B_COND,
+    ARM64_CBZ,  // cbz/cbnz
+    ARM64_TBZ,  // tbz/tbnz
+    ARM64_ADR,
+    ARM64_ADRP,
+    ARM64_LDR_LIT,   // ldr wt/xt, ldrsw
+    ARM64_LDR_LIT_V, // ldr st/dt/qt
+    ARM64_PRFM_LIT,
+}ARM64_INST_TYPE;
+
+ARM64_INST_TYPE arm64_inst_type(uint32_t inst);
+
+/**
+ * @brief target of a pc-relative inst at `pc`, the address loaded for ADR/ADRP/literal
+ */
+uint64_t arm64_inst_target(uint32_t inst, uint64_t pc);
+
+int arm64_b_in_range(uint64_t pc, uint64_t target);
+uint32_t arm64_b(uint64_t pc, uint64_t target);
+uint32_t arm64_bl(uint64_t pc, uint64_t target);
+uint32_t arm64_ldr_lit(uint32_t rt, int32_t offset);
+
+/**
+ * @brief ldr x17, #8; br x17; .quad target
+ * @return words written
+ */
+int32_t arm64_place_abs_jmp(uint32_t *out, uint64_t target);
+
+/**
+ * @brief rewrite `inst` from `pc` to run at `newPc`
+ * @param out at least ARM64_MAX_RELOC_WORDS words
+ * @return words written, -1: can not relocate
+ */
+int32_t arm64_relocate_inst(uint32_t inst, uint64_t pc, uint64_t newPc, uint32_t *out);
+
+void arm64_inst_str(uint32_t inst, char *buf, int size);
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+// Invocation is one call of an intercepted function, passed to every Interceptor of it
+type Invocation struct {
+	// symbol of the intercepted function
+	Func string
+	// arguments, Before could replace them
+	Args []reflect.Value
+	// results, set before After is called, After could replace them
+	Results []reflect.Value
+	// recovered from the function, it panics again after every After
+	Panic interface{}
+	// kept from Before to After of the same Interceptor
+	State interface{}
+}
+
+// Interceptor is a pair of callbacks around a function, either could be nil.
+// Befores run in the order added, Afters in the reverse
+type Interceptor struct {
+	Name   string
+	Before func(inv *Invocation)
+	After  func(inv *Invocation)
+}
+
+// chain is the list of interceptors of a patched function, copied on write under trampolineMu
+type chain struct {
+	name         string
+	interceptors atomic.Value // []*Interceptor
+}
+
+func (c *chain) load() []*Interceptor {
+	its, _ := c.interceptors.Load().([]*Interceptor)
+	return its
+}
+
+/**
+ * @description: add `it` at the end of the interceptors of `iSrc`.
+ *  1. iSrc is patched once by the first interceptor, adding or removing more does not patch it again.
+ *  2. If iSrc is hooked by AddHook/AddHookP_CALL, the interceptors run around its hook function.
+ *  3. UnHook/UnHookWait removes the patch and every interceptor of it
+ * @param {interface{}} iSrc
+ * @param {*Interceptor} it
+ * @return {*}
+ */
+func AddInterceptor(iSrc interface{}, it *Interceptor) error {
+	if common.AgentIsDisabled() {
+		return disabledError("AddInterceptor", iSrc)
+	}
+
+	src := reflect.ValueOf(iSrc)
+	if src.Kind() != reflect.Func {
+		return &HookError{Op: "AddInterceptor", Func: "src", Err: ErrNotFunction}
+	}
+	if it == nil {
+		return newHookError("AddInterceptor", src.Pointer(), ErrInvalidInput)
+	}
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	return addInterceptorLocked("AddInterceptor", src.Pointer(), src.Type(), it)
+}
+
+/**
+ * @description: AddInterceptor on the function at `src` of type `typ`, trampolineMu must be held
+ * @param {string} op
+ * @param {uintptr} src
+ * @param {reflect.Type} typ
+ * @param {*Interceptor} it
+ * @return {*}
+ */
+func addInterceptorLocked(op string, src uintptr, typ reflect.Type, it *Interceptor) error {
+	point, origin := resolveABIWrapper(src), src
+	if entry, ok := chainPointLocked(src); ok {
+		if entry.chain != nil {
+			its := entry.chain.load()
+			entry.chain.interceptors.Store(append(its[:len(its):len(its)], it))
+			return nil
+		}
+		// a typed hook: its hook function has the signature of src
+		if entry.closure != nil || (entry.kind != HookDirect && entry.kind != HookPCall) {
+			return newHookError(op, src, ErrAlreadyHooked)
+		}
+		point, origin = entry.target, entry.target
+	}
+
+	c := &chain{name: funcName(src)}
+	c.interceptors.Store([]*Interceptor{it})
+	entry, err := installClosureHookLocked(op, point, typ, -1, func(origin reflect.Value) hookBody {
+		return chainBody(c, origin)
+	}, HookChain)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		entry.origin = origin
+		entry.chain = c
+	}
+	common.Logf("interceptor %s is added on %s", it.Name, c.name)
+	return nil
+}
+
+/**
+ * @description: remove `it` from the interceptors of `iSrc`, the function stays patched
+ * @param {interface{}} iSrc
+ * @param {*Interceptor} it
+ * @return {*}
+ */
+func RemoveInterceptor(iSrc interface{}, it *Interceptor) error {
+	src := reflect.ValueOf(iSrc)
+	if src.Kind() != reflect.Func {
+		return &HookError{Op: "RemoveInterceptor", Func: "src", Err: ErrNotFunction}
+	}
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	return removeInterceptorLocked("RemoveInterceptor", src.Pointer(), it)
+}
+
+// RemoveInterceptor on the function at `src`, trampolineMu must be held
+func removeInterceptorLocked(op string, src uintptr, it *Interceptor) error {
+	entry, ok := chainPointLocked(src)
+	if !ok || entry.chain == nil {
+		return newHookError(op, src, ErrNotHooked)
+	}
+	old := entry.chain.load()
+	its := make([]*Interceptor, 0, len(old))
+	for _, other := range old {
+		if other != it {
+			its = append(its, other)
+		}
+	}
+	if len(its) == len(old) {
+		return newHookError(op, src, ErrNoInterceptor)
+	}
+	entry.chain.interceptors.Store(its)
+	return nil
+}
+
+/**
+ * @description: the entry of `src`: the chain on it, else the chain on its hook function,
+ *  else the hook on it. trampolineMu must be held
+ * @param {uintptr} src
+ * @return {*} false if `src` is not hooked
+ */
+func chainPointLocked(src uintptr) (*hookEntry, bool) {
+	addr := lookupHook(src)
+	if addr == 0 {
+		return nil, false
+	}
+	entry := trampolineMap[addr]
+	if entry.chain == nil && entry.closure == nil {
+		if inner := lookupHook(entry.target); inner != 0 && trampolineMap[inner].chain != nil {
+			return trampolineMap[inner], true
+		}
+	}
+	return entry, true
+}
+
+/**
+ * @description: the hook of a chain: every Before, the origin, every After
+ * @param {*chain} c
+ * @param {reflect.Value} origin
+ * @return {*}
+ */
+func chainBody(c *chain, origin reflect.Value) hookBody {
+	variadic := origin.Type().IsVariadic()
+	return func(args []reflect.Value) []reflect.Value {
+		its := c.load()
+		inv := &Invocation{Func: c.name, Args: args}
+		states := make([]interface{}, len(its))
+		for i, it := range its {
+			if it.Before != nil {
+				inv.State = nil
+				runInterceptor(it, "Before", it.Before, inv)
+				states[i] = inv.State
+			}
+		}
+
+		func() {
+			defer func() {
+				inv.Panic = recover()
+			}()
+			if variadic {
+				inv.Results = origin.CallSlice(inv.Args)
+			} else {
+				inv.Results = origin.Call(inv.Args)
+			}
+		}()
+
+		for i := len(its) - 1; i >= 0; i-- {
+			if its[i].After != nil {
+				inv.State = states[i]
+				runInterceptor(its[i], "After", its[i].After, inv)
+			}
+		}
+		if inv.Panic != nil {
+			panic(inv.Panic)
+		}
+		return inv.Results
+	}
+}
+
+// a broken interceptor never breaks the function, its panic is logged
+func runInterceptor(it *Interceptor, stage string, fn func(inv *Invocation), inv *Invocation) {
+	defer func() {
+		if r := recover(); r != nil {
+			common.Logf("interceptor %s %s on %s panics:%s", it.Name, stage, inv.Func, fmt.Sprint(r))
+		}
+	}()
+	fn(inv)
+}
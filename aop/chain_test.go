@@ -0,0 +1,220 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//go:noinline
+func chainSrc(a, b int) int {
+	x := a*10 + b
+	return x
+}
+
+//go:noinline
+func chainPanic(msg string) int {
+	if msg != "" {
+		panic(msg)
+	}
+	return len(msg)
+}
+
+//go:noinline
+func chainJoin(sep string, parts ...string) string {
+	return strings.Join(parts, sep)
+}
+
+func recordInterceptor(name string, calls *[]string) *Interceptor {
+	return &Interceptor{
+		Name: name,
+		Before: func(inv *Invocation) {
+			inv.State = name
+			*calls = append(*calls, "before "+name)
+		},
+		After: func(inv *Invocation) {
+			*calls = append(*calls, "after "+inv.State.(string))
+		},
+	}
+}
+
+func TestInterceptorChain(t *testing.T) {
+	var calls []string
+	first := recordInterceptor("first", &calls)
+	second := recordInterceptor("second", &calls)
+	// doubles a and adds 1 to the result
+	third := &Interceptor{
+		Name: "third",
+		Before: func(inv *Invocation) {
+			inv.Args[0] = reflect.ValueOf(int(inv.Args[0].Int() * 2))
+		},
+		After: func(inv *Invocation) {
+			inv.Results[0] = reflect.ValueOf(int(inv.Results[0].Int() + 1))
+		},
+	}
+	for _, it := range []*Interceptor{first, second, third} {
+		if err := AddInterceptor(chainSrc, it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer UnHookWait(chainSrc, time.Second)
+
+	if ret := chainSrc(1, 2); ret != 23 {
+		t.Fatalf("chainSrc returns %d", ret)
+	}
+	want := []string{"before first", "before second", "after second", "after first"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls %v", calls)
+	}
+
+	var info *HookInfo
+	for _, h := range Hooks() {
+		if strings.HasSuffix(h.Source, ".chainSrc") {
+			info = &h
+		}
+	}
+	if info == nil || info.Kind != HookChain || !reflect.DeepEqual(info.Interceptors, []string{"first", "second", "third"}) {
+		t.Fatalf("Hooks: %+v", info)
+	}
+
+	// no patch again
+	if err := RemoveInterceptor(chainSrc, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveInterceptor(chainSrc, third); err != nil {
+		t.Fatal(err)
+	}
+	calls = nil
+	if ret := chainSrc(1, 2); ret != 12 || !reflect.DeepEqual(calls, []string{"before second", "after second"}) {
+		t.Fatalf("chainSrc returns %d, calls %v", ret, calls)
+	}
+	if err := RemoveInterceptor(chainSrc, first); !errors.Is(err, ErrNoInterceptor) {
+		t.Fatalf("remove twice: %v", err)
+	}
+	if err := AddHook(chainSrc, typedHook, typedTramp); !errors.Is(err, ErrAlreadyHooked) {
+		t.Fatalf("AddHook on a chain: %v", err)
+	}
+
+	if err := RemoveInterceptor(chainSrc, second); err != nil {
+		t.Fatal(err)
+	}
+	calls = nil
+	if ret := chainSrc(1, 2); ret != 12 || len(calls) != 0 {
+		t.Fatalf("chainSrc returns %d, calls %v", ret, calls)
+	}
+}
+
+func TestInterceptorPanic(t *testing.T) {
+	var recovered interface{}
+	broken := &Interceptor{
+		Name:   "broken",
+		Before: func(inv *Invocation) { panic("broken interceptor") },
+	}
+	watch := &Interceptor{
+		Name:  "watch",
+		After: func(inv *Invocation) { recovered = inv.Panic },
+	}
+	if err := AddInterceptor(chainPanic, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddInterceptor(chainPanic, watch); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(chainPanic, time.Second)
+
+	// the broken one is skipped
+	if ret := chainPanic(""); ret != 0 || recovered != nil {
+		t.Fatalf("chainPanic returns %d, panic %v", ret, recovered)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("recover %v", r)
+			}
+		}()
+		chainPanic("boom")
+	}()
+	if recovered != "boom" {
+		t.Fatalf("After sees %v", recovered)
+	}
+}
+
+func TestInterceptorVariadic(t *testing.T) {
+	var args int
+	it := &Interceptor{
+		Name:   "count",
+		Before: func(inv *Invocation) { args = inv.Args[1].Len() },
+	}
+	if err := AddInterceptor(chainJoin, it); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(chainJoin, time.Second)
+
+	if ret := chainJoin("-", "a", "b", "c"); ret != "a-b-c" || args != 3 {
+		t.Fatalf("chainJoin returns %q, %d args", ret, args)
+	}
+}
+
+//go:noinline
+func typedSrc(a, b int) int {
+	x := a*100 + b
+	return x
+}
+
+//go:noinline
+func typedTramp(a, b int) int {
+	x := a*100 + b
+	return x
+}
+
+//go:noinline
+func typedHook(a, b int) int {
+	return typedTramp(a, b) + 1
+}
+
+// the interceptors run around the hook of AddHook
+func TestInterceptorOnHook(t *testing.T) {
+	if err := AddHook(typedSrc, typedHook, typedTramp); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(typedSrc, time.Second)
+
+	var results []int64
+	it := &Interceptor{
+		Name:  "timing",
+		After: func(inv *Invocation) { results = append(results, inv.Results[0].Int()) },
+	}
+	if err := AddInterceptor(typedSrc, it); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(typedHook, time.Second)
+
+	if ret := typedSrc(1, 2); ret != 103 || !reflect.DeepEqual(results, []int64{103}) {
+		t.Fatalf("typedSrc returns %d, interceptor sees %v", ret, results)
+	}
+	if err := RemoveInterceptor(typedSrc, it); err != nil {
+		t.Fatal(err)
+	}
+	if ret := typedSrc(1, 2); ret != 103 || len(results) != 1 {
+		t.Fatalf("typedSrc returns %d, interceptor sees %v", ret, results)
+	}
+}
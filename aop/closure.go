@@ -0,0 +1,165 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// funcval is what a go func value points to
+type funcval struct {
+	fn uintptr
+}
+
+/**
+ * @description: a func value of type `typ` running the code at `pc`, a closure without context
+ * @param {reflect.Type} typ
+ * @param {uintptr} pc
+ * @return {*}
+ */
+func funcOf(typ reflect.Type, pc uintptr) reflect.Value {
+	fv := &funcval{fn: pc}
+	return reflect.NewAt(typ, unsafe.Pointer(&fv)).Elem()
+}
+
+// hookBody is the hook made at runtime: it gets the arguments of src and returns its results
+type hookBody func(args []reflect.Value) []reflect.Value
+
+// closureGate counts the goroutines in one hook made by reflect.MakeFunc, they share the
+// code of reflect and are not told apart by their stacks. See UnHookWait
+type closureGate struct {
+	running int32
+	// src is restored, a call entering the hook now runs src and not the origin released
+	closed int32
+}
+
+/**
+ * @description: call `src` itself with the arguments of a hook of type `typ`
+ *  ctxArg >= 0: the last argument is the closure context of a function literal, it points
+ *  to the func value of the instance whose code is src
+ * @param {reflect.Type} typ
+ * @param {uintptr} src
+ * @param {int} ctxArg
+ * @return {*}
+ */
+func srcBody(typ reflect.Type, src uintptr, ctxArg int) hookBody {
+	if ctxArg < 0 {
+		fn := funcOf(typ, src)
+		if typ.IsVariadic() {
+			return fn.CallSlice
+		}
+		return fn.Call
+	}
+	params := make([]reflect.Type, typ.NumIn()-1)
+	for i := range params {
+		params[i] = typ.In(i)
+	}
+	results := make([]reflect.Type, typ.NumOut())
+	for i := range results {
+		results[i] = typ.Out(i)
+	}
+	literal := reflect.FuncOf(params, results, false)
+	return func(args []reflect.Value) []reflect.Value {
+		last := len(args) - 1
+		ctx := unsafe.Pointer(args[last].Pointer())
+		return reflect.NewAt(literal, unsafe.Pointer(&ctx)).Elem().Call(args[:last])
+	}
+}
+
+/**
+ * @description: hook `src` with a function of type `typ` made by reflect.MakeFunc, no trampoline
+ *  function is needed. The closure has no code of its own: a stub loads the closure context
+ *  register and jumps to reflect. `makeBody` gets the origin function of type `typ`
+ * @param {string} op
+ * @param {uintptr} src
+ * @param {reflect.Type} typ
+ * @param {func} makeBody
+ * @param {HookKind} kind
+ * @return {*}
+ */
+func installClosureHook(op string, src uintptr, typ reflect.Type, makeBody func(origin reflect.Value) hookBody, kind HookKind) error {
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	_, err := installClosureHookLocked(op, src, typ, -1, makeBody, kind)
+	return err
+}
+
+/**
+ * @description: installClosureHook, trampolineMu must be held.
+ *  ctxArg >= 0: src is a function literal, the stub moves its closure context to the ctxArg-th
+ *  integer register, the last parameter of `typ`. The origin passed to makeBody runs on a
+ *  func value {code, context} then, see literalOrigin
+ * @return {*} the new entry in the registry, nil in the verify only mode
+ */
+func installClosureHookLocked(op string, src uintptr, typ reflect.Type, ctxArg int, makeBody func(origin reflect.Value) hookBody, kind HookKind) (*hookEntry, error) {
+	// src is patched before the origin is known, the calls in between wait for it
+	var body atomic.Value
+	gate := &closureGate{}
+	restored := srcBody(typ, src, ctxArg)
+	closure := reflect.MakeFunc(typ, func(args []reflect.Value) []reflect.Value {
+		atomic.AddInt32(&gate.running, 1)
+		defer atomic.AddInt32(&gate.running, -1)
+		if atomic.LoadInt32(&gate.closed) != 0 {
+			return restored(args)
+		}
+		for {
+			if fn, ok := body.Load().(hookBody); ok {
+				return fn(args)
+			}
+			runtime.Gosched()
+		}
+	})
+
+	iface := closure.Interface()
+	code := closure.Pointer()
+
+	if verifyOnly {
+		// the stub goes near reflect, as far as reflect is
+		return nil, recordVerifyLocked(verifyHookLocked(op, codePointer(src), codePointer(code), nil, src, kind))
+	}
+
+	stub := engineClosureStub((*[2]uintptr)(unsafe.Pointer(&iface))[1], codePointer(code), ctxArg)
+	if stub == nil {
+		return nil, newHookError(op, src, ErrNoNearMemory)
+	}
+	entry, err := installHookLocked(op, codePointer(src), stub, nil, src, kind)
+	if err != nil {
+		engineFreeStub(stub)
+		return nil, err
+	}
+	// the stub is no go function, show reflect in Hooks
+	entry.target = code
+	entry.closure = iface
+	entry.stub = stub
+	entry.gate = gate
+	origin := engineOrigin(entry.trampoline)
+	if ctxArg >= 0 {
+		if entry.contextStub = engineContextStub(origin); entry.contextStub == nil {
+			// nothing ran the origin yet
+			engineUnhook(entry.trampoline)
+			engineFreeStub(stub)
+			delete(trampolineMap, src)
+			return nil, newHookError(op, src, ErrNoNearMemory)
+		}
+		origin = entry.contextStub
+	}
+	body.Store(makeBody(funcOf(typ, uintptr(origin))))
+	return entry, nil
+}
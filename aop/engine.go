@@ -0,0 +1,67 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+/**
+ * The engine patches the code, everything above it is go.
+ * engine_cgo.go: the C engine, decoding by the C port of x86asm, live patching by int3 and SIGTRAP.
+ * engine_purego.go: the go engine on linux/amd64 for `CGO_ENABLED=0` or `-tags pinpoint_purego`,
+ * decoding by golang.org/x/arch/x86/x86asm.
+ * engine_purego_other.go: no cgo anywhere else, every hook fails with ErrNoEngine.
+ *
+ * Both of them provide:
+ *  engineHook(src, target, trampolineFunc unsafe.Pointer) (unsafe.Pointer, *hookFault)
+ *  engineVerify(src, target, trampolineFunc unsafe.Pointer) *engineReport
+ *  engineUnhook, engineUnhookSrc, engineRehookSrc, engineRelease(trampoline unsafe.Pointer)
+ *  engineOrigin(trampoline unsafe.Pointer) unsafe.Pointer
+ *  enginePatchedBytes(trampoline unsafe.Pointer) int
+ *  engineClosureStub(closure uintptr, code unsafe.Pointer, ctxArg int) unsafe.Pointer
+ *  engineContextStub(code unsafe.Pointer) unsafe.Pointer
+ *  engineFreeStub(stub unsafe.Pointer)
+ *  engineBranchTargets(pc uintptr, size int, call bool, max int) []uintptr
+ *  engineMemStats(m *MemStats)
+ */
+
+// hookFault is why the engine failed
+type hookFault struct {
+	err error
+	// address where it failed
+	addr uintptr
+	// decoded instruction blocked the patch, empty if none
+	inst string
+}
+
+func (f *hookFault) hookError(op string) *HookError {
+	hookErr := newHookError(op, f.addr, f.err)
+	hookErr.Inst = f.inst
+	return hookErr
+}
+
+// engineReport is what engineHook would do, made without touching any memory
+type engineReport struct {
+	// nil: engineHook would patch
+	fault *hookFault
+	// bytes replaced by the jmp at src, and the instructions in them
+	srcSize int
+	insts   []string
+	// bytes the replaced instructions take in the trampoline
+	relocatedSize int
+	// the go stack check of src is in the replaced bytes
+	stackCheck bool
+	// target is out of the direct jmp
+	forward bool
+}
@@ -0,0 +1,165 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/pinpoint-apm/go-aop-agent/aop/internal/growpad"
+)
+
+// #cgo CFLAGS: -DNTEST -DTRACE
+// #include "pinpoint.h"
+import "C"
+
+func init() {
+	// a hook without trampoline_func calls runtime.morestack from the pad, see set_grow_pad
+	if pad, size := growpad.Range(); pad != 0 {
+		C.set_grow_pad(codePointer(pad), C.int32_t(size))
+	}
+}
+
+/**
+ * @description: convert the error from the C engine
+ * @param {*C.HookErr} cErr
+ * @return {*}
+ */
+func hookFaultFromC(cErr *C.HookErr) *hookFault {
+	var err error
+	switch cErr.code {
+	case C.HOOK_E_INVALID_INPUT:
+		err = ErrInvalidInput
+	case C.HOOK_E_NO_MEM:
+		err = ErrNoMemory
+	case C.HOOK_E_UNKNOWN_INST:
+		err = ErrUnknownInstruction
+	case C.HOOK_E_TOO_SHORT:
+		err = ErrFunctionTooShort
+	case C.HOOK_E_RELOCATE:
+		err = ErrRelocate
+	case C.HOOK_E_NO_NEAR_MEM:
+		err = ErrNoNearMemory
+	case C.HOOK_E_MPROTECT:
+		err = ErrMprotect
+	default:
+		err = fmt.Errorf("hook failed, code %d", int(cErr.code))
+	}
+	return &hookFault{err: err, addr: uintptr(unsafe.Pointer(cErr.addr)), inst: C.GoString(&cErr.inst[0])}
+}
+
+func engineHook(src, target, trampolineFunc unsafe.Pointer) (unsafe.Pointer, *hookFault) {
+	var cErr C.HookErr
+	trampoline := C.hook_e(src, target, trampolineFunc, &cErr)
+	if trampoline == nil {
+		return nil, hookFaultFromC(&cErr)
+	}
+	return trampoline, nil
+}
+
+func engineVerify(src, target, trampolineFunc unsafe.Pointer) *engineReport {
+	var cReport C.HookReport
+	report := &engineReport{}
+	if C.verify_hook(src, target, trampolineFunc, &cReport) != 0 {
+		report.fault = hookFaultFromC(&cReport.err)
+	}
+	report.srcSize = int(cReport.srcSize)
+	for i := 0; i < int(cReport.instCount) && i < C.HOOK_REPORT_MAX_INST; i++ {
+		report.insts = append(report.insts, C.GoString(&cReport.inst[i][0]))
+	}
+	report.relocatedSize = int(cReport.relocatedSize)
+	report.stackCheck = cReport.stackCheck != 0
+	report.forward = cReport.forward != 0
+	return report
+}
+
+func engineUnhook(trampoline unsafe.Pointer) {
+	C.unhook(trampoline)
+}
+
+func engineUnhookSrc(trampoline unsafe.Pointer) {
+	C.unhook_src(trampoline)
+}
+
+func engineRehookSrc(trampoline unsafe.Pointer) {
+	C.rehook_src(trampoline)
+}
+
+func engineRelease(trampoline unsafe.Pointer) {
+	C.release_trampoline(trampoline)
+}
+
+func engineOrigin(trampoline unsafe.Pointer) unsafe.Pointer {
+	return C.trampoline_origin(trampoline)
+}
+
+func enginePatchedBytes(trampoline unsafe.Pointer) int {
+	return int((*C.Trampoline)(trampoline).fromInstBackUp.instBackupSize)
+}
+
+func engineClosureStub(closure uintptr, code unsafe.Pointer, ctxArg int) unsafe.Pointer {
+	return C.make_closure_stub(C.uintptr_t(closure), code, C.int32_t(ctxArg))
+}
+
+func engineContextStub(code unsafe.Pointer) unsafe.Pointer {
+	return C.make_context_stub(code)
+}
+
+func engineFreeStub(stub unsafe.Pointer) {
+	C.free_closure_stub(stub)
+}
+
+func engineBranchTargets(pc uintptr, size int, call bool, max int) []uintptr {
+	var cCall C.int32_t
+	if call {
+		cCall = 1
+	}
+	targets := make([]uintptr, max)
+	n := C.located_branch_targets(codePointer(pc), C.int32_t(size), cCall,
+		(*unsafe.Pointer)(unsafe.Pointer(&targets[0])), C.int32_t(len(targets)))
+	return targets[:n]
+}
+
+func engineMemStats(m *MemStats) {
+	pages := make([]C.NearPageStat, maxMemStatPages)
+	var counters C.NearMemCounters
+	n := int(C.get_near_mem_stats(&pages[0], C.int32_t(len(pages)), &counters))
+	if n > len(pages) {
+		n = len(pages)
+	}
+
+	m.Pages = m.Pages[:0]
+	for _, page := range pages[:n] {
+		m.Pages = append(m.Pages, PageStat{
+			Address:     uintptr(unsafe.Pointer(page.page)),
+			Size:        int(page.size),
+			Blocks:      int(page.blocks),
+			Writing:     int(page.writing),
+			UsedBytes:   int(page.usedBytes),
+			FreeBlocks:  int(page.freeBlocks),
+			LargestFree: int(page.largestFree),
+			Writable:    page.prot&syscall.PROT_WRITE != 0,
+			Executable:  page.prot&syscall.PROT_EXEC != 0,
+		})
+	}
+	m.Mapped = uint64(counters.mapped)
+	m.Unmapped = uint64(counters.unmapped)
+}
@@ -0,0 +1,703 @@
+//go:build (!cgo || pinpoint_purego) && linux && amd64
+// +build !cgo pinpoint_purego
+// +build linux
+// +build amd64
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/arch/x86/x86asm"
+
+	"github.com/pinpoint-apm/go-aop-agent/aop/internal/growpad"
+)
+
+/**
+ * The go engine: hook_e of pinpoint.c without cgo.
+ * A jmp is placed by one atomic store when it lies in an aligned 8 bytes word, which the entry
+ * of a go function always does (functions are aligned to 32 bytes). There is no SIGTRAP handler
+ * in go, a patch crossing a word is written as it is and is not safe for goroutines running there.
+ * Neither is a goroutine which ran the first inst of the entry before the store, it runs the middle of the jmp
+ */
+
+const (
+	jmpInstSize       = 5
+	backupInstSize    = 32
+	morestackBlockMax = 128
+	maxCodeBytes      = 1 << 30
+	// mov reg, rdx; mov rdx, imm64; jmp [rip]; .quad code
+	closureStubSize = 3 + 10 + x86AbsJmpSize
+	// mov rdx, [rdx+8]; jmp [rip]; .quad code
+	contextStubSize = 4 + x86AbsJmpSize
+	// call morestack; jmp reload
+	growSlotSize = 16
+	growSlotMax  = 256
+
+	sysMembarrier                              = 324
+	membarrierPrivateExpeditedSyncCore         = 1 << 5
+	membarrierRegisterPrivateExpeditedSyncCore = 1 << 6
+)
+
+// integer argument registers of ABIInternal: rax rbx rcx rdi rsi r8 r9 r10 r11
+var intArgRegs = [...]byte{0, 3, 1, 7, 6, 8, 9, 10, 11}
+
+// the state of a patched src, the handle engineHook returns
+type pureTrampoline struct {
+	src uintptr
+	to  uintptr
+	// bytes replaced at src
+	backup []byte
+	// 0 if none
+	trampFunc   uintptr
+	trampBackup []byte
+	// no trampFunc: runtime.morestack is called from this slot of the grow pad, 0: src checks no stack
+	growSlot uintptr
+	// near memory, forward is 0 if src jumps to `to` directly
+	forward uintptr
+	back    uintptr
+}
+
+var (
+	// hook/unhook flip the protection of code pages, never let two of them interleave
+	engineMu sync.Mutex
+	// 1: membarrier SYNC_CORE registered, -1: not supported. under engineMu
+	membarrierState int
+	// slots of the grow pad taken, under engineMu. see growpad.Range
+	growSlotUsed [growSlotMax]bool
+)
+
+// text at `addr` as a slice, it is never in the go heap
+func textBytes(addr uintptr, n int) []byte {
+	return (*[maxCodeBytes]byte)(codePointer(addr))[:n:n]
+}
+
+// serialize the instruction fetch of every thread after code is written
+func syncCores() {
+	if membarrierState == 0 {
+		membarrierState = -1
+		if _, _, errno := syscall.Syscall(sysMembarrier, membarrierRegisterPrivateExpeditedSyncCore, 0, 0); errno == 0 {
+			membarrierState = 1
+		}
+	}
+	if membarrierState == 1 {
+		syscall.Syscall(sysMembarrier, membarrierPrivateExpeditedSyncCore, 0, 0)
+	}
+}
+
+/**
+ * @description: write `code` over live code at `addr`. the bytes in the word holding `addr` go
+ *  by one atomic store, after the tail: the tail is behind the jmp and never runs
+ * @param {uintptr} addr
+ * @param {[]byte} code
+ * @return {*}
+ */
+func patchCode(addr uintptr, code []byte) *hookFault {
+	page := addr &^ uintptr(pageSize-1)
+	size := int(addr + uintptr(len(code)) - page)
+	if !mprotect(page, size, syscall.PROT_READ|syscall.PROT_WRITE|syscall.PROT_EXEC) {
+		return &hookFault{err: ErrMprotect, addr: addr}
+	}
+
+	word := addr &^ 7
+	head := len(code)
+	if addr+uintptr(head) > word+8 {
+		head = int(word + 8 - addr)
+	}
+	if head == len(code) || head >= jmpInstSize {
+		copy(textBytes(word+8, len(code)-head), code[head:])
+		var buf [8]byte
+		copy(buf[:], textBytes(word, 8))
+		copy(buf[addr-word:], code[:head])
+		atomic.StoreUint64((*uint64)(codePointer(word)), binary.LittleEndian.Uint64(buf[:]))
+	} else {
+		copy(textBytes(addr, len(code)), code)
+	}
+	syncCores()
+
+	if !mprotect(page, size, syscall.PROT_READ|syscall.PROT_EXEC) {
+		return &hookFault{err: ErrMprotect, addr: addr}
+	}
+	return nil
+}
+
+func placeJmp(src, target uintptr) *hookFault {
+	return patchCode(src, appendRel32([]byte{0xE9}, uint64(src+jmpInstSize), uint64(target)))
+}
+
+// copy from detour: jmp, ret and int3 end the function
+func endsFunction(inst *x86asm.Inst) bool {
+	switch inst.Op {
+	case x86asm.JMP, x86asm.RET:
+		return true
+	case x86asm.INT:
+		return byte(inst.Opcode>>24) == 0xCC
+	}
+	return false
+}
+
+// go pads the text between functions with int3
+func isInt3Padding(start, end uintptr) bool {
+	for ; start < end; start++ {
+		if textBytes(start, 1)[0] != 0xCC {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * @description: go1.17+ checks the stack at entry, the jbe goes to a block calling
+ *  runtime.morestack_noctxt and jumping to the entry again. find that block of `fn`
+ * @param {uintptr} fn
+ * @return {*} 0 if no stack check in fn, and the size of the check till the end of jbe
+ */
+func locatedGoMorestack(fn uintptr) (uintptr, int) {
+	p, block := fn, uintptr(0)
+	for i := 0; i < 5 && block == 0; i++ {
+		raw := textBytes(p, backupInstSize)
+		inst, ok := x86Decode(raw)
+		if !ok || endsFunction(&inst) {
+			return 0, 0
+		}
+		if inst.Op == x86asm.JBE {
+			block = uintptr(x86Target(&inst, raw, uint64(p)))
+		}
+		p += uintptr(inst.Len)
+	}
+	if block == 0 {
+		return 0, 0
+	}
+
+	for q := block; q-block < morestackBlockMax; {
+		raw := textBytes(q, backupInstSize)
+		inst, ok := x86Decode(raw)
+		if !ok {
+			return 0, 0
+		}
+		if inst.Op == x86asm.JMP {
+			if uintptr(x86Target(&inst, raw, uint64(q))) != fn {
+				return 0, 0
+			}
+			return block, int(p - fn)
+		}
+		if endsFunction(&inst) {
+			return 0, 0
+		}
+		q += uintptr(inst.Len)
+	}
+	return 0, 0
+}
+
+/**
+ * @description: the whole inst at `addr` covering `minSpace` bytes, copied
+ * @param {uintptr} addr
+ * @param {int} minSpace
+ * @return {*}
+ */
+func makeSpaceForJmp(addr uintptr, minSpace int) ([]byte, *hookFault) {
+	end := addr + uintptr(minSpace)
+	p := addr
+	for p < end {
+		raw := textBytes(p, backupInstSize)
+		inst, ok := x86Decode(raw)
+		if !ok {
+			return nil, &hookFault{err: ErrUnknownInstruction, addr: p, inst: fmt.Sprintf("%02X %02X %02X %02X", raw[0], raw[1], raw[2], raw[3])}
+		}
+
+		op := byte(inst.Opcode >> 24)
+		if (op == 0xC3 || op == 0xE9 || op == 0xEB) && isInt3Padding(p+uintptr(inst.Len), end) {
+			// go ABIInternal leaf `addl bx, ax; ret` or tail call `jmp fn`, nothing behind them runs
+			// through, the int3 padding after them belongs to nobody
+			p += uintptr(inst.Len)
+			if p < end {
+				p = end
+			}
+			break
+		}
+		if endsFunction(&inst) {
+			return nil, &hookFault{err: ErrFunctionTooShort, addr: p, inst: inst.String()}
+		}
+		p += uintptr(inst.Len)
+	}
+
+	if p-addr > backupInstSize {
+		return nil, &hookFault{err: ErrRelocate, addr: addr}
+	}
+	return append([]byte(nil), textBytes(addr, int(p-addr))...), nil
+}
+
+/**
+ * @description: relocate `backup` of src into `newPc`.
+ *  jcc of the go stack check leaves the window, it goes to `morestack`
+ * @param {[]byte} backup
+ * @param {uintptr} src
+ * @param {uintptr} newPc
+ * @param {uintptr} srcMorestack the morestack block of src, 0: no stack check
+ * @param {uintptr} morestack where the jcc goes, 0: keep srcMorestack
+ * @return {*}
+ */
+func relocateBackup(backup []byte, src, newPc, srcMorestack, morestack uintptr) ([]byte, *hookFault) {
+	if morestack == 0 {
+		morestack = srcMorestack
+	}
+	code, failOff := x86Relocate(backup, uint64(src), uint64(newPc), uint64(srcMorestack), uint64(morestack))
+	if failOff == -1 {
+		return code, nil
+	}
+	fault := &hookFault{err: ErrRelocate, addr: src + uintptr(failOff)}
+	if inst, ok := x86Decode(backup[failOff:]); ok {
+		fault.inst = inst.String()
+	}
+	return nil, fault
+}
+
+func insertBack(t *pureTrampoline) *hookFault {
+	bound := x86RelocateBound(t.backup)
+	if bound == -1 {
+		return &hookFault{err: ErrUnknownInstruction, addr: t.src}
+	}
+
+	// runtime.morestack must be called from go text, the block of trampoline_func jumps to
+	// trampoline_func, which lands in `back` and checks again. without trampoline_func, `back`
+	// calls morestack from a slot of the grow pad. see insert_back_trampoline
+	srcMorestack, _ := locatedGoMorestack(t.src)
+	growSize := 0
+	if t.trampFunc == 0 && srcMorestack != 0 {
+		if growSize = growCodeSize(srcMorestack); growSize == -1 {
+			return &hookFault{err: ErrRelocate, addr: srcMorestack}
+		}
+		if t.growSlot = getGrowSlot(); t.growSlot == 0 {
+			return &hookFault{err: ErrNoNearMemory, addr: srcMorestack}
+		}
+	}
+
+	// without trampoline_func, `back` is called directly, keep it near src
+	near := t.src
+	if t.trampFunc != 0 {
+		near = t.trampFunc
+	}
+	back := getNearMem(near, bound+x86AbsJmpSize+growSize)
+	if back == 0 {
+		dropBack(t, 0)
+		return &hookFault{err: ErrNoNearMemory, addr: near}
+	}
+
+	grow := back + uintptr(bound+x86AbsJmpSize)
+	var morestack uintptr
+	if t.trampFunc != 0 {
+		morestack, _ = locatedGoMorestack(t.trampFunc)
+	} else if t.growSlot != 0 {
+		morestack = grow
+	}
+	code, fault := relocateBackup(t.backup, t.src, back, srcMorestack, morestack)
+	if fault != nil {
+		dropBack(t, back)
+		return fault
+	}
+	code = appendJmp(code, uint64(back)+uint64(len(code)), uint64(t.src)+uint64(len(t.backup)))
+	copy(textBytes(back, len(code)), code)
+
+	var slotCode []byte
+	if t.growSlot != 0 {
+		var code []byte
+		if code, slotCode = growCode(grow, srcMorestack, t.growSlot, back); code == nil {
+			slot := t.growSlot
+			dropBack(t, back)
+			return &hookFault{err: ErrNoNearMemory, addr: slot}
+		}
+		copy(textBytes(grow, len(code)), code)
+	}
+
+	// the last step, nothing to rollback on trampoline_func. nobody runs a free grow slot
+	if !sealNearMem(back) {
+		dropBack(t, back)
+		return &hookFault{err: ErrMprotect, addr: back}
+	}
+	if t.trampFunc != 0 {
+		if fault := placeJmp(t.trampFunc, back); fault != nil {
+			dropBack(t, back)
+			return fault
+		}
+	}
+	if t.growSlot != 0 {
+		if fault := patchCode(t.growSlot, slotCode); fault != nil {
+			dropBack(t, back)
+			return fault
+		}
+	}
+	t.back = back
+	return nil
+}
+
+func insertForward(t *pureTrampoline) *hookFault {
+	if fitsRel32(uint64(t.to) - uint64(t.src+jmpInstSize)) {
+		return placeJmp(t.src, t.to)
+	}
+
+	forward := getNearMem(t.src, x86AbsJmpSize)
+	if forward == 0 {
+		return &hookFault{err: ErrNoNearMemory, addr: t.src}
+	}
+	copy(textBytes(forward, x86AbsJmpSize), appendAbsJmp(nil, uint64(t.to)))
+	if !sealNearMem(forward) {
+		putNearMem(forward)
+		return &hookFault{err: ErrMprotect, addr: forward}
+	}
+	if fault := placeJmp(t.src, forward); fault != nil {
+		putNearMem(forward)
+		return fault
+	}
+	t.forward = forward
+	return nil
+}
+
+// a slot of the grow pad, 0: every slot is taken
+func getGrowSlot() uintptr {
+	pad, size := growpad.Range()
+	for i := 0; i < size/growSlotSize && i < growSlotMax; i++ {
+		if !growSlotUsed[i] {
+			growSlotUsed[i] = true
+			return pad + uintptr(i*growSlotSize)
+		}
+	}
+	return 0
+}
+
+func putGrowSlot(slot uintptr) {
+	if slot != 0 {
+		pad, _ := growpad.Range()
+		growSlotUsed[(slot-pad)/growSlotSize] = false
+	}
+}
+
+/**
+ * @description: split the morestack block of src: spill args; call morestack; reload args; jmp src
+ * @param {uintptr} block
+ * @return {*} the call and the jmp, false if the block is not known or some inst of it is pc-relative
+ */
+func splitMorestackBlock(block uintptr) (uintptr, uintptr, bool) {
+	call := uintptr(0)
+	for q := block; q-block < morestackBlockMax; {
+		raw := textBytes(q, backupInstSize)
+		inst, ok := x86Decode(raw)
+		if !ok {
+			return 0, 0, false
+		}
+		switch typ := x86TypeOf(&inst, raw); {
+		case typ == x86Jmp:
+			return call, q, call != 0
+		case typ == x86Call && call == 0 && inst.Len == jmpInstSize:
+			call = q
+		case typ != x86Other:
+			return 0, 0, false
+		}
+		q += uintptr(inst.Len)
+	}
+	return 0, 0, false
+}
+
+// size of growCode, -1 if the block can not be split
+func growCodeSize(block uintptr) int {
+	call, jmp, ok := splitMorestackBlock(block)
+	if !ok {
+		return -1
+	}
+	return int(call-block) + jmpInstSize + int(jmp-call-jmpInstSize) + jmpInstSize
+}
+
+/**
+ * @description: without trampoline_func, the block of src jumps to src again when the stack is
+ *  grown, that is the hook. `back` spills the args as the block does and calls morestack from a
+ *  slot of the grow pad, see write_grow_code of pinpoint.c
+ * @param {uintptr} grow where the code goes
+ * @param {uintptr} block the morestack block of src
+ * @param {uintptr} slot
+ * @param {uintptr} entry of `back`
+ * @return {*} the code at grow and the code of the slot, nil if they are out of the reach of each other
+ */
+func growCode(grow, block, slot, entry uintptr) ([]byte, []byte) {
+	call, jmp, _ := splitMorestackBlock(block)
+	raw := textBytes(call, jmpInstSize)
+	inst, _ := x86Decode(raw)
+	morestack := x86Target(&inst, raw, uint64(call))
+	reload := grow + (call - block) + jmpInstSize
+	if !fitsRel32(uint64(slot)-uint64(reload)) || !fitsRel32(morestack-uint64(slot+jmpInstSize)) ||
+		!fitsRel32(uint64(reload)-uint64(slot+2*jmpInstSize)) {
+		return nil, nil
+	}
+
+	code := append([]byte(nil), textBytes(block, int(call-block))...)
+	code = appendRel32(append(code, 0xE9), uint64(reload), uint64(slot))
+	code = append(code, textBytes(call+jmpInstSize, int(jmp-call-jmpInstSize))...)
+	code = appendRel32(append(code, 0xE9), uint64(grow)+uint64(len(code))+jmpInstSize, uint64(entry))
+
+	slotCode := appendRel32([]byte{0xE8}, uint64(slot+jmpInstSize), morestack)
+	slotCode = appendRel32(append(slotCode, 0xE9), uint64(slot+2*jmpInstSize), uint64(reload))
+	for len(slotCode) < growSlotSize {
+		slotCode = append(slotCode, 0xCC)
+	}
+	return code, slotCode
+}
+
+// `back` is not used, give it back with the grow slot taken for it
+func dropBack(t *pureTrampoline, back uintptr) {
+	putGrowSlot(t.growSlot)
+	t.growSlot = 0
+	putNearMem(back)
+}
+
+// the whole go stack check goes to `back`, or it jumps to src again
+func srcSpace(src uintptr) int {
+	if block, checkSize := locatedGoMorestack(src); block != 0 && checkSize > jmpInstSize {
+		return checkSize
+	}
+	return jmpInstSize
+}
+
+func restoreTrampFunc(t *pureTrampoline) {
+	if t.trampFunc != 0 {
+		// a hook still running calls the origin function, as trampoline_func did
+		patchCode(t.trampFunc, t.trampBackup)
+	}
+}
+
+func hookLocked(src, to, trampFunc uintptr) (*pureTrampoline, *hookFault) {
+	t := &pureTrampoline{src: src, to: to, trampFunc: trampFunc}
+	var fault *hookFault
+	if t.backup, fault = makeSpaceForJmp(src, srcSpace(src)); fault != nil {
+		return nil, fault
+	}
+	if trampFunc != 0 {
+		if t.trampBackup, fault = makeSpaceForJmp(trampFunc, jmpInstSize); fault != nil {
+			return nil, fault
+		}
+	}
+
+	// 1. insert `back` trampoline, `src` is untouched if it failed
+	if fault = insertBack(t); fault != nil {
+		return nil, fault
+	}
+	// 2. insert `forward` trampoline
+	if fault = insertForward(t); fault != nil {
+		restoreTrampFunc(t)
+		dropBack(t, t.back)
+		return nil, fault
+	}
+	return t, nil
+}
+
+func isHookInputValid(src, to, trampFunc uintptr) bool {
+	return src != 0 && to != 0 && src != to && trampFunc != src && trampFunc != to
+}
+
+func engineHook(src, target, trampolineFunc unsafe.Pointer) (unsafe.Pointer, *hookFault) {
+	if !isHookInputValid(uintptr(src), uintptr(target), uintptr(trampolineFunc)) {
+		return nil, &hookFault{err: ErrInvalidInput, addr: uintptr(src)}
+	}
+
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	t, fault := hookLocked(uintptr(src), uintptr(target), uintptr(trampolineFunc))
+	if fault != nil {
+		return nil, fault
+	}
+	return unsafe.Pointer(t), nil
+}
+
+func engineVerify(src, target, trampolineFunc unsafe.Pointer) *engineReport {
+	report := &engineReport{}
+	from, to, trampFunc := uintptr(src), uintptr(target), uintptr(trampolineFunc)
+	if !isHookInputValid(from, to, trampFunc) {
+		report.fault = &hookFault{err: ErrInvalidInput, addr: from}
+		return report
+	}
+
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	srcMorestack, _ := locatedGoMorestack(from)
+	report.stackCheck = srcMorestack != 0
+	backup, fault := makeSpaceForJmp(from, srcSpace(from))
+	if fault != nil {
+		report.fault = fault
+		return report
+	}
+	report.srcSize = len(backup)
+	for off := 0; off < len(backup); {
+		inst, ok := x86Decode(backup[off:])
+		if !ok {
+			break
+		}
+		report.insts = append(report.insts, inst.String())
+		off += inst.Len
+	}
+
+	// without trampoline_func, `back` spills and reloads as the morestack block of src does
+	if trampFunc == 0 && srcMorestack != 0 && growCodeSize(srcMorestack) == -1 {
+		report.fault = &hookFault{err: ErrRelocate, addr: srcMorestack}
+		return report
+	}
+
+	near, morestack := from, uintptr(0)
+	if trampFunc != 0 {
+		if _, fault = makeSpaceForJmp(trampFunc, jmpInstSize); fault != nil {
+			report.fault = fault
+			return report
+		}
+		near = trampFunc
+		morestack, _ = locatedGoMorestack(trampFunc)
+	}
+	if x86RelocateBound(backup) == -1 {
+		report.fault = &hookFault{err: ErrUnknownInstruction, addr: from}
+		return report
+	}
+	code, fault := relocateBackup(backup, from, near, srcMorestack, morestack)
+	if fault != nil {
+		report.fault = fault
+		return report
+	}
+	report.relocatedSize = len(code)
+	report.forward = !fitsRel32(uint64(to) - uint64(from+jmpInstSize))
+	return report
+}
+
+func engineUnhook(trampoline unsafe.Pointer) {
+	if trampoline == nil {
+		return
+	}
+
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	t := (*pureTrampoline)(trampoline)
+	patchCode(t.src, t.backup)
+	restoreTrampFunc(t)
+	// forward/back and the grow slot may still be running by other goroutines, leave them
+	t.forward, t.back, t.growSlot = 0, 0, 0
+}
+
+func engineUnhookSrc(trampoline unsafe.Pointer) {
+	if trampoline == nil {
+		return
+	}
+
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	t := (*pureTrampoline)(trampoline)
+	patchCode(t.src, t.backup)
+}
+
+func engineRehookSrc(trampoline unsafe.Pointer) {
+	if trampoline == nil {
+		return
+	}
+
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	t := (*pureTrampoline)(trampoline)
+	to := t.to
+	if t.forward != 0 {
+		to = t.forward
+	}
+	placeJmp(t.src, to)
+}
+
+func engineRelease(trampoline unsafe.Pointer) {
+	if trampoline == nil {
+		return
+	}
+
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	t := (*pureTrampoline)(trampoline)
+	restoreTrampFunc(t)
+	putGrowSlot(t.growSlot)
+	putNearMem(t.forward)
+	putNearMem(t.back)
+	t.forward, t.back, t.growSlot = 0, 0, 0
+}
+
+func engineOrigin(trampoline unsafe.Pointer) unsafe.Pointer {
+	return codePointer((*pureTrampoline)(trampoline).back)
+}
+
+func enginePatchedBytes(trampoline unsafe.Pointer) int {
+	return len((*pureTrampoline)(trampoline).backup)
+}
+
+// writeStub puts `code` in near memory and seals it
+func writeStub(near uintptr, code []byte) unsafe.Pointer {
+	stub := getNearMem(near, len(code))
+	if stub == 0 {
+		return nil
+	}
+	copy(textBytes(stub, len(code)), code)
+	if !sealNearMem(stub) {
+		putNearMem(stub)
+		return nil
+	}
+	return codePointer(stub)
+}
+
+func engineClosureStub(closure uintptr, code unsafe.Pointer, ctxArg int) unsafe.Pointer {
+	if ctxArg >= len(intArgRegs) {
+		return nil
+	}
+	stub := make([]byte, 0, closureStubSize)
+	if ctxArg >= 0 {
+		reg := intArgRegs[ctxArg]
+		stub = append(stub, 0x48|reg>>3, 0x89, 0xC0|2<<3|reg&7)
+	}
+	stub = appendLE64(append(stub, 0x48, 0xBA), uint64(closure))
+	stub = appendAbsJmp(stub, uint64(uintptr(code)))
+	return writeStub(uintptr(code), stub)
+}
+
+func engineContextStub(code unsafe.Pointer) unsafe.Pointer {
+	stub := make([]byte, 0, contextStubSize)
+	stub = append(stub, 0x48, 0x8B, 0x52, 0x08)
+	stub = appendAbsJmp(stub, uint64(uintptr(code)))
+	return writeStub(uintptr(code), stub)
+}
+
+func engineFreeStub(stub unsafe.Pointer) {
+	putNearMem(uintptr(stub))
+}
+
+func engineBranchTargets(pc uintptr, size int, call bool, max int) []uintptr {
+	var targets []uintptr
+	code := textBytes(pc, size)
+	for off := 0; off < size && len(targets) < max; {
+		inst, ok := x86Decode(code[off:])
+		if !ok {
+			break
+		}
+		if (call && inst.Op == x86asm.CALL) || (!call && inst.Op == x86asm.JMP) {
+			if target := x86Target(&inst, code[off:], uint64(pc)+uint64(off)); target != 0 {
+				targets = append(targets, uintptr(target))
+			}
+		}
+		off += inst.Len
+	}
+	return targets
+}
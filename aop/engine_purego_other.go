@@ -0,0 +1,69 @@
+//go:build (!cgo || pinpoint_purego) && !(linux && amd64)
+// +build !cgo pinpoint_purego
+// +build !linux !amd64
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"unsafe"
+)
+
+// the go engine decodes x86 only, the other platforms need the C engine
+
+func engineHook(src, target, trampolineFunc unsafe.Pointer) (unsafe.Pointer, *hookFault) {
+	return nil, &hookFault{err: ErrNoEngine, addr: uintptr(src)}
+}
+
+func engineVerify(src, target, trampolineFunc unsafe.Pointer) *engineReport {
+	return &engineReport{fault: &hookFault{err: ErrNoEngine, addr: uintptr(src)}}
+}
+
+func engineUnhook(trampoline unsafe.Pointer) {}
+
+func engineUnhookSrc(trampoline unsafe.Pointer) {}
+
+func engineRehookSrc(trampoline unsafe.Pointer) {}
+
+func engineRelease(trampoline unsafe.Pointer) {}
+
+func engineOrigin(trampoline unsafe.Pointer) unsafe.Pointer {
+	return nil
+}
+
+func enginePatchedBytes(trampoline unsafe.Pointer) int {
+	return 0
+}
+
+func engineClosureStub(closure uintptr, code unsafe.Pointer, ctxArg int) unsafe.Pointer {
+	return nil
+}
+
+func engineContextStub(code unsafe.Pointer) unsafe.Pointer {
+	return nil
+}
+
+func engineFreeStub(stub unsafe.Pointer) {}
+
+func engineBranchTargets(pc uintptr, size int, call bool, max int) []uintptr {
+	return nil
+}
+
+func engineMemStats(m *MemStats) {
+	*m = MemStats{}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// reasons of a failed AddHook*/UnHook*, check them with errors.Is
+var (
+	ErrAgentDisabled      = errors.New("agent disabled")
+	ErrNotFunction        = errors.New("not function")
+	ErrSignatureMismatch  = errors.New("src, target,trampoline_func signature must be the same")
+	ErrInvalidInput       = errors.New("src, target,trampoline_func must be different functions")
+	ErrTargetNotFound     = errors.New("located nearest target failed")
+	ErrSymbolNotFound     = errors.New("symbol not found in the binary")
+	ErrNoContext          = errors.New("no context.Context parameter to find the trace")
+	ErrAlreadyHooked      = errors.New("src exist")
+	ErrNotHooked          = errors.New("src not hooked")
+	ErrHookBusy           = errors.New("goroutines are running in the hook")
+	ErrNoInterceptor      = errors.New("interceptor not added")
+	ErrNotInterface       = errors.New("not a pointer to an interface")
+	ErrNoContextRegister  = errors.New("no register left for the closure context")
+	ErrUnknownInstruction = errors.New("unknown instruction")
+	ErrFunctionTooShort   = errors.New("function too short")
+	ErrRelocate           = errors.New("instruction can not be relocated")
+	ErrNoNearMemory       = errors.New("no free memory in the reach of a jmp from src")
+	ErrNoMemory           = errors.New("out of memory")
+	ErrMprotect           = errors.New("mprotect failed")
+	ErrNoEngine           = errors.New("no hook engine without cgo on this platform")
+)
+
+// HookError records why a hook operation failed on which function
+type HookError struct {
+	// AddHook, AddHookP_CALL, AddHookP_JMP, AddHookGeneric, AddHookByName, AddHookSpec, AddHookLiteral, AddInterceptor, AddInterfaceInterceptor, UnHookWait
+	Op string
+	// symbol of the function where it failed
+	Func string
+	// address where it failed, 0 if unknown
+	Addr uintptr
+	// decoded instruction blocked the patch, empty if none
+	Inst string
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	msg := e.Op
+	if e.Func != "" {
+		msg += " " + e.Func
+	}
+	if e.Addr != 0 {
+		msg += fmt.Sprintf(" at %#x", e.Addr)
+	}
+	msg += ": " + e.Err.Error()
+	if e.Inst != "" {
+		msg += " (" + e.Inst + ")"
+	}
+	return msg
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+func newHookError(op string, addr uintptr, err error) *HookError {
+	return &HookError{
+		Op:   op,
+		Func: funcName(addr),
+		Addr: addr,
+		Err:  err,
+	}
+}
+
+/**
+ * @description: ErrAgentDisabled of `op` on `iSrc`, checked before iSrc is, it may be no function
+ * @param {string} op
+ * @param {interface{}} iSrc
+ * @return {*}
+ */
+func disabledError(op string, iSrc interface{}) *HookError {
+	if src := reflect.ValueOf(iSrc); src.Kind() == reflect.Func {
+		return newHookError(op, src.Pointer(), ErrAgentDisabled)
+	}
+	return &HookError{Op: op, Func: "src", Err: ErrAgentDisabled}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+//go:noinline
+//go:nosplit
+//go:norace
+func err_foo(a, b int64) int64 {
+	x := a*7 + b
+	return x ^ 0x3579
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func err_foo_tramp(a, b int64) int64 {
+	x := a*9 + b
+	return x ^ 0x2468
+}
+
+//go:noinline
+func hook_err_foo(a, b int64) int64 {
+	return err_foo_tramp(a, b) + 1
+}
+
+// code of the raw funcs, the engine decodes it and fails before it patches
+var (
+	// nop; ret; nop: a ret with code behind it
+	tooShortCode = [16]byte{0x90, 0xC3, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90}
+	// 0xFF /7 is no x86 instruction
+	unknownCode = [16]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+)
+
+/**
+ * @description: a func whose code is `code`, it must never be called
+ * @param {*[16]byte} code
+ * @return {*}
+ */
+func rawFunc(code *[16]byte) func(a, b int64) int64 {
+	fv := &struct{ pc uintptr }{uintptr(unsafe.Pointer(code))}
+	return *(*func(a, b int64) int64)(unsafe.Pointer(&fv))
+}
+
+func checkHookError(t *testing.T, err, want error) *HookError {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("want %q, got %v", want, err)
+	}
+	var hookErr *HookError
+	if !errors.As(err, &hookErr) {
+		t.Fatalf("%v is not HookError", err)
+	}
+	return hookErr
+}
+
+func TestHookErrors(t *testing.T) {
+	checkHookError(t, AddHook(err_foo, "hook_err_foo", err_foo_tramp), ErrNotFunction)
+	checkHookError(t, AddHook(err_foo, fakeRaw, err_foo_tramp), ErrSignatureMismatch)
+	checkHookError(t, AddHookP_CALL(err_foo, hook_err_foo, err_foo_tramp), ErrTargetNotFound)
+	checkHookError(t, AddHook(err_foo, hook_err_foo, err_foo), ErrInvalidInput)
+	checkHookError(t, UnHookWait(err_foo, time.Millisecond), ErrNotHooked)
+
+	if err := AddHook(err_foo, hook_err_foo, err_foo_tramp); err != nil {
+		t.Fatal(err)
+	}
+	hookErr := checkHookError(t, AddHook(err_foo, hook_err_foo, err_foo_tramp), ErrAlreadyHooked)
+	if hookErr.Op != "AddHook" || !strings.HasSuffix(hookErr.Func, ".err_foo") || hookErr.Addr == 0 {
+		t.Errorf("bad HookError: %+v", *hookErr)
+	}
+	if err := UnHookWait(err_foo, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("FORCE_DISABLE_PINPOINT_AGENT", "true")
+	defer os.Unsetenv("FORCE_DISABLE_PINPOINT_AGENT")
+	hookErr = checkHookError(t, AddHook(err_foo, hook_err_foo, err_foo_tramp), ErrAgentDisabled)
+	if hookErr.Op != "AddHook" || !strings.HasSuffix(hookErr.Func, ".err_foo") {
+		t.Errorf("bad HookError: %+v", *hookErr)
+	}
+	checkHookError(t, AddHookByName("main.nowhere", hook_err_foo, err_foo_tramp), ErrAgentDisabled)
+}
+
+func TestHookErrorInst(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the raw code is x86")
+	}
+
+	cases := []struct {
+		name string
+		code *[16]byte
+		want error
+		inst string
+	}{
+		{"tooShort", &tooShortCode, ErrFunctionTooShort, "ret"},
+		{"unknown", &unknownCode, ErrUnknownInstruction, "FF FF FF FF"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			src := rawFunc(c.code)
+			hookErr := checkHookError(t, AddHook(src, hook_err_foo, err_foo_tramp), c.want)
+			if hookErr.Inst == "" || !strings.Contains(strings.ToLower(hookErr.Inst), strings.ToLower(c.inst)) {
+				t.Errorf("bad Inst %q, want %q", hookErr.Inst, c.inst)
+			}
+			if hookErr.Addr < uintptr(unsafe.Pointer(c.code)) || hookErr.Addr >= uintptr(unsafe.Pointer(c.code))+16 {
+				t.Errorf("Addr %x is not in the code at %p", hookErr.Addr, c.code)
+			}
+
+			_, err := VerifyHook(src, hook_err_foo, err_foo_tramp)
+			checkHookError(t, err, c.want)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"testing"
+)
+
+type shapeInt int
+
+//go:noinline
+func twice[T int | shapeInt](x T) T {
+	return x + x
+}
+
+//go:noinline
+func twiceTrampoline(dict uintptr, x int) int {
+	return x * 3
+}
+
+//go:noinline
+func hookTwice(dict uintptr, x int) int {
+	return twiceTrampoline(dict, x) + 1
+}
+
+//go:noinline
+func rawShapeHook(dict uintptr) int {
+	return 0
+}
+
+func TestAddHookGeneric(t *testing.T) {
+	if err := AddHookGeneric(twice[int], hookTwice, twiceTrampoline); err != nil {
+		t.Fatal(err)
+	}
+
+	// twice[shapeInt] shares the body of twice[int]
+	if got := twice(3); got != 7 {
+		t.Fatalf("twice(3) = %d, want 7", got)
+	}
+	if got := twice(shapeInt(3)); got != 7 {
+		t.Fatalf("twice(shapeInt(3)) = %d, want 7", got)
+	}
+
+	found := false
+	for _, info := range Hooks() {
+		if info.Kind == HookGeneric {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("generic hook not listed: %v", Hooks())
+	}
+
+	UnHook(twice[int])
+	if got := twice(3); got != 6 {
+		t.Fatalf("unhooked twice(3) = %d, want 6", got)
+	}
+}
+
+func TestAddHookGenericError(t *testing.T) {
+	// the dictionary is missing
+	if err := AddHookGeneric(twice[int], twice[int], twice[int]); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("err = %v, want %v", err, ErrSignatureMismatch)
+	}
+	if err := AddHookGeneric(twice[int], rawShapeHook, rawShapeHook); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("err = %v, want %v", err, ErrSignatureMismatch)
+	}
+	// raw is not generic
+	if err := AddHookGeneric(raw, rawShapeHook, rawShapeHook); !errors.Is(err, ErrTargetNotFound) {
+		t.Fatalf("err = %v, want %v", err, ErrTargetNotFound)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+// types the binary links for reflect: every pointer type, *T of a type with methods among them
+//
+//go:linkname typelinks reflect.typelinks
+func typelinks() (sections []unsafe.Pointer, offset [][]int32)
+
+// a pointer value, its address is no pointer the GC cares for
+var directIfaceSentinel uintptr
+
+/**
+ * @description: every type in the typelinks of the binary
+ * @return {*}
+ */
+func linkedTypes() []reflect.Type {
+	// a reflect.Type is a *rtype in an interface, borrow the itab of one
+	sample := reflect.TypeOf(0)
+	tab := (*[2]unsafe.Pointer)(unsafe.Pointer(&sample))[0]
+
+	var types []reflect.Type
+	sections, offsets := typelinks()
+	for i, base := range sections {
+		for _, off := range offsets[i] {
+			var typ reflect.Type
+			words := (*[2]unsafe.Pointer)(unsafe.Pointer(&typ))
+			words[0] = tab
+			words[1] = unsafe.Pointer(uintptr(base) + uintptr(off))
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+/**
+ * @description: concrete types implementing `iface`. T is taken if its value implements it,
+ *  else *T: the methods of *T on T go to T again
+ * @param {reflect.Type} iface
+ * @return {*}
+ */
+func implementers(iface reflect.Type) []reflect.Type {
+	seen := make(map[reflect.Type]bool)
+	var out []reflect.Type
+	for _, typ := range linkedTypes() {
+		if typ.Kind() != reflect.Ptr || typ.Elem().Kind() == reflect.Interface {
+			continue
+		}
+		impl := typ.Elem()
+		if !impl.Implements(iface) {
+			impl = typ
+			if !impl.Implements(iface) {
+				continue
+			}
+		}
+		if !seen[impl] {
+			seen[impl] = true
+			out = append(out, impl)
+		}
+	}
+	return out
+}
+
+/**
+ * @description: a value of `typ` is the data word of an interface, not a pointer to it.
+ *  Put a known pointer in it and see if the interface holds that pointer
+ * @param {reflect.Type} typ
+ * @return {*}
+ */
+func isDirectIface(typ reflect.Type) bool {
+	if typ.Size() != unsafe.Sizeof(uintptr(0)) {
+		return false
+	}
+	value := reflect.New(typ)
+	*(*unsafe.Pointer)(unsafe.Pointer(value.Pointer())) = unsafe.Pointer(&directIfaceSentinel)
+	var iface interface{} = value.Elem().Interface()
+	return (*[2]unsafe.Pointer)(unsafe.Pointer(&iface))[1] == unsafe.Pointer(&directIfaceSentinel)
+}
+
+/**
+ * @description: the code an interface call of method `index` of `iface` runs for `impl`, as it is
+ *  in the itab, and its type: the data word of the interface is passed as the receiver
+ * @param {reflect.Type} iface
+ * @param {reflect.Type} impl
+ * @param {int} index
+ * @return {*}
+ */
+func itabMethod(iface, impl reflect.Type, index int) (uintptr, reflect.Type) {
+	value := reflect.New(iface)
+	value.Elem().Set(reflect.Zero(impl))
+	// iface: {tab *itab; data}, itab: {inter, _type; hash uint32; fun [n]uintptr}
+	tab := *(*unsafe.Pointer)(unsafe.Pointer(value.Pointer()))
+	code := *(*uintptr)(unsafe.Pointer(uintptr(tab) + 2*unsafe.Sizeof(uintptr(0)) + 8 + uintptr(index)*unsafe.Sizeof(uintptr(0))))
+
+	recv := impl
+	if impl.Kind() != reflect.Ptr && !isDirectIface(impl) {
+		recv = reflect.PtrTo(impl)
+	}
+	method := iface.Method(index).Type
+	in := []reflect.Type{recv}
+	for i := 0; i < method.NumIn(); i++ {
+		in = append(in, method.In(i))
+	}
+	out := make([]reflect.Type, method.NumOut())
+	for i := range out {
+		out[i] = method.Out(i)
+	}
+	return code, reflect.FuncOf(in, out, method.IsVariadic())
+}
+
+// the interface type of a nil pointer to it, such as (*driver.Conn)(nil)
+func interfaceOf(op string, iIface interface{}) (reflect.Type, error) {
+	typ := reflect.TypeOf(iIface)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Interface {
+		return nil, &HookError{Op: op, Func: fmt.Sprint(typ), Err: ErrNotInterface}
+	}
+	return typ.Elem(), nil
+}
+
+/**
+ * @description: add `it` on `method` of every concrete type implementing an interface, no matter
+ *  the type is known or not. The types are found in the typelinks of the binary, the method each
+ *  of them runs for an interface call is found in its itab, and intercepted as AddInterceptor.
+ *  1. iIface is a nil pointer to the interface: (*driver.Conn)(nil), (*http.RoundTripper)(nil).
+ *  2. Invocation.Args[0] is the receiver as the interface holds it: a pointer to a struct, the value of a pointer-shaped type.
+ *  3. A direct call of a method on its concrete type goes to the same method only if the
+ *     receiver is the same, a value method called by interface runs its *T wrapper.
+ * @param {interface{}} iIface
+ * @param {string} method
+ * @param {*Interceptor} it
+ * @return {*} number of methods intercepted, error if any of them failed
+ */
+func AddInterfaceInterceptor(iIface interface{}, method string, it *Interceptor) (int, error) {
+	if common.AgentIsDisabled() {
+		return 0, &HookError{Op: "AddInterfaceInterceptor", Func: method, Err: ErrAgentDisabled}
+	}
+	iface, err := interfaceOf("AddInterfaceInterceptor", iIface)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := iface.MethodByName(method)
+	if !ok || it == nil {
+		return 0, &HookError{Op: "AddInterfaceInterceptor", Func: iface.String() + "." + method, Err: ErrInvalidInput}
+	}
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+
+	var failed []string
+	done := make(map[uintptr]bool)
+	for _, impl := range implementers(iface) {
+		code, typ := itabMethod(iface, impl, m.Index)
+		if done[code] {
+			continue
+		}
+		done[code] = true
+
+		if !argSizeMatches(code, typ) {
+			err = newHookError("AddInterfaceInterceptor", code, ErrSignatureMismatch)
+		} else {
+			err = addInterceptorLocked("AddInterfaceInterceptor", code, typ, it)
+		}
+		if err != nil {
+			common.Logf("Hook %s of %s failed:%s", method, impl, err)
+			failed = append(failed, err.Error())
+			delete(done, code)
+		}
+	}
+
+	if len(failed) > 0 {
+		return len(done), fmt.Errorf("%s.%s: %d of %d methods failed: %s", iface, method, len(failed), len(done)+len(failed), strings.Join(failed, "; "))
+	}
+	return len(done), nil
+}
+
+/**
+ * @description: remove `it` from `method` of every concrete type implementing the interface,
+ *  the methods stay patched
+ * @param {interface{}} iIface
+ * @param {string} method
+ * @param {*Interceptor} it
+ * @return {*} number of methods `it` is removed from
+ */
+func RemoveInterfaceInterceptor(iIface interface{}, method string, it *Interceptor) (int, error) {
+	iface, err := interfaceOf("RemoveInterfaceInterceptor", iIface)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := iface.MethodByName(method)
+	if !ok {
+		return 0, &HookError{Op: "RemoveInterfaceInterceptor", Func: iface.String() + "." + method, Err: ErrInvalidInput}
+	}
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+
+	removed := 0
+	done := make(map[uintptr]bool)
+	for _, impl := range implementers(iface) {
+		code, _ := itabMethod(iface, impl, m.Index)
+		if done[code] {
+			continue
+		}
+		done[code] = true
+		if removeInterceptorLocked("RemoveInterfaceInterceptor", code, it) == nil {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, &HookError{Op: "RemoveInterfaceInterceptor", Func: iface.String() + "." + method, Err: ErrNoInterceptor}
+	}
+	return removed, nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type shape interface {
+	Area(scale int) int
+}
+
+// value method
+type square struct {
+	side int
+}
+
+//go:noinline
+func (s square) Area(scale int) int {
+	x := s.side * s.side
+	return x * scale
+}
+
+// pointer method
+type rect struct {
+	w, h int
+}
+
+//go:noinline
+func (r *rect) Area(scale int) int {
+	x := r.w * r.h
+	return x * scale
+}
+
+// pointer-shaped, the interface holds the map itself
+type scaled map[string]int
+
+//go:noinline
+func (s scaled) Area(scale int) int {
+	x := s["w"] * s["h"]
+	return x * scale
+}
+
+//go:noinline
+func areaOf(s shape, scale int) int {
+	return s.Area(scale)
+}
+
+func TestAddInterfaceInterceptor(t *testing.T) {
+	if _, err := AddInterfaceInterceptor(shape(nil), "Area", &Interceptor{}); !errors.Is(err, ErrNotInterface) {
+		t.Fatalf("not a pointer to interface: %v", err)
+	}
+	if _, err := AddInterfaceInterceptor((*shape)(nil), "Perimeter", &Interceptor{}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("no such method: %v", err)
+	}
+
+	var recvs []string
+	it := &Interceptor{
+		Name: "area",
+		Before: func(inv *Invocation) {
+			recvs = append(recvs, inv.Args[0].Type().String())
+		},
+		After: func(inv *Invocation) {
+			inv.Results[0] = reflect.ValueOf(int(inv.Results[0].Int() + 1))
+		},
+	}
+	n, err := AddInterfaceInterceptor((*shape)(nil), "Area", it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 3 {
+		t.Fatalf("%d methods intercepted", n)
+	}
+
+	shapes := []shape{square{side: 2}, &rect{w: 2, h: 3}, scaled{"w": 3, "h": 3}}
+	for i, want := range []int{8, 12, 18} {
+		if ret := areaOf(shapes[i], 2); ret != want+1 {
+			t.Fatalf("%T.Area returns %d", shapes[i], ret)
+		}
+	}
+	sort.Strings(recvs)
+	if want := []string{"*aop.rect", "*aop.square", "aop.scaled"}; !reflect.DeepEqual(recvs, want) {
+		t.Fatalf("receivers %v", recvs)
+	}
+
+	removed, err := RemoveInterfaceInterceptor((*shape)(nil), "Area", it)
+	if err != nil || removed != n {
+		t.Fatalf("removed %d of %d: %v", removed, n, err)
+	}
+	for i, want := range []int{8, 12, 18} {
+		if ret := areaOf(shapes[i], 2); ret != want {
+			t.Fatalf("%T.Area returns %d", shapes[i], ret)
+		}
+	}
+	if _, err := RemoveInterfaceInterceptor((*shape)(nil), "Area", it); !errors.Is(err, ErrNoInterceptor) {
+		t.Fatalf("remove twice: %v", err)
+	}
+}
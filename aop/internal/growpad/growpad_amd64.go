@@ -0,0 +1,36 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package growpad holds go text the hook engine calls runtime.morestack from.
+// The package has no cgo, go assembly is not allowed next to cgo
+package growpad
+
+// size must match the pad of growpad_amd64.s
+const size = 4096
+
+func growPad()
+
+func growPadPC() uintptr
+
+/**
+ * @description: the pad for the hooks without trampoline_func. The return address of
+ *  runtime.morestack must be go text with no frame, or the stack copy throws `unknown pc`.
+ *  The pad is never called, the engine writes into it
+ * @return {*} address and size of the pad
+ */
+func Range() (uintptr, int) {
+	return growPadPC(), size
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#include "textflag.h"
+
+#define PAD4 BYTE $0xCC; BYTE $0xCC; BYTE $0xCC; BYTE $0xCC
+#define PAD16 PAD4; PAD4; PAD4; PAD4
+#define PAD64 PAD16; PAD16; PAD16; PAD16
+#define PAD256 PAD64; PAD64; PAD64; PAD64
+
+// growPad is never called. Its slots are go text with no frame, a hook without trampoline_func
+// calls runtime.morestack from one, see Range
+TEXT ·growPad(SB), NOSPLIT|NOFRAME, $0-0
+	PAD256; PAD256; PAD256; PAD256
+	PAD256; PAD256; PAD256; PAD256
+	PAD256; PAD256; PAD256; PAD256
+	PAD256; PAD256; PAD256; PAD256
+
+// func growPadPC() uintptr
+TEXT ·growPadPC(SB), NOSPLIT, $0-8
+	LEAQ ·growPad(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
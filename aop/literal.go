@@ -0,0 +1,143 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+// literalFunc is a func value of a function literal: its code and the closure context
+type literalFunc struct {
+	fn  uintptr
+	ctx unsafe.Pointer
+}
+
+var unsafePointerType = reflect.TypeOf(unsafe.Pointer(nil))
+
+/**
+ * @description: a func value of type `typ` running the origin of a hooked function literal
+ *  with the closure context `ctx`, the captured variables of one instance
+ * @param {reflect.Type} typ
+ * @param {uintptr} code the context stub of the origin
+ * @param {unsafe.Pointer} ctx
+ * @return {*}
+ */
+func literalOrigin(typ reflect.Type, code uintptr, ctx unsafe.Pointer) reflect.Value {
+	fv := &literalFunc{fn: code, ctx: ctx}
+	return reflect.NewAt(typ, unsafe.Pointer(&fv)).Elem()
+}
+
+/**
+ * @description: Hook the function literal named `name`, such as `main.main.func1`, in every
+ * instance the program makes of it.
+ * 1. The compiler names a literal after the function it is in: `pkg.F.func1`, `pkg.(*T).M.func2`,
+ *    `pkg.F.func1.1` for one in another literal.
+ * 2. iHook gets the origin first, then the arguments of the literal:
+ *    func(origin func(int) int, x int) int for a func(int) int literal.
+ *    origin runs the instance called, with its captured variables.
+ * 3. The closure context is passed to the hook in a free integer register, a literal taking
+ *    all of them, or built for the stack ABI (go1.16), fails with ErrNoContextRegister.
+ * @param {string} name
+ * @param {interface{}} iHook
+ * @return {*}
+ */
+func AddHookLiteral(name string, iHook interface{}) error {
+	if common.AgentIsDisabled() {
+		return &HookError{Op: "AddHookLiteral", Func: name, Err: ErrAgentDisabled}
+	}
+
+	hook := reflect.ValueOf(iHook)
+	if hook.Kind() != reflect.Func {
+		return &HookError{Op: "AddHookLiteral", Func: "hook", Err: ErrNotFunction}
+	}
+	hookType := hook.Type()
+	if hookType.NumIn() == 0 || hookType.In(0).Kind() != reflect.Func {
+		return &HookError{Op: "AddHookLiteral", Func: "hook", Err: ErrSignatureMismatch}
+	}
+	typ := hookType.In(0)
+
+	src := lookupSymbol(name)
+	if src == 0 {
+		return &HookError{Op: "AddHookLiteral", Func: name, Err: ErrSymbolNotFound}
+	}
+	if !literalHookMatches(hookType, typ) || !argSizeMatches(src, typ) {
+		return newHookError("AddHookLiteral", src, ErrSignatureMismatch)
+	}
+	ctxArg, ok := nextIntReg(typ)
+	if !ok {
+		return newHookError("AddHookLiteral", src, ErrNoContextRegister)
+	}
+
+	// the arguments of the literal, then its context
+	params := make([]reflect.Type, typ.NumIn(), typ.NumIn()+1)
+	for i := range params {
+		params[i] = typ.In(i)
+	}
+	results := make([]reflect.Type, typ.NumOut())
+	for i := range results {
+		results[i] = typ.Out(i)
+	}
+	withCtx := reflect.FuncOf(append(params, unsafePointerType), results, false)
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	_, err := installClosureHookLocked("AddHookLiteral", src, withCtx, ctxArg, func(origin reflect.Value) hookBody {
+		return literalBody(hook, typ, origin.Pointer())
+	}, HookLiteral)
+	return err
+}
+
+// hookType is func(origin typ, the parameters of typ) the results of typ
+func literalHookMatches(hookType, typ reflect.Type) bool {
+	if hookType.NumIn() != typ.NumIn()+1 || hookType.NumOut() != typ.NumOut() || hookType.IsVariadic() != typ.IsVariadic() {
+		return false
+	}
+	for i := 0; i < typ.NumIn(); i++ {
+		if hookType.In(i+1) != typ.In(i) {
+			return false
+		}
+	}
+	for i := 0; i < typ.NumOut(); i++ {
+		if hookType.Out(i) != typ.Out(i) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * @description: the hook of a function literal: call `hook` with the origin of the instance
+ * @param {reflect.Value} hook
+ * @param {reflect.Type} typ type of the literal
+ * @param {uintptr} code the context stub of the origin
+ * @return {*}
+ */
+func literalBody(hook reflect.Value, typ reflect.Type, code uintptr) hookBody {
+	return func(args []reflect.Value) []reflect.Value {
+		last := len(args) - 1
+		in := make([]reflect.Value, 0, len(args))
+		in = append(in, literalOrigin(typ, code, unsafe.Pointer(args[last].Pointer())))
+		in = append(in, args[:last]...)
+		if typ.IsVariadic() {
+			return hook.CallSlice(in)
+		}
+		return hook.Call(in)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const literalPkg = "github.com/pinpoint-apm/go-aop-agent/aop."
+
+//go:noinline
+func makeCounter(step int) func(int) int {
+	n := 0
+	return func(times int) int {
+		n += step * times
+		return n
+	}
+}
+
+//go:noinline
+func makeFormatter(prefix string, scale float64) func(string, float64, []string, int) (string, error) {
+	return func(name string, x float64, tags []string, n int) (string, error) {
+		if n < 0 {
+			return "", errors.New(prefix + name)
+		}
+		return fmt.Sprintf("%s%s=%g[%s]x%d", prefix, name, x*scale, strings.Join(tags, ","), n), nil
+	}
+}
+
+//go:noinline
+func makeWide(base int) func(a, b, c, d, e, f, g, h, i int) int {
+	return func(a, b, c, d, e, f, g, h, i int) int {
+		return base + a + b + c + d + e + f + g + h + i
+	}
+}
+
+func TestHookLiteral(t *testing.T) {
+	if !regABI {
+		if err := AddHookLiteral(literalPkg+"makeCounter.func1", func(origin func(int) int, times int) int { return 0 }); !errors.Is(err, ErrNoContextRegister) {
+			t.Fatalf("stack ABI: %v", err)
+		}
+		return
+	}
+
+	byTwo, byTen := makeCounter(2), makeCounter(10)
+	byTwo(1)
+
+	var calls int
+	err := AddHookLiteral(literalPkg+"makeCounter.func1", func(origin func(int) int, times int) int {
+		calls++
+		// the context is held by origin only
+		runtime.GC()
+		return origin(times) + 1000
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(byTwo, time.Second)
+
+	// every instance, the ones made before the hook too, keeps its own captured variables
+	if ret := byTwo(1); ret != 1004 {
+		t.Errorf("byTwo = %d", ret)
+	}
+	if ret := byTen(3); ret != 1030 {
+		t.Errorf("byTen = %d", ret)
+	}
+	if ret := makeCounter(5)(1); ret != 1005 {
+		t.Errorf("new instance = %d", ret)
+	}
+	if ret := byTwo(2); ret != 1008 {
+		t.Errorf("byTwo = %d", ret)
+	}
+	if calls != 4 {
+		t.Errorf("hook calls = %d", calls)
+	}
+
+	found := false
+	for _, info := range Hooks() {
+		if info.Source == literalPkg+"makeCounter.func1" {
+			found = info.Kind == HookLiteral
+		}
+	}
+	if !found {
+		t.Error("literal hook is not listed")
+	}
+
+	if err := UnHookWait(byTen, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ret := byTwo(1); ret != 10 {
+		t.Errorf("unhooked byTwo = %d", ret)
+	}
+}
+
+func TestHookLiteralRegisters(t *testing.T) {
+	if !regABI {
+		t.Skip("stack ABI")
+	}
+
+	format := makeFormatter("x.", 0.5)
+	err := AddHookLiteral(literalPkg+"makeFormatter.func1",
+		func(origin func(string, float64, []string, int) (string, error), name string, x float64, tags []string, n int) (string, error) {
+			s, err := origin(strings.ToUpper(name), x, append(tags, "hooked"), n)
+			return "<" + s + ">", err
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(format, time.Second)
+
+	if s, err := format("a", 3, []string{"t"}, 2); err != nil || s != "<x.A=1.5[t,hooked]x2>" {
+		t.Errorf("format = %q, %v", s, err)
+	}
+	if _, err := format("b", 0, nil, -1); err == nil || err.Error() != "x.B" {
+		t.Errorf("format error = %v", err)
+	}
+
+	// all integer registers are taken by the arguments
+	wide := makeWide(1)
+	err = AddHookLiteral(literalPkg+"makeWide.func1", func(origin func(a, b, c, d, e, f, g, h, i int) int, a, b, c, d, e, f, g, h, i int) int {
+		return 0
+	})
+	if !errors.Is(err, ErrNoContextRegister) {
+		t.Errorf("wide literal: %v", err)
+	}
+	if ret := wide(1, 1, 1, 1, 1, 1, 1, 1, 1); ret != 10 {
+		t.Errorf("wide = %d", ret)
+	}
+
+	err = AddHookLiteral(literalPkg+"makeFormatter.func1", func(origin func(int) int, times int) int { return 0 })
+	if !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("mismatch: %v", err)
+	}
+}
+
+func TestHookLiteralConcurrent(t *testing.T) {
+	if !regABI {
+		t.Skip("stack ABI")
+	}
+
+	err := AddHookLiteral(literalPkg+"makeCounter.func1", func(origin func(int) int, times int) int {
+		return origin(times)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(makeCounter(0), time.Second)
+
+	var wg sync.WaitGroup
+	for g := 1; g <= 8; g++ {
+		wg.Add(1)
+		go func(step int) {
+			defer wg.Done()
+			count := makeCounter(step)
+			for i := 1; i <= 1000; i++ {
+				if ret := count(1); ret != step*i {
+					t.Errorf("step %d: %d at %d", step, ret, i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// makeDeep has a frame too big for a fresh goroutine, its stack check fails in the origin
+//
+//go:noinline
+func makeDeep(base int) func(int) int {
+	return func(n int) int {
+		var buf [64 << 10]byte
+		buf[n%len(buf)] = byte(n)
+		return int(buf[(n*7)%len(buf)]) + base + n
+	}
+}
+
+func TestHookLiteralStackGrowth(t *testing.T) {
+	if !regABI {
+		t.Skip("stack ABI")
+	}
+
+	deep := makeDeep(100)
+	var calls int32
+	err := AddHookLiteral(literalPkg+"makeDeep.func1", func(origin func(int) int, n int) int {
+		atomic.AddInt32(&calls, 1)
+		return origin(n) + 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookWait(deep, time.Second)
+
+	for i := 1; i <= 100; i++ {
+		ch := make(chan int)
+		// a fresh goroutine starts with a small stack
+		go func() {
+			ch <- deep(i)
+		}()
+		if got := <-ch; got != i+101 {
+			t.Fatalf("deep(%d) = %d", i, got)
+		}
+	}
+	// growing the stack in the origin must not run the hook again
+	if got := atomic.LoadInt32(&calls); got != 100 {
+		t.Fatalf("hook ran %d times for 100 calls", got)
+	}
+}
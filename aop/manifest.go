@@ -0,0 +1,334 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+// ManifestEnv names the hook manifest loaded at startup
+const ManifestEnv = "PINPOINT_HOOKS"
+
+// HookSpec is a function profiled as a method call span (PP_METHOD_CALL)
+type HookSpec struct {
+	// symbol of the function, as AddHookByName takes it
+	Symbol string `json:"symbol"`
+	// go signature of Symbol, the receiver is the first parameter. A type of another
+	// package is written as the type of the same shape: `*sql.DB` as unsafe.Pointer
+	Signature string `json:"signature"`
+	// interceptor name of the span, Symbol if empty
+	Name string `json:"name"`
+	// record the arguments but context.Context
+	Args bool `json:"args"`
+	// record the results but error
+	Return bool `json:"return"`
+	// "once"(default): a span per call, as common.PinFuncOnce.
+	// "sum": a span summing up the calls in a trace, as common.PinFuncSum
+	Style string `json:"style"`
+}
+
+// HookManifest is the file of `PINPOINT_HOOKS`, JSON or YAML
+type HookManifest struct {
+	Hooks []HookSpec `json:"hooks"`
+}
+
+type pinFunc func(ctx context.Context, name string, args ...interface{}) (context.Context, common.DeferFunc)
+
+var manifestStyles = map[string]pinFunc{
+	"":     common.PinFuncOnce,
+	"once": common.PinFuncOnce,
+	"sum":  common.PinFuncSum,
+}
+
+func init() {
+	if path := os.Getenv(ManifestEnv); path != "" {
+		if err := LoadHookManifest(path); err != nil {
+			common.Logf("load %s failed:%s", ManifestEnv, err)
+		}
+	}
+}
+
+/**
+ * @description: hook every function in the manifest at `path`.
+ *  A function failed is logged and skipped, the rest are still hooked
+ * @param {string} path
+ * @return {*} what failed
+ */
+func LoadHookManifest(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	manifest, err := ParseHookManifest(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	var failed []string
+	for _, spec := range manifest.Hooks {
+		common.Logf("try to hook %s", spec.Symbol)
+		if err := AddHookSpec(spec); err != nil {
+			common.Logf("Hook %s failed:%s", spec.Symbol, err)
+			failed = append(failed, err.Error())
+			continue
+		}
+		common.Logf("%s is hooked", spec.Symbol)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s: %d of %d hooks failed: %s", path, len(failed), len(manifest.Hooks), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+/**
+ * @description: hook the function in `spec` by its symbol, no code of the hook is needed.
+ *  1. The signature is checked against the argument frame of the symbol, it is all the runtime knows.
+ *  2. The trace is found by the first context.Context parameter, the span is not made without it.
+ *  3. Remove it by UnHookByName
+ * @param {HookSpec} spec
+ * @return {*}
+ */
+func AddHookSpec(spec HookSpec) error {
+	if common.AgentIsDisabled() {
+		return &HookError{Op: "AddHookSpec", Func: spec.Symbol, Err: ErrAgentDisabled}
+	}
+
+	pin, ok := manifestStyles[spec.Style]
+	if !ok {
+		return &HookError{Op: "AddHookSpec", Func: spec.Symbol, Err: fmt.Errorf("unknown style %q", spec.Style)}
+	}
+	typ, err := parseSignature(spec.Signature)
+	if err != nil {
+		return &HookError{Op: "AddHookSpec", Func: spec.Symbol, Err: err}
+	}
+	ctxIn := -1
+	for i := 0; i < typ.NumIn() && ctxIn < 0; i++ {
+		if typ.In(i) == contextType {
+			ctxIn = i
+		}
+	}
+	if ctxIn < 0 {
+		return &HookError{Op: "AddHookSpec", Func: spec.Symbol, Err: ErrNoContext}
+	}
+
+	src := lookupSymbol(spec.Symbol)
+	if src == 0 {
+		return &HookError{Op: "AddHookSpec", Func: spec.Symbol, Err: ErrSymbolNotFound}
+	}
+	src = resolveABIWrapper(src)
+	if !argSizeMatches(src, typ) {
+		return newHookError("AddHookSpec", src, ErrSignatureMismatch)
+	}
+
+	name := spec.Name
+	if name == "" {
+		name = spec.Symbol
+	}
+	return installClosureHook("AddHookSpec", src, typ, func(origin reflect.Value) hookBody {
+		return specBody(spec, name, pin, ctxIn, origin)
+	}, HookBySpec)
+}
+
+/**
+ * @description: the hook of a manifest function: a span around the origin
+ * @param {HookSpec} spec
+ * @param {string} name interceptor name
+ * @param {pinFunc} pin
+ * @param {int} ctxIn index of the context.Context parameter
+ * @param {reflect.Value} origin
+ * @return {*}
+ */
+func specBody(spec HookSpec, name string, pin pinFunc, ctxIn int, origin reflect.Value) hookBody {
+	typ := origin.Type()
+	return func(args []reflect.Value) []reflect.Value {
+		ctx, _ := args[ctxIn].Interface().(context.Context)
+		var recorded []interface{}
+		if spec.Args {
+			for i, arg := range args {
+				if i != ctxIn {
+					recorded = append(recorded, arg.Interface())
+				}
+			}
+		}
+
+		nctx, done := pin(ctx, name, recorded...)
+		defer func() {
+			if r := recover(); r != nil {
+				err := fmt.Errorf("panic: %v", r)
+				done(&err)
+				panic(r)
+			}
+		}()
+		args[ctxIn] = reflect.ValueOf(&nctx).Elem()
+
+		var rets []reflect.Value
+		if typ.IsVariadic() {
+			rets = origin.CallSlice(args)
+		} else {
+			rets = origin.Call(args)
+		}
+
+		var err error
+		var results []interface{}
+		for i, ret := range rets {
+			if typ.Out(i) == errorType {
+				err, _ = ret.Interface().(error)
+			} else if spec.Return {
+				results = append(results, ret.Interface())
+			}
+		}
+		done(&err, results...)
+		return rets
+	}
+}
+
+/**
+ * @description: parse a manifest, JSON if it starts with `{` or `[`, else YAML
+ * @param {[]byte} data
+ * @return {*}
+ */
+func ParseHookManifest(data []byte) (*HookManifest, error) {
+	manifest := &HookManifest{}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return manifest, parseManifestYAML(string(data), manifest)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.DisallowUnknownFields()
+	var err error
+	if trimmed[0] == '[' {
+		err = dec.Decode(&manifest.Hooks)
+	} else {
+		err = dec.Decode(manifest)
+	}
+	return manifest, err
+}
+
+/**
+ * @description: the YAML of a manifest: a list of flat mappings under `hooks:`, or the list alone
+ *  hooks:
+ *    - symbol: main.(*Store).Get
+ *      signature: func(unsafe.Pointer, context.Context, string) ([]byte, error)
+ *      args: true
+ * @param {string} data
+ * @param {*HookManifest} manifest
+ * @return {*}
+ */
+func parseManifestYAML(data string, manifest *HookManifest) error {
+	for n, line := range strings.Split(data, "\n") {
+		text := strings.TrimSpace(stripYAMLComment(line))
+		switch {
+		case text == "" || text == "---":
+			continue
+		case text == "hooks:" && line[0] != ' ' && len(manifest.Hooks) == 0:
+			continue
+		case text == "-" || strings.HasPrefix(text, "- "):
+			manifest.Hooks = append(manifest.Hooks, HookSpec{})
+			if text = strings.TrimSpace(text[1:]); text == "" {
+				continue
+			}
+		case len(manifest.Hooks) == 0:
+			return fmt.Errorf("line %d: %q is not in a hook", n+1, text)
+		}
+
+		if err := setSpecField(&manifest.Hooks[len(manifest.Hooks)-1], text); err != nil {
+			return fmt.Errorf("line %d: %s", n+1, err)
+		}
+	}
+	return nil
+}
+
+// stripYAMLComment drops `# ...` out of quotes
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+/**
+ * @description: set a field of `spec` by a YAML `key: value`
+ * @param {*HookSpec} spec
+ * @param {string} text
+ * @return {*}
+ */
+func setSpecField(spec *HookSpec, text string) error {
+	colon := strings.Index(text, ":")
+	if colon < 0 {
+		return fmt.Errorf("%q is not `key: value`", text)
+	}
+	key, value := strings.TrimSpace(text[:colon]), strings.TrimSpace(text[colon+1:])
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		value = unquoted
+	} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+
+	parseBool := func(field *bool) error {
+		switch strings.ToLower(value) {
+		case "true", "yes", "on":
+			*field = true
+		case "false", "no", "off", "":
+			*field = false
+		default:
+			return fmt.Errorf("%s: %q is not a bool", key, value)
+		}
+		return nil
+	}
+
+	switch key {
+	case "symbol":
+		spec.Symbol = value
+	case "signature":
+		spec.Signature = value
+	case "name":
+		spec.Name = value
+	case "style":
+		spec.Style = value
+	case "args":
+		return parseBool(&spec.Args)
+	case "return":
+		return parseBool(&spec.Return)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+type specStore struct {
+	prefix string
+}
+
+//go:noinline
+func (s *specStore) get(ctx context.Context, key string, n int) (string, error) {
+	if n < 0 {
+		return "", errors.New("negative n")
+	}
+	return s.prefix + strings.Repeat(key, n), nil
+}
+
+//go:noinline
+func specSum(ctx context.Context, xs ...int) int {
+	sum := 0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum
+}
+
+//go:noinline
+func specFloats(a float64, ctx context.Context, b float32, s []byte, i interface{}) (float64, bool) {
+	return a + float64(b) + float64(len(s)), i != nil
+}
+
+const (
+	specStoreGet = "github.com/pinpoint-apm/go-aop-agent/aop.(*specStore).get"
+	specSumName  = "github.com/pinpoint-apm/go-aop-agent/aop.specSum"
+)
+
+// pinCall is what a span of a manifest hook recorded
+type pinCall struct {
+	name string
+	args []interface{}
+	err  error
+	rets []interface{}
+}
+
+// recordStyle replaces a style by a recorder, the agent is not running in tests
+func recordStyle(t *testing.T, style string) *[]*pinCall {
+	calls := &[]*pinCall{}
+	old := manifestStyles[style]
+	manifestStyles[style] = func(ctx context.Context, name string, args ...interface{}) (context.Context, common.DeferFunc) {
+		if ctx == nil {
+			return ctx, func(*error, ...interface{}) {}
+		}
+		call := &pinCall{name: name, args: args}
+		*calls = append(*calls, call)
+		return context.WithValue(ctx, common.TRACE_ID, common.TraceIdType(len(*calls))), func(err *error, ret ...interface{}) {
+			call.err, call.rets = *err, ret
+		}
+	}
+	t.Cleanup(func() { manifestStyles[style] = old })
+	return calls
+}
+
+func TestParseSignature(t *testing.T) {
+	cases := []struct {
+		sig  string
+		want interface{}
+	}{
+		{"func()", func() {}},
+		{"func(context.Context, string) error", func(context.Context, string) error { return nil }},
+		{"func(c unsafe.Pointer, ctx context.Context, query string, args ...interface{}) (unsafe.Pointer, error)",
+			func(unsafe.Pointer, context.Context, string, ...interface{}) (unsafe.Pointer, error) { return nil, nil }},
+		{"func(*sql.DB, map[string]int, chan int, <-chan int, func(int) error) (n int, err error)",
+			func(unsafe.Pointer, unsafe.Pointer, unsafe.Pointer, unsafe.Pointer, unsafe.Pointer) (int, error) {
+				return 0, nil
+			}},
+		{"func([]byte, [][]string, any, uint8, float32)", func([]byte, [][]string, interface{}, uint8, float32) {}},
+	}
+	for _, c := range cases {
+		typ, err := parseSignature(c.sig)
+		if err != nil {
+			t.Fatalf("%s: %s", c.sig, err)
+		}
+		if want := reflect.TypeOf(c.want); typ != want {
+			t.Fatalf("%s: got %s, want %s", c.sig, typ, want)
+		}
+	}
+
+	for _, sig := range []string{"", "func(", "f(int)", "func(sql.DB)", "func(...int, int)", "func() ...int"} {
+		if _, err := parseSignature(sig); err == nil {
+			t.Fatalf("%q parsed", sig)
+		}
+	}
+}
+
+func TestArgFrameSize(t *testing.T) {
+	for _, fn := range []interface{}{
+		(*specStore).get,
+		specSum,
+		specFloats,
+		(*byNameConn).query,
+		twiceTrampolineFrame,
+	} {
+		v := reflect.ValueOf(fn)
+		args, ok := funcArgSize(runtime.FuncForPC(v.Pointer()))
+		if !ok {
+			t.Fatalf("%s: no args", funcName(v.Pointer()))
+		}
+		if got := argFrameSize(v.Type()); alignUp(got, ptrSize) != alignUp(int(args), ptrSize) {
+			t.Fatalf("%s: frame %d, runtime says %d", funcName(v.Pointer()), got, args)
+		}
+	}
+}
+
+// more arguments than registers
+//
+//go:noinline
+func twiceTrampolineFrame(a, b, c, d, e, f, g, h, i, j, k int, s string) (int, string) {
+	return a + b + c + d + e + f + g + h + i + j + k, s
+}
+
+func TestParseHookManifest(t *testing.T) {
+	yaml := `
+# profiled without code
+hooks:
+  - symbol: "main.(*Store).Get"   # quoted
+    signature: func(unsafe.Pointer, context.Context, string) ([]byte, error)
+    name: 'Store''s Get'
+    args: true
+    return: yes
+  -
+    symbol: main.Sum
+    signature: func(context.Context, ...int) int
+    style: sum
+`
+	want := []HookSpec{
+		{Symbol: "main.(*Store).Get", Signature: "func(unsafe.Pointer, context.Context, string) ([]byte, error)",
+			Name: "Store's Get", Args: true, Return: true},
+		{Symbol: "main.Sum", Signature: "func(context.Context, ...int) int", Style: "sum"},
+	}
+	manifest, err := ParseHookManifest([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(manifest.Hooks, want) {
+		t.Fatalf("yaml: %+v", manifest.Hooks)
+	}
+
+	json := `{"hooks": [
+		{"symbol": "main.(*Store).Get", "signature": "func(unsafe.Pointer, context.Context, string) ([]byte, error)",
+		 "name": "Store's Get", "args": true, "return": true},
+		{"symbol": "main.Sum", "signature": "func(context.Context, ...int) int", "style": "sum"}]}`
+	if manifest, err = ParseHookManifest([]byte(json)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(manifest.Hooks, want) {
+		t.Fatalf("json: %+v", manifest.Hooks)
+	}
+
+	for _, bad := range []string{
+		"symbol: main.F",
+		"hooks:\n  - symbol: main.F\n    level: 3",
+		"- args: maybe",
+		`- name: "unterminated\"`,
+		`[{"symbol": "main.F", "level": 3}]`,
+	} {
+		if _, err := ParseHookManifest([]byte(bad)); err == nil {
+			t.Fatalf("%q parsed", bad)
+		}
+	}
+}
+
+func TestLoadHookManifest(t *testing.T) {
+	calls := recordStyle(t, "")
+	sums := recordStyle(t, "sum")
+
+	path := filepath.Join(t.TempDir(), "hooks.yaml")
+	manifest := `hooks:
+  - symbol: ` + specStoreGet + `
+    signature: func(s unsafe.Pointer, ctx context.Context, key string, n int) (string, error)
+    name: store.get
+    args: true
+    return: true
+  - symbol: ` + specSumName + `
+    signature: func(context.Context, ...int) int
+    style: sum
+`
+	if err := os.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadHookManifest(path); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookByName(specSumName)
+	defer UnHookByName(specStoreGet)
+
+	found := 0
+	for _, info := range Hooks() {
+		if info.Source == specStoreGet || info.Source == specSumName {
+			if info.Kind != HookBySpec {
+				t.Fatalf("%s kind %s", info.Source, info.Kind)
+			}
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("%d hooks listed", found)
+	}
+
+	store := &specStore{prefix: ">"}
+	if got, err := store.get(context.Background(), "ab", 2); got != ">abab" || err != nil {
+		t.Fatalf("get = %q, %v", got, err)
+	}
+	if _, err := store.get(context.Background(), "ab", -1); err == nil {
+		t.Fatal("get lost its error")
+	}
+	if len(*calls) != 2 {
+		t.Fatalf("%d spans", len(*calls))
+	}
+	first, second := (*calls)[0], (*calls)[1]
+	if first.name != "store.get" || first.err != nil || !reflect.DeepEqual(first.rets, []interface{}{">abab"}) ||
+		len(first.args) != 3 || first.args[1] != "ab" || first.args[2] != 2 {
+		t.Fatalf("first span %+v", first)
+	}
+	if second.err == nil || second.err.Error() != "negative n" {
+		t.Fatalf("second span %+v", second)
+	}
+
+	if got := specSum(context.Background(), 1, 2, 3); got != 6 {
+		t.Fatalf("sum = %d", got)
+	}
+	if len(*sums) != 1 || (*sums)[0].name != specSumName || (*sums)[0].args != nil || (*sums)[0].rets != nil {
+		t.Fatalf("sum spans %+v", *sums)
+	}
+
+	UnHookByName(specStoreGet)
+	if got, _ := store.get(context.Background(), "x", 1); got != ">x" || len(*calls) != 2 {
+		t.Fatalf("unhooked get = %q, %d spans", got, len(*calls))
+	}
+}
+
+//go:noinline
+func specTrace(ctx context.Context) int64 {
+	if ctx == nil {
+		return -1
+	}
+	id, _ := ctx.Value(common.TRACE_ID).(common.TraceIdType)
+	return int64(id)
+}
+
+// the origin runs in the context of the span
+func TestAddHookSpecContext(t *testing.T) {
+	recordStyle(t, "")
+	spec := HookSpec{Symbol: "github.com/pinpoint-apm/go-aop-agent/aop.specTrace", Signature: "func(context.Context) int64"}
+	if err := AddHookSpec(spec); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHookByName(spec.Symbol)
+
+	if got := specTrace(context.Background()); got != 1 {
+		t.Fatalf("trace %d, want 1", got)
+	}
+	// no trace without a context
+	if got := specTrace(nil); got != -1 {
+		t.Fatalf("trace %d of nil", got)
+	}
+}
+
+func TestAddHookSpecError(t *testing.T) {
+	recordStyle(t, "")
+	hooks := len(Hooks())
+	cases := []struct {
+		spec HookSpec
+		err  error
+	}{
+		{HookSpec{Symbol: "no/such.pkg.Func", Signature: "func(context.Context)"}, ErrSymbolNotFound},
+		{HookSpec{Symbol: specStoreGet, Signature: "func(unsafe.Pointer, context.Context, string) (string, error)"}, ErrSignatureMismatch},
+		{HookSpec{Symbol: specStoreGet, Signature: "func(unsafe.Pointer, string, string, int) (string, error)"}, ErrNoContext},
+	}
+	for _, c := range cases {
+		if err := AddHookSpec(c.spec); !errors.Is(err, c.err) {
+			t.Fatalf("%+v: %v, want %v", c.spec, err, c.err)
+		}
+	}
+
+	for _, spec := range []HookSpec{
+		{Symbol: specSumName, Signature: "func(context.Context, ...int) int", Style: "twice"},
+		{Symbol: specSumName, Signature: "func(context.Context, ...sql.Int) int"},
+	} {
+		var hookErr *HookError
+		if err := AddHookSpec(spec); !errors.As(err, &hookErr) {
+			t.Fatalf("%+v: %v", spec, err)
+		}
+	}
+
+	if err := LoadHookManifest(filepath.Join(t.TempDir(), "none.yaml")); err == nil {
+		t.Fatal("loaded a missing manifest")
+	}
+	if len(Hooks()) != hooks {
+		t.Fatalf("hooks left: %+v", Hooks())
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+// a hook takes a few blocks, pages are far fewer than hooks
+const maxMemStatPages = 1024
+
+// PageStat is a page mapped near the go text for trampolines and closure stubs
+type PageStat struct {
+	Address uintptr
+	Size    int
+	// blocks holding code of a hook
+	Blocks int
+	// blocks handed out and being written
+	Writing     int
+	UsedBytes   int
+	FreeBlocks  int
+	LargestFree int
+	Writable    bool
+	Executable  bool
+}
+
+// MemStats is the state of the near memory allocator
+type MemStats struct {
+	Pages []PageStat
+	// pages mapped and given back to the OS since start
+	Mapped   uint64
+	Unmapped uint64
+}
+
+/**
+ * @description: fill `m` with the near memory allocator. A page is writable only while
+ *  a hook is being placed, an idle one is executable or not accessible at all
+ * @param {*MemStats} m
+ * @return {*}
+ */
+func ReadMemStats(m *MemStats) {
+	engineMemStats(m)
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"testing"
+	"time"
+)
+
+//go:noinline
+//go:nosplit
+//go:norace
+func mem_foo(a, b int64) int64 {
+	x := a*11 + b
+	return x ^ 0x2468
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func mem_foo_tramp(a, b int64) int64 {
+	x := a*13 + b
+	return x ^ 0x1357
+}
+
+//go:noinline
+func hook_mem_foo(a, b int64) int64 {
+	return mem_foo_tramp(a, b) + 1
+}
+
+func TestReadMemStats(t *testing.T) {
+	if err := AddHook(mem_foo, hook_mem_foo, mem_foo_tramp); err != nil {
+		t.Fatal(err)
+	}
+	var m MemStats
+	ReadMemStats(&m)
+	if len(m.Pages) == 0 || m.Mapped == 0 {
+		t.Fatalf("no page after hook: %+v", m)
+	}
+	if err := UnHookWait(mem_foo, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ReadMemStats(&m)
+	pages, mapped := len(m.Pages), m.Mapped
+	for i := 0; i < 256; i++ {
+		if err := AddHook(mem_foo, hook_mem_foo, mem_foo_tramp); err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+		if err := UnHookWait(mem_foo, time.Second); err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+	}
+
+	ReadMemStats(&m)
+	if len(m.Pages) != pages || m.Mapped != mapped {
+		t.Fatalf("hook/unhook leaks pages: %d -> %d, mapped %d -> %d", pages, len(m.Pages), mapped, m.Mapped)
+	}
+	for _, page := range m.Pages {
+		if page.Writable {
+			t.Fatalf("page %x is writable: %+v", page.Address, page)
+		}
+		if page.Writing != 0 || page.UsedBytes > page.Size || page.LargestFree > page.Size-page.UsedBytes {
+			t.Fatalf("bad page %x: %+v", page.Address, page)
+		}
+	}
+}
@@ -0,0 +1,713 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * Near allocator: a trampoline or a stub must be in reach of the rel32 jmp (+/-2GB) or
+ * the b (+/-128MB) patched to it. Pages are mapped near the code, and handed out in blocks.
+ *  - the metadata of a page is in the C heap, nothing but code is in the page
+ *  - free blocks of a page are a list sorted by offset, a block put back merges with its neighbors
+ *  - W^X: a page is writable only while a block in it is written, and executable only while it
+ *    has sealed code. A page having both is writable and executable just for the time of the write
+ *  - an empty page is given back to the OS, but the last one: hook/unhook cycles need not map it again
+ */
+#include "pinpoint.h"
+
+#define NEAR_MEM_ALIGN 16
+// set in NearChunk.blocks while the block is not sealed
+#define BLOCK_WRITING 0x80000000u
+
+typedef struct near_free_s
+{
+    int32_t offset;
+    int32_t size;
+    struct near_free_s *next;
+} NearFree;
+
+typedef struct near_chunk_s
+{
+    BYTE *page;
+    int32_t live;    // sealed blocks
+    int32_t writing; // blocks handed out and not sealed yet
+    int32_t prot;
+    NearFree *free;
+    // size of the block at each NEAR_MEM_ALIGN unit, BLOCK_WRITING if not sealed, 0: no block starts there
+    uint32_t *blocks;
+    struct near_chunk_s *next;
+} NearChunk;
+
+static NearChunk *near_chunks_g;
+static uint64_t near_mapped_g;
+static uint64_t near_unmapped_g;
+// guards near_chunks_g and every chunk hanging on it
+static pthread_mutex_t near_mem_lock_g = PTHREAD_MUTEX_INITIALIZER;
+
+static inline int32_t align_block(int32_t size)
+{
+    return (size + NEAR_MEM_ALIGN - 1) & ~(NEAR_MEM_ALIGN - 1);
+}
+
+void *get_page_boundary(void *ptr)
+{
+    return (void *)((long)ptr & ~(getpagesize() - 1));
+}
+
+static inline void *get_near_low(void *ptr)
+{
+    return (void *)(((long)ptr > NEAR_RANGE) ? (long)ptr - NEAR_RANGE : 0x80000);
+}
+
+static inline void *get_near_above(void *ptr)
+{
+    return (void *)((unsigned long)ptr < 0xffffffffffffffffUL - NEAR_RANGE ? (unsigned long)ptr + NEAR_RANGE : 0xfffffffffff80000);
+}
+
+int set_mm_area_opt(void *ptr, int size, int prot)
+{
+    int page_size = getpagesize();
+    void *p = get_page_boundary(ptr);
+
+    for (; p <= ptr + size; p += page_size)
+    {
+        int ret = mprotect(p, page_size, prot);
+        if (ret != 0)
+        {
+            LOG_TRACE("mprotect on [start:%p,size:%d] opt:%d error:%s ", p, page_size, prot, strerror(errno));
+            return -1;
+        }
+    }
+    return 0;
+}
+
+static void *try_get_page_from_addr_hi(void *low, void *hi)
+{
+    int page = getpagesize();
+    void *mem = NULL;
+
+    for (; low < hi; hi -= page)
+    {
+        // force map memory from start, nothing runs in a fresh page
+        mem = mmap(hi, page, PROT_READ | PROT_WRITE, MAP_ANONYMOUS | MAP_PRIVATE, -1, 0);
+        if (mem == MAP_FAILED)
+        {
+            LOG_TRACE("mmap:%p->%d failed:%s", hi, page, strerror(errno));
+        }
+        else if (mem != hi)
+        {
+            munmap(mem, page);
+        }
+        else
+        {
+            return mem;
+        }
+    }
+    return NULL;
+}
+
+static void *try_get_page_from_addr_lo(void *low, void *hi)
+{
+    int page = getpagesize();
+    void *mem = NULL;
+
+    for (; low < hi; low += page)
+    {
+        // force map memory from start, nothing runs in a fresh page
+        mem = mmap(low, page, PROT_READ | PROT_WRITE, MAP_ANONYMOUS | MAP_PRIVATE, -1, 0);
+        if (mem == MAP_FAILED)
+        {
+            LOG_TRACE("mmap:%p->%d failed:%s", low, page, strerror(errno));
+        }
+        else if (mem != low)
+        {
+            munmap(mem, page);
+        }
+        else
+        {
+            return mem;
+        }
+    }
+    return NULL;
+}
+
+/**
+ * @brief Get the page neighbor mem object
+ * size is 1 pagesize(4096)
+ * @param where
+ * @return void*
+ */
+static void *get_neighbor_page(void *where)
+{
+    void *target = get_page_boundary(where);
+    void *lo = get_near_low(target);
+    void *hi = get_near_above(target);
+    void *try = NULL;
+    // Try looking NEAR_HALF below or lower.
+    if (try == NULL && (unsigned long)target > NEAR_HALF)
+    {
+        try = try_get_page_from_addr_hi(lo, target - NEAR_HALF);
+    }
+
+    if (try == NULL && (unsigned long)target < 0xffffffffffffffffUL - NEAR_HALF)
+    {
+        try = try_get_page_from_addr_lo(target + NEAR_HALF, hi);
+    }
+
+    if (try == NULL && (unsigned long)target > NEAR_HALF)
+    {
+        try = try_get_page_from_addr_hi(target - NEAR_HALF, target);
+    }
+
+    if (try == NULL && (unsigned long)target < 0xffffffffffffffffUL - NEAR_HALF)
+    {
+        try = try_get_page_from_addr_hi(target, target + NEAR_HALF);
+    }
+
+    if (try == NULL)
+    {
+        try = try_get_page_from_addr_hi(lo, target);
+    }
+
+    if (try == NULL)
+    {
+        try = try_get_page_from_addr_lo(target, hi);
+    }
+
+    LOG_TRACE("where:%p neighbor:%p range:%ld", where, try, where - try);
+    return try;
+}
+
+// W^X: writable while written, executable while having code
+static int32_t chunk_prot(const NearChunk *chunk)
+{
+    if (chunk->writing > 0)
+    {
+        // the live code in the page keeps running while another block is written
+        return chunk->live > 0 ? PROT_READ | PROT_WRITE | PROT_EXEC : PROT_READ | PROT_WRITE;
+    }
+    return chunk->live > 0 ? PROT_READ | PROT_EXEC : PROT_NONE;
+}
+
+static int32_t update_chunk_prot(NearChunk *chunk)
+{
+    int32_t prot = chunk_prot(chunk);
+    if (prot == chunk->prot)
+    {
+        return 0;
+    }
+    if (mprotect(chunk->page, getpagesize(), prot) != 0)
+    {
+        LOG_ETRACE("mprotect %p to %d failed:%s", chunk->page, prot, strerror(errno));
+        return -1;
+    }
+    chunk->prot = prot;
+    return 0;
+}
+
+static NearChunk *new_chunk(BYTE *page)
+{
+    int32_t size = getpagesize();
+    NearChunk *chunk = calloc(1, sizeof(NearChunk));
+    NearFree *free_block = malloc(sizeof(NearFree));
+    uint32_t *blocks = calloc(size / NEAR_MEM_ALIGN, sizeof(uint32_t));
+    if (chunk == NULL || free_block == NULL || blocks == NULL)
+    {
+        free(chunk);
+        free(free_block);
+        free(blocks);
+        munmap(page, size);
+        return NULL;
+    }
+
+    free_block->offset = 0;
+    free_block->size = size;
+    free_block->next = NULL;
+    chunk->page = page;
+    chunk->prot = PROT_READ | PROT_WRITE;
+    chunk->free = free_block;
+    chunk->blocks = blocks;
+    chunk->next = near_chunks_g;
+    near_chunks_g = chunk;
+    near_mapped_g++;
+    return chunk;
+}
+
+static NearChunk *find_chunk(void *mem)
+{
+    BYTE *page = get_page_boundary(mem);
+    NearChunk *chunk = near_chunks_g;
+    while (chunk != NULL && chunk->page != page)
+    {
+        chunk = chunk->next;
+    }
+    return chunk;
+}
+
+/**
+ * @brief put [offset, offset+size) on the free list, merge it with the neighbors
+ * @return int32_t -1: out of memory, the block is lost
+ */
+static int32_t free_range(NearChunk *chunk, int32_t offset, int32_t size)
+{
+    NearFree **link = &chunk->free;
+    NearFree *prev = NULL;
+    while (*link != NULL && (*link)->offset < offset)
+    {
+        prev = *link;
+        link = &(*link)->next;
+    }
+
+    NearFree *next = *link;
+    if (prev != NULL && prev->offset + prev->size == offset)
+    {
+        prev->size += size;
+        if (next != NULL && prev->offset + prev->size == next->offset)
+        {
+            prev->size += next->size;
+            prev->next = next->next;
+            free(next);
+        }
+        return 0;
+    }
+    if (next != NULL && offset + size == next->offset)
+    {
+        next->offset = offset;
+        next->size += size;
+        return 0;
+    }
+
+    NearFree *block = malloc(sizeof(NearFree));
+    if (block == NULL)
+    {
+        return -1;
+    }
+    block->offset = offset;
+    block->size = size;
+    block->next = next;
+    *link = block;
+    return 0;
+}
+
+static void *alloc_from_chunk(NearChunk *chunk, void *where, int32_t size)
+{
+    NearFree **link = &chunk->free;
+    for (; *link != NULL; link = &(*link)->next)
+    {
+        NearFree *block = *link;
+        BYTE *mem = chunk->page + block->offset;
+        if (block->size < size || labs((long)where - (long)mem) >= NEAR_RANGE)
+        {
+            continue;
+        }
+
+        int32_t offset = block->offset;
+        block->offset += size;
+        block->size -= size;
+        if (block->size == 0)
+        {
+            *link = block->next;
+            free(block);
+        }
+        chunk->blocks[offset / NEAR_MEM_ALIGN] = (uint32_t)size | BLOCK_WRITING;
+        chunk->writing++;
+        if (update_chunk_prot(chunk) == -1)
+        {
+            chunk->blocks[offset / NEAR_MEM_ALIGN] = 0;
+            chunk->writing--;
+            free_range(chunk, offset, size);
+            return NULL;
+        }
+        return mem;
+    }
+    return NULL;
+}
+
+// unmap an empty chunk, but keep the last one
+static void release_empty_chunk(NearChunk *empty)
+{
+    NearChunk **link = &near_chunks_g;
+    NearChunk **emptyLink = NULL;
+    int32_t others = 0;
+    for (; *link != NULL; link = &(*link)->next)
+    {
+        if (*link == empty)
+        {
+            emptyLink = link;
+        }
+        else if ((*link)->live == 0 && (*link)->writing == 0)
+        {
+            others++;
+        }
+    }
+
+    if (others == 0 || emptyLink == NULL)
+    {
+        update_chunk_prot(empty);
+        return;
+    }
+
+    *emptyLink = empty->next;
+    munmap(empty->page, getpagesize());
+    near_unmapped_g++;
+    while (empty->free != NULL)
+    {
+        NearFree *next = empty->free->next;
+        free(empty->free);
+        empty->free = next;
+    }
+    free(empty->blocks);
+    free(empty);
+}
+
+/**
+ * @brief a block of `size` bytes in +/-NEAR_RANGE of `where`, writable.
+ *  write the code then seal_neighbor_mem it, before anything jumps there
+ * @param where
+ * @param size
+ * @return void* NULL: no memory near `where`
+ */
+void *get_neighbor_mem(void *where, int size)
+{
+    int32_t blockSize = align_block(size);
+    if (blockSize <= 0 || blockSize > getpagesize())
+    {
+        return NULL;
+    }
+
+    pthread_mutex_lock(&near_mem_lock_g);
+    void *mem = NULL;
+    for (NearChunk *chunk = near_chunks_g; chunk != NULL && mem == NULL; chunk = chunk->next)
+    {
+        mem = alloc_from_chunk(chunk, where, blockSize);
+    }
+    if (mem == NULL)
+    {
+        BYTE *page = get_neighbor_page(where);
+        NearChunk *chunk = page != NULL ? new_chunk(page) : NULL;
+        if (chunk != NULL)
+        {
+            mem = alloc_from_chunk(chunk, where, blockSize);
+        }
+    }
+    pthread_mutex_unlock(&near_mem_lock_g);
+    return mem;
+}
+
+/**
+ * @brief the code in `mem` is written, make it executable and read only
+ * @param mem from get_neighbor_mem
+ * @return int32_t -1: mprotect failed, the block is still writable
+ */
+int32_t seal_neighbor_mem(void *mem)
+{
+    pthread_mutex_lock(&near_mem_lock_g);
+    NearChunk *chunk = find_chunk(mem);
+    assert(chunk != NULL);
+    uint32_t *block = &chunk->blocks[((BYTE *)mem - chunk->page) / NEAR_MEM_ALIGN];
+    assert(*block & BLOCK_WRITING);
+
+    *block &= ~BLOCK_WRITING;
+    chunk->writing--;
+    chunk->live++;
+    flush_inst_cache(mem, *block);
+    int32_t ret = update_chunk_prot(chunk);
+    if (ret == -1)
+    {
+        *block |= BLOCK_WRITING;
+        chunk->writing++;
+        chunk->live--;
+    }
+    pthread_mutex_unlock(&near_mem_lock_g);
+    return ret;
+}
+
+/**
+ * @brief put memory from get_neighbor_mem back, sealed or not.
+ *  caller must make sure nobody is running in it
+ * @param mem
+ */
+void put_neighbor_mem(void *mem)
+{
+    if (mem == NULL)
+    {
+        return;
+    }
+
+    pthread_mutex_lock(&near_mem_lock_g);
+    NearChunk *chunk = find_chunk(mem);
+    assert(chunk != NULL);
+    int32_t offset = (BYTE *)mem - chunk->page;
+    uint32_t block = chunk->blocks[offset / NEAR_MEM_ALIGN];
+    assert(block != 0);
+
+    chunk->blocks[offset / NEAR_MEM_ALIGN] = 0;
+    if (block & BLOCK_WRITING)
+    {
+        chunk->writing--;
+    }
+    else
+    {
+        chunk->live--;
+    }
+    free_range(chunk, offset, block & ~BLOCK_WRITING);
+
+    if (chunk->live == 0 && chunk->writing == 0)
+    {
+        release_empty_chunk(chunk);
+    }
+    else
+    {
+        update_chunk_prot(chunk);
+    }
+    pthread_mutex_unlock(&near_mem_lock_g);
+}
+
+/**
+ * @brief stats of every page of the near allocator
+ * @param pages
+ * @param max at most `max` pages are written
+ * @param counters could be NULL
+ * @return int32_t number of pages
+ */
+int32_t get_near_mem_stats(NearPageStat *pages, int32_t max, NearMemCounters *counters)
+{
+    pthread_mutex_lock(&near_mem_lock_g);
+    int32_t n = 0;
+    for (NearChunk *chunk = near_chunks_g; chunk != NULL; chunk = chunk->next, n++)
+    {
+        if (n >= max)
+        {
+            continue;
+        }
+        NearPageStat *stat = &pages[n];
+        memset(stat, 0, sizeof(*stat));
+        stat->page = chunk->page;
+        stat->size = getpagesize();
+        stat->blocks = chunk->live;
+        stat->writing = chunk->writing;
+        stat->prot = chunk->prot;
+        stat->usedBytes = stat->size;
+        for (NearFree *block = chunk->free; block != NULL; block = block->next)
+        {
+            stat->usedBytes -= block->size;
+            stat->freeBlocks++;
+            if (block->size > stat->largestFree)
+            {
+                stat->largestFree = block->size;
+            }
+        }
+    }
+    if (counters != NULL)
+    {
+        counters->mapped = near_mapped_g;
+        counters->unmapped = near_unmapped_g;
+    }
+    pthread_mutex_unlock(&near_mem_lock_g);
+    return n;
+}
+
+#ifdef UTEST_NEARMEM
+
+static int32_t page_stat(void *mem, NearPageStat *stat)
+{
+    NearPageStat pages[64];
+    int32_t n = get_near_mem_stats(pages, 64, NULL);
+    assert(n <= 64);
+    for (int32_t i = 0; i < n; i++)
+    {
+        if (pages[i].page == get_page_boundary(mem))
+        {
+            *stat = pages[i];
+            return 0;
+        }
+    }
+    return -1;
+}
+
+void test_reuse_neighbor_mem()
+{
+    assert(align_block(0) == 0);
+    assert(align_block(7) == 16);
+    assert(align_block(16) == 16);
+    assert(align_block(17) == 32);
+
+    BYTE *a = get_neighbor_mem(printf, 12);
+    assert(a != NULL && labs((long)a - (long)printf) < NEAR_RANGE);
+    assert(seal_neighbor_mem(a) == 0);
+    put_neighbor_mem(a);
+    // the last page is kept, the block is handed out again
+    BYTE *b = get_neighbor_mem(printf, 12);
+    assert(b == a);
+    put_neighbor_mem(b);
+    LOG_TRACE("passed");
+}
+
+void test_merge_neighbor_mem()
+{
+    BYTE *a = get_neighbor_mem(printf, 16);
+    BYTE *b = get_neighbor_mem(printf, 16);
+    BYTE *c = get_neighbor_mem(printf, 16);
+    assert(b == a + 16 && c == b + 16);
+
+    NearPageStat stat;
+    put_neighbor_mem(b);
+    assert(page_stat(a, &stat) == 0 && stat.freeBlocks == 2 && stat.usedBytes == 32);
+    put_neighbor_mem(a);
+    assert(page_stat(c, &stat) == 0 && stat.freeBlocks == 2 && stat.usedBytes == 16);
+    // [a, c) is one block again
+    BYTE *ab = get_neighbor_mem(printf, 32);
+    assert(ab == a);
+    put_neighbor_mem(ab);
+    put_neighbor_mem(c);
+    assert(page_stat(a, &stat) == 0 && stat.freeBlocks == 1 && stat.largestFree == stat.size);
+    LOG_TRACE("passed");
+}
+
+void test_neighbor_mem_prot()
+{
+    NearPageStat stat;
+    BYTE *a = get_neighbor_mem(printf, 16);
+    assert(page_stat(a, &stat) == 0 && stat.prot == (PROT_READ | PROT_WRITE) && stat.writing == 1);
+    a[0] = 0xC3;
+    assert(seal_neighbor_mem(a) == 0);
+    assert(page_stat(a, &stat) == 0 && stat.prot == (PROT_READ | PROT_EXEC) && stat.blocks == 1 && stat.writing == 0);
+
+    // writing next to live code
+    BYTE *b = get_neighbor_mem(printf, 16);
+    assert(page_stat(b, &stat) == 0 && stat.prot == (PROT_READ | PROT_WRITE | PROT_EXEC));
+    put_neighbor_mem(b);
+    assert(page_stat(a, &stat) == 0 && stat.prot == (PROT_READ | PROT_EXEC));
+
+    put_neighbor_mem(a);
+    assert(page_stat(a, &stat) == 0 && stat.prot == PROT_NONE && stat.blocks == 0);
+    LOG_TRACE("passed");
+}
+
+void test_release_neighbor_page()
+{
+    NearMemCounters before, after;
+    NearPageStat pages[64];
+    int32_t n = get_near_mem_stats(pages, 64, &before);
+    int32_t page = getpagesize();
+
+    BYTE *a = get_neighbor_mem(printf, page);
+    BYTE *b = get_neighbor_mem(printf, page);
+    assert(a != NULL && b != NULL && get_page_boundary(a) != get_page_boundary(b));
+    assert(seal_neighbor_mem(a) == 0 && seal_neighbor_mem(b) == 0);
+    put_neighbor_mem(a);
+    put_neighbor_mem(b);
+
+    // one of the empty pages is unmapped
+    assert(get_near_mem_stats(pages, 64, &after) == n);
+    assert(after.mapped - before.mapped == after.unmapped - before.unmapped);
+    assert(after.unmapped > before.unmapped);
+
+    // hook/unhook cycles do not map new pages
+    for (int i = 0; i < 1000; i++)
+    {
+        BYTE *mem = get_neighbor_mem(printf, 64);
+        assert(seal_neighbor_mem(mem) == 0);
+        put_neighbor_mem(mem);
+    }
+    assert(get_near_mem_stats(pages, 64, &before) == n);
+    assert(before.mapped == after.mapped);
+    LOG_TRACE("passed");
+}
+
+#define MEM_THREADS 8
+#define MEM_ALLOCS 256
+#define MEM_ALLOC_SIZE 24
+
+static void *alloc_neighbor_mem_routine(void *arg)
+{
+    void **slots = arg;
+    int i = 0;
+    for (; i < MEM_ALLOCS; i++)
+    {
+        slots[i] = get_neighbor_mem(printf, MEM_ALLOC_SIZE);
+        assert(slots[i] != NULL);
+    }
+    return NULL;
+}
+
+static int cmp_ptr(const void *a, const void *b)
+{
+    uintptr_t l = (uintptr_t) * (void *const *)a;
+    uintptr_t r = (uintptr_t) * (void *const *)b;
+    return (l > r) - (l < r);
+}
+
+void test_concurrent_get_neighbor_mem()
+{
+    static void *slots[MEM_THREADS * MEM_ALLOCS];
+    pthread_t threads[MEM_THREADS];
+    int i = 0;
+    for (; i < MEM_THREADS; i++)
+    {
+        assert(pthread_create(&threads[i], NULL, alloc_neighbor_mem_routine, &slots[i * MEM_ALLOCS]) == 0);
+    }
+
+    for (i = 0; i < MEM_THREADS; i++)
+    {
+        pthread_join(threads[i], NULL);
+    }
+
+    // no two threads got overlapped memory
+    qsort(slots, MEM_THREADS * MEM_ALLOCS, sizeof(void *), cmp_ptr);
+    for (i = 1; i < MEM_THREADS * MEM_ALLOCS; i++)
+    {
+        assert((BYTE *)slots[i] - (BYTE *)slots[i - 1] >= MEM_ALLOC_SIZE);
+    }
+    for (i = 0; i < MEM_THREADS * MEM_ALLOCS; i++)
+    {
+        put_neighbor_mem(slots[i]);
+    }
+    LOG_TRACE("passed");
+}
+
+void test_try_get_page_from_addr_hi()
+{
+    void *hi = &test_try_get_page_from_addr_hi;
+    void *lo = hi - getpagesize() * 128;
+    // text of this binary is mapped there, only NULL or a page in [lo,hi) is right
+    void *page = try_get_page_from_addr_hi(lo, hi);
+    assert(page == NULL || (page >= lo && page < hi));
+
+    page = get_neighbor_page(hi);
+    assert(page != NULL && labs((long)page - (long)hi) < NEAR_RANGE);
+    munmap(page, getpagesize());
+    LOG_TRACE("passed");
+}
+
+int main()
+{
+    printf("-------test_reuse_neighbor_mem----------------------------\n");
+    test_reuse_neighbor_mem();
+    printf("-------test_merge_neighbor_mem----------------------------\n");
+    test_merge_neighbor_mem();
+    printf("-------test_neighbor_mem_prot----------------------------\n");
+    test_neighbor_mem_prot();
+    printf("-------test_release_neighbor_page----------------------------\n");
+    test_release_neighbor_page();
+    printf("-------test_concurrent_get_neighbor_mem----------------------------\n");
+    test_concurrent_get_neighbor_mem();
+    printf("-------test_try_get_page_from_addr_hi----------------------------\n");
+    test_try_get_page_from_addr_hi();
+    return 0;
+}
+
+#endif
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//go:noinline
+func stress_foo(a, b int64) int64 {
+	x := a*3 + b
+	return x ^ 0x5a5a
+}
+
+// it runs for the hook still running after UnHook
+//
+//go:noinline
+func stress_foo_tramp(a, b int64) int64 {
+	x := a*3 + b
+	return x ^ 0x5a5a
+}
+
+//go:noinline
+func hook_stress_foo(a, b int64) int64 {
+	return stress_foo_tramp(a, b) + 1
+}
+
+// the hook is placed and removed while goroutines keep calling the function
+func TestHookConcurrentCalls(t *testing.T) {
+	var (
+		stop  int32
+		calls int64
+		bad   int64
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 4*runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func(a int64) {
+			defer wg.Done()
+			for b := int64(0); atomic.LoadInt32(&stop) == 0; b++ {
+				origin := (a*3 + b) ^ 0x5a5a
+				if ret := stress_foo(a, b); ret != origin && ret != origin+1 {
+					atomic.AddInt64(&bad, 1)
+				}
+				atomic.AddInt64(&calls, 1)
+			}
+		}(int64(i))
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := AddHook(stress_foo, hook_stress_foo, stress_foo_tramp); err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+		runtime.Gosched()
+		if i%2 == 0 {
+			UnHook(stress_foo)
+		} else if err := UnHookWait(stress_foo, 5*time.Second); err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if bad != 0 {
+		t.Fatalf("%d of %d calls returned a wrong value", bad, calls)
+	}
+}
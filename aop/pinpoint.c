@@ -1,3 +1,6 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
 /*
  * Copyright 2021 NAVER Corp.
  *
@@ -13,343 +16,495 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
+// REG_RIP of ucontext
+#ifndef _GNU_SOURCE
+#define _GNU_SOURCE
+#endif
 #include "pinpoint.h"
 #include "goX86asm.h"
+#include "x86.h"
+#include <signal.h>
+#include <ucontext.h>
+#if defined(__linux__)
+#include <sys/syscall.h>
+#endif
 
-static const BYTE NOP_1 = (0xfa);
-static const BYTE NOP_2[] = {0xd9, 0xd0};
-static const BYTE NOP_3[] = {0x0f, 0x1f, 0x00};
+// hook/unhook flip the protection of code pages, never let two of them interleave
+static pthread_mutex_t hook_lock_g = PTHREAD_MUTEX_INITIALIZER;
 
-typedef struct page_mem_chunk_s
+void set_hook_err(HookErr *err, HOOK_ERR_CODE code, void *addr, const char *inst)
 {
-    uint16_t freeOffset;
-    struct page_mem_chunk_s *next;
-} PageMemChunk;
+    if (err == NULL)
+    {
+        return;
+    }
 
-static PageMemChunk *mem_chunk_header_g;
-static void *get_neighbor_page(void *where);
-static int set_mm_area_opt(void *ptr, int size, int prot);
+    err->code = code;
+    err->addr = addr;
+    err->inst[0] = '\0';
+    if (inst != NULL)
+    {
+        strncpy(err->inst, inst, HOOK_ERR_INST_SIZE - 1);
+        err->inst[HOOK_ERR_INST_SIZE - 1] = '\0';
+    }
+}
 
-static inline int value_to_cpu(int v)
+// the relocated backup inst in `back` run the same as the inst being restored
+static void restore_src_inst(Trampoline *trampoline)
 {
-    int to = v & ~(sizeof(long) - 1);
-
-    return (to < v) ? (to + (int)sizeof(long)) : (v);
+    LOG_TRACE("restore the backup inst to %p", trampoline->target);
+    patch_code(trampoline->target, trampoline->fromInstBackUp.instBackUp, trampoline->fromInstBackUp.instBackupSize,
+               trampoline->back->inst, NULL);
 }
 
-static inline void append_page_chunk(void *page)
+void restore_trampoline_func_inst(Trampoline *trampoline)
 {
-    PageMemChunk *newChunk = (PageMemChunk *)page;
-    newChunk->next = NULL;
-    newChunk->freeOffset = (uint16_t)sizeof(PageMemChunk);
-
-    if (mem_chunk_header_g == NULL)
+    if (trampoline->trampolineFunc.pTrampFunc == NULL)
     {
-        mem_chunk_header_g = newChunk;
         return;
     }
+    LOG_TRACE("restore the trampoline_func inst to %p", trampoline->trampolineFunc.pTrampFunc);
+    // a hook still running calls the origin function, as trampoline_func did
+    patch_code(trampoline->trampolineFunc.pTrampFunc, trampoline->trampolineFunc.bakInstAr, trampoline->trampolineFunc.bakInstArLen,
+               trampoline->back->inst, NULL);
+}
 
-    PageMemChunk *end = mem_chunk_header_g;
-    while (end->next != NULL)
+void unhook(void *ptr)
+{
+    if (ptr == NULL)
     {
-        end = end->next;
+        return;
     }
 
-    end->next = newChunk;
+    pthread_mutex_lock(&hook_lock_g);
+    Trampoline *trampoline = (Trampoline *)ptr;
+    // restore target inst
+    restore_src_inst(trampoline);
+    // restore trampoline_func
+    restore_trampoline_func_inst(trampoline);
+
+    // forward/back and the grow slot may still be running by other threads, leave them.
+    // They are never put back, only unhook_src + release_trampoline (UnHookWait) do
+    trampoline->forward = NULL;
+    trampoline->back = NULL;
+    // free trampoline
+    free(ptr);
+    pthread_mutex_unlock(&hook_lock_g);
 }
 
-static void *get_jmp32_mem_from_chunk(const void *dst, int size)
+/**
+ * @brief restore the inst of src only, calls on src go to the origin function again.
+ *  the trampoline is kept, goroutines inside `to` still reach the origin function by it.
+ * @param ptr
+ */
+void unhook_src(void *ptr)
 {
-    size = value_to_cpu(size);
-
-    PageMemChunk *pChunk = mem_chunk_header_g;
-    while (pChunk)
+    if (ptr == NULL)
     {
-        int maxSize = getpagesize() - pChunk->freeOffset;
-        void *pfree = (char *)pChunk + pChunk->freeOffset;
+        return;
+    }
 
-        if (maxSize >= size && labs((long int)dst - (long int)pfree) < (long int)(0x7ff80000))
-        {
-            // update lastUsedOffset
-            set_mm_area_opt(pChunk, sizeof(PageMemChunk), PROT_READ | PROT_WRITE | PROT_EXEC);
-            pChunk->freeOffset += size;
+    pthread_mutex_lock(&hook_lock_g);
+    restore_src_inst((Trampoline *)ptr);
+    pthread_mutex_unlock(&hook_lock_g);
+}
 
-            return pfree;
-        }
-        pChunk = pChunk->next;
+/**
+ * @brief undo unhook_src: place the jmp on src again
+ * @param ptr
+ */
+void rehook_src(void *ptr)
+{
+    if (ptr == NULL)
+    {
+        return;
     }
-    return NULL;
+
+    pthread_mutex_lock(&hook_lock_g);
+    place_src_jmp((Trampoline *)ptr);
+    pthread_mutex_unlock(&hook_lock_g);
 }
 
-void *get_page_boundary(void *ptr)
+/**
+ * @brief finish unhook_src: restore trampoline_func and put forward/back memory back.
+ *  caller must make sure nobody is running in `to`, forward or back
+ * @param ptr
+ */
+void release_trampoline(void *ptr)
 {
-    return (void *)((long)ptr & ~(getpagesize() - 1));
+    if (ptr == NULL)
+    {
+        return;
+    }
+
+    pthread_mutex_lock(&hook_lock_g);
+    Trampoline *trampoline = (Trampoline *)ptr;
+    restore_trampoline_func_inst(trampoline);
+    put_grow_slot(trampoline->trampolineFunc.growSlot);
+    put_neighbor_mem(trampoline->forward);
+    put_neighbor_mem(trampoline->back);
+    trampoline->forward = NULL;
+    trampoline->back = NULL;
+    free(ptr);
+    pthread_mutex_unlock(&hook_lock_g);
 }
 
-static inline void *get_2gb_low(void *ptr)
+/**
+ * @brief entry of the relocated inst of src, calling it runs the origin function
+ * @param ptr
+ * @return void*
+ */
+void *trampoline_origin(void *ptr)
 {
-    return (void *)(((long)ptr > 0x7ff80000) ? (long)ptr - 0x7ff80000 : 0x80000);
+    Trampoline *trampoline = (Trampoline *)ptr;
+    return trampoline->back != NULL ? (void *)trampoline->back->inst : NULL;
 }
 
-static inline void *get_2gb_above(void *ptr)
+void free_closure_stub(void *stub)
 {
-    return (void *)((unsigned long)ptr < 0xffffffff80000000 ? (unsigned long)ptr + 0x7ff80000 : 0xfffffffffff80000);
+    put_neighbor_mem(stub);
 }
 
-int set_mm_area_opt(void *ptr, int size, int prot)
+// slots of the grow pad, see set_grow_pad
+static BYTE *grow_pad_g = NULL;
+static int32_t grow_slots_g = 0;
+static BYTE grow_slot_used_g[GROW_SLOT_MAX];
+
+void set_grow_pad(void *pad, int32_t size)
 {
-    int page_size = getpagesize();
-    void *p = get_page_boundary(ptr);
+    pthread_mutex_lock(&hook_lock_g);
+    grow_pad_g = pad;
+    grow_slots_g = size / GROW_SLOT_SIZE < GROW_SLOT_MAX ? size / GROW_SLOT_SIZE : GROW_SLOT_MAX;
+    pthread_mutex_unlock(&hook_lock_g);
+}
 
-    for (; p <= ptr + size; p += page_size)
+void *get_grow_slot(void)
+{
+    for (int32_t i = 0; i < grow_slots_g; i++)
     {
-        int ret = mprotect(p, page_size, prot);
-        if (ret != 0)
+        if (!grow_slot_used_g[i])
         {
-            LOG_TRACE("mprotect on [start:%p,size:%d] opt:%d error:%s ", p, page_size, prot, strerror(errno));
-            return -1;
+            grow_slot_used_g[i] = 1;
+            return grow_pad_g + i * GROW_SLOT_SIZE;
         }
     }
-    return 0;
+    return NULL;
 }
 
-static void *try_get_page_from_addr_hi(void *low, void *hi)
+void put_grow_slot(void *slot)
 {
-    int page = getpagesize();
-    void *mem = NULL;
-
-    for (; low < hi; hi -= page)
+    if (slot != NULL)
     {
-        // force map memory from start
-        mem = mmap(hi, page, PROT_READ | PROT_EXEC | PROT_WRITE, MAP_ANONYMOUS | MAP_PRIVATE, -1, 0);
-        if (mem == NULL)
-        {
-            LOG_TRACE("mmap:%p->%d failed:%s", hi, page, strerror(errno));
-        }
-        else if (mem != hi)
-        {
-            munmap(mem, page);
-        }
-        else
-        {
-            return mem;
-        }
+        grow_slot_used_g[((BYTE *)slot - grow_pad_g) / GROW_SLOT_SIZE] = 0;
     }
-    return mem;
 }
 
-static void *try_get_page_from_addr_lo(void *low, void *hi)
-{
-    int page = getpagesize();
-    void *mem = NULL;
+#if defined(__x86_64__)
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//                                                  x86-64 backend                                                                //
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+static const BYTE NOP_1 = (0xfa);
+static const BYTE NOP_2[] = {0xd9, 0xd0};
+static const BYTE NOP_3[] = {0x0f, 0x1f, 0x00};
 
-    for (; low < hi; low += page)
+void place_safe_nop_inst(BYTE *p, int size)
+{
+    if (size <= 0)
     {
-        // force map memory from start
-        mem = mmap(low, page, PROT_READ | PROT_EXEC | PROT_WRITE, MAP_ANONYMOUS | MAP_PRIVATE, -1, 0);
-        if (mem == NULL)
-        {
-            LOG_TRACE("mmap:%p->%d failed:%s", low, page, strerror(errno));
-        }
-        else if (mem != low)
-        {
-            munmap(mem, page);
-        }
-        else
+        return;
+    }
+    else if (size == 1)
+    {
+        *p = NOP_1;
+    }
+    else if (size == 3)
+    {
+        *(p) = NOP_3[0];
+        *(p + 1) = NOP_3[1];
+        *(p + 2) = NOP_3[2];
+    }
+    else if (size % 2 == 0)
+    {
+        int i = 0;
+        for (; i < size;)
         {
-            return mem;
+            *(p + i) = NOP_2[0];
+            *(p + i + 1) = NOP_2[1];
+            i += 2;
         }
     }
-    return mem;
+    else
+    {
+        // size -3 : must goto `size%2 == 0`
+        place_safe_nop_inst(p, size - 3);
+        p += (size - 3);
+        place_safe_nop_inst(p, 3);
+    }
 }
 
-void *get_neighbor_mem(void *where, int size)
+// jmp rel32 running at `pc` written to `p`, the rest of `placedSize` is nop. `p` must be writable
+static void write_direct_jmp_inst(BYTE *p, BYTE *pc, void *target, uint32_t placedSize)
 {
-    void *mem = get_jmp32_mem_from_chunk(where, size);
-    if (mem == NULL)
-    {
-        void *page = get_neighbor_page(where);
-        if (page == NULL)
-        {
-            return NULL;
-        }
-
-        append_page_chunk(page);
-
-        return get_neighbor_mem(where, size);
-    }
+    assert(placedSize >= JMP_INST_SIZE);
+    p[0] = 0xE9;
+    *(int32_t *)(p + 1) = (int32_t)((BYTE *)target - pc - 5);
+    place_safe_nop_inst(p + JMP_INST_SIZE, placedSize - JMP_INST_SIZE);
+}
 
-    return mem;
+// jmp [rip+disp32] reading the target from `slot`. `p` must be writable
+static void write_indirect_jmp_inst(BYTE *p, void *slot, uint32_t placedSize)
+{
+    assert(placedSize >= LONG_JMP_INST_SIZE);
+    p[0] = 0xFF;
+    p[1] = 0x25;
+    *(int32_t *)(p + 2) = (int32_t)((BYTE *)slot - (p + 6));
+    place_safe_nop_inst(p + LONG_JMP_INST_SIZE, placedSize - LONG_JMP_INST_SIZE);
 }
 
 /**
- * @brief Get the page neighbor mem object
- * size is 1 pagesize(4096)
- * @param where
- * @return void*
+ * Patching live code.
+ * An inst is fetched by other cores while it is written, they must never run a torn one:
+ *  - the bytes in one aligned 8 bytes word, and no thread can be inside the old code: a single atomic store
+ *  - else int3 first on every old inst, the tail, then the first byte (as text_poke_bp in linux).
+ *    A thread hitting an int3 meanwhile is sent by the SIGTRAP handler to `resume`, or to `inner`
+ *    for an inst past the first one, where the same old inst is relocated
+ * Cores are serialized between the steps by membarrier if the kernel has it.
+ * The int3 on the inner inst catch a thread which ran the first inst before the patch, on a core or
+ * right after it is scheduled again. They are gone once the tail is written: a thread the OS took off
+ * its core inside the old code, and did not run again till the patch is done, runs a torn inst.
+ * Nothing but stopping every thread closes that, hook a function before it is called by many threads if it could
  */
-void *get_neighbor_page(void *where)
+#define INT3_INST 0xCC
+
+// the window being patched, read by the SIGTRAP handler. seq is odd while it is changed
+static volatile uint32_t patch_seq_g;
+static BYTE *volatile patch_addr_g;
+static volatile int32_t patch_size_g;
+// where a thread at each int3 goes, [0] is `resume`
+static void *volatile patch_resume_g[BACKUP_INST_SIZE];
+static struct sigaction old_sigtrap_g;
+static int32_t sigtrap_installed_g;
+
+#if defined(__linux__) && defined(__NR_membarrier)
+// membarrier_cmd of linux/membarrier.h, 4.16+
+#define MEMBARRIER_SYNC_CORE (1 << 5)
+#define MEMBARRIER_REGISTER_SYNC_CORE (1 << 6)
+// -1: not checked, 0: no membarrier sync core, 1: registered
+static int32_t membarrier_g = -1;
+#endif
+
+// where a thread trapped by the int3 at `int3` goes, NULL: not an int3 of the window
+static void *patch_resume_at(BYTE *int3)
 {
-    // LOG_TRACE("start get neighbort page:%p",where);
-    void *target = get_page_boundary(where);
-    // LOG_TRACE("where:%p target:%p",where,target);
-    void *lo = get_2gb_low(target);
-    void *hi = get_2gb_above(target);
-    // LOG_TRACE("lo:%p hi:%p",lo,hi);
-    void *try = NULL;
-    // Try looking 1GB below or lower.
-    if (try == NULL && target > (void *)0x40000000)
+    uint32_t seq = __atomic_load_n(&patch_seq_g, __ATOMIC_ACQUIRE);
+    BYTE *addr = __atomic_load_n(&patch_addr_g, __ATOMIC_ACQUIRE);
+    int32_t size = __atomic_load_n(&patch_size_g, __ATOMIC_ACQUIRE);
+    if (seq % 2 != 0 || addr == NULL || int3 < addr || int3 >= addr + size)
     {
-        // LOG_TRACE("try in > -1GB");
-        try = try_get_page_from_addr_hi(lo, target - 0x40000000);
+        return NULL;
     }
+    void *resume = __atomic_load_n(&patch_resume_g[int3 - addr], __ATOMIC_ACQUIRE);
+    return __atomic_load_n(&patch_seq_g, __ATOMIC_ACQUIRE) == seq ? resume : NULL;
+}
 
-    if (try == NULL && target < (void *)0xffffffff40000000)
+static void set_patch_window(BYTE *addr, int32_t size, void *resume, void *const *inner)
+{
+    __atomic_add_fetch(&patch_seq_g, 1, __ATOMIC_SEQ_CST);
+    __atomic_store_n(&patch_addr_g, addr, __ATOMIC_RELEASE);
+    __atomic_store_n(&patch_size_g, size, __ATOMIC_RELEASE);
+    for (int32_t i = 0; i < BACKUP_INST_SIZE; i++)
     {
-        // LOG_TRACE("try in > +1GB");
-        try = try_get_page_from_addr_lo(target + 0x40000000, hi);
+        void *to = i == 0 ? resume : (inner != NULL && i < size ? inner[i] : NULL);
+        __atomic_store_n(&patch_resume_g[i], to, __ATOMIC_RELEASE);
     }
+    __atomic_add_fetch(&patch_seq_g, 1, __ATOMIC_SEQ_CST);
+}
 
-    if (try == NULL && target > (void *)0x40000000)
+static void on_sigtrap(int sig, siginfo_t *info, void *ctx)
+{
+    ucontext_t *uc = (ucontext_t *)ctx;
+    greg_t *rip = &uc->uc_mcontext.gregs[REG_RIP];
+    // SI_KERNEL: an int3, rip is behind it
+    if (info->si_code == SI_KERNEL)
     {
-        //  LOG_TRACE("try in <-1GB");
-        try = try_get_page_from_addr_hi(target - 0x40000000, target);
+        BYTE *int3 = (BYTE *)*rip - 1;
+        void *resume = patch_resume_at(int3);
+        if (resume != NULL)
+        {
+            *rip = (greg_t)resume;
+            return;
+        }
+        // the patch is done before the signal came, run the new inst
+        if (__atomic_load_n(int3, __ATOMIC_ACQUIRE) != INT3_INST)
+        {
+            *rip = (greg_t)int3;
+            return;
+        }
     }
 
-    if (try == NULL && target < (void *)0xffffffff40000000)
+    // not ours: a breakpoint, pass it to the handler before
+    if (old_sigtrap_g.sa_flags & SA_SIGINFO)
     {
-        // LOG_TRACE("try in <+1GB");
-        try = try_get_page_from_addr_hi(target, target + 0x40000000);
+        old_sigtrap_g.sa_sigaction(sig, info, ctx);
     }
-
-    if (try == NULL)
+    else if (old_sigtrap_g.sa_handler == SIG_DFL)
     {
-        // LOG_TRACE("try in [-2GB,target)");
-        try = try_get_page_from_addr_hi(lo, target);
+        sigaction(SIGTRAP, &old_sigtrap_g, NULL);
+        raise(SIGTRAP);
     }
+    else if (old_sigtrap_g.sa_handler != SIG_IGN)
+    {
+        old_sigtrap_g.sa_handler(sig);
+    }
+}
 
-    if (try == NULL)
+// go installs its handlers before any hook, this one is chained in front of them
+static int32_t install_sigtrap(void)
+{
+    if (sigtrap_installed_g)
     {
-        // LOG_TRACE("try in [target,+2GB)");
-        try = try_get_page_from_addr_lo(target, hi);
+        return 0;
     }
 
-    LOG_TRACE("where:%p neighbor:%p range:%ld", where, try, where - try);
-    return try;
+    struct sigaction act;
+    memset(&act, 0, sizeof(act));
+    act.sa_sigaction = on_sigtrap;
+    // go requires SA_ONSTACK, a goroutine stack is too small for a handler
+    act.sa_flags = SA_SIGINFO | SA_ONSTACK | SA_RESTART;
+    sigemptyset(&act.sa_mask);
+    if (sigaction(SIGTRAP, &act, &old_sigtrap_g) != 0)
+    {
+        LOG_ETRACE("sigaction SIGTRAP failed:%s", strerror(errno));
+        return -1;
+    }
+    sigtrap_installed_g = 1;
+    return 0;
 }
 
-void unhook(void *ptr)
+// every core running this process serializes its inst stream
+static void sync_cores(void)
 {
-    if (ptr == NULL)
+#if defined(MEMBARRIER_SYNC_CORE)
+    if (membarrier_g == -1)
+    {
+        membarrier_g = syscall(__NR_membarrier, MEMBARRIER_REGISTER_SYNC_CORE, 0) == 0;
+    }
+    if (membarrier_g == 1 && syscall(__NR_membarrier, MEMBARRIER_SYNC_CORE, 0) == 0)
     {
         return;
     }
+#endif
+    // x86 snoops the inst cache, the store is seen by other cores soon without it
+    __atomic_thread_fence(__ATOMIC_SEQ_CST);
+}
 
-    // restore target inst
-    Trampoline *trampoline = (Trampoline *)ptr;
-    LOG_TRACE("restore the backup inst to %p", trampoline->target);
-    set_mm_area_opt(trampoline->target, trampoline->fromInstBackUp.instBackupSize, PROT_READ | PROT_WRITE | PROT_EXEC);
-    memcpy(trampoline->target, trampoline->fromInstBackUp.instBackUp, trampoline->fromInstBackUp.instBackupSize);
-    set_mm_area_opt(trampoline->target, trampoline->fromInstBackUp.instBackupSize, PROT_READ | PROT_EXEC);
-
-    // restore trampoline_func
-    LOG_TRACE("restore the trampoline_func inst to %p", trampoline->trampolineFunc.pTrampFunc);
-    set_mm_area_opt(trampoline->trampolineFunc.pTrampFunc, trampoline->trampolineFunc.bakInstArLen, PROT_READ | PROT_WRITE | PROT_EXEC);
-    memcpy(trampoline->trampolineFunc.pTrampFunc, trampoline->trampolineFunc.bakInstAr, trampoline->trampolineFunc.bakInstArLen);
-    set_mm_area_opt(trampoline->target, trampoline->trampolineFunc.bakInstArLen, PROT_READ | PROT_EXEC);
-
-    // munmap forward*
-    // int page = getpagesize();
-    // munmap(trampoline->forward,page);
-    // munmap(trampoline->trampoline02,page);
-    trampoline->forward = NULL;
-    trampoline->back = NULL;
-    // free trampoline
-    free(ptr);
+// a thread could be at an inst after the first one in the `size` bytes at `p`
+static int32_t runs_into(const BYTE *p, int32_t size, void *const *inner)
+{
+    if (inner != NULL)
+    {
+        for (int32_t i = 1; i < size; i++)
+        {
+            if (inner[i] != NULL)
+            {
+                return 1;
+            }
+        }
+        return 0;
+    }
+    Inst inst = {0};
+    if (decode((BYTE *)p, BACKUP_INST_SIZE, &inst, 64, false) != E_OK)
+    {
+        return 1;
+    }
+    // jmp, ret and int3 never fall through
+    return inst.Len < size && p[0] != 0xE9 && p[0] != 0xEB && p[0] != 0xC3 && p[0] != INT3_INST &&
+           !(p[0] == 0xFF && p[1] == 0x25);
 }
 
-void place_safe_nop_inst(BYTE *p, int size)
+int32_t patch_code(void *addr, const void *code, int32_t size, void *resume, void *const *inner)
 {
+    BYTE *dst = addr;
+    const BYTE *src = code;
     if (size <= 0)
     {
-        return;
+        return 0;
     }
-    else if (size == 1)
+    assert(size <= BACKUP_INST_SIZE);
+    if (install_sigtrap() == -1 || set_mm_area_opt(dst, size, PROT_READ | PROT_WRITE | PROT_EXEC) != 0)
     {
-        *p = NOP_1;
+        return -1;
     }
-    else if (size == 3)
+
+    uint64_t *word = (uint64_t *)((uintptr_t)dst & ~(uintptr_t)7);
+    int32_t offset = dst - (BYTE *)word;
+    int32_t stuck = runs_into(dst, size, inner);
+    if (offset + size <= 8 && !stuck)
     {
-        *(p) = NOP_3[0];
-        *(p + 1) = NOP_3[1];
-        *(p + 2) = NOP_3[2];
+        uint64_t value = __atomic_load_n(word, __ATOMIC_RELAXED);
+        memcpy((BYTE *)&value + offset, src, size);
+        __atomic_store_n(word, value, __ATOMIC_SEQ_CST);
     }
-    else if (size % 2 == 0)
+    else
     {
-        int i = 0;
-        for (; i < size;)
+        if (stuck && inner == NULL)
         {
-            *(p + i) = NOP_2[0];
-            *(p + i + 1) = NOP_2[1];
-            i += 2;
+            LOG_TRACE("%p: no place for a thread inside the old inst to go, only the first one is trapped", dst);
+        }
+        set_patch_window(dst, size, resume, inner);
+        for (int32_t i = 1; inner != NULL && i < size; i++)
+        {
+            if (inner[i] != NULL)
+            {
+                __atomic_store_n(dst + i, INT3_INST, __ATOMIC_SEQ_CST);
+            }
         }
+        __atomic_store_n(dst, INT3_INST, __ATOMIC_SEQ_CST);
+        sync_cores();
+        memcpy(dst + 1, src + 1, size - 1);
+        sync_cores();
+        __atomic_store_n(dst, src[0], __ATOMIC_SEQ_CST);
     }
-    else
+    sync_cores();
+    // a thread trapped by the int3 at the first inst but not handled yet runs the new inst,
+    // one at an inner inst needs the window still, it is kept till the next patch
+    if (inner == NULL)
     {
-        // size -3 : must goto `size%2 == 0`
-        place_safe_nop_inst(p, size - 3);
-        p += (size - 3);
-        place_safe_nop_inst(p, 3);
+        set_patch_window(NULL, 0, NULL, NULL);
     }
+    set_mm_area_opt(dst, size, PROT_READ | PROT_EXEC);
+    return 0;
 }
 
-int32_t place_direct_jmp_inst(void *src, void *target, uint32_t placedSize)
+/**
+ * @brief jmp to `target` over `placedSize` bytes of src
+ * @param inner see patch_code, NULL if the code at src never runs past its first inst
+ * @return int32_t -1: failed
+ */
+int32_t place_direct_jmp_inst(void *src, void *target, uint32_t placedSize, void *const *inner)
 {
-    assert(placedSize >= JMP_INST_SIZE);
-    set_mm_area_opt(src, JMP_INST_SIZE, PROT_READ | PROT_WRITE | PROT_EXEC);
+    assert(placedSize >= JMP_INST_SIZE && placedSize <= BACKUP_INST_SIZE);
 #if DTRACE
     {
         BYTE *raw = src;
         LOG_TRACE("before:%p %X %X %X %X %X", src, raw[0], raw[1], raw[2], raw[3], raw[4]);
     }
 #endif
-    BYTE *inst = src;
-    *inst++ = 0xE9;
-    *(int32_t *)inst++ = (int32_t)(target - src - 5);
-    place_safe_nop_inst(inst + JMP_INST_SIZE, placedSize - JMP_INST_SIZE);
-    set_mm_area_opt(src, JMP_INST_SIZE, PROT_READ | PROT_EXEC);
-#if DTRACE
-    {
-        BYTE *raw = src;
-        LOG_TRACE("[directly jmp] after:%p target:%p %X %X %X %X %X", src, target, raw[0], raw[1], raw[2], raw[3], raw[4]);
-    }
-#endif
-    return JMP_INST_SIZE;
-}
-
-int32_t place_indirect_jmp_inst(void *src, void *target, uint32_t placedSize)
-{
-    assert(placedSize >= LONG_JMP_INST_SIZE);
-    set_mm_area_opt(src, LONG_JMP_INST_SIZE, PROT_READ | PROT_WRITE | PROT_EXEC);
-#if DTRACE
+    BYTE inst[BACKUP_INST_SIZE];
+    write_direct_jmp_inst(inst, src, target, placedSize);
+    // a thread at src goes to target, the same as the jmp
+    if (patch_code(src, inst, placedSize, target, inner) == -1)
     {
-        BYTE *raw = src;
-        LOG_TRACE("before:%p %X %X %X %X %X %X", src, raw[0], raw[1], raw[2], raw[3], raw[4], raw[5]);
+        return -1;
     }
-#endif
-    BYTE *inst = src;
-    *inst++ = 0xFF;
-    *inst++ = 0x25;
-    *(int32_t *)inst++ = (int32_t)(target - (src + 6));
-    place_safe_nop_inst(inst + LONG_JMP_INST_SIZE, placedSize - LONG_JMP_INST_SIZE);
-    set_mm_area_opt(src, LONG_JMP_INST_SIZE, PROT_READ | PROT_EXEC);
 #if DTRACE
     {
         BYTE *raw = src;
-        LOG_TRACE("[indirectly jmp] src:%p target:%p %X %X %X %X %X %X", src, target, raw[0], raw[1], raw[2], raw[3], raw[4], raw[5]);
+        LOG_TRACE("[directly jmp] after:%p target:%p %X %X %X %X %X", src, target, raw[0], raw[1], raw[2], raw[3], raw[4]);
     }
 #endif
-    return LONG_JMP_INST_SIZE;
+    return JMP_INST_SIZE;
 }
 
 inline int32_t calc_inst_size(Reg *from, int len)
@@ -359,94 +514,300 @@ inline int32_t calc_inst_size(Reg *from, int len)
     return inst.Len;
 }
 
-int32_t calcRelativeOffset(BYTE *reg, int32_t size, BYTE *instBaseAddr)
+/**
+ * @brief generate `back trampoline` for call `origin function`
+ * 1. `from` must be writable/executeable
+ *
+ * @param from function address of `origin function template`
+ * @param to origin function/method entry inst
+ * @param p_inst saved inst from `Foo`
+ * @param inst_size size of p_inst
+ * @return void*
+ */
+
+/**
+ * @brief generate `back trampoline` for call `origin function`
+ * 1. `from` must be writable/executeable
+ *
+ * @param from t
+ * @param from_inst
+ * @return TrampolineBack*
+ */
+// spill args; call morestack; reload args; jmp fn
+#define MORESTACK_BLOCK_MAX 128
+
+int32_t detour_does_code_end_function(OpcodeType pbCode);
+
+/**
+ * @brief go1.17+ checks the stack at entry:
+ *   small frame: cmp rsp, [r14+0x10]; jbe morestack
+ *   frame < 4K:  lea r12, [rsp-x]; cmp r12, [r14+0x10]; jbe morestack
+ *   big frame:   mov r12, rsp; sub r12, x; jb morestack; cmp r12, [r14+0x10]; jbe morestack
+ *  the morestack block calls runtime.morestack_noctxt and jumps to the entry again.
+ *  find that block of `fn`
+ * @param fn
+ * @param checkSize size of the check, till the end of jbe. could be NULL
+ * @return BYTE* NULL: no stack check in fn
+ */
+BYTE *located_go_morestack(BYTE *fn, int32_t *checkSize)
 {
+    BYTE *p = fn;
+    BYTE *block = NULL;
+    Inst inst = {0};
 
-    Reg *cur = reg;
+    for (int i = 0; i < 5 && block == NULL; i++)
+    {
+        if (decode(p, BACKUP_INST_SIZE, &inst, 64, false) != E_OK || detour_does_code_end_function(inst.Opcode))
+        {
+            return NULL;
+        }
+        block = inst.Op == JBE ? (BYTE *)x86_inst_target(&inst, p, (uint64_t)p) : NULL;
+        p += inst.Len;
+    }
 
-    // copy from https://github.com/DarthTon/Blackbone/pull/420
-    const int64_t diffMinVals[] = {0ll, -128ll, -32768ll, -8388608ll, -2147483648ll, -549755813888ll, -140737488355328ll, -36028797018963968ll, -9223372036854775807ll};
-    const int64_t diffMaxVals[] = {0ll, 127ll, 32767ll, 8388607ll, 2147483647ll, 549755813887ll, 140737488355327ll, 36028797018963967ll, 9223372036854775807ll};
+    if (block == NULL)
+    {
+        return NULL;
+    }
 
-    do
+    int32_t size = p - fn;
+    for (p = block; p - block < MORESTACK_BLOCK_MAX; p += inst.Len)
     {
-        Inst inst = {0};
-        E_RET_TYPE ret = decode(cur, size, &inst, 64, false);
-        if (ret != E_OK || (inst.Len == 1 && (inst.Op == INT || inst.Op == RET)) || (inst.Len == 3 && inst.Op == 0xC2)) // 0xCC -> INT 0xC3/0xC2-> RETN
+        if (decode(p, BACKUP_INST_SIZE, &inst, 64, false) != E_OK)
         {
-            break;
+            return NULL;
         }
 
-        if (inst.PCRel != 0)
+        if (inst.Op == JMP)
         {
-            assert(inst.PCRelOff != 0);
-            // NOTE: how about big-endian
-            int32_t relative = 0;
+            if ((BYTE *)x86_inst_target(&inst, p, (uint64_t)p) != fn)
+            {
+                return NULL;
+            }
+            if (checkSize != NULL)
+            {
+                *checkSize = size;
+            }
+            return block;
+        }
 
-            const uintptr_t ofst = inst.PCRelOff;
-            const uintptr_t sz = inst.PCRel;
+        if (detour_does_code_end_function(inst.Opcode))
+        {
+            return NULL;
+        }
+    }
+    return NULL;
+}
 
-            memcpy(&relative, cur + ofst, sz);
+/**
+ * @brief relocate the backup inst into `out`.
+ *  jcc of the go stack check leaves the window, it goes to `morestack`
+ * @param out
+ * @param outPc where `out` runs
+ * @param bakInst
+ * @param srcMorestack the morestack block of src, NULL: no stack check
+ * @param morestack where the jcc goes, NULL: keep srcMorestack
+ * @param err
+ * @return int32_t size written, -1: failed
+ */
+static int32_t relocate_backup_inst(BYTE *out, uint64_t outPc, FromInstBackUp *bakInst, BYTE *srcMorestack, BYTE *morestack, HookErr *err)
+{
+    if (morestack == NULL)
+    {
+        morestack = srcMorestack;
+    }
 
-            int64_t newRel = instBaseAddr + (int64_t)relative - reg; // relative + (instBaseAddr - reg);
+    int32_t failOff = 0;
+    int32_t len = x86_relocate(bakInst->instBackUp, bakInst->instBackupSize, (uint64_t)bakInst->instBaseAddr, outPc, out,
+                               (uint64_t)srcMorestack, (uint64_t)morestack, &failOff);
+    if (len == -1)
+    {
+        Inst inst = {0};
+        char buf[HOOK_ERR_INST_SIZE] = {0};
+        if (decode(bakInst->instBackUp + failOff, bakInst->instBackupSize - failOff, &inst, 64, false) == E_OK)
+        {
+            inst_str(&inst, buf, sizeof(buf));
+        }
+        LOG_ETRACE("can not relocate %s at %p to %lx", buf, bakInst->instBaseAddr + failOff, outPc);
+        set_hook_err(err, HOOK_E_RELOCATE, bakInst->instBaseAddr + failOff, buf);
+    }
+    return len;
+}
 
-            if (newRel < diffMinVals[sz] || newRel > diffMaxVals[sz])
-            {
-                LOG_ETRACE("invalid offset. newDiff:%ld inst offset:%ld diff size:%ld", newRel, ofst, sz);
-                return -1;
-            }
+/**
+ * @brief split the morestack block of src: spill args; call morestack; reload args; jmp src
+ * @param block
+ * @param call the call inst
+ * @param jmp the jmp back to src
+ * @return int32_t 0: ok, -1: the block is not known, or some inst of it is pc-relative
+ */
+static int32_t split_morestack_block(BYTE *block, BYTE **call, BYTE **jmp)
+{
+    Inst inst = {0};
+    *call = NULL;
+    for (BYTE *p = block; p - block < MORESTACK_BLOCK_MAX; p += inst.Len)
+    {
+        if (decode(p, BACKUP_INST_SIZE, &inst, 64, false) != E_OK)
+        {
+            return -1;
+        }
 
-            LOG_TRACE("origin relative:%x updated relative:%lx ", relative, newRel);
-            memcpy(cur + ofst, &newRel, sz);
+        X86_INST_TYPE type = x86_inst_type(&inst, p);
+        if (type == X86_JMP)
+        {
+            *jmp = p;
+            return *call != NULL ? 0 : -1;
+        }
+        if (type == X86_CALL && *call == NULL && inst.Len == CALL_INST_SIZE)
+        {
+            *call = p;
         }
-        cur += inst.Len;
-        size -= inst.Len;
-    } while (size > 0);
+        else if (type != X86_OTHER)
+        {
+            return -1;
+        }
+    }
+    return -1;
+}
 
-    return 0;
+/**
+ * @brief without trampoline_func, the block of src jumps to src again when the stack is grown,
+ *  that is the hook. `back` spills the args as the block does and calls morestack from a slot
+ *  of the grow pad, the return address is go text with no frame:
+ *    back->inst: relocated inst, jbe grow; jmp origin function
+ *    grow:       spill args; jmp slot
+ *    slot:       call morestack; jmp reload
+ *    reload:     reload args; jmp back->inst, the stack is checked again
+ * @param grow NULL: only the size
+ * @param block the morestack block of src
+ * @param slot
+ * @param entry back->inst
+ * @param slotCode GROW_SLOT_SIZE bytes, what goes into the slot after `back` is sealed
+ * @return int32_t size written at grow, -1: failed
+ */
+static int32_t write_grow_code(BYTE *grow, BYTE *block, BYTE *slot, BYTE *entry, BYTE *slotCode)
+{
+    BYTE *call, *jmp;
+    if (split_morestack_block(block, &call, &jmp) == -1)
+    {
+        return -1;
+    }
+    int32_t spill = call - block;
+    int32_t reloadSize = jmp - (call + CALL_INST_SIZE);
+    if (grow == NULL)
+    {
+        return spill + JMP_INST_SIZE + reloadSize + JMP_INST_SIZE;
+    }
+
+    Inst inst = {0};
+    decode(call, BACKUP_INST_SIZE, &inst, 64, false);
+    BYTE *morestack = (BYTE *)x86_inst_target(&inst, call, (uint64_t)call);
+    BYTE *reload = grow + spill + JMP_INST_SIZE;
+    BYTE *end = reload + reloadSize + JMP_INST_SIZE;
+    if (labs((long)slot - (long)grow) >> 31 != 0 || labs((long)morestack - (long)slot) >> 31 != 0 ||
+        labs((long)reload - (long)slot) >> 31 != 0)
+    {
+        return -1;
+    }
+
+    memcpy(grow, block, spill);
+    write_direct_jmp_inst(grow + spill, grow + spill, slot, JMP_INST_SIZE);
+    memcpy(reload, call + CALL_INST_SIZE, reloadSize);
+    write_direct_jmp_inst(reload + reloadSize, reload + reloadSize, entry, JMP_INST_SIZE);
+
+    memset(slotCode, INT3_INST, GROW_SLOT_SIZE);
+    slotCode[0] = 0xE8;
+    *(int32_t *)(slotCode + 1) = (int32_t)(morestack - (slot + CALL_INST_SIZE));
+    write_direct_jmp_inst(slotCode + CALL_INST_SIZE, slot + CALL_INST_SIZE, reload, JMP_INST_SIZE);
+    return end - grow;
+}
+
+// a thread at an inst of the backup of src goes on at the same inst relocated in `back`
+static void **back_inner(TrampolineBack *back, void **inner)
+{
+    for (int32_t i = 0; i < BACKUP_INST_SIZE; i++)
+    {
+        inner[i] = i > 0 && back->instOff[i] >= 0 ? back->inst + back->instOff[i] : NULL;
+    }
+    return inner;
 }
 
-/**
- * @brief generate `back trampoline` for call `origin function`
- * 1. `from` must be writable/executeable
- *
- * @param from function address of `origin function template`
- * @param to origin function/method entry inst
- * @param p_inst saved inst from `Foo`
- * @param inst_size size of p_inst
- * @return void*
- */
+// `back` is not used, give it back with the grow slot taken for it
+static void drop_back_trampoline(TrampolineFuncT *trampolineFunc, TrampolineBack *back)
+{
+    put_grow_slot(trampolineFunc->growSlot);
+    trampolineFunc->growSlot = NULL;
+    put_neighbor_mem(back);
+}
 
-/**
- * @brief generate `back trampoline` for call `origin function`
- * 1. `from` must be writable/executeable
- *
- * @param from t
- * @param from_inst
- * @return TrampolineBack*
- */
-TrampolineBack *insert_back_trampoline(TrampolineFuncT *trampolineFunc, FromInstBackUp *bakInst)
+TrampolineBack *insert_back_trampoline(TrampolineFuncT *trampolineFunc, FromInstBackUp *bakInst, HookErr *err)
 {
     void *origin_func = bakInst->instBaseAddr + bakInst->instBackupSize;
     LOG_TRACE("trampoline_func:%p origin_func:%p", trampolineFunc->pTrampFunc, origin_func);
 
-    BYTE *inst = bakInst->instBackUp;
-    int32_t len = bakInst->instBackupSize;
+    // relocated inst + jmp back to origin function, a short branch grows when it is relocated
+    int32_t bound = x86_relocate_bound(bakInst->instBackUp, bakInst->instBackupSize);
+    if (bound == -1)
+    {
+        LOG_ETRACE("can not decode the backup inst of %p", bakInst->instBaseAddr);
+        set_hook_err(err, HOOK_E_UNKNOWN_INST, bakInst->instBaseAddr, NULL);
+        return NULL;
+    }
+
+    /**
+     * runtime.morestack must be called from go text, or the stack copy throws `unknown pc`.
+     * the block of src jumps to src again when the stack is grown, that is the hook, not the origin.
+     * the block of trampoline_func jumps to trampoline_func, which lands in `back` and checks again.
+     * they have the same signature, so spill and reload the same registers.
+     * without trampoline_func, `back` calls morestack from a slot of the grow pad, see write_grow_code
+     */
+    BYTE *srcMorestack = located_go_morestack(bakInst->instBaseAddr, NULL);
+    int32_t growSize = 0;
+    if (trampolineFunc->pTrampFunc == NULL && srcMorestack != NULL)
+    {
+        growSize = write_grow_code(NULL, srcMorestack, NULL, NULL, NULL);
+        trampolineFunc->growSlot = growSize != -1 ? get_grow_slot() : NULL;
+        if (trampolineFunc->growSlot == NULL)
+        {
+            LOG_ETRACE("no grow slot for the morestack block %p of %p", srcMorestack, bakInst->instBaseAddr);
+            set_hook_err(err, growSize == -1 ? HOOK_E_RELOCATE : HOOK_E_NO_NEAR_MEM, srcMorestack, NULL);
+            return NULL;
+        }
+    }
 
-    TrampolineBack *back = (TrampolineBack *)get_neighbor_mem(trampolineFunc->pTrampFunc, sizeof(TrampolineBack) + len);
-    back->restoreInstSize = len;
+    // without trampoline_func, `back` is called directly, keep it near src
+    void *near = trampolineFunc->pTrampFunc != NULL ? trampolineFunc->pTrampFunc : bakInst->instBaseAddr;
+    TrampolineBack *back = (TrampolineBack *)get_neighbor_mem(near, sizeof(TrampolineBack) + bound + LONG_JMP_INST_SIZE + growSize);
+    if (back == NULL)
+    {
+        LOG_ETRACE("no free memory near %p", near);
+        set_hook_err(err, HOOK_E_NO_NEAR_MEM, near, NULL);
+        drop_back_trampoline(trampolineFunc, NULL);
+        return NULL;
+    }
     back->toAddress = (long)origin_func;
-    // insert jmp: trampoline_func to trampoline memory inst address
-    place_direct_jmp_inst(trampolineFunc->pTrampFunc, back->inst, trampolineFunc->bakInstArLen);
 
-    // restore from_inst
-    memcpy(back->inst, inst, len);
+    BYTE *grow = back->inst + bound + LONG_JMP_INST_SIZE;
+    BYTE *morestack = trampolineFunc->pTrampFunc != NULL ? located_go_morestack(trampolineFunc->pTrampFunc, NULL)
+                                                         : (trampolineFunc->growSlot != NULL ? grow : NULL);
+    LOG_TRACE("morestack of src:%p trampoline_func:%p", srcMorestack, morestack);
 
-    // note: after reloactedOffset, some inst could be changed
-    if (calcRelativeOffset(back->inst, len, bakInst->instBaseAddr) != 0)
+    int32_t len = relocate_backup_inst(back->inst, (uint64_t)back->inst, bakInst, srcMorestack, morestack, err);
+    if (len == -1)
     {
+        drop_back_trampoline(trampolineFunc, back);
         return NULL;
     }
+    back->restoreInstSize = len;
+
+    // a thread stopped inside the backup inst while the jmp is placed goes on at the same inst here
+    int32_t newOff[BACKUP_INST_SIZE];
+    x86_relocate_layout(bakInst->instBackUp, bakInst->instBackupSize, (uint64_t)bakInst->instBaseAddr, (uint64_t)back->inst,
+                        (uint64_t)srcMorestack, (uint64_t)(morestack != NULL ? morestack : srcMorestack), newOff);
+    for (int32_t i = 0; i < BACKUP_INST_SIZE; i++)
+    {
+        back->instOff[i] = i < bakInst->instBackupSize ? newOff[i] : -1;
+    }
 
     // jmp trampoline to origin function
     BYTE *jmpInst = back->inst + len;
@@ -455,12 +816,38 @@ TrampolineBack *insert_back_trampoline(TrampolineFuncT *trampolineFunc, FromInst
     if (labs((long)jmpInst - (long)origin_func) >> 31 == 0)
     {
         // use  directly jmp
-        place_direct_jmp_inst(jmpInst, origin_func, JMP_INST_SIZE);
+        write_direct_jmp_inst(jmpInst, jmpInst, origin_func, JMP_INST_SIZE);
     }
     else
     {
         // insert jmp: trampoline to func
-        place_indirect_jmp_inst(jmpInst, &back->toAddress, LONG_JMP_INST_SIZE);
+        write_indirect_jmp_inst(jmpInst, &back->toAddress, LONG_JMP_INST_SIZE);
+    }
+
+    BYTE slotCode[GROW_SLOT_SIZE];
+    if (trampolineFunc->growSlot != NULL && write_grow_code(grow, srcMorestack, trampolineFunc->growSlot, back->inst, slotCode) == -1)
+    {
+        LOG_ETRACE("grow slot %p is out of the reach of %p", trampolineFunc->growSlot, back);
+        set_hook_err(err, HOOK_E_NO_NEAR_MEM, trampolineFunc->growSlot, NULL);
+        drop_back_trampoline(trampolineFunc, back);
+        return NULL;
+    }
+
+    // insert jmp: trampoline_func to trampoline memory inst address
+    // the last step, nothing to rollback on trampoline_func. nobody runs a free grow slot
+    int32_t sealed = seal_neighbor_mem(back);
+    if (sealed == -1 || (trampolineFunc->pTrampFunc != NULL &&
+                         place_direct_jmp_inst(trampolineFunc->pTrampFunc, back->inst, trampolineFunc->bakInstArLen, NULL) == -1))
+    {
+        set_hook_err(err, HOOK_E_MPROTECT, sealed == -1 ? (void *)back : trampolineFunc->pTrampFunc, NULL);
+        drop_back_trampoline(trampolineFunc, back);
+        return NULL;
+    }
+    if (trampolineFunc->growSlot != NULL && patch_code(trampolineFunc->growSlot, slotCode, GROW_SLOT_SIZE, NULL, NULL) == -1)
+    {
+        set_hook_err(err, HOOK_E_MPROTECT, trampolineFunc->growSlot, NULL);
+        drop_back_trampoline(trampolineFunc, back);
+        return NULL;
     }
 
     return back;
@@ -475,25 +862,50 @@ TrampolineBack *insert_back_trampoline(TrampolineFuncT *trampolineFunc, FromInst
  *  note: go-layer must free trampoline pointer
  * @param src
  * @param dst
- * @return TrampolineForward* address of trampoline. NULL: no need to trampoline, directly jmp is enough
+ * @param back relocated backup inst of src, a thread inside them while the jmp is placed goes on there
+ * @param err code is set if failed
+ * @return TrampolineForward* address of trampoline. NULL: no need to trampoline, directly jmp is enough, or failed
  */
-TrampolineForward *insert_forward_trampoline(void *from, void *to)
+TrampolineForward *insert_forward_trampoline(void *from, void *to, TrampolineBack *back, HookErr *err)
 {
+    void *inner[BACKUP_INST_SIZE];
+    back_inner(back, inner);
+
     // check range size
     if (labs((long)from - (long)to) >> 31 == 0)
     {
         // use  directly jmp
-        place_direct_jmp_inst(from, to, JMP_INST_SIZE);
+        if (place_direct_jmp_inst(from, to, JMP_INST_SIZE, inner) == -1)
+        {
+            set_hook_err(err, HOOK_E_MPROTECT, from, NULL);
+        }
         return NULL;
     }
 
     // use directly jmp and indirect jmp
 
     TrampolineForward *forward = (TrampolineForward *)get_neighbor_mem(from, sizeof(TrampolineForward));
+    if (forward == NULL)
+    {
+        LOG_ETRACE("no free memory near %p", from);
+        set_hook_err(err, HOOK_E_NO_NEAR_MEM, from, NULL);
+        return NULL;
+    }
     forward->toAddress = (long)to;
     // x64
-    place_indirect_jmp_inst(forward->inst, &forward->toAddress, LONG_JMP_INST_SIZE);
-    place_direct_jmp_inst(from, forward->inst, JMP_INST_SIZE);
+    write_indirect_jmp_inst(forward->inst, &forward->toAddress, LONG_JMP_INST_SIZE);
+    if (seal_neighbor_mem(forward) == -1)
+    {
+        set_hook_err(err, HOOK_E_MPROTECT, forward->inst, NULL);
+        put_neighbor_mem(forward);
+        return NULL;
+    }
+    if (place_direct_jmp_inst(from, forward->inst, JMP_INST_SIZE, inner) == -1)
+    {
+        set_hook_err(err, HOOK_E_MPROTECT, from, NULL);
+        put_neighbor_mem(forward);
+        return NULL;
+    }
 
     return forward;
 }
@@ -546,7 +958,20 @@ int32_t detour_does_code_end_function(OpcodeType pbCode)
     return 0;
 }
 
-int32_t make_space_for_jmp_boundary(void *address, const int32_t minSpace, BYTE *bakInstBytes, int32_t maxBakSize)
+// go pads the text between functions with int3
+static int32_t is_int3_padding(BYTE *start, BYTE *end)
+{
+    for (; start < end; start++)
+    {
+        if (*start != 0xcc)
+        {
+            return 0;
+        }
+    }
+    return 1;
+}
+
+int32_t make_space_for_jmp_boundary(void *address, const int32_t minSpace, BYTE *bakInstBytes, int32_t maxBakSize, HookErr *err)
 {
     assert(minSpace <= maxBakSize);
 
@@ -558,15 +983,33 @@ int32_t make_space_for_jmp_boundary(void *address, const int32_t minSpace, BYTE
 
         if (ret != E_OK)
         {
-            LOG_ETRACE("unknown instruction");
+            char buf[HOOK_ERR_INST_SIZE] = {0};
+            snprintf(buf, sizeof(buf), "%02X %02X %02X %02X", pByte[0], pByte[1], pByte[2], pByte[3]);
+            LOG_ETRACE("unknown instruction: %s", buf);
+            set_hook_err(err, HOOK_E_UNKNOWN_INST, pByte, buf);
             return -1;
         }
 
+        if ((OPCODE_1(inst.Opcode) == 0xc3 || OPCODE_1(inst.Opcode) == 0xe9 || OPCODE_1(inst.Opcode) == 0xeb) &&
+            is_int3_padding(pByte + inst.Len, (BYTE *)address + minSpace))
+        {
+            // go ABIInternal leaf `addl bx, ax; ret` or tail call `jmp fn`, nothing behind them runs
+            // through, the int3 padding after them belongs to nobody
+            LOG_TRACE("function ends at %p, take the int3 padding", pByte);
+            pByte += inst.Len;
+            if (pByte < (BYTE *)address + minSpace)
+            {
+                pByte = (BYTE *)address + minSpace;
+            }
+            break;
+        }
+
         if (detour_does_code_end_function(inst.Opcode))
         {
-            char buf[128] = {0};
+            char buf[HOOK_ERR_INST_SIZE] = {0};
             inst_str(&inst, buf, sizeof(buf));
             LOG_ETRACE("met end function when scan space: %s", buf);
+            set_hook_err(err, HOOK_E_TOO_SHORT, pByte, buf);
             return -1;
         }
 
@@ -586,6 +1029,7 @@ int32_t make_space_for_jmp_boundary(void *address, const int32_t minSpace, BYTE
     if (usageLen > maxBakSize)
     {
         LOG_ETRACE("[🐛]backup space is too small. address:%p usageLen:%d maxBakSize:%d", address, usageLen, maxBakSize);
+        set_hook_err(err, HOOK_E_RELOCATE, address, NULL);
         return -1;
     }
     memcpy(bakInstBytes, address, usageLen);
@@ -622,125 +1066,427 @@ void *located_nearest_call_target(void *start)
         pInst += _inst.Len;
     } while (detour_does_code_end_function(_inst.Opcode) != 1);
 
-    LOG_TRACE("start:%p no such callq", start);
-    return NULL;
+    LOG_TRACE("start:%p no such callq", start);
+    return NULL;
+}
+
+void *located_nearest_jmp_target(void *start)
+{
+#define UNKNOWN_SIZE 32
+    BYTE *pInst = start;
+    Inst _inst = {0};
+    do
+    {
+        E_RET_TYPE ret = decode(pInst, UNKNOWN_SIZE, &_inst, 64, false);
+        if (ret != E_OK)
+        {
+            break;
+        }
+
+        if (_inst.Len == JMP_INST_SIZE && _inst.Op == JMP && OPCODE_1(_inst.Opcode) == 0xE9)
+        {
+            Rel *rel = get_rel_arg(&_inst.Args[0]);
+            if (rel == NULL)
+            {
+                LOG_TRACE("no such rel in `callq` inst");
+                break;
+            }
+            BYTE *pfunc = pInst + JMP_INST_SIZE + *rel;
+            return pfunc;
+        }
+        pInst += _inst.Len;
+    } while (detour_does_code_end_function_e9(_inst.Opcode) != 1);
+    LOG_TRACE("start:%p no such callq", start);
+    return NULL;
+}
+
+/**
+ * @brief collect the targets of `call rel32` (call=1) or `jmp rel` (call=0) in [start, start+size)
+ * @param start
+ * @param size
+ * @param call
+ * @param targets
+ * @param max
+ * @return int32_t number of targets
+ */
+int32_t located_branch_targets(void *start, int32_t size, int32_t call, void **targets, int32_t max)
+{
+    BYTE *pInst = start;
+    int32_t n = 0;
+    while (pInst < (BYTE *)start + size && n < max)
+    {
+        Inst _inst = {0};
+        if (decode(pInst, (BYTE *)start + size - pInst, &_inst, 64, false) != E_OK)
+        {
+            break;
+        }
+
+        if ((call && _inst.Op == CALL) || (!call && _inst.Op == JMP))
+        {
+            BYTE *target = (BYTE *)x86_inst_target(&_inst, pInst, (uint64_t)pInst);
+            if (target != NULL)
+            {
+                targets[n++] = target;
+            }
+        }
+        pInst += _inst.Len;
+    }
+    return n;
+}
+
+// /**
+//  * @brief patch for hook
+//  *   parse the machine code, update the from address from callq
+//  * exp: callq platform is complex, needs more test
+//  * @param from
+//  * @param to
+//  * @param trampoline_func
+//  * @return void*
+//  */
+// void* hookP0_1(void* from,void* to,void* trampoline_func)
+// {
+//     void*n_from = located_nearest_call_target(from);
+//     if(n_from){
+//         return hook(n_from,to,trampoline_func);
+//     }else{
+//         return NULL;
+//     }
+// }
+
+/**
+ * @brief
+ *
+ * @param from
+ * @param to
+ * @param trampoline
+ * @param err
+ * @return void*
+ */
+void *hook_locked(void *from, void *to, void *callFrom, HookErr *err)
+{
+    Trampoline *trampoline = (Trampoline *)malloc(sizeof(Trampoline));
+    if (trampoline == NULL)
+    {
+        LOG_ETRACE("malloc %ld failed", sizeof(Trampoline));
+        set_hook_err(err, HOOK_E_NO_MEM, from, NULL);
+        return NULL;
+    }
+
+    // locate the safe inst boundary for jmp-from inst
+    {
+        // the whole go stack check goes to `back`, or it jumps to src again
+        int32_t minSpace = JMP_INST_SIZE;
+        int32_t checkSize = 0;
+        if (located_go_morestack(from, &checkSize) != NULL && checkSize > minSpace)
+        {
+            minSpace = checkSize;
+        }
+        int32_t size = make_space_for_jmp_boundary(from, minSpace, trampoline->fromInstBackUp.instBackUp, BACKUP_INST_SIZE, err);
+        if (size == -1)
+        {
+            free(trampoline);
+            return NULL;
+        }
+
+        trampoline->fromInstBackUp.instBackupSize = size;
+        trampoline->fromInstBackUp.instBaseAddr = from;
+        trampoline->target = from;
+        trampoline->to = to;
+    }
+
+    // locate the safe inst boundary for jmp-trampoline_func inst
+    trampoline->trampolineFunc.bakInstArLen = 0;
+    trampoline->trampolineFunc.pTrampFunc = NULL;
+    trampoline->trampolineFunc.growSlot = NULL;
+    if (callFrom != NULL)
+    {
+        int32_t size = make_space_for_jmp_boundary(callFrom, JMP_INST_SIZE, trampoline->trampolineFunc.bakInstAr, BACKUP_INST_SIZE, err);
+        if (size == -1)
+        {
+            free(trampoline);
+            return NULL;
+        }
+        trampoline->trampolineFunc.bakInstArLen = size;
+        trampoline->trampolineFunc.pTrampFunc = callFrom;
+    }
+
+    // 1. insert `back` trampoline, `from` is untouched if it failed
+    TrampolineBack *back = insert_back_trampoline(&trampoline->trampolineFunc, &trampoline->fromInstBackUp, err);
+    if (back == NULL)
+    {
+        LOG_ETRACE("hook: from:%p to:%p trampoline:%p failed", from, to, callFrom);
+        free(trampoline);
+        return NULL;
+    }
+    trampoline->back = back;
+    LOG_TRACE("trampoline_func:%p -> origin landing:%lx ", callFrom, back->toAddress);
+
+    // 2. insert `forward` trampoline
+    trampoline->forward = insert_forward_trampoline(from, to, back, err);
+    if (err->code != HOOK_E_OK)
+    {
+        LOG_ETRACE("hook: from:%p to:%p trampoline:%p failed", from, to, callFrom);
+        restore_trampoline_func_inst(trampoline);
+        drop_back_trampoline(&trampoline->trampolineFunc, back);
+        free(trampoline);
+        return NULL;
+    }
+    LOG_TRACE("forward trampoline:%p from:%p to:%p backup:{base:%p size:%d} ", trampoline->forward,
+              from, to, trampoline->fromInstBackUp.instBaseAddr, trampoline->fromInstBackUp.instBackupSize);
+
+    // 3. return trampoline for unhook
+    return trampoline;
+}
+
+/**
+ * @brief place the jmp on src again, the same as hook_locked did
+ * @param trampoline
+ * @return int32_t -1: failed
+ */
+int32_t place_src_jmp(Trampoline *trampoline)
+{
+    void *to = trampoline->forward ? (void *)trampoline->forward->inst : trampoline->to;
+    void *inner[BACKUP_INST_SIZE];
+    return place_direct_jmp_inst(trampoline->target, to, JMP_INST_SIZE, back_inner(trampoline->back, inner));
+}
+
+/**
+ * @brief hook_locked without writing: the same space made at src and trampoline_func,
+ *  the backup inst relocated into a buffer as if `back` were placed by trampoline_func
+ * @param from
+ * @param to
+ * @param callFrom
+ * @param report
+ */
+void verify_hook_locked(void *from, void *to, void *callFrom, HookReport *report)
+{
+    HookErr *err = &report->err;
+    FromInstBackUp bakInst;
+
+    int32_t minSpace = JMP_INST_SIZE;
+    int32_t checkSize = 0;
+    BYTE *srcMorestack = located_go_morestack(from, &checkSize);
+    if (srcMorestack != NULL && checkSize > minSpace)
+    {
+        minSpace = checkSize;
+    }
+    report->stackCheck = srcMorestack != NULL;
+
+    int32_t size = make_space_for_jmp_boundary(from, minSpace, bakInst.instBackUp, BACKUP_INST_SIZE, err);
+    if (size == -1)
+    {
+        return;
+    }
+    bakInst.instBackupSize = size;
+    bakInst.instBaseAddr = from;
+    report->srcSize = size;
+
+    for (int32_t off = 0; off < size;)
+    {
+        Inst inst = {0};
+        if (decode(bakInst.instBackUp + off, size - off, &inst, 64, false) != E_OK)
+        {
+            break;
+        }
+        if (report->instCount < HOOK_REPORT_MAX_INST)
+        {
+            inst_str(&inst, report->inst[report->instCount], HOOK_ERR_INST_SIZE);
+        }
+        report->instCount++;
+        off += inst.Len;
+    }
+
+    // without trampoline_func, `back` spills and reloads as the morestack block of src does
+    if (callFrom == NULL && srcMorestack != NULL && write_grow_code(NULL, srcMorestack, NULL, NULL, NULL) == -1)
+    {
+        set_hook_err(err, HOOK_E_RELOCATE, srcMorestack, NULL);
+        return;
+    }
+
+    BYTE *morestack = NULL;
+    if (callFrom != NULL)
+    {
+        BYTE bakInstAr[BACKUP_INST_SIZE];
+        report->trampolineFuncSize = make_space_for_jmp_boundary(callFrom, JMP_INST_SIZE, bakInstAr, BACKUP_INST_SIZE, err);
+        if (report->trampolineFuncSize == -1)
+        {
+            return;
+        }
+        morestack = located_go_morestack(callFrom, NULL);
+    }
+
+    int32_t bound = x86_relocate_bound(bakInst.instBackUp, size);
+    if (bound == -1)
+    {
+        set_hook_err(err, HOOK_E_UNKNOWN_INST, from, NULL);
+        return;
+    }
+    BYTE *out = malloc(bound);
+    if (out == NULL)
+    {
+        set_hook_err(err, HOOK_E_NO_MEM, from, NULL);
+        return;
+    }
+    BYTE *near = callFrom != NULL ? callFrom : from;
+    report->relocatedSize = relocate_backup_inst(out, (uint64_t)near, &bakInst, srcMorestack, morestack, err);
+    free(out);
+
+    report->forward = labs((long)from - (long)to) >> 31 != 0;
+}
+
+// mov reg, rdx; mov rdx, imm64; jmp [rip]; .quad code
+#define CLOSURE_STUB_SIZE (3 + 10 + LONG_JMP_INST_SIZE + 8)
+// mov rdx, [rdx+8]; jmp [rip]; .quad code
+#define CONTEXT_STUB_SIZE (4 + LONG_JMP_INST_SIZE + 8)
+
+// integer argument registers of ABIInternal: rax rbx rcx rdi rsi r8 r9 r10 r11
+static const BYTE INT_ARG_REGS[] = {0, 3, 1, 7, 6, 8, 9, 10, 11};
+
+/**
+ * @brief go passes the closure context in rdx
+ * @param closure
+ * @param code
+ * @param ctxArg >= 0: the context the stub is entered with goes to this integer argument register first
+ * @return void* NULL: no memory or ctxArg out of the registers
+ */
+void *make_closure_stub(uintptr_t closure, void *code, int32_t ctxArg)
+{
+    if (ctxArg >= (int32_t)sizeof(INT_ARG_REGS))
+    {
+        return NULL;
+    }
+    BYTE *stub = get_neighbor_mem(code, CLOSURE_STUB_SIZE);
+    if (stub == NULL)
+    {
+        return NULL;
+    }
+
+    BYTE *p = stub;
+    if (ctxArg >= 0)
+    {
+        BYTE reg = INT_ARG_REGS[ctxArg];
+        *p++ = 0x48 | (reg >> 3);
+        *p++ = 0x89;
+        *p++ = 0xC0 | (2 << 3) | (reg & 7);
+    }
+    *p++ = 0x48;
+    *p++ = 0xBA;
+    memcpy(p, &closure, sizeof(closure));
+    p += sizeof(closure);
+    *p++ = 0xFF;
+    *p++ = 0x25;
+    memset(p, 0, sizeof(int32_t));
+    p += sizeof(int32_t);
+    memcpy(p, &code, sizeof(code));
+    if (seal_neighbor_mem(stub) == -1)
+    {
+        put_neighbor_mem(stub);
+        return NULL;
+    }
+    return stub;
 }
 
-void *located_nearest_jmp_target(void *start)
+/**
+ * @brief code a func value {stub, context} runs: the closure context is loaded from the
+ *  second word of the func value, then `code` goes on as entered by the closure itself
+ * @param code
+ * @return void* NULL: no memory
+ */
+void *make_context_stub(void *code)
 {
-#define UNKNOWN_SIZE 32
-    BYTE *pInst = start;
-    Inst _inst = {0};
-    do
+    BYTE *stub = get_neighbor_mem(code, CONTEXT_STUB_SIZE);
+    if (stub == NULL)
     {
-        E_RET_TYPE ret = decode(pInst, UNKNOWN_SIZE, &_inst, 64, false);
-        if (ret != E_OK)
-        {
-            break;
-        }
+        return NULL;
+    }
 
-        if (_inst.Len == JMP_INST_SIZE && _inst.Op == JMP && OPCODE_1(_inst.Opcode) == 0xE9)
-        {
-            Rel *rel = get_rel_arg(&_inst.Args[0]);
-            if (rel == NULL)
-            {
-                LOG_TRACE("no such rel in `callq` inst");
-                break;
-            }
-            BYTE *pfunc = pInst + JMP_INST_SIZE + *rel;
-            return pfunc;
-        }
-        pInst += _inst.Len;
-    } while (detour_does_code_end_function_e9(_inst.Opcode) != 1);
-    LOG_TRACE("start:%p no such callq", start);
-    return NULL;
+    static const BYTE loadCtx[] = {0x48, 0x8B, 0x52, 0x08};
+    BYTE *p = stub;
+    memcpy(p, loadCtx, sizeof(loadCtx));
+    p += sizeof(loadCtx);
+    *p++ = 0xFF;
+    *p++ = 0x25;
+    memset(p, 0, sizeof(int32_t));
+    p += sizeof(int32_t);
+    memcpy(p, &code, sizeof(code));
+    if (seal_neighbor_mem(stub) == -1)
+    {
+        put_neighbor_mem(stub);
+        return NULL;
+    }
+    return stub;
 }
 
-// /**
-//  * @brief patch for hook
-//  *   parse the machine code, update the from address from callq
-//  * exp: callq platform is complex, needs more test
-//  * @param from
-//  * @param to
-//  * @param trampoline_func
-//  * @return void*
-//  */
-// void* hookP0_1(void* from,void* to,void* trampoline_func)
-// {
-//     void*n_from = located_nearest_call_target(from);
-//     if(n_from){
-//         return hook(n_from,to,trampoline_func);
-//     }else{
-//         return NULL;
-//     }
-// }
+#endif
 
 /**
  * @brief
- *
+ *  thread-safe entry of hook_locked, hook/unhook are serialized by hook_lock_g
  * @param from
  * @param to
  * @param trampoline
+ * @param err why it failed, could be NULL
  * @return void*
  */
-void *hook(void *from, void *to, void *callFrom)
+static int32_t is_hook_input_valid(void *from, void *to, void *callFrom, HookErr *err)
 {
-    if (from == to || callFrom == from || callFrom == to)
+    if (from == NULL || to == NULL || from == to || callFrom == from || callFrom == to)
     {
         LOG_ETRACE("input is invalid");
-        return NULL;
+        set_hook_err(err, HOOK_E_INVALID_INPUT, from, NULL);
+        return 0;
     }
+    return 1;
+}
 
-    Trampoline *trampoline = (Trampoline *)malloc(sizeof(Trampoline));
-    if (trampoline == NULL)
+void *hook_e(void *from, void *to, void *callFrom, HookErr *err)
+{
+    HookErr local;
+    if (err == NULL)
     {
-        LOG_ETRACE("malloc %ld failed", sizeof(Trampoline));
-        return NULL;
+        err = &local;
     }
+    set_hook_err(err, HOOK_E_OK, NULL, NULL);
 
-    // locate the safe inst boundary for jmp-from inst
+    if (!is_hook_input_valid(from, to, callFrom, err))
     {
-        int32_t size = make_space_for_jmp_boundary(from, JMP_INST_SIZE, trampoline->fromInstBackUp.instBackUp, BACKUP_INST_SIZE);
-        if (size == -1)
-        {
-            return NULL;
-        }
-
-        trampoline->fromInstBackUp.instBackupSize = size;
-        trampoline->fromInstBackUp.instBaseAddr = from;
-        trampoline->target = from;
+        return NULL;
     }
 
-    // locate the safe inst boundary for jmp-trampoline_func inst
-    {
-        int32_t size = make_space_for_jmp_boundary(callFrom, JMP_INST_SIZE, trampoline->trampolineFunc.bakInstAr, BACKUP_INST_SIZE);
-        if (size == -1)
-        {
-            return NULL;
-        }
-        trampoline->trampolineFunc.bakInstArLen = size;
-        trampoline->trampolineFunc.pTrampFunc = callFrom;
-    }
+    pthread_mutex_lock(&hook_lock_g);
+    void *trampoline = hook_locked(from, to, callFrom, err);
+    pthread_mutex_unlock(&hook_lock_g);
+    return trampoline;
+}
 
-    // 1. insert `forward` trampoline
-    trampoline->forward = insert_forward_trampoline(from, to);
-    LOG_TRACE("forward trampoline:%p from:%p to:%p backup:{base:%p size:%d} ", trampoline->forward,
-              from, to, trampoline->fromInstBackUp.instBaseAddr, trampoline->fromInstBackUp.instBackupSize);
+void *hook(void *from, void *to, void *callFrom)
+{
+    return hook_e(from, to, callFrom, NULL);
+}
 
-    // 2. insert `to` trampoline
-    TrampolineBack *back = insert_back_trampoline(&trampoline->trampolineFunc, &trampoline->fromInstBackUp);
-    if (back == NULL)
+/**
+ * @brief check what hook_e would do on `from`, nothing is written or allocated near it
+ * @param from
+ * @param to
+ * @param callFrom
+ * @param report filled as far as the check goes
+ * @return int32_t 0: hook_e would patch, -1: report->err tells why not
+ */
+int32_t verify_hook(void *from, void *to, void *callFrom, HookReport *report)
+{
+    memset(report, 0, sizeof(*report));
+    if (!is_hook_input_valid(from, to, callFrom, &report->err))
     {
-        LOG_ETRACE("hook: from:%p to:%p trampoline:%p failed", from, to, callFrom);
-        return NULL;
+        return -1;
     }
-    trampoline->back = back;
-    LOG_TRACE("trampoline_func:%p -> origin landing:%lx ", callFrom, back->toAddress);
-    // 3. return trampoline for unhook
-    return trampoline;
+
+    pthread_mutex_lock(&hook_lock_g);
+    verify_hook_locked(from, to, callFrom, report);
+    pthread_mutex_unlock(&hook_lock_g);
+    return report->err.code == HOOK_E_OK ? 0 : -1;
 }
 
-#ifndef NTEST
+#if !defined(NTEST) && defined(__x86_64__)
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 //                                                  test zone                                                                    //
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -794,24 +1540,238 @@ void test_hook()
     LOG_TRACE("passed");
 }
 
+void test_release_trampoline()
+{
+    void *trampoline = hook(foo, hook_foo, foo1);
+    assert(trampoline != NULL);
+    assert(foo(1, 3) == 44);
+
+    unhook_src(trampoline);
+    assert(foo(1, 3) == 4);
+    // rollback
+    rehook_src(trampoline);
+    assert(foo(1, 3) == 44);
+
+    unhook_src(trampoline);
+    release_trampoline(trampoline);
+    assert(foo(1, 3) == 4);
+    assert(foo1(3, 1) == 2);
+
+    // the chunk space is reused
+    trampoline = hook(foo, hook_foo, foo1);
+    assert(foo(1, 3) == 44);
+    unhook_src(trampoline);
+    release_trampoline(trampoline);
+    LOG_TRACE("passed");
+}
+
+#define PATCH_THREADS 8
+#define PATCH_ROUNDS 5000
+
+static volatile int patch_stop_g;
+
+// mov eax, imm32; ret
+static void write_ret_imm(BYTE *p, int32_t imm)
+{
+    p[0] = 0xB8;
+    memcpy(p + 1, &imm, sizeof(imm));
+    p[5] = 0xC3;
+}
+
+static void *call_patched_routine(void *arg)
+{
+    int (*volatile f)(void) = (int (*)(void))arg;
+    while (!patch_stop_g)
+    {
+        int ret = f();
+        assert(ret == 1 || ret == 2);
+    }
+    return NULL;
+}
+
+/**
+ * @brief threads keep running the code patched, cross an aligned word, int3 is placed first
+ */
+void test_patch_code_concurrent()
+{
+    BYTE *code = get_neighbor_mem(test_patch_code_concurrent, 32);
+    BYTE *resume = get_neighbor_mem(test_patch_code_concurrent, 16);
+    assert(code && resume);
+    // the 6 bytes at 5 cross the aligned 8 bytes
+    BYTE *f = code + 5;
+    memset(code, 0xCC, 32);
+    write_ret_imm(f, 1);
+    write_ret_imm(resume, 2);
+    assert(seal_neighbor_mem(code) == 0 && seal_neighbor_mem(resume) == 0);
+
+    pthread_t threads[PATCH_THREADS];
+    int i = 0;
+    patch_stop_g = 0;
+    for (; i < PATCH_THREADS; i++)
+    {
+        assert(pthread_create(&threads[i], NULL, call_patched_routine, f) == 0);
+    }
+
+    BYTE one[6], two[6];
+    write_ret_imm(one, 1);
+    write_ret_imm(two, 2);
+    // a thread at the ret goes on at the ret of `resume`
+    void *inner[BACKUP_INST_SIZE] = {0};
+    inner[5] = resume + 5;
+    for (i = 0; i < PATCH_ROUNDS; i++)
+    {
+        // both go on at `resume`, it returns 2 which either of them could
+        assert(patch_code(f, i % 2 ? one : two, sizeof(one), resume, inner) == 0);
+    }
+    patch_stop_g = 1;
+    for (i = 0; i < PATCH_THREADS; i++)
+    {
+        pthread_join(threads[i], NULL);
+    }
+    assert(((int (*)(void))f)() == 1);
+    put_neighbor_mem(resume);
+    put_neighbor_mem(code);
+    LOG_TRACE("passed");
+}
+
+/**
+ * @brief the old code has 3 inst in the patched bytes. a thread which ran the first one before the patch
+ *  must not run the middle of the new one, the int3 on the inner inst send it to the copy of the old code
+ */
+void test_patch_code_inner()
+{
+    // xor eax, eax; add eax, 1; ret
+    const BYTE one[6] = {0x31, 0xC0, 0x83, 0xC0, 0x01, 0xC3};
+    BYTE two[6];
+    write_ret_imm(two, 2);
+
+    BYTE *code = get_neighbor_mem(test_patch_code_inner, 32);
+    BYTE *copyOne = get_neighbor_mem(test_patch_code_inner, 16);
+    BYTE *copyTwo = get_neighbor_mem(test_patch_code_inner, 16);
+    assert(code && copyOne && copyTwo);
+    // in one aligned word, only the inner inst keep it from the single store
+    BYTE *f = code + 8;
+    memset(code, 0xCC, 32);
+    memcpy(f, one, sizeof(one));
+    memcpy(copyOne, one, sizeof(one));
+    memcpy(copyTwo, two, sizeof(two));
+    assert(seal_neighbor_mem(code) == 0 && seal_neighbor_mem(copyOne) == 0 && seal_neighbor_mem(copyTwo) == 0);
+
+    void *innerOne[BACKUP_INST_SIZE] = {0};
+    innerOne[2] = copyOne + 2;
+    innerOne[5] = copyOne + 5;
+    void *innerTwo[BACKUP_INST_SIZE] = {0};
+    innerTwo[5] = copyTwo + 5;
+
+    pthread_t threads[PATCH_THREADS];
+    int i = 0;
+    patch_stop_g = 0;
+    for (; i < PATCH_THREADS; i++)
+    {
+        assert(pthread_create(&threads[i], NULL, call_patched_routine, f) == 0);
+    }
+    for (i = 0; i < PATCH_ROUNDS; i++)
+    {
+        if (i % 2 == 0)
+        {
+            assert(patch_code(f, two, sizeof(two), copyTwo, innerOne) == 0);
+        }
+        else
+        {
+            assert(patch_code(f, one, sizeof(one), copyOne, innerTwo) == 0);
+        }
+    }
+    patch_stop_g = 1;
+    for (i = 0; i < PATCH_THREADS; i++)
+    {
+        pthread_join(threads[i], NULL);
+    }
+    assert(((int (*)(void))f)() == 1);
+    put_neighbor_mem(copyTwo);
+    put_neighbor_mem(copyOne);
+    put_neighbor_mem(code);
+    LOG_TRACE("passed");
+}
+
+__attribute__((noinline)) int stress_src(int x)
+{
+    return x * 5 + 3;
+}
+
+__attribute__((noinline)) int stress_trampoline(int x)
+{
+    return x * 7 - 1;
+}
+
+__attribute__((noinline)) int stress_hook(int x)
+{
+    return stress_trampoline(x) + 100;
+}
+
+static void *call_stress_routine(void *arg)
+{
+    (void)arg;
+    int (*volatile f)(int) = stress_src;
+    int x = 0;
+    while (!patch_stop_g)
+    {
+        int ret = f(x);
+        assert(ret == x * 5 + 3 || ret == x * 5 + 3 + 100);
+        x = (x + 1) & 0xffff;
+    }
+    return NULL;
+}
+
+/**
+ * @brief hook and unhook a function others keep calling
+ */
+void test_hook_concurrent()
+{
+    pthread_t threads[PATCH_THREADS];
+    int i = 0;
+    patch_stop_g = 0;
+    for (; i < PATCH_THREADS; i++)
+    {
+        assert(pthread_create(&threads[i], NULL, call_stress_routine, NULL) == 0);
+    }
+
+    void *t = hook(stress_src, stress_hook, stress_trampoline);
+    assert(t != NULL);
+    for (i = 0; i < PATCH_ROUNDS; i++)
+    {
+        unhook_src(t);
+        rehook_src(t);
+    }
+    unhook_src(t);
+    patch_stop_g = 1;
+    for (i = 0; i < PATCH_THREADS; i++)
+    {
+        pthread_join(threads[i], NULL);
+    }
+    // nobody is in stress_hook
+    release_trampoline(t);
+    assert(stress_src(1) == 8 && stress_trampoline(1) == 6);
+    LOG_TRACE("passed");
+}
+
 void empty() {}
 void test_make_space()
 {
     {
         BYTE inst[32] = {0};
-        assert(make_space_for_jmp_boundary(test_hook, 5, inst, 32) > 0);
-        assert(make_space_for_jmp_boundary(empty, 5, inst, 32) > 0);
+        assert(make_space_for_jmp_boundary(test_hook, 5, inst, 32, NULL) > 0);
+        assert(make_space_for_jmp_boundary(empty, 5, inst, 32, NULL) > 0);
     }
     // BYTE inst[9]={0x64, 0x48, 0x8b, 0x0c, 0x25 ,0xf8 ,0xff ,0xff ,0xff};
     {
         BYTE inst[9] = {0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF};
         BYTE movInst[9] = {0x64, 0x48, 0x8b, 0x0c, 0x25, 0xf8, 0xff, 0xff, 0xff};
         BYTE buf[32] = {0};
-        assert(make_space_for_jmp_boundary(inst, 1, buf, 32) == -1);
-        assert(make_space_for_jmp_boundary(inst, 3, buf, 32) == -1);
-        assert(make_space_for_jmp_boundary(inst, 4, buf, 32) == -1);
-        assert(make_space_for_jmp_boundary(inst, 5, buf, 32) == -1);
-        assert(make_space_for_jmp_boundary(movInst, sizeof(movInst), buf, 32) == sizeof(inst));
+        assert(make_space_for_jmp_boundary(inst, 1, buf, 32, NULL) == -1);
+        assert(make_space_for_jmp_boundary(inst, 3, buf, 32, NULL) == -1);
+        assert(make_space_for_jmp_boundary(inst, 4, buf, 32, NULL) == -1);
+        assert(make_space_for_jmp_boundary(inst, 5, buf, 32, NULL) == -1);
+        assert(make_space_for_jmp_boundary(movInst, sizeof(movInst), buf, 32, NULL) == sizeof(inst));
     }
 
     LOG_TRACE("passed");
@@ -832,13 +1792,11 @@ void testAsmCall()
 void testLea()
 {
 
-    BYTE inst[] = {0x48, 0x8D, 0x05, 0xA9, 0xA2, 0x020, 0x40};
-    calcRelativeOffset(inst, sizeof(inst), inst + 1024);
-    uint32_t i = 0;
-    for (; i < sizeof(inst); i++)
-    {
-        printf("0x%x ", inst[i]);
-    }
+    // lea rax, [rip+0x4020a2a9]
+    BYTE inst[] = {0x48, 0x8D, 0x05, 0xA9, 0xA2, 0x20, 0x40};
+    BYTE out[sizeof(inst)] = {0};
+    assert(x86_relocate(inst, sizeof(inst), (uint64_t)inst, (uint64_t)inst + 1024, out, 0, 0, NULL) == sizeof(inst));
+    assert(*(int32_t *)(out + 3) == 0x4020A2A9 - 1024);
 }
 
 void B()
@@ -862,14 +1820,85 @@ void test_call_nearest_func()
     LOG_TRACE("passed");
 }
 
-void test_call_get_jmp32_mem_from_chunk()
+/**
+ * @brief nop4; nop4; lea eax, [rdi+rsi]; ret
+ *  8 bytes are backed up, the jmp back is past the padding of TrampolineBack
+ */
+__asm__(".pushsection .text\n"
+        ".globl back_size_add\n"
+        "back_size_add:\n"
+        ".byte 0x0f, 0x1f, 0x40, 0x00\n"
+        ".byte 0x0f, 0x1f, 0x40, 0x00\n"
+        ".byte 0x8d, 0x04, 0x37\n"
+        ".byte 0xc3\n"
+        ".popsection\n");
+int back_size_add(int a, int b);
+
+__attribute__((noinline)) int back_size_trampoline(int a, int b)
+{
+    return a * b;
+}
+
+__attribute__((noinline)) int hook_back_size(int a, int b)
+{
+    return back_size_trampoline(a, b) + 100;
+}
+
+void test_back_trampoline_size()
+{
+    Trampoline *t = hook(back_size_add, hook_back_size, back_size_trampoline);
+    assert(t && t->back);
+    // the next block does not overlap the jmp back
+    BYTE *jmpEnd = t->back->inst + t->back->restoreInstSize + LONG_JMP_INST_SIZE;
+    BYTE *next = get_neighbor_mem(back_size_trampoline, 24);
+    assert(next >= jmpEnd || next + 24 <= (BYTE *)t->back);
+    memset(next, 0xCC, 24);
+    assert(back_size_add(1, 2) == 103);
+    unhook(t);
+    assert(back_size_add(1, 2) == 3);
+    LOG_TRACE("passed");
+}
+
+/**
+ * @brief lea eax, [rdi+rsi]; nop4; add eax, 1; ret
+ *  the 7 bytes replaced by the jmp cross a page, the code after them is on the next page
+ */
+__asm__(".pushsection .text\n"
+        ".balign 4096\n"
+        ".skip 4090, 0xcc\n"
+        ".globl page_window_trampoline\n"
+        "page_window_trampoline:\n"
+        ".byte 0x8d, 0x04, 0x37\n"
+        ".byte 0x0f, 0x1f, 0x40, 0x00\n"
+        ".byte 0x83, 0xc0, 0x01\n"
+        ".byte 0xc3\n"
+        ".popsection\n");
+int page_window_trampoline(int a, int b);
+
+__attribute__((noinline)) int page_window_src(int a, int b)
+{
+    return a * b;
+}
+
+__attribute__((noinline)) int hook_page_window(int a, int b)
 {
-    assert(value_to_cpu(7) == 8);
-    assert(value_to_cpu(8) == 8);
-    assert(value_to_cpu(9) == 16);
-    assert(value_to_cpu(0) == 0);
+    return page_window_trampoline(a, b) + 100;
+}
 
-    assert(get_neighbor_mem(printf, 12) != NULL);
+void test_jmp_nop_window()
+{
+    BYTE code[11];
+    memcpy(code, page_window_trampoline, sizeof(code));
+    void *t = hook(page_window_src, hook_page_window, page_window_trampoline);
+    assert(t);
+    // the jmp and nops stay in the window
+    assert(memcmp((BYTE *)page_window_trampoline + 7, code + 7, 4) == 0);
+    assert(page_window_src(3, 4) == 112);
+    unhook(t);
+    assert(page_window_src(3, 4) == 12);
+    assert(memcmp(page_window_trampoline, code, sizeof(code)) == 0);
+    assert(page_window_trampoline(3, 4) == 8);
+    LOG_TRACE("passed");
 }
 
 void test_32_range()
@@ -918,6 +1947,253 @@ void test_retStr()
     LOG_TRACE(" hook(HookRetStr,HookRetStr,HookRetStrTrampoline) failed ");
 }
 
+void test_hook_err()
+{
+    HookErr err;
+    assert(hook_e(foo, foo, foo1, &err) == NULL);
+    assert(err.code == HOOK_E_INVALID_INPUT);
+
+    BYTE badInst[9] = {0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF};
+    BYTE retInst[9] = {0x90, 0xC3, 0x90, 0x90, 0x90, 0xCC, 0xCC, 0xCC, 0xCC};
+    BYTE buf[32] = {0};
+    assert(make_space_for_jmp_boundary(badInst, 5, buf, 32, &err) == -1);
+    assert(err.code == HOOK_E_UNKNOWN_INST && err.addr == badInst);
+    assert(make_space_for_jmp_boundary(retInst, 5, buf, 32, &err) == -1);
+    assert(err.code == HOOK_E_TOO_SHORT && err.addr == retInst + 1 && strcmp(err.inst, "RET") == 0);
+
+    // go leaf `addl bx, ax; ret` and int3 padding
+    BYTE leafInst[9] = {0x01, 0xD8, 0xC3, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC};
+    assert(make_space_for_jmp_boundary(leafInst, 5, buf, 32, &err) == 5);
+    assert(memcmp(buf, leafInst, 5) == 0);
+
+    // tail call `jmp fn`, it is relocated as it is
+    BYTE tailInst[9] = {0xE9, 0x10, 0x00, 0x00, 0x00, 0xCC, 0xCC, 0xCC, 0xCC};
+    assert(make_space_for_jmp_boundary(tailInst, 5, buf, 32, &err) == 5);
+    BYTE shortTailInst[9] = {0xEB, 0x10, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC};
+    assert(make_space_for_jmp_boundary(shortTailInst, 5, buf, 32, &err) == 5);
+    // but not a jmp with code behind it
+    BYTE jmpInst[9] = {0xEB, 0x10, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90};
+    assert(make_space_for_jmp_boundary(jmpInst, 5, buf, 32, &err) == -1 && err.code == HOOK_E_TOO_SHORT);
+
+    void *trampoline = hook_e(foo, hook_foo, foo1, &err);
+    assert(trampoline != NULL && err.code == HOOK_E_OK);
+    unhook(trampoline);
+    LOG_TRACE("passed");
+}
+
+void test_go_morestack()
+{
+    BYTE fn[] = {
+        0x49, 0x3B, 0x66, 0x10,       // cmp rsp, [r14+0x10]
+        0x76, 0x06,                   // jbe 12
+        0x55,                         // push rbp
+        0x48, 0x89, 0xE5,             // mov rbp, rsp
+        0x5D,                         // pop rbp
+        0xC3,                         // ret
+        0xE8, 0x00, 0x00, 0x00, 0x00, // 12: call morestack
+        0xEB, 0xED,                   // jmp fn
+    };
+    int32_t checkSize = 0;
+    assert(located_go_morestack(fn, &checkSize) == fn + 12 && checkSize == 6);
+    // a jmp elsewhere is not the morestack block
+    fn[18] = 0xEE;
+    assert(located_go_morestack(fn, NULL) == NULL);
+    assert(located_go_morestack((BYTE *)empty, NULL) == NULL);
+    fn[18] = 0xED;
+
+    // cmp is copied, jbe is widened to the morestack of trampoline_func
+    FromInstBackUp bak = {.instBackupSize = 6, .instBaseAddr = fn};
+    memcpy(bak.instBackUp, fn, 6);
+    BYTE out[64] = {0};
+    BYTE *morestack = out + 100;
+    assert(relocate_backup_inst(out, (uint64_t)out, &bak, fn + 12, morestack, NULL) == 10);
+    assert(memcmp(out, fn, 4) == 0 && out[4] == 0x0F && out[5] == 0x86);
+    assert(*(int32_t *)(out + 6) == morestack - (out + 10));
+
+    // no morestack of trampoline_func, the one of src is kept
+    assert(relocate_backup_inst(out, (uint64_t)out, &bak, fn + 12, NULL, NULL) == 10);
+    assert(out + 10 + *(int32_t *)(out + 6) == fn + 12);
+
+    BYTE big[] = {
+        0x49, 0x89, 0xE4,                         // mov r12, rsp
+        0x49, 0x81, 0xEC, 0xA8, 0x1F, 0x00, 0x00, // sub r12, 0x1fa8
+        0x72, 0x08,                               // jb 20
+        0x4D, 0x3B, 0x66, 0x10,                   // cmp r12, [r14+0x10]
+        0x76, 0x02,                               // jbe 20
+        0x55,                                     // push rbp
+        0xC3,                                     // ret
+        0xE8, 0x00, 0x00, 0x00, 0x00,             // 20: call morestack
+        0xEB, 0xE5,                               // jmp big
+    };
+    assert(located_go_morestack(big, &checkSize) == big + 20 && checkSize == 18);
+    bak.instBackupSize = 18;
+    bak.instBaseAddr = big;
+    memcpy(bak.instBackUp, big, 18);
+    assert(relocate_backup_inst(out, (uint64_t)out, &bak, big + 20, morestack, NULL) == 26);
+    assert(out[10] == 0x0F && out[11] == 0x82 && *(int32_t *)(out + 12) == morestack - (out + 16));
+    assert(out[20] == 0x0F && out[21] == 0x86 && *(int32_t *)(out + 22) == morestack - (out + 26));
+
+    void *targets[4];
+    assert(located_branch_targets(fn, sizeof(fn), 1, targets, 4) == 1 && targets[0] == fn + 17);
+    assert(located_branch_targets(fn, sizeof(fn), 0, targets, 4) == 1 && targets[0] == fn);
+    LOG_TRACE("passed");
+}
+
+void test_grow_code()
+{
+    BYTE block[] = {
+        0x48, 0x89, 0x44, 0x24, 0x08, // mov [rsp+8], rax
+        0xE8, 0x00, 0x00, 0x00, 0x00, // call morestack
+        0x48, 0x8B, 0x44, 0x24, 0x08, // mov rax, [rsp+8]
+        0xEB, 0xEC,                   // jmp fn
+    };
+    assert(write_grow_code(NULL, block, NULL, NULL, NULL) == 20);
+
+    BYTE grow[32], slot[GROW_SLOT_SIZE], slotCode[GROW_SLOT_SIZE];
+    BYTE *entry = grow + 100;
+    assert(write_grow_code(grow, block, slot, entry, slotCode) == 20);
+    // grow: spill; jmp slot
+    assert(memcmp(grow, block, 5) == 0 && grow[5] == 0xE9 && grow + 10 + *(int32_t *)(grow + 6) == slot);
+    // reload; jmp entry
+    assert(memcmp(grow + 10, block + 10, 5) == 0 && grow[15] == 0xE9 && grow + 20 + *(int32_t *)(grow + 16) == entry);
+    // slot: call morestack; jmp reload
+    assert(slotCode[0] == 0xE8 && slot + 5 + *(int32_t *)(slotCode + 1) == block + 10);
+    assert(slotCode[5] == 0xE9 && slot + 10 + *(int32_t *)(slotCode + 6) == grow + 10);
+
+    // a spill out of [rip+x] can not be moved as it is
+    block[2] = 0x05;
+    assert(write_grow_code(NULL, block, NULL, NULL, NULL) == -1);
+    LOG_TRACE("passed");
+}
+
+__attribute__((noinline)) int reloc_trampoline(int x)
+{
+    return x * 3 + 1;
+}
+
+__attribute__((noinline)) int hook_reloc(int x)
+{
+    return reloc_trampoline(x) + 100;
+}
+
+__attribute__((noinline)) int reloc_helper()
+{
+    return 41;
+}
+
+/**
+ * @brief hook functions with a jcc, a rip-relative lea and a call in the patched window
+ */
+void test_hook_relocate()
+{
+    BYTE *code = get_neighbor_mem(reloc_trampoline, 32);
+    assert(code);
+
+    BYTE fn[] = {
+        0x85, 0xFF,                               // test edi, edi
+        0x74, 0x0A,                               // je 14
+        0x48, 0x8D, 0x05, 0x0D, 0x00, 0x00, 0x00, // lea rax, [rip+0xd]: 24
+        0x8B, 0x00,                               // mov eax, [rax]
+        0xC3,                                     // ret
+        0x8D, 0x47, 0x01,                         // 14: lea eax, [rdi+1]
+        0xC3,                                     // ret
+        0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC,       //
+        0x34, 0x12, 0x00, 0x00,                   // 24: .long 0x1234
+    };
+    memcpy(code, fn, sizeof(fn));
+    assert(seal_neighbor_mem(code) == 0);
+    int (*volatile f)(int) = (int (*)(int))code;
+    assert(f(5) == 0x1234 && f(0) == 1);
+
+    HookErr err;
+    void *t = hook_e(code, hook_reloc, reloc_trampoline, &err);
+    assert(t && err.code == HOOK_E_OK);
+    assert(f(5) == 0x1234 + 100 && f(0) == 1 + 100);
+    unhook(t);
+    assert(f(5) == 0x1234 && f(0) == 1);
+
+    // call reloc_helper; add eax, 1; ret. the call returns into the origin function
+    BYTE *call = get_neighbor_mem(reloc_trampoline, 16);
+    assert(call);
+    int32_t rel = (BYTE *)reloc_helper - (call + 5);
+    call[0] = 0xE8;
+    memcpy(call + 1, &rel, sizeof(rel));
+    call[5] = 0x83, call[6] = 0xC0, call[7] = 0x01, call[8] = 0xC3;
+    assert(seal_neighbor_mem(call) == 0);
+    int (*volatile g)(int) = (int (*)(int))call;
+    assert(g(0) == 42);
+    t = hook_e(call, hook_reloc, reloc_trampoline, &err);
+    assert(t && err.code == HOOK_E_OK);
+    assert(g(0) == 42 + 100);
+    unhook(t);
+    assert(g(0) == 42);
+    put_neighbor_mem(call);
+    put_neighbor_mem(code);
+    LOG_TRACE("passed");
+}
+
+static void *origin_of_reloc;
+
+__attribute__((noinline)) int hook_reloc_origin(int x)
+{
+    return ((int (*)(int))origin_of_reloc)(x) + 100;
+}
+
+/**
+ * @brief no trampoline_func, the origin is called by trampoline_origin
+ */
+void test_hook_without_trampoline_func()
+{
+    BYTE *code = get_neighbor_mem(reloc_trampoline, 32);
+    assert(code);
+    // lea eax, [rdi+rdi*1]; nop*3; ret
+    BYTE fn[] = {0x8D, 0x04, 0x3F, 0x90, 0x90, 0x90, 0xC3};
+    memcpy(code, fn, sizeof(fn));
+    assert(seal_neighbor_mem(code) == 0);
+    int (*volatile f)(int) = (int (*)(int))code;
+
+    HookErr err;
+    void *t = hook_e(code, hook_reloc_origin, NULL, &err);
+    assert(t && err.code == HOOK_E_OK);
+    origin_of_reloc = trampoline_origin(t);
+    assert(origin_of_reloc);
+    assert(f(3) == 106);
+    unhook(t);
+    assert(f(3) == 6);
+    LOG_TRACE("passed");
+}
+
+void test_verify_hook()
+{
+    BYTE before[16];
+    memcpy(before, (void *)foo, sizeof(before));
+    HookReport report;
+    assert(verify_hook(foo, hook_foo, foo1, &report) == 0 && report.err.code == HOOK_E_OK);
+    assert(report.srcSize >= JMP_INST_SIZE && report.instCount > 0 && report.inst[0][0] != '\0');
+    assert(report.relocatedSize >= report.srcSize && report.trampolineFuncSize >= JMP_INST_SIZE);
+    assert(memcmp(before, (void *)foo, sizeof(before)) == 0);
+
+    // the go stack check is taken as a whole
+    BYTE fn[] = {
+        0x49, 0x3B, 0x66, 0x10,       // cmp rsp, [r14+0x10]
+        0x76, 0x06,                   // jbe 12
+        0x55,                         // push rbp
+        0x48, 0x89, 0xE5,             // mov rbp, rsp
+        0x5D,                         // pop rbp
+        0xC3,                         // ret
+        0xE8, 0x00, 0x00, 0x00, 0x00, // 12: call morestack
+        0xEB, 0xED,                   // jmp fn
+    };
+    assert(verify_hook(fn, hook_foo, NULL, &report) == 0);
+    assert(report.stackCheck && report.srcSize == 6 && report.instCount == 2 && report.relocatedSize == 10);
+
+    BYTE retInst[9] = {0x90, 0xC3, 0x90, 0x90, 0x90, 0xCC, 0xCC, 0xCC, 0xCC};
+    assert(verify_hook(retInst, hook_foo, foo1, &report) == -1);
+    assert(report.err.code == HOOK_E_TOO_SHORT && report.err.addr == retInst + 1);
+    assert(verify_hook(foo, foo, NULL, &report) == -1 && report.err.code == HOOK_E_INVALID_INPUT);
+    LOG_TRACE("passed");
+}
+
 void test_invalid_hook()
 {
     hook(retStr, NULL, NULL);
@@ -934,12 +2210,6 @@ void test_located_nearest_jmp_target()
     LOG_TRACE("%p", land);
 }
 
-void test_try_get_page_from_addr_hi()
-{
-    void *hi = &test_located_nearest_jmp_target;
-    assert(try_get_page_from_addr_hi(hi - getpagesize() * 128, hi));
-}
-
 int main()
 {
     printf("-------test_make_space---------------------------- \n");
@@ -948,12 +2218,34 @@ int main()
     test_hook();
     printf("-------test_hook---------------------------- \n");
     test_hook();
+    printf("-------test_hook_err---------------------------- \n");
+    test_hook_err();
+    printf("-------test_go_morestack---------------------------- \n");
+    test_go_morestack();
+    printf("-------test_grow_code------------------------------- \n");
+    test_grow_code();
+    printf("-------test_hook_relocate---------------------------- \n");
+    test_hook_relocate();
+    printf("-------test_hook_without_trampoline_func---------------------------- \n");
+    test_hook_without_trampoline_func();
+    printf("-------test_verify_hook---------------------------- \n");
+    test_verify_hook();
+    printf("-------test_release_trampoline---------------------------- \n");
+    test_release_trampoline();
+    printf("-------test_patch_code_concurrent---------------------------- \n");
+    test_patch_code_concurrent();
+    printf("-------test_patch_code_inner---------------------------- \n");
+    test_patch_code_inner();
+    printf("-------test_hook_concurrent---------------------------- \n");
+    test_hook_concurrent();
     printf("-------testAsmCall---------------------------- \n");
     testAsmCall();
     printf("-------test_call_nearest_func----------------------------\n");
     test_call_nearest_func();
-    printf("-------test_call_get_jmp32_mem_from_chunk----------------------------\n");
-    test_call_get_jmp32_mem_from_chunk();
+    printf("-------test_back_trampoline_size----------------------------\n");
+    test_back_trampoline_size();
+    printf("-------test_jmp_nop_window----------------------------\n");
+    test_jmp_nop_window();
     printf("-------test_32_range----------------------------\n");
     test_32_range();
     printf("-------test_retStr----------------------------\n");
@@ -964,8 +2256,6 @@ int main()
     testLea();
     printf("-------test_located_nearest_jmp_target----------------------------\n");
     test_located_nearest_jmp_target();
-    printf("-------test_try_get_page_from_addr_hi----------------------------\n");
-    test_try_get_page_from_addr_hi();
     return 0;
 }
 
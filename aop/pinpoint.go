@@ -17,27 +17,16 @@
 package aop
 
 import (
-	"errors"
 	"reflect"
 	"unsafe"
 
 	"github.com/pinpoint-apm/go-aop-agent/common"
 )
 
-// #cgo CFLAGS: -DNTEST -DTRACE
-// #include "pinpoint.h"
-import "C"
-
-var trampolineMap map[uintptr]unsafe.Pointer
-
-func init() {
-	trampolineMap = make(map[uintptr]unsafe.Pointer)
-}
-
 func AddHookP_CALL(iSrc, iTarget, iTrampoline_func interface{}) error {
 
 	if common.AgentIsDisabled() {
-		return errors.New("agent disabled")
+		return disabledError("AddHookP_CALL", iSrc)
 	}
 
 	src := reflect.ValueOf(iSrc)
@@ -45,40 +34,22 @@ func AddHookP_CALL(iSrc, iTarget, iTrampoline_func interface{}) error {
 	trampoline_func := reflect.ValueOf(iTrampoline_func)
 
 	// bug: check the signature of all functions
-	if src.Kind() != reflect.Func {
-		return errors.New("src is not function")
-	} else if target.Kind() != reflect.Func {
-		return errors.New("target is not function")
-	} else if trampoline_func.Kind() != reflect.Func {
-		return errors.New("trampoline_func is not function")
+	if err := checkFuncs("AddHookP_CALL", src, target, trampoline_func); err != nil {
+		return err
 	}
 
-	if src.Type() != target.Type() || target.Type() != trampoline_func.Type() {
-		return errors.New("src, target,trampoline_func signature must be the same")
+	// go1.17+ puts calls of morestack and panics into the function too, they are skipped
+	newSrc := resolveBranch(src.Pointer(), true)
+	if newSrc == 0 {
+		return newHookError("AddHookP_CALL", src.Pointer(), ErrTargetNotFound)
 	}
 
-	newSrcPointer := C.located_nearest_call_target(unsafe.Pointer(src.Pointer()))
-	if newSrcPointer == nil {
-		return errors.New("located nearest target failed")
-	}
-
-	if _, ok := trampolineMap[uintptr(newSrcPointer)]; ok {
-		return errors.New("src exist")
-	}
-
-	trampoline := C.hook(newSrcPointer, unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()))
-	if trampoline == nil {
-		return errors.New("hook failed, check the output under \"-DDEBUG\" ")
-	} else {
-		// store into trampoline map
-		trampolineMap[uintptr(newSrcPointer)] = trampoline
-		return nil
-	}
+	return installHook("AddHookP_CALL", codePointer(newSrc), unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()), src.Pointer(), HookPCall)
 }
 
 func AddHookP_JMP(iSrc, iTarget, iTrampoline_func interface{}) error {
 	if common.AgentIsDisabled() {
-		return errors.New("agent disabled")
+		return disabledError("AddHookP_JMP", iSrc)
 	}
 
 	src := reflect.ValueOf(iSrc)
@@ -86,23 +57,12 @@ func AddHookP_JMP(iSrc, iTarget, iTrampoline_func interface{}) error {
 	trampoline_func := reflect.ValueOf(iTrampoline_func)
 	// skip Kind checking
 
-	newSrcPointer := C.located_nearest_jmp_target(unsafe.Pointer(src.Pointer()))
-	if newSrcPointer == nil {
-		return errors.New("located nearest target failed")
+	newSrc := resolveBranch(src.Pointer(), false)
+	if newSrc == 0 {
+		return newHookError("AddHookP_JMP", src.Pointer(), ErrTargetNotFound)
 	}
 
-	if _, ok := trampolineMap[uintptr(newSrcPointer)]; ok {
-		return errors.New("src exist")
-	}
-
-	trampoline := C.hook(newSrcPointer, unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()))
-	if trampoline == nil {
-		return errors.New("hook failed, check the output under \"-DDEBUG\" ")
-	} else {
-		// store into trampoline map
-		trampolineMap[uintptr(newSrcPointer)] = trampoline
-		return nil
-	}
+	return installHook("AddHookP_JMP", codePointer(newSrc), unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()), src.Pointer(), HookPJmp)
 }
 
 /**
@@ -117,51 +77,178 @@ func AddHookP_JMP(iSrc, iTarget, iTrampoline_func interface{}) error {
 func AddHook(iSrc, iTarget, iTrampoline_func interface{}) error {
 
 	if common.AgentIsDisabled() {
-		return errors.New("agent disabled")
+		return disabledError("AddHook", iSrc)
 	}
 
 	src := reflect.ValueOf(iSrc)
 	target := reflect.ValueOf(iTarget)
 	trampoline_func := reflect.ValueOf(iTrampoline_func)
 
+	if err := checkFuncs("AddHook", src, target, trampoline_func); err != nil {
+		return err
+	}
+
+	return installHook("AddHook", codePointer(resolveABIWrapper(src.Pointer())), unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()), src.Pointer(), HookDirect)
+}
+
+/**
+ * @description: Bind `iTarget` and `iTrampoline_func` on the function named `name` in the running binary
+ * 1. name is the symbol as runtime.FuncForPC reports it, such as
+ *    `github.com/go-sql-driver/mysql.(*mysqlConn).Query`. unexported functions and methods are fine.
+ * 2. iTarget and iTrampoline_func take the receiver as the first parameter. A type
+ *    not importable is passed as unsafe.Pointer, other parameters keep their types.
+ * 3. The argument frame of `name` must be the one of iTarget, it is all the runtime knows of `name`.
+ * @param {string} name
+ * @param {*} iTarget
+ * @param {interface{}} iTrampoline_func
+ * @return {*}
+ */
+func AddHookByName(name string, iTarget, iTrampoline_func interface{}) error {
+	if common.AgentIsDisabled() {
+		return &HookError{Op: "AddHookByName", Func: name, Err: ErrAgentDisabled}
+	}
+
+	target := reflect.ValueOf(iTarget)
+	trampoline_func := reflect.ValueOf(iTrampoline_func)
+	if target.Kind() != reflect.Func {
+		return &HookError{Op: "AddHookByName", Func: "target", Err: ErrNotFunction}
+	} else if trampoline_func.Kind() != reflect.Func {
+		return &HookError{Op: "AddHookByName", Func: "trampoline_func", Err: ErrNotFunction}
+	}
+
+	src := lookupSymbol(name)
+	if src == 0 {
+		return &HookError{Op: "AddHookByName", Func: name, Err: ErrSymbolNotFound}
+	}
+	src = resolveABIWrapper(src)
+
+	if target.Type() != trampoline_func.Type() || !sameArgSize(src, target.Pointer()) {
+		return newHookError("AddHookByName", src, ErrSignatureMismatch)
+	}
+
+	return installHook("AddHookByName", codePointer(src), unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()), src, HookByName)
+}
+
+/**
+ * @description: Bind `iTarget` and `iTrampoline_func` on the body of an instantiated generic function
+ * 1. iSrc is an instantiation, such as `Max[int]` or `(*List[string]).Push`.
+ * 2. The body is shared by every instantiation of the same GC shape (`Max[int]` and
+ *    `Max[MyInt]`), so all of them are hooked.
+ * 3. iTarget and iTrampoline_func take the dictionary as an extra first parameter:
+ *    func(dict uintptr, x int, y int) int for Max[int]. The dictionary tells the instantiations apart.
+ * @param {*} iSrc
+ * @param {*} iTarget
+ * @param {interface{}} iTrampoline_func
+ * @return {*}
+ */
+func AddHookGeneric(iSrc, iTarget, iTrampoline_func interface{}) error {
+	if common.AgentIsDisabled() {
+		return disabledError("AddHookGeneric", iSrc)
+	}
+
+	src := reflect.ValueOf(iSrc)
+	target := reflect.ValueOf(iTarget)
+	trampoline_func := reflect.ValueOf(iTrampoline_func)
+
+	if err := checkShapeFuncs("AddHookGeneric", src, target, trampoline_func); err != nil {
+		return err
+	}
+
+	shape := resolveShape(src.Pointer())
+	if shape == 0 {
+		return newHookError("AddHookGeneric", src.Pointer(), ErrTargetNotFound)
+	}
+
+	return installHook("AddHookGeneric", codePointer(shape), unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()), src.Pointer(), HookGeneric)
+}
+
+/**
+ * @description: target and trampoline_func must be `src` with a leading dictionary, types of
+ *  the rest are compared by kind and size, a shape body does not know the named types
+ * @param {string} op
+ * @param {*} src
+ * @param {*} target
+ * @param {reflect.Value} trampoline_func
+ * @return {*}
+ */
+func checkShapeFuncs(op string, src, target, trampoline_func reflect.Value) error {
 	if src.Kind() != reflect.Func {
-		return errors.New("src is not function")
+		return &HookError{Op: op, Func: "src", Err: ErrNotFunction}
 	} else if target.Kind() != reflect.Func {
-		return errors.New("target is not function")
+		return &HookError{Op: op, Func: "target", Err: ErrNotFunction}
 	} else if trampoline_func.Kind() != reflect.Func {
-		return errors.New("trampoline_func is not function")
+		return &HookError{Op: op, Func: "trampoline_func", Err: ErrNotFunction}
 	}
 
-	if _, ok := trampolineMap[src.Pointer()]; ok {
-		return errors.New("src exist")
+	srcType, hookType := src.Type(), target.Type()
+	if hookType != trampoline_func.Type() || hookType.NumIn() != srcType.NumIn()+1 || hookType.NumOut() != srcType.NumOut() {
+		return newHookError(op, src.Pointer(), ErrSignatureMismatch)
+	}
+	if dict := hookType.In(0).Kind(); dict != reflect.Uintptr && dict != reflect.UnsafePointer {
+		return newHookError(op, src.Pointer(), ErrSignatureMismatch)
 	}
 
-	if src.Type() == target.Type() && target.Type() == trampoline_func.Type() {
-
-		trampoline := C.hook(unsafe.Pointer(src.Pointer()), unsafe.Pointer(target.Pointer()), unsafe.Pointer(trampoline_func.Pointer()))
-		if trampoline == nil {
-			return errors.New("hook failed, check the output under \"-DDEBUG\" ")
-		} else {
-			// store into trampoline map
-			trampolineMap[src.Pointer()] = trampoline
-			return nil
+	sameShape := func(a, b reflect.Type) bool {
+		return a.Kind() == b.Kind() && a.Size() == b.Size()
+	}
+	for i := 0; i < srcType.NumIn(); i++ {
+		if !sameShape(srcType.In(i), hookType.In(i+1)) {
+			return newHookError(op, src.Pointer(), ErrSignatureMismatch)
+		}
+	}
+	for i := 0; i < srcType.NumOut(); i++ {
+		if !sameShape(srcType.Out(i), hookType.Out(i)) {
+			return newHookError(op, src.Pointer(), ErrSignatureMismatch)
 		}
-	} else {
-		return errors.New("src, target,trampoline_func signature must be the same")
 	}
+	return nil
+}
+
+/**
+ * @description: src, target and trampoline_func must be functions with the same signature
+ * @param {string} op
+ * @param {*} src
+ * @param {*} target
+ * @param {reflect.Value} trampoline_func
+ * @return {*}
+ */
+func checkFuncs(op string, src, target, trampoline_func reflect.Value) error {
+	if src.Kind() != reflect.Func {
+		return &HookError{Op: op, Func: "src", Err: ErrNotFunction}
+	} else if target.Kind() != reflect.Func {
+		return &HookError{Op: op, Func: "target", Err: ErrNotFunction}
+	} else if trampoline_func.Kind() != reflect.Func {
+		return &HookError{Op: op, Func: "trampoline_func", Err: ErrNotFunction}
+	}
+
+	if src.Type() != target.Type() || target.Type() != trampoline_func.Type() {
+		return newHookError(op, src.Pointer(), ErrSignatureMismatch)
+	}
+	return nil
 }
 
 /**
  * @description: remove the hook on `iSrc`
- * 1. DO NOT CALL this function when function is called by other goroutines
- * 2. The memory will not free until the program exit
+ * 1. DO NOT CALL this function when function is called by other goroutines,
+ *    use UnHookWait instead
+ * 2. The trampoline memory is left, a goroutine still in the hook may run it. It is never
+ *    reused, only UnHookWait gives it back
+ * 3. AddHook/UnHook are safe to call from different goroutines
  * @param {interface{}} iSrc
  * @return {*}
  */
 func UnHook(iSrc interface{}) {
 	src := reflect.ValueOf(iSrc)
-	if trampoline, ok := trampolineMap[src.Pointer()]; ok {
-		C.unhook(trampoline)
-		delete(trampolineMap, src.Pointer())
+	removeHook(src.Pointer())
+}
+
+/**
+ * @description: remove the hook added by AddHookByName or AddHookLiteral, the same as UnHook
+ * @param {string} name
+ * @return {*}
+ */
+func UnHookByName(name string) {
+	if src := lookupSymbol(name); src != 0 {
+		removeHook(resolveABIWrapper(src))
 	}
 }
@@ -24,6 +24,7 @@
 #include <errno.h>
 #include <stdlib.h>
 #include <assert.h>
+#include <pthread.h>
 
 #ifdef TRACE
 
@@ -41,6 +42,37 @@
 typedef unsigned char BYTE;
 #endif
 
+// memory from get_neighbor_mem is in [where - NEAR_RANGE, where + NEAR_RANGE)
+#if defined(__aarch64__)
+// B imm26 reaches +/-128MB
+#define NEAR_RANGE 0x7f00000L
+#define NEAR_HALF 0x4000000L
+#else
+// jmp rel32 reaches +/-2GB
+#define NEAR_RANGE 0x7ff80000L
+#define NEAR_HALF 0x40000000L
+#endif
+
+#if defined(__aarch64__)
+
+typedef struct trampoline_forward_s{
+    uint32_t inst[2];  // ldr x17, #8; br x17
+    long toAddress;
+}TrampolineForward;
+
+typedef struct trampoline_back_s{
+    long toAddress;
+    int32_t restoreInstSize;
+    uint32_t inst[0]; // include relocated inst and jmp inst
+}TrampolineBack;
+
+#define BACKUP_INST_SIZE 32
+#define JMP_INST_SIZE 4
+
+#else
+
+#define BACKUP_INST_SIZE 32
+
 typedef struct trampoline_forward_s{
     long toAddress;
     BYTE inst[6];   // indirectly jmp：0xFF 0x25
@@ -49,14 +81,17 @@ typedef struct trampoline_forward_s{
 typedef struct trampoline_back_s{
     long toAddress;
     int32_t restoreInstSize;
+    // offset in inst of the backup inst at each offset of src, -1: no inst starts there
+    int16_t instOff[BACKUP_INST_SIZE];
     BYTE inst[0]; // include restore inst and jmp inst
 }TrampolineBack;
 
-#define BACKUP_INST_SIZE 32
 #define JMP_INST_SIZE 5
 #define LONG_JMP_INST_SIZE 6
 #define CALL_INST_SIZE 5
 
+#endif
+
 typedef struct {
     BYTE instBackUp[BACKUP_INST_SIZE];
     uint8_t instBackupSize;
@@ -78,6 +113,8 @@ typedef struct {
     void* pTrampFunc;
     BYTE bakInstAr[BACKUP_INST_SIZE];
     uint8_t bakInstArLen;
+    // no pTrampFunc: runtime.morestack is called from this slot of the grow pad, NULL: src checks no stack
+    void* growSlot;
 }TrampolineFuncT;
 
 typedef struct trampoline_s{
@@ -91,12 +128,120 @@ typedef struct trampoline_s{
 
     // store the src address for restore
     void* target;
+    // address of the hook function
+    void* to;
     TrampolineFuncT trampolineFunc;
     TrampolineForward* forward;
     TrampolineBack* back;
 }Trampoline;
 
+typedef enum {
+    HOOK_E_OK = 0,
+    HOOK_E_INVALID_INPUT,   // from/to/trampolineFunc overlap
+    HOOK_E_NO_MEM,          // malloc failed
+    HOOK_E_UNKNOWN_INST,    // decoder does not know the inst
+    HOOK_E_TOO_SHORT,       // function ends before the jmp fits
+    HOOK_E_RELOCATE,        // inst can not be moved into the back trampoline
+    HOOK_E_NO_NEAR_MEM,     // no free page in +/-2GB
+    HOOK_E_MPROTECT,        // mprotect failed
+}HOOK_ERR_CODE;
+
+#define HOOK_ERR_INST_SIZE 64
+
+// call morestack; jmp reload, see set_grow_pad
+#define GROW_SLOT_SIZE 16
+#define GROW_SLOT_MAX 256
+
+typedef struct {
+    HOOK_ERR_CODE code;
+    // address where the error met
+    void* addr;
+    // decoded inst blocked the patch, empty if no such inst
+    char inst[HOOK_ERR_INST_SIZE];
+}HookErr;
+
+#define HOOK_REPORT_MAX_INST 8
+
+// what hook_e would do, made without touching any memory
+typedef struct {
+    HookErr err;            // HOOK_E_OK: hook_e would patch
+    int32_t srcSize;        // bytes replaced by the jmp at src
+    int32_t instCount;      // inst in the replaced bytes, at most HOOK_REPORT_MAX_INST listed
+    char inst[HOOK_REPORT_MAX_INST][HOOK_ERR_INST_SIZE];
+    int32_t relocatedSize;  // bytes the replaced inst take in `back`
+    int32_t stackCheck;     // the go stack check of src is in the replaced bytes
+    int32_t forward;        // `to` is out of the direct jmp, a forward trampoline is needed
+    int32_t trampolineFuncSize; // bytes replaced at trampolineFunc
+}HookReport;
+
+// a page of the near allocator
+typedef struct {
+    void* page;
+    int32_t size;
+    int32_t blocks;      // sealed blocks, code runs there
+    int32_t writing;     // blocks handed out and not sealed yet
+    int32_t usedBytes;
+    int32_t freeBlocks;  // ranges on the free list
+    int32_t largestFree;
+    int32_t prot;        // PROT_* of the page now
+}NearPageStat;
+
+typedef struct {
+    uint64_t mapped;     // pages mapped since start
+    uint64_t unmapped;   // pages given back to the OS
+}NearMemCounters;
+
+// near allocator in nearmem.c: a block is writable till sealed, then read and exec only
+void*   get_neighbor_mem(void* where,int size);
+int32_t seal_neighbor_mem(void* mem);
+void    put_neighbor_mem(void* mem);
+int32_t get_near_mem_stats(NearPageStat* pages,int32_t max,NearMemCounters* counters);
+void* get_page_boundary(void* ptr);
+int   set_mm_area_opt(void* ptr,int size,int prot);
+
+// shared by the arch backends
+void  set_hook_err(HookErr* err,HOOK_ERR_CODE code,void* addr,const char* inst);
+// called with hook_lock_g held. NULL: no pad or every slot is taken
+void* get_grow_slot(void);
+void  put_grow_slot(void* slot);
+void  restore_trampoline_func_inst(Trampoline* trampoline);
+
+static inline void flush_inst_cache(void* ptr,int size)
+{
+    __builtin___clear_cache((char*)ptr,(char*)ptr+size);
+}
+
+// implemented by the arch backend: x86-64 in pinpoint.c, aarch64 in pinpoint_arm64.c
+// called with hook_lock_g held
+void*   hook_locked(void* from,void* to,void* callFrom,HookErr* err);
+int32_t place_src_jmp(Trampoline* trampoline);
+// write `size` bytes of `code` over live code at `addr`, safe against threads running it.
+// a thread reaching `addr` while it is written goes on at `resume`, which does the same as `code`.
+// inner[i] is where a thread at the old inst starting at addr+i goes on, NULL if no inst starts there.
+// inner is NULL if no thread ever stops inside the old code: its first inst covers `size` or never falls through
+int32_t patch_code(void* addr,const void* code,int32_t size,void* resume,void* const* inner);
+void    verify_hook_locked(void* from,void* to,void* callFrom,HookReport* report);
+
 void* hook(void* from,void* to,void* trampolineFunc);
+// trampolineFunc could be NULL, call the origin function by trampoline_origin then
+void* hook_e(void* from,void* to,void* trampolineFunc,HookErr* err);
+void* trampoline_origin(void* trampoline);
+// dry run of hook_e, decode and relocate as it does, write nothing. -1: hook_e would fail
+int32_t verify_hook(void* from,void* to,void* callFrom,HookReport* report);
+// code jumping to `code` with the closure context register set to `closure`,
+// a go pointer passed as an integer, go keeps it alive.
+// ctxArg >= 0: the context the stub is entered with is moved to the ctxArg-th integer argument register
+void* make_closure_stub(uintptr_t closure,void* code,int32_t ctxArg);
+// code jumping to `code` with the closure context register loaded from the second word of the func value
+void* make_context_stub(void* code);
+void  free_closure_stub(void* stub);
 void* located_nearest_call_target(void*start);
 void* located_nearest_jmp_target(void*start);
-void  unhook(void* ptr);
\ No newline at end of file
+int32_t located_branch_targets(void* start,int32_t size,int32_t call,void** targets,int32_t max);
+void  unhook(void* ptr);
+void  unhook_src(void* ptr);
+void  rehook_src(void* ptr);
+void  release_trampoline(void* ptr);
+// go text with no frame, never called, cut into GROW_SLOT_SIZE slots. A hook without trampoline_func
+// calls runtime.morestack from a slot, its return address must be go text or the stack copy throws
+void  set_grow_pad(void* pad,int32_t size);
\ No newline at end of file
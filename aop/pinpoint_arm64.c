@@ -0,0 +1,488 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * aarch64 backend of the hook engine.
+ * Every inst is 4 bytes and a `b` reaches +/-128MB, so only the first inst of
+ * src and trampoline_func is replaced:
+ *
+ *  src:              b to | b forward
+ *  forward:          ldr x17, #8; br x17; .quad to
+ *  trampoline_func:  b back
+ *  back:             relocated first inst of src; b src+4 | ldr x17, #8; br x17; .quad src+4
+ *
+ * x17(IP1) is free to clobber at a function entry by AAPCS64, go never keeps a live value in it
+ */
+#if defined(__aarch64__)
+#include "pinpoint.h"
+#include "arm64.h"
+
+/**
+ * @brief write `n` words of code to `dst`, flush the inst cache
+ * @param dst
+ * @param words
+ * @param n
+ * @return int32_t -1: mprotect failed
+ */
+static int32_t place_code(void *dst, const uint32_t *words, int32_t n)
+{
+    int32_t size = n * ARM64_INST_SIZE;
+    if (set_mm_area_opt(dst, size, PROT_READ | PROT_WRITE | PROT_EXEC) != 0)
+    {
+        return -1;
+    }
+    // a single inst is aligned, the store is atomic to other cores
+    if (n == 1)
+    {
+        __atomic_store_n((uint32_t *)dst, words[0], __ATOMIC_SEQ_CST);
+    }
+    else
+    {
+        memcpy(dst, words, size);
+    }
+    flush_inst_cache(dst, size);
+    set_mm_area_opt(dst, size, PROT_READ | PROT_EXEC);
+    return 0;
+}
+
+// a single inst is written by one store, a thread runs either the old or the new one
+int32_t patch_code(void *addr, const void *code, int32_t size, void *resume, void *const *inner)
+{
+    (void)resume;
+    (void)inner;
+    uint32_t words[BACKUP_INST_SIZE / ARM64_INST_SIZE];
+    assert(size % ARM64_INST_SIZE == 0 && size <= BACKUP_INST_SIZE);
+    memcpy(words, code, size);
+    return place_code(addr, words, size / ARM64_INST_SIZE);
+}
+
+static int32_t place_b_inst(void *src, void *target)
+{
+    uint32_t inst = arm64_b((uint64_t)src, (uint64_t)target);
+    LOG_TRACE("src:%p b %p (%08X)", src, target, inst);
+    return place_code(src, &inst, 1);
+}
+
+TrampolineBack *insert_back_trampoline(TrampolineFuncT *trampolineFunc, FromInstBackUp *bakInst, HookErr *err)
+{
+    BYTE *src = bakInst->instBaseAddr;
+    void *origin_func = src + ARM64_INST_SIZE;
+    LOG_TRACE("trampoline_func:%p origin_func:%p", trampolineFunc->pTrampFunc, origin_func);
+
+    int32_t size = sizeof(TrampolineBack) + (ARM64_MAX_RELOC_WORDS + ARM64_ABS_JMP_WORDS) * ARM64_INST_SIZE;
+    // without trampoline_func, `back` is called directly, keep it near src
+    void *near = trampolineFunc->pTrampFunc != NULL ? trampolineFunc->pTrampFunc : (void *)src;
+    TrampolineBack *back = (TrampolineBack *)get_neighbor_mem(near, size);
+    if (back == NULL)
+    {
+        LOG_ETRACE("no free memory near %p", near);
+        set_hook_err(err, HOOK_E_NO_NEAR_MEM, near, NULL);
+        return NULL;
+    }
+    back->toAddress = (long)origin_func;
+
+    uint32_t code[ARM64_MAX_RELOC_WORDS + ARM64_ABS_JMP_WORDS];
+    uint32_t inst = *(uint32_t *)bakInst->instBackUp;
+    int32_t n = arm64_relocate_inst(inst, (uint64_t)src, (uint64_t)back->inst, code);
+    if (n == -1)
+    {
+        char str[HOOK_ERR_INST_SIZE];
+        arm64_inst_str(inst, str, sizeof(str));
+        LOG_ETRACE("can not relocate %s at %p", str, src);
+        set_hook_err(err, HOOK_E_RELOCATE, src, str);
+        put_neighbor_mem(back);
+        return NULL;
+    }
+    back->restoreInstSize = n * ARM64_INST_SIZE;
+
+    // jmp back to origin function
+    uint64_t jmpPc = (uint64_t)(back->inst + n);
+    if (arm64_b_in_range(jmpPc, (uint64_t)origin_func))
+    {
+        code[n++] = arm64_b(jmpPc, (uint64_t)origin_func);
+    }
+    else
+    {
+        n += arm64_place_abs_jmp(code + n, (uint64_t)origin_func);
+    }
+
+    // trampoline_func is patched at last, nothing to rollback on it
+    memcpy(back->inst, code, n * ARM64_INST_SIZE);
+    if (seal_neighbor_mem(back) == -1 ||
+        (trampolineFunc->pTrampFunc != NULL && place_b_inst(trampolineFunc->pTrampFunc, back->inst) == -1))
+    {
+        set_hook_err(err, HOOK_E_MPROTECT, trampolineFunc->pTrampFunc, NULL);
+        put_neighbor_mem(back);
+        return NULL;
+    }
+    return back;
+}
+
+/**
+ * @brief b from `from` to `to`, through a forward trampoline if `to` is out of +/-128MB
+ * @param from
+ * @param to
+ * @param err code is set if failed
+ * @return TrampolineForward* NULL: directly b is enough, or failed
+ */
+TrampolineForward *insert_forward_trampoline(void *from, void *to, HookErr *err)
+{
+    if (arm64_b_in_range((uint64_t)from, (uint64_t)to))
+    {
+        if (place_b_inst(from, to) == -1)
+        {
+            set_hook_err(err, HOOK_E_MPROTECT, from, NULL);
+        }
+        return NULL;
+    }
+
+    TrampolineForward *forward = (TrampolineForward *)get_neighbor_mem(from, sizeof(TrampolineForward));
+    if (forward == NULL)
+    {
+        LOG_ETRACE("no free memory near %p", from);
+        set_hook_err(err, HOOK_E_NO_NEAR_MEM, from, NULL);
+        return NULL;
+    }
+
+    uint32_t code[ARM64_ABS_JMP_WORDS];
+    // inst + toAddress is exactly `ldr x17, #8; br x17; .quad to`
+    arm64_place_abs_jmp(code, (uint64_t)to);
+    memcpy(forward, code, sizeof(code));
+    if (seal_neighbor_mem(forward) == -1 || place_b_inst(from, forward->inst) == -1)
+    {
+        set_hook_err(err, HOOK_E_MPROTECT, from, NULL);
+        put_neighbor_mem(forward);
+        return NULL;
+    }
+    return forward;
+}
+
+void *hook_locked(void *from, void *to, void *callFrom, HookErr *err)
+{
+    Trampoline *trampoline = (Trampoline *)malloc(sizeof(Trampoline));
+    if (trampoline == NULL)
+    {
+        LOG_ETRACE("malloc %ld failed", sizeof(Trampoline));
+        set_hook_err(err, HOOK_E_NO_MEM, from, NULL);
+        return NULL;
+    }
+
+    memcpy(trampoline->fromInstBackUp.instBackUp, from, ARM64_INST_SIZE);
+    trampoline->fromInstBackUp.instBackupSize = ARM64_INST_SIZE;
+    trampoline->fromInstBackUp.instBaseAddr = from;
+    trampoline->target = from;
+    trampoline->to = to;
+
+    trampoline->trampolineFunc.bakInstArLen = 0;
+    trampoline->trampolineFunc.pTrampFunc = callFrom;
+    // the stack check is not relocated on arm64
+    trampoline->trampolineFunc.growSlot = NULL;
+    if (callFrom != NULL)
+    {
+        memcpy(trampoline->trampolineFunc.bakInstAr, callFrom, ARM64_INST_SIZE);
+        trampoline->trampolineFunc.bakInstArLen = ARM64_INST_SIZE;
+    }
+
+    // 1. insert `back` trampoline, `from` is untouched if it failed
+    TrampolineBack *back = insert_back_trampoline(&trampoline->trampolineFunc, &trampoline->fromInstBackUp, err);
+    if (back == NULL)
+    {
+        LOG_ETRACE("hook: from:%p to:%p trampoline:%p failed", from, to, callFrom);
+        free(trampoline);
+        return NULL;
+    }
+    trampoline->back = back;
+
+    // 2. insert `forward` trampoline
+    trampoline->forward = insert_forward_trampoline(from, to, err);
+    if (err->code != HOOK_E_OK)
+    {
+        LOG_ETRACE("hook: from:%p to:%p trampoline:%p failed", from, to, callFrom);
+        restore_trampoline_func_inst(trampoline);
+        put_neighbor_mem(back);
+        free(trampoline);
+        return NULL;
+    }
+    LOG_TRACE("forward trampoline:%p from:%p to:%p back:%p", trampoline->forward, from, to, back);
+
+    return trampoline;
+}
+
+int32_t place_src_jmp(Trampoline *trampoline)
+{
+    void *to = trampoline->forward ? (void *)trampoline->forward->inst : trampoline->to;
+    return place_b_inst(trampoline->target, to);
+}
+
+/**
+ * @brief hook_locked without writing: relocate the first inst of src as if `back` were placed by trampoline_func
+ * @param from
+ * @param to
+ * @param callFrom
+ * @param report
+ */
+void verify_hook_locked(void *from, void *to, void *callFrom, HookReport *report)
+{
+    uint32_t inst = *(uint32_t *)from;
+    report->srcSize = ARM64_INST_SIZE;
+    report->instCount = 1;
+    arm64_inst_str(inst, report->inst[0], HOOK_ERR_INST_SIZE);
+    report->trampolineFuncSize = callFrom != NULL ? ARM64_INST_SIZE : 0;
+
+    uint32_t code[ARM64_MAX_RELOC_WORDS];
+    void *near = callFrom != NULL ? callFrom : from;
+    int32_t n = arm64_relocate_inst(inst, (uint64_t)from, (uint64_t)near, code);
+    if (n == -1)
+    {
+        set_hook_err(&report->err, HOOK_E_RELOCATE, from, report->inst[0]);
+        return;
+    }
+    report->relocatedSize = n * ARM64_INST_SIZE;
+    report->forward = !arm64_b_in_range((uint64_t)from, (uint64_t)to);
+}
+
+// mov xN, x26; ldr x26, #12; ldr x17, #16; br x17; .quad closure; .quad code
+#define CLOSURE_STUB_WORDS 8
+// ldr x26, [x26, #8]; ldr x17, #8; br x17; .quad code
+#define CONTEXT_STUB_WORDS 5
+// go passes the closure context in x26
+#define X26 26
+// integer arguments of ABIInternal: x0-x15
+#define INT_ARG_REGS 16
+
+void *make_closure_stub(uintptr_t closure, void *code, int32_t ctxArg)
+{
+    if (ctxArg >= INT_ARG_REGS)
+    {
+        return NULL;
+    }
+    uint32_t *stub = get_neighbor_mem(code, CLOSURE_STUB_WORDS * ARM64_INST_SIZE);
+    if (stub == NULL)
+    {
+        return NULL;
+    }
+
+    uint32_t words[CLOSURE_STUB_WORDS] = {
+        // orr xN, xzr, x26; a nop if the context stays
+        ctxArg >= 0 ? 0xAA0003E0 | (X26 << 16) | (uint32_t)ctxArg : ARM64_NOP,
+        arm64_ldr_lit(X26, 12),
+        arm64_ldr_lit(17, 16),
+        ARM64_BR_X17,
+    };
+    memcpy(words + 4, &closure, sizeof(closure));
+    memcpy(words + 6, &code, sizeof(code));
+    memcpy(stub, words, sizeof(words));
+    if (seal_neighbor_mem(stub) == -1)
+    {
+        put_neighbor_mem(stub);
+        return NULL;
+    }
+    return stub;
+}
+
+void *make_context_stub(void *code)
+{
+    uint32_t *stub = get_neighbor_mem(code, CONTEXT_STUB_WORDS * ARM64_INST_SIZE);
+    if (stub == NULL)
+    {
+        return NULL;
+    }
+
+    uint32_t words[CONTEXT_STUB_WORDS] = {
+        // ldr x26, [x26, #8]
+        0xF9400000 | (1 << 10) | (X26 << 5) | X26,
+        arm64_ldr_lit(17, 8),
+        ARM64_BR_X17,
+    };
+    memcpy(words + 3, &code, sizeof(code));
+    memcpy(stub, words, sizeof(words));
+    if (seal_neighbor_mem(stub) == -1)
+    {
+        put_neighbor_mem(stub);
+        return NULL;
+    }
+    return stub;
+}
+
+// go functions are short, the first call/b is not far away
+#define SCAN_MAX_INST 64
+
+static void *located_nearest_target(void *start, ARM64_INST_TYPE type)
+{
+    uint32_t *pInst = start;
+    for (int i = 0; i < SCAN_MAX_INST; i++, pInst++)
+    {
+        if (arm64_inst_type(*pInst) == type)
+        {
+            void *pfunc = (void *)arm64_inst_target(*pInst, (uint64_t)pInst);
+            LOG_TRACE("origin start: %p real func: %p", start, pfunc);
+            return pfunc;
+        }
+        if (*pInst == ARM64_RET)
+        {
+            break;
+        }
+    }
+    LOG_TRACE("start:%p no such inst", start);
+    return NULL;
+}
+
+void *located_nearest_call_target(void *start)
+{
+    return located_nearest_target(start, ARM64_BL);
+}
+
+void *located_nearest_jmp_target(void *start)
+{
+    return located_nearest_target(start, ARM64_B);
+}
+
+int32_t located_branch_targets(void *start, int32_t size, int32_t call, void **targets, int32_t max)
+{
+    ARM64_INST_TYPE type = call ? ARM64_BL : ARM64_B;
+    uint32_t *pInst = start;
+    int32_t n = 0;
+    for (; (BYTE *)pInst < (BYTE *)start + size && n < max; pInst++)
+    {
+        if (arm64_inst_type(*pInst) == type)
+        {
+            targets[n++] = (void *)arm64_inst_target(*pInst, (uint64_t)pInst);
+        }
+    }
+    return n;
+}
+
+#if !defined(NTEST)
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//                                                  test zone                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+__attribute__((noinline)) int foo(int a, int b)
+{
+    int x = a * 3 + b;
+    return x ^ 0x5555;
+}
+
+__attribute__((noinline)) int foo_trampoline(int a, int b)
+{
+    int x = a * 5 + b;
+    return x ^ 0x3333;
+}
+
+__attribute__((noinline)) int hook_foo(int a, int b)
+{
+    return foo_trampoline(a, b) + 1;
+}
+
+static int call_foo(int (*volatile f)(int, int), int a, int b)
+{
+    return f(a, b);
+}
+
+void test_hook()
+{
+    int want = call_foo(foo, 3, 4);
+    void *t = hook(foo, hook_foo, foo_trampoline);
+    assert(t);
+    assert(call_foo(foo, 3, 4) == want + 1);
+    unhook(t);
+    assert(call_foo(foo, 3, 4) == want);
+}
+
+void test_unhook_src()
+{
+    int want = call_foo(foo, 1, 2);
+    void *t = hook(foo, hook_foo, foo_trampoline);
+    assert(t);
+    unhook_src(t);
+    assert(call_foo(foo, 1, 2) == want);
+    // the trampoline still reaches foo
+    assert(call_foo(hook_foo, 1, 2) == want + 1);
+    rehook_src(t);
+    assert(call_foo(foo, 1, 2) == want + 1);
+    unhook_src(t);
+    release_trampoline(t);
+    assert(call_foo(foo, 1, 2) == want);
+}
+
+static void *origin_of_foo;
+
+__attribute__((noinline)) int hook_foo_origin(int a, int b)
+{
+    return ((int (*)(int, int))origin_of_foo)(a, b) + 1;
+}
+
+void test_hook_without_trampoline_func()
+{
+    int want = call_foo(foo, 3, 4);
+    void *t = hook(foo, hook_foo_origin, NULL);
+    assert(t);
+    origin_of_foo = trampoline_origin(t);
+    assert(call_foo(foo, 3, 4) == want + 1);
+    unhook(t);
+    assert(call_foo(foo, 3, 4) == want);
+}
+
+void test_verify_hook()
+{
+    uint32_t before = *(uint32_t *)foo;
+    HookReport report;
+    assert(verify_hook(foo, hook_foo, foo_trampoline, &report) == 0);
+    assert(report.srcSize == ARM64_INST_SIZE && report.instCount == 1 && report.inst[0][0] != '\0');
+    assert(report.relocatedSize > 0 && report.trampolineFuncSize == ARM64_INST_SIZE);
+    assert(*(uint32_t *)foo == before);
+
+    assert(verify_hook(foo, foo, NULL, &report) == -1 && report.err.code == HOOK_E_INVALID_INPUT);
+}
+
+void test_invalid_hook()
+{
+    HookErr err;
+    assert(hook_e(foo, foo, foo_trampoline, &err) == NULL);
+    assert(err.code == HOOK_E_INVALID_INPUT);
+}
+
+__attribute__((noinline)) int callee(int a)
+{
+    return a + 7;
+}
+
+__attribute__((noinline)) int caller(int a)
+{
+    return callee(a) * 2;
+}
+
+void test_located_nearest_call_target()
+{
+    assert(located_nearest_call_target(caller) == (void *)callee);
+}
+
+int main()
+{
+    test_hook();
+    test_unhook_src();
+    test_hook_without_trampoline_func();
+    test_verify_hook();
+    test_invalid_hook();
+    test_located_nearest_call_target();
+    return 0;
+}
+#endif
+
+#endif
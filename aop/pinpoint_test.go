@@ -440,6 +440,7 @@ func TestAddHookP_CALL(t *testing.T) {
 
 func TestAgentDisable(t *testing.T) {
 	os.Setenv("FORCE_DISABLE_PINPOINT_AGENT", "True")
+	defer os.Unsetenv("FORCE_DISABLE_PINPOINT_AGENT")
 
 	if err := AddHookP_CALL(callRaw, fakeRaw, hookRawTrampoline); err == nil {
 		t.Log("AddHookP_CALL failed")
@@ -0,0 +1,373 @@
+//go:build (!cgo || pinpoint_purego) && linux && amd64
+// +build !cgo pinpoint_purego
+// +build linux
+// +build amd64
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+)
+
+/**
+ * Near allocator of the go engine, the same as nearmem.c: pages mapped in reach of the rel32 jmp,
+ * handed out in blocks, W^X, and an empty page is given back to the OS but the last one
+ */
+
+const (
+	nearMemAlign = 16
+	// jmp rel32 reaches +/-2GB
+	nearRange = 0x7ff80000
+	nearHalf  = 0x40000000
+	// set in nearPage.blocks while the block is not sealed
+	blockWriting = 0x80000000
+)
+
+type nearFree struct {
+	offset, size int
+}
+
+type nearPage struct {
+	addr uintptr
+	// sealed blocks, and blocks handed out not sealed yet
+	live, writing int
+	prot          int
+	// sorted by offset
+	free []nearFree
+	// size of the block at each nearMemAlign unit, blockWriting if not sealed, 0: no block starts there
+	blocks []uint32
+}
+
+var (
+	// guards nearPages and every page in it
+	nearMu       sync.Mutex
+	nearPages    []*nearPage
+	nearMapped   uint64
+	nearUnmapped uint64
+	pageSize     = syscall.Getpagesize()
+)
+
+func mmapAt(addr uintptr) uintptr {
+	mem, _, errno := syscall.Syscall6(syscall.SYS_MMAP, addr, uintptr(pageSize), syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS, ^uintptr(0), 0)
+	if errno != 0 {
+		return 0
+	}
+	if mem != addr {
+		munmap(mem)
+		return 0
+	}
+	return mem
+}
+
+func munmap(addr uintptr) {
+	syscall.Syscall(syscall.SYS_MUNMAP, addr, uintptr(pageSize), 0)
+}
+
+func mprotect(addr uintptr, size int, prot int) bool {
+	_, _, errno := syscall.Syscall(syscall.SYS_MPROTECT, addr, uintptr(size), uintptr(prot))
+	return errno == 0
+}
+
+// the first page mapped in [lo, hi), from hi down or from lo up
+func tryPageIn(lo, hi uintptr, down bool) uintptr {
+	page := uintptr(pageSize)
+	if down {
+		for addr := hi; addr > lo; addr -= page {
+			if mem := mmapAt(addr); mem != 0 {
+				return mem
+			}
+		}
+		return 0
+	}
+	for addr := lo; addr < hi; addr += page {
+		if mem := mmapAt(addr); mem != 0 {
+			return mem
+		}
+	}
+	return 0
+}
+
+/**
+ * @description: a fresh page in reach of `where`, half of the range away first: the heap of C and go
+ *  grows next to the text
+ * @param {uintptr} where
+ * @return {*} 0 if none
+ */
+func neighborPage(where uintptr) uintptr {
+	target := where &^ uintptr(pageSize-1)
+	lo, hi := uintptr(0x80000), ^uintptr(0)-0x7ffff
+	if target > nearRange {
+		lo = target - nearRange
+	}
+	if target < ^uintptr(0)-nearRange {
+		hi = target + nearRange
+	}
+
+	var mem uintptr
+	if mem == 0 && target > nearHalf {
+		mem = tryPageIn(lo, target-nearHalf, true)
+	}
+	if mem == 0 && target < ^uintptr(0)-nearHalf {
+		mem = tryPageIn(target+nearHalf, hi, false)
+	}
+	if mem == 0 && target > nearHalf {
+		mem = tryPageIn(target-nearHalf, target, true)
+	}
+	if mem == 0 && target < ^uintptr(0)-nearHalf {
+		mem = tryPageIn(target, target+nearHalf, true)
+	}
+	if mem == 0 {
+		mem = tryPageIn(lo, target, true)
+	}
+	if mem == 0 {
+		mem = tryPageIn(target, hi, false)
+	}
+	return mem
+}
+
+// W^X: writable while written, executable while having code
+func (p *nearPage) wantProt() int {
+	if p.writing > 0 {
+		// the live code in the page keeps running while another block is written
+		if p.live > 0 {
+			return syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC
+		}
+		return syscall.PROT_READ | syscall.PROT_WRITE
+	}
+	if p.live > 0 {
+		return syscall.PROT_READ | syscall.PROT_EXEC
+	}
+	return syscall.PROT_NONE
+}
+
+func (p *nearPage) updateProt() bool {
+	prot := p.wantProt()
+	if prot == p.prot {
+		return true
+	}
+	if !mprotect(p.addr, pageSize, prot) {
+		return false
+	}
+	p.prot = prot
+	return true
+}
+
+// put [offset, offset+size) on the free list, merge it with the neighbors
+func (p *nearPage) freeRange(offset, size int) {
+	i := sort.Search(len(p.free), func(i int) bool { return p.free[i].offset >= offset })
+	if i > 0 && p.free[i-1].offset+p.free[i-1].size == offset {
+		p.free[i-1].size += size
+		if i < len(p.free) && p.free[i-1].offset+p.free[i-1].size == p.free[i].offset {
+			p.free[i-1].size += p.free[i].size
+			p.free = append(p.free[:i], p.free[i+1:]...)
+		}
+		return
+	}
+	if i < len(p.free) && offset+size == p.free[i].offset {
+		p.free[i].offset = offset
+		p.free[i].size += size
+		return
+	}
+	p.free = append(p.free, nearFree{})
+	copy(p.free[i+1:], p.free[i:])
+	p.free[i] = nearFree{offset: offset, size: size}
+}
+
+func inNearRange(where, mem uintptr) bool {
+	if where > mem {
+		return where-mem < nearRange
+	}
+	return mem-where < nearRange
+}
+
+func (p *nearPage) alloc(where uintptr, size int) uintptr {
+	for i := range p.free {
+		block := &p.free[i]
+		mem := p.addr + uintptr(block.offset)
+		if block.size < size || !inNearRange(where, mem) {
+			continue
+		}
+
+		offset := block.offset
+		block.offset += size
+		block.size -= size
+		if block.size == 0 {
+			p.free = append(p.free[:i], p.free[i+1:]...)
+		}
+		p.blocks[offset/nearMemAlign] = uint32(size) | blockWriting
+		p.writing++
+		if !p.updateProt() {
+			p.blocks[offset/nearMemAlign] = 0
+			p.writing--
+			p.freeRange(offset, size)
+			return 0
+		}
+		return mem
+	}
+	return 0
+}
+
+func findNearPage(mem uintptr) *nearPage {
+	addr := mem &^ uintptr(pageSize-1)
+	for _, p := range nearPages {
+		if p.addr == addr {
+			return p
+		}
+	}
+	return nil
+}
+
+// unmap an empty page, but keep the last one
+func releaseEmptyPage(empty *nearPage) {
+	at, others := -1, 0
+	for i, p := range nearPages {
+		if p == empty {
+			at = i
+		} else if p.live == 0 && p.writing == 0 {
+			others++
+		}
+	}
+	if others == 0 || at == -1 {
+		empty.updateProt()
+		return
+	}
+	nearPages = append(nearPages[:at], nearPages[at+1:]...)
+	munmap(empty.addr)
+	nearUnmapped++
+}
+
+/**
+ * @description: a block of `size` bytes in +/-2GB of `where`, writable.
+ *  write the code then sealNearMem it, before anything jumps there
+ * @param {uintptr} where
+ * @param {int} size
+ * @return {*} 0: no memory near `where`
+ */
+func getNearMem(where uintptr, size int) uintptr {
+	size = alignUp(size, nearMemAlign)
+	if size <= 0 || size > pageSize {
+		return 0
+	}
+
+	nearMu.Lock()
+	defer nearMu.Unlock()
+	for _, p := range nearPages {
+		if mem := p.alloc(where, size); mem != 0 {
+			return mem
+		}
+	}
+	addr := neighborPage(where)
+	if addr == 0 {
+		return 0
+	}
+	p := &nearPage{
+		addr:   addr,
+		prot:   syscall.PROT_READ | syscall.PROT_WRITE,
+		free:   []nearFree{{offset: 0, size: pageSize}},
+		blocks: make([]uint32, pageSize/nearMemAlign),
+	}
+	nearPages = append([]*nearPage{p}, nearPages...)
+	nearMapped++
+	return p.alloc(where, size)
+}
+
+/**
+ * @description: the code in `mem` is written, make it executable and read only
+ * @param {uintptr} mem from getNearMem
+ * @return {*} false: mprotect failed, the block is still writable
+ */
+func sealNearMem(mem uintptr) bool {
+	nearMu.Lock()
+	defer nearMu.Unlock()
+	p := findNearPage(mem)
+	block := &p.blocks[int(mem-p.addr)/nearMemAlign]
+	*block &^= blockWriting
+	p.writing--
+	p.live++
+	if !p.updateProt() {
+		*block |= blockWriting
+		p.writing++
+		p.live--
+		return false
+	}
+	return true
+}
+
+/**
+ * @description: put memory from getNearMem back, sealed or not.
+ *  caller must make sure nobody is running in it
+ * @param {uintptr} mem
+ */
+func putNearMem(mem uintptr) {
+	if mem == 0 {
+		return
+	}
+
+	nearMu.Lock()
+	defer nearMu.Unlock()
+	p := findNearPage(mem)
+	offset := int(mem - p.addr)
+	block := p.blocks[offset/nearMemAlign]
+	p.blocks[offset/nearMemAlign] = 0
+	if block&blockWriting != 0 {
+		p.writing--
+	} else {
+		p.live--
+	}
+	p.freeRange(offset, int(block&^blockWriting))
+
+	if p.live == 0 && p.writing == 0 {
+		releaseEmptyPage(p)
+	} else {
+		p.updateProt()
+	}
+}
+
+func engineMemStats(m *MemStats) {
+	nearMu.Lock()
+	defer nearMu.Unlock()
+	m.Pages = m.Pages[:0]
+	for i, p := range nearPages {
+		if i >= maxMemStatPages {
+			break
+		}
+		stat := PageStat{
+			Address:    p.addr,
+			Size:       pageSize,
+			Blocks:     p.live,
+			Writing:    p.writing,
+			UsedBytes:  pageSize,
+			Writable:   p.prot&syscall.PROT_WRITE != 0,
+			Executable: p.prot&syscall.PROT_EXEC != 0,
+		}
+		for _, block := range p.free {
+			stat.UsedBytes -= block.size
+			stat.FreeBlocks++
+			if block.size > stat.LargestFree {
+				stat.LargestFree = block.size
+			}
+		}
+		m.Pages = append(m.Pages, stat)
+	}
+	m.Mapped = nearMapped
+	m.Unmapped = nearUnmapped
+}
@@ -0,0 +1,316 @@
+//go:build (!cgo || pinpoint_purego) && linux && amd64
+// +build !cgo pinpoint_purego
+// +build linux
+// +build amd64
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"encoding/binary"
+	"math"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+/**
+ * x86-64 relocator of the go engine, the same as x86.c.
+ * Moves the backup inst of a function to run at another place, never touches code memory
+ */
+
+const (
+	// jmp rel32: 0xE9 +imm32
+	x86JmpRel32Size = 5
+	// jcc rel32: 0x0F 0x8X +imm32
+	x86JccRel32Size = 6
+	// jmp [rip]; .quad target
+	x86AbsJmpSize = 14
+	// the longest sequence one inst becomes: a call emulated by pushing its return address
+	x86MaxRelocSize = 34
+	// the longest code x86Relocate takes
+	x86MaxRelocCode = 64
+)
+
+type x86InstType int
+
+const (
+	x86Other x86InstType = iota // not pc-relative, copy as it is
+	x86Rel32                    // [rip+disp32] operand, xbegin: fixed in place
+	x86Jmp                      // jmp rel8/rel32
+	x86Jcc                      // jcc rel8/rel32
+	x86Jcxz                     // jrcxz/jecxz, loop, loope, loopne: rel8 only
+	x86Call                     // call rel32
+	x86End                      // ret, int3, ud2: nothing behind it runs
+	x86Bad                      // pc-relative, but no way to move it: rel16, unknown rel8
+)
+
+// decode the inst at the start of `code`
+func x86Decode(code []byte) (x86asm.Inst, bool) {
+	inst, err := x86asm.Decode(code, 64)
+	if err != nil || inst.Len <= 0 || inst.Len > len(code) {
+		return inst, false
+	}
+	return inst, true
+}
+
+func x86TypeOf(inst *x86asm.Inst, raw []byte) x86InstType {
+	if inst.Op == x86asm.RET || inst.Op == x86asm.INT || inst.Op == x86asm.UD2 {
+		return x86End
+	}
+	if inst.PCRel == 0 {
+		return x86Other
+	}
+
+	op := raw[inst.PCRelOff-1]
+	switch inst.PCRel {
+	case 1:
+		switch {
+		case op == 0xEB:
+			return x86Jmp
+		case op&0xF0 == 0x70:
+			return x86Jcc
+		case op >= 0xE0 && op <= 0xE3:
+			return x86Jcxz
+		}
+		return x86Bad
+	case 4:
+		switch {
+		case op == 0xE9:
+			return x86Jmp
+		case op == 0xE8:
+			return x86Call
+		case inst.PCRelOff >= 2 && raw[inst.PCRelOff-2] == 0x0F && op&0xF0 == 0x80:
+			return x86Jcc
+		}
+		return x86Rel32
+	}
+	// rel16 truncates rip in 64-bit mode
+	return x86Bad
+}
+
+/**
+ * @description: target of a pc-relative inst at `pc`, the address referenced for [rip+disp32]
+ * @return {*} 0: not pc-relative
+ */
+func x86Target(inst *x86asm.Inst, raw []byte, pc uint64) uint64 {
+	switch inst.PCRel {
+	case 1:
+		return pc + uint64(inst.Len) + uint64(int64(int8(raw[inst.PCRelOff])))
+	case 4:
+		rel := int32(binary.LittleEndian.Uint32(raw[inst.PCRelOff:]))
+		return pc + uint64(inst.Len) + uint64(int64(rel))
+	}
+	return 0
+}
+
+func appendLE32(out []byte, v uint32) []byte {
+	return append(out, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendLE64(out []byte, v uint64) []byte {
+	return appendLE32(appendLE32(out, uint32(v)), uint32(v>>32))
+}
+
+func fitsRel32(v uint64) bool {
+	return int64(v) >= math.MinInt32 && int64(v) <= math.MaxInt32
+}
+
+func appendRel32(out []byte, pc, target uint64) []byte {
+	return appendLE32(out, uint32(int32(target-pc)))
+}
+
+func appendAbsJmp(out []byte, target uint64) []byte {
+	out = append(out, 0xFF, 0x25, 0, 0, 0, 0)
+	return appendLE64(out, target)
+}
+
+// jmp rel32 if target is in range, else jmp [rip]
+func appendJmp(out []byte, newPc, target uint64) []byte {
+	if fitsRel32(target - (newPc + x86JmpRel32Size)) {
+		return appendRel32(append(out, 0xE9), newPc+x86JmpRel32Size, target)
+	}
+	return appendAbsJmp(out, target)
+}
+
+func x86JmpSize(newPc, target uint64) int {
+	if fitsRel32(target - (newPc + x86JmpRel32Size)) {
+		return x86JmpRel32Size
+	}
+	return x86AbsJmpSize
+}
+
+/**
+ * @description: relocate one inst to `newPc`, appended to `out`
+ * @param {uint64} target where the branch goes at the new place, redirected and mapped into the code
+ * @param {bool} retOut the return address of a call is behind the relocated code
+ * @return {*} false: can not relocate
+ */
+func x86RelocateOne(inst *x86asm.Inst, raw []byte, pc, newPc, target uint64, retOut bool, out []byte) ([]byte, bool) {
+	length := inst.Len
+	switch x86TypeOf(inst, raw) {
+	case x86Other:
+		return append(out, raw[:length]...), true
+
+	case x86Rel32:
+		if !fitsRel32(target - (newPc + uint64(length))) {
+			return out, false
+		}
+		start := len(out)
+		out = append(out, raw[:length]...)
+		binary.LittleEndian.PutUint32(out[start+inst.PCRelOff:], uint32(int32(target-(newPc+uint64(length)))))
+		return out, true
+
+	case x86Jmp:
+		return appendJmp(out, newPc, target), true
+
+	case x86Jcc:
+		cond := raw[inst.PCRelOff-1] & 0x0F
+		if fitsRel32(target - (newPc + x86JccRel32Size)) {
+			return appendRel32(append(out, 0x0F, 0x80|cond), newPc+x86JccRel32Size, target), true
+		}
+		// j!cc over the absolute jmp
+		return appendAbsJmp(append(out, 0x70|(cond^1), x86AbsJmpSize), target), true
+
+	case x86Jcxz:
+		// jrcxz taken; jmp not_taken; taken: jmp target. prefix 0x67 selects ecx, keep it
+		n := inst.PCRelOff
+		out = append(out, raw[:n]...)
+		out = append(out, 2, 0xEB, byte(x86JmpSize(newPc+uint64(n)+3, target)))
+		return appendJmp(out, newPc+uint64(n)+3, target), true
+
+	case x86Call:
+		ret := pc + uint64(length)
+		if retOut {
+			// lea rsp, [rsp-8]; mov dword [rsp], ret_lo; mov dword [rsp+4], ret_hi; jmp target
+			start := len(out)
+			out = append(out, 0x48, 0x8D, 0x64, 0x24, 0xF8)
+			out = appendLE32(append(out, 0xC7, 0x04, 0x24), uint32(ret))
+			out = appendLE32(append(out, 0xC7, 0x44, 0x24, 0x04), uint32(ret>>32))
+			return appendJmp(out, newPc+uint64(len(out)-start), target), true
+		}
+		if fitsRel32(target - (newPc + uint64(length))) {
+			return appendRel32(append(out, 0xE8), newPc+uint64(length), target), true
+		}
+		// call [rip+2]; jmp +8; .quad target
+		out = append(out, 0xFF, 0x15, 0x02, 0x00, 0x00, 0x00, 0xEB, 0x08)
+		return appendLE64(out, target), true
+	}
+	return out, false
+}
+
+/**
+ * @description: the most bytes x86Relocate writes for `code`
+ * @param {[]byte} code
+ * @return {*} -1: `code` can not be decoded
+ */
+func x86RelocateBound(code []byte) int {
+	bound := 0
+	for off := 0; off < len(code); {
+		inst, ok := x86Decode(code[off:])
+		if !ok {
+			return -1
+		}
+		switch x86TypeOf(&inst, code[off:]) {
+		case x86End:
+			return bound + len(code) - off
+		case x86Jmp:
+			bound += x86AbsJmpSize
+		case x86Jcc:
+			bound += 2 + x86AbsJmpSize
+		case x86Jcxz:
+			bound += inst.PCRelOff + 3 + x86AbsJmpSize
+		case x86Call:
+			bound += x86MaxRelocSize
+		default:
+			bound += inst.Len
+		}
+		off += inst.Len
+	}
+	return bound
+}
+
+/**
+ * @description: one pass over the code. with `final` false, only newOff is filled
+ * @param {[]int} newOff offset of each inst at the new place, by its offset in code. -1: not an inst boundary
+ * @return {*} the code and -1, or the offset of the inst can not be moved
+ */
+func x86RelocatePass(code []byte, pc, newPc uint64, final bool, redirectFrom, redirectTo uint64, newOff []int) ([]byte, int) {
+	size := uint64(len(code))
+	var out []byte
+	for off := 0; off < len(code); {
+		raw := code[off:]
+		inst, ok := x86Decode(raw)
+		if !ok {
+			return nil, off
+		}
+
+		typ := x86TypeOf(&inst, raw)
+		if typ == x86End {
+			// ret and the int3 padding after it, never run through
+			newOff[off] = len(out)
+			return append(out, raw...), -1
+		}
+
+		target := x86Target(&inst, raw, pc+uint64(off))
+		if redirectFrom != 0 && target == redirectFrom {
+			target = redirectTo
+		} else if typ != x86Rel32 && target >= pc && target < pc+size {
+			// branch into the code goes to its relocated copy. the first pass does not know it, any near one does
+			to := int(target - pc)
+			if final && newOff[to] == -1 {
+				return nil, off
+			}
+			target = newPc
+			if final {
+				target += uint64(newOff[to])
+			}
+		}
+
+		newOff[off] = len(out)
+		retOut := pc+uint64(off+inst.Len) >= pc+size
+		if out, ok = x86RelocateOne(&inst, raw, pc+uint64(off), newPc+uint64(len(out)), target, retOut, out); !ok {
+			return nil, off
+		}
+		off += inst.Len
+	}
+	return out, -1
+}
+
+/**
+ * @description: rewrite `code` from `pc` to run at `newPc`.
+ *  short branches are widened, branches out of rel32 go through an absolute jmp,
+ *  branches into the code go to the relocated inst.
+ *  a call returning behind the code pushes its origin return address, so tracebacks see the origin function
+ * @param {[]byte} code copy of the code at pc
+ * @param {uint64} redirectFrom branches to it go to `redirectTo`, 0: none
+ * @return {*} the relocated code and -1, or nil and the offset of the inst can not be moved
+ */
+func x86Relocate(code []byte, pc, newPc, redirectFrom, redirectTo uint64) ([]byte, int) {
+	if len(code) > x86MaxRelocCode {
+		return nil, 0
+	}
+	newOff := make([]int, len(code))
+	for i := range newOff {
+		newOff[i] = -1
+	}
+	// sizes only depend on the inst before, so the second pass lays out the same
+	if _, failOff := x86RelocatePass(code, pc, newPc, false, redirectFrom, redirectTo, newOff); failOff != -1 {
+		return nil, failOff
+	}
+	return x86RelocatePass(code, pc, newPc, true, redirectFrom, redirectTo, newOff)
+}
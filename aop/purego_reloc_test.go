@@ -0,0 +1,130 @@
+//go:build (!cgo || pinpoint_purego) && linux && amd64
+// +build !cgo pinpoint_purego
+// +build linux
+// +build amd64
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+const (
+	relocPC   = 0x400000
+	relocNear = relocPC + 0x1000
+	relocFar  = relocPC + 0x100000000
+)
+
+// joins the byte pieces of an instruction
+func cat(pieces ...[]byte) []byte {
+	return bytes.Join(pieces, nil)
+}
+
+func le32(v int64) []byte {
+	return appendLE32(nil, uint32(v))
+}
+
+func le64(v uint64) []byte {
+	return appendLE64(nil, v)
+}
+
+// jmp [rip]; .quad
+func absJmp(v uint64) []byte {
+	return appendAbsJmp(nil, v)
+}
+
+// the cases of x86.c
+var relocCases = []struct {
+	name  string
+	code  []byte
+	newPc uint64
+	want  []byte // nil: can not be relocated
+}{
+	{"other", []byte{0x48, 0x89, 0xD8}, relocFar, []byte{0x48, 0x89, 0xD8}},
+	{"lea rip", cat([]byte{0x48, 0x8D, 0x05}, le32(0x100)), relocNear, cat([]byte{0x48, 0x8D, 0x05}, le32(0x100-0x1000))},
+	{"cmp rip imm", cat([]byte{0x80, 0x3D}, le32(0x100), []byte{0x07}), relocNear, cat([]byte{0x80, 0x3D}, le32(0x100-0x1000), []byte{0x07})},
+	{"mov rip far", cat([]byte{0x48, 0x8B, 0x05}, le32(0x100)), relocFar, nil},
+	{"jmp rel8", []byte{0xEB, 0x10}, relocNear, cat([]byte{0xE9}, le32(0x12-0x1000-5))},
+	{"jmp rel8 far", []byte{0xEB, 0x10}, relocFar, absJmp(relocPC + 0x12)},
+	{"jmp rel32", cat([]byte{0xE9}, le32(0x100)), relocNear, cat([]byte{0xE9}, le32(0x105-0x1000-5))},
+	{"jcc rel8", []byte{0x76, 0x10}, relocNear, cat([]byte{0x0F, 0x86}, le32(0x12-0x1000-6))},
+	{"jcc rel8 far", []byte{0x76, 0x10}, relocFar, cat([]byte{0x77, 0x0E}, absJmp(relocPC+0x12))},
+	{"jcc rel32", cat([]byte{0x0F, 0x85}, le32(0x100)), relocNear, cat([]byte{0x0F, 0x85}, le32(0x106-0x1000-6))},
+	{"jrcxz", []byte{0xE3, 0x10}, relocNear, cat([]byte{0xE3, 0x02, 0xEB, 0x05, 0xE9}, le32(0x12-0x1000-9))},
+	{"jecxz far", []byte{0x67, 0xE3, 0x10}, relocFar, cat([]byte{0x67, 0xE3, 0x02, 0xEB, 0x0E}, absJmp(relocPC+0x13))},
+	{"call", cat([]byte{0xE8}, le32(0x100)), relocNear,
+		cat([]byte{0x48, 0x8D, 0x64, 0x24, 0xF8, 0xC7, 0x04, 0x24}, le32(relocPC+5), []byte{0xC7, 0x44, 0x24, 0x04}, le32(0), []byte{0xE9}, le32(0x105-0x1000-25))},
+	{"call in", cat([]byte{0xE8}, le32(0x100), []byte{0x90}), relocNear, cat([]byte{0xE8}, le32(0x105-0x1000-5), []byte{0x90})},
+	{"call in far", cat([]byte{0xE8}, le32(0x100), []byte{0x90}), relocFar, cat([]byte{0xFF, 0x15, 0x02, 0, 0, 0, 0xEB, 0x08}, le64(relocPC+0x105), []byte{0x90})},
+	{"jcc inside", []byte{0x75, 0x01, 0x90, 0x90}, relocFar, cat([]byte{0x0F, 0x85}, le32(1), []byte{0x90, 0x90})},
+	{"jmp self", []byte{0xEB, 0xFE}, relocFar, cat([]byte{0xE9}, le32(-5))},
+	{"jcc mid inst", []byte{0x75, 0x01, 0xB8, 0x90, 0x90, 0x90, 0x90}, relocFar, nil},
+	{"ret", []byte{0x01, 0xD8, 0xC3, 0xCC, 0xCC}, relocFar, []byte{0x01, 0xD8, 0xC3, 0xCC, 0xCC}},
+}
+
+func TestX86Relocate(t *testing.T) {
+	for _, c := range relocCases {
+		got, failOff := x86Relocate(c.code, relocPC, c.newPc, 0, 0)
+		if c.want == nil {
+			if failOff == -1 {
+				t.Errorf("%s: relocated % X", c.name, got)
+			}
+			continue
+		}
+		if failOff != -1 || !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got % X failOff %d, want % X", c.name, got, failOff, c.want)
+		}
+		if len(got) > x86RelocateBound(c.code) {
+			t.Errorf("%s: %d bytes over the bound %d", c.name, len(got), x86RelocateBound(c.code))
+		}
+	}
+}
+
+func TestX86RelocateRedirect(t *testing.T) {
+	// go stack check: cmp rsp, [r14+0x10]; jbe morestack
+	code := []byte{0x49, 0x3B, 0x66, 0x10, 0x76, 0x20}
+	got, failOff := x86Relocate(code, relocPC, relocNear, relocPC+0x26, relocNear+0x100)
+	if failOff != -1 || len(got) != 10 || got[4] != 0x0F || got[5] != 0x86 {
+		t.Fatalf("got % X failOff %d", got, failOff)
+	}
+	if target := relocNear + 10 + uint64(int32(binary.LittleEndian.Uint32(got[6:]))); target != relocNear+0x100 {
+		t.Errorf("jbe goes to %#x", target)
+	}
+
+	// nop; mov rax, [rip+0x100]
+	bad := cat([]byte{0x90, 0x48, 0x8B, 0x05}, le32(0x100))
+	if _, failOff := x86Relocate(bad, relocPC, relocFar, 0, 0); failOff != 1 {
+		t.Errorf("failOff %d", failOff)
+	}
+}
+
+// locatedGoMorestack finds the stack check of a go function on the real text
+func TestLocatedGoMorestack(t *testing.T) {
+	pc := resolveABIWrapper(reflect.ValueOf(TestLocatedGoMorestack).Pointer())
+	block, size := locatedGoMorestack(pc)
+	if block == 0 || size < jmpInstSize {
+		t.Fatalf("block %#x size %d", block, size)
+	}
+	if srcSpace(pc) != size {
+		t.Errorf("space %d, stack check %d", srcSpace(pc), size)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// HookKind tells which AddHook* installed the hook
+type HookKind int
+
+const (
+	// AddHook
+	HookDirect HookKind = iota
+	// AddHookP_CALL
+	HookPCall
+	// AddHookP_JMP
+	HookPJmp
+	// AddHookGeneric
+	HookGeneric
+	// AddHookByName
+	HookByName
+	// AddHookSpec, LoadHookManifest
+	HookBySpec
+	// AddInterceptor
+	HookChain
+	// AddHookLiteral
+	HookLiteral
+)
+
+func (k HookKind) String() string {
+	switch k {
+	case HookDirect:
+		return "direct"
+	case HookPCall:
+		return "P_CALL"
+	case HookPJmp:
+		return "P_JMP"
+	case HookGeneric:
+		return "generic"
+	case HookByName:
+		return "name"
+	case HookBySpec:
+		return "spec"
+	case HookChain:
+		return "chain"
+	case HookLiteral:
+		return "literal"
+	default:
+		return "unknown"
+	}
+}
+
+// HookInfo describes one installed hook
+type HookInfo struct {
+	// symbol of the function passed as iSrc
+	Source string
+	// symbol of the function really patched, differs from Source for P_CALL/P_JMP/generic
+	Patched    string
+	Target     string
+	Trampoline string
+	Kind       HookKind
+	// patched address and the size of instructions replaced there
+	Address      uintptr
+	PatchedBytes int
+	// names of the interceptors of a chain, in order
+	Interceptors []string
+}
+
+// hookEntry is one patched src
+type hookEntry struct {
+	kind HookKind
+	// trampoline returned by engineHook
+	trampoline unsafe.Pointer
+	// address of the function passed by user, differs from the patched
+	// address for AddHookP_CALL/AddHookP_JMP
+	origin uintptr
+	// address of the hook function
+	target uintptr
+	// address of the trampoline function
+	trampolineFunc uintptr
+	// set by UnHookWait while waiting for the goroutines leaving target
+	draining bool
+	// a hook made by reflect.MakeFunc: the closure, kept alive for the stub entering it
+	closure interface{}
+	stub    unsafe.Pointer
+	gate    *closureGate
+	// AddHookLiteral: entry of the origin loading the closure context from the func value
+	contextStub unsafe.Pointer
+	// interceptors of AddInterceptor
+	chain *chain
+}
+
+// trampolineMap records every patched src address and its C trampoline.
+// trampolineMu must be held while reading or writing it, and across the
+// engineHook/engineUnhook call, so checking and patching a src is one atomic step.
+var (
+	trampolineMu  sync.Mutex
+	trampolineMap = make(map[uintptr]*hookEntry)
+)
+
+/**
+ * @description: patch `src` and record it in the registry, only verify it in the verify only mode
+ * @param {string} op name of the caller, for HookError
+ * @param {*} src address to patch
+ * @param {*} target
+ * @param {unsafe.Pointer} trampolineFunc
+ * @param {uintptr} origin the function passed by user
+ * @param {HookKind} kind
+ * @return {*}
+ */
+func installHook(op string, src, target, trampolineFunc unsafe.Pointer, origin uintptr, kind HookKind) error {
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+
+	if verifyOnly {
+		return recordVerifyLocked(verifyHookLocked(op, src, target, trampolineFunc, origin, kind))
+	}
+	_, err := installHookLocked(op, src, target, trampolineFunc, origin, kind)
+	return err
+}
+
+/**
+ * @description: installHook, trampolineMu must be held
+ * @return {*} the new entry in the registry
+ */
+func installHookLocked(op string, src, target, trampolineFunc unsafe.Pointer, origin uintptr, kind HookKind) (*hookEntry, error) {
+	if _, ok := trampolineMap[uintptr(src)]; ok {
+		return nil, newHookError(op, uintptr(src), ErrAlreadyHooked)
+	}
+
+	trampoline, fault := engineHook(src, target, trampolineFunc)
+	if fault != nil {
+		return nil, fault.hookError(op)
+	}
+	// store into trampoline map
+	entry := &hookEntry{
+		kind:           kind,
+		trampoline:     trampoline,
+		origin:         origin,
+		target:         uintptr(target),
+		trampolineFunc: uintptr(trampolineFunc),
+	}
+	trampolineMap[uintptr(src)] = entry
+	return entry, nil
+}
+
+/**
+ * @description: find the patched address of `src`. trampolineMu must be held
+ * @param {uintptr} src patched address or the function passed by user
+ * @return {*} 0 if `src` is not hooked
+ */
+func lookupHook(src uintptr) uintptr {
+	if _, ok := trampolineMap[src]; ok {
+		return src
+	}
+	for addr, entry := range trampolineMap {
+		if entry.origin == src {
+			return addr
+		}
+	}
+	return 0
+}
+
+/**
+ * @description: restore `src` and drop it from the registry
+ * @param {uintptr} src
+ * @return {*} false if `src` is not hooked
+ */
+func removeHook(src uintptr) bool {
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+
+	addr := lookupHook(src)
+	if addr == 0 || trampolineMap[addr].draining {
+		return false
+	}
+	engineUnhook(trampolineMap[addr].trampoline)
+	delete(trampolineMap, addr)
+	return true
+}
+
+/**
+ * @description: list all installed hooks, sorted by Source
+ * @return {*}
+ */
+func Hooks() []HookInfo {
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+
+	hooks := make([]HookInfo, 0, len(trampolineMap))
+	for addr, entry := range trampolineMap {
+		if entry.draining {
+			continue
+		}
+		info := HookInfo{
+			Source:       funcName(entry.origin),
+			Patched:      funcName(addr),
+			Target:       funcName(entry.target),
+			Trampoline:   funcName(entry.trampolineFunc),
+			Kind:         entry.kind,
+			Address:      addr,
+			PatchedBytes: enginePatchedBytes(entry.trampoline),
+		}
+		if entry.chain != nil {
+			for _, it := range entry.chain.load() {
+				info.Interceptors = append(info.Interceptors, it.Name)
+			}
+		}
+		hooks = append(hooks, info)
+	}
+
+	sort.Slice(hooks, func(i, j int) bool {
+		if hooks[i].Source != hooks[j].Source {
+			return hooks[i].Source < hooks[j].Source
+		}
+		return hooks[i].Address < hooks[j].Address
+	})
+	return hooks
+}
+
+func funcName(pc uintptr) string {
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
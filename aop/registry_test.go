@@ -0,0 +1,249 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// run with `go test -race`
+// nosplit+norace keep the prologue free of stack checks and race calls,
+// so these stay hookable under the race detector
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regSrc0(a, b int64) int64 {
+	x := a*3 + b
+	return x ^ 0x5555
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regTramp0(a, b int64) int64 {
+	x := a*5 + b
+	return x ^ 0x3333
+}
+
+//go:noinline
+func regHook0(a, b int64) int64 {
+	return regTramp0(a, b) + 1
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regSrc1(a, b int64) int64 {
+	x := a*3 + b
+	return x ^ 0x6666
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regTramp1(a, b int64) int64 {
+	x := a*5 + b
+	return x ^ 0x4444
+}
+
+//go:noinline
+func regHook1(a, b int64) int64 {
+	return regTramp1(a, b) + 1
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regSrc2(a, b int64) int64 {
+	x := a*3 + b
+	return x ^ 0x7777
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regTramp2(a, b int64) int64 {
+	x := a*5 + b
+	return x ^ 0x2222
+}
+
+//go:noinline
+func regHook2(a, b int64) int64 {
+	return regTramp2(a, b) + 1
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regSrc3(a, b int64) int64 {
+	x := a*3 + b
+	return x ^ 0x1111
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func regTramp3(a, b int64) int64 {
+	x := a*5 + b
+	return x ^ 0x0999
+}
+
+//go:noinline
+func regHook3(a, b int64) int64 {
+	return regTramp3(a, b) + 1
+}
+
+type regCase struct {
+	src, hook, tramp func(a, b int64) int64
+	origin           int64
+}
+
+var regCases = []regCase{
+	{regSrc0, regHook0, regTramp0, (1*3 + 2) ^ 0x5555},
+	{regSrc1, regHook1, regTramp1, (1*3 + 2) ^ 0x6666},
+	{regSrc2, regHook2, regTramp2, (1*3 + 2) ^ 0x7777},
+	{regSrc3, regHook3, regTramp3, (1*3 + 2) ^ 0x1111},
+}
+
+func TestConcurrentAddHookSameSrc(t *testing.T) {
+	c := regCases[0]
+	const workers = 16
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = AddHook(c.src, c.hook, c.tramp)
+		}(i)
+	}
+	wg.Wait()
+	defer UnHook(c.src)
+
+	succeed := 0
+	for _, err := range errs {
+		if err == nil {
+			succeed++
+		}
+	}
+	if succeed != 1 {
+		t.Fatalf("%d of %d AddHook succeed, expect exactly 1", succeed, workers)
+	}
+
+	if ret := c.src(1, 2); ret != c.origin+1 {
+		t.Fatalf("hook not working: %d", ret)
+	}
+}
+
+func TestConcurrentAddUnHook(t *testing.T) {
+	const rounds = 64
+
+	var wg sync.WaitGroup
+	for _, c := range regCases {
+		wg.Add(1)
+		go func(c regCase) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if err := AddHook(c.src, c.hook, c.tramp); err != nil {
+					t.Errorf("round %d: %s", i, err)
+					return
+				}
+				UnHook(c.src)
+			}
+		}(c)
+	}
+
+	// readers race with writers on the registry
+	for i := 0; i < len(regCases); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				UnHook(foo_test)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, c := range regCases {
+		if ret := c.src(1, 2); ret != c.origin {
+			t.Errorf("src is still hooked: %d", ret)
+		}
+	}
+
+	for _, c := range regCases {
+		if err := AddHook(c.src, c.hook, c.tramp); err != nil {
+			t.Fatal(err)
+		}
+		if ret := c.src(1, 2); ret != c.origin+1 {
+			t.Errorf("hook not working after churn: %d", ret)
+		}
+		UnHook(c.src)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	c := regCases[1]
+	if err := AddHook(c.src, c.hook, c.tramp); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(source string) *HookInfo {
+		for _, h := range Hooks() {
+			if strings.HasSuffix(h.Source, source) {
+				return &h
+			}
+		}
+		return nil
+	}
+
+	h := find(".regSrc1")
+	if h == nil {
+		t.Fatal("regSrc1 not listed")
+	}
+	if h.Patched != h.Source ||
+		!strings.HasSuffix(h.Target, ".regHook1") ||
+		!strings.HasSuffix(h.Trampoline, ".regTramp1") {
+		t.Errorf("bad symbols: %+v", *h)
+	}
+	if h.Kind != HookDirect || h.Kind.String() != "direct" {
+		t.Errorf("bad kind: %s", h.Kind)
+	}
+	if h.Address != reflect.ValueOf(c.src).Pointer() || h.PatchedBytes < 5 {
+		t.Errorf("bad patch: %x %d", h.Address, h.PatchedBytes)
+	}
+
+	UnHook(c.src)
+	if find(".regSrc1") != nil {
+		t.Error("regSrc1 listed after UnHook")
+	}
+
+	// P_CALL patches the call in callRaw, TestAddHookP_CALL may have placed it
+	if err := AddHookP_CALL(callRaw, hookRaw, hookRawTrampoline); err != nil && !errors.Is(err, ErrAlreadyHooked) {
+		t.Fatal(err)
+	}
+	if h := find(".callRaw"); h == nil || h.Kind != HookPCall || h.Kind.String() != "P_CALL" ||
+		!strings.HasSuffix(h.Patched, ".raw") || !strings.HasSuffix(h.Target, ".hookRaw") {
+		t.Errorf("bad P_CALL hook: %+v", h)
+	}
+}
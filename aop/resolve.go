@@ -0,0 +1,174 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// functions are aligned to 32 bytes on amd64, 16 on arm64
+	funcAlign = 16
+	// wrappers are tiny, do not walk into a huge function for nothing
+	maxFuncScan = 64 << 10
+	maxTargets  = 256
+	// file of the wrappers generated by the compiler
+	autogenerated = "<autogenerated>"
+)
+
+// codePointer converts the address of code, it is never in the go heap
+func codePointer(pc uintptr) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&pc))
+}
+
+/**
+ * @description: size of the go function starting at `entry`, padding included
+ * @param {uintptr} entry
+ * @return {*} 0 if entry is not the entry of a go function
+ */
+func funcSize(entry uintptr) int {
+	fn := runtime.FuncForPC(entry)
+	if fn == nil || fn.Entry() != entry {
+		return 0
+	}
+
+	size := funcAlign
+	for ; size < maxFuncScan; size += funcAlign {
+		next := runtime.FuncForPC(entry + uintptr(size))
+		if next == nil || next.Entry() != entry {
+			break
+		}
+	}
+	return size
+}
+
+/**
+ * @description: targets of call (call=true) or jmp in the function at `pc`, which leave it
+ * @param {uintptr} pc
+ * @param {bool} call
+ * @return {*}
+ */
+func branchTargets(pc uintptr, call bool) []uintptr {
+	size := funcSize(pc)
+	if size == 0 {
+		return nil
+	}
+
+	targets := engineBranchTargets(pc, size, call, maxTargets)
+	out := targets[:0]
+	for _, target := range targets {
+		// jmp inside the function is not a tail call
+		if target >= pc && target < pc+uintptr(size) {
+			continue
+		}
+		out = append(out, target)
+	}
+	return out
+}
+
+// runtime calls in a function: morestack, panics, write barriers
+func isRuntimeCall(name string) bool {
+	return name == "" || strings.HasPrefix(name, "runtime.")
+}
+
+/**
+ * @description: the first function called/jumped by the function at `pc`,
+ *  calls into the runtime are skipped, they are never the wrapped body
+ * @param {uintptr} pc
+ * @param {bool} call
+ * @return {*} 0 if not found
+ */
+func resolveBranch(pc uintptr, call bool) uintptr {
+	for _, target := range branchTargets(pc, call) {
+		if !isRuntimeCall(funcName(target)) {
+			return resolveABIWrapper(target)
+		}
+	}
+	return 0
+}
+
+/**
+ * @description: the ABI0 wrapper of a go function `F`, called by assembly, is an autogenerated
+ *  function also named `F` calling the ABIInternal `F` which every go caller goes to.
+ *  Return the go `F` for its wrapper, else pc itself. The wrapper of an assembly function
+ *  is kept: go callers reach the assembly only through it
+ * @param {uintptr} pc
+ * @return {*}
+ */
+func resolveABIWrapper(pc uintptr) uintptr {
+	fn := runtime.FuncForPC(pc)
+	if fn == nil || fn.Entry() != pc {
+		return pc
+	}
+	if file, _ := fn.FileLine(pc); file != autogenerated {
+		return pc
+	}
+	for _, call := range []bool{true, false} {
+		for _, target := range branchTargets(pc, call) {
+			body := runtime.FuncForPC(target)
+			if body == nil || body.Entry() != target || body.Name() != fn.Name() {
+				continue
+			}
+			if file, _ := body.FileLine(target); !strings.HasSuffix(file, ".s") {
+				return target
+			}
+		}
+	}
+	return pc
+}
+
+// genericName drops the type arguments: `F[int]` -> `F`, `(*T[...]).M` -> `(*T).M`
+func genericName(name string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range name {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+/**
+ * @description: an instantiated generic function `F[int]` is a wrapper passing its
+ *  dictionary to the shape body `F[go.shape.int]`, which is shared by every
+ *  instantiation of the same GC shape. Find the shape body
+ * @param {uintptr} pc
+ * @return {*} 0 if pc is not an instantiation
+ */
+func resolveShape(pc uintptr) uintptr {
+	name := funcName(pc)
+	if !strings.Contains(name, "[") {
+		return 0
+	}
+	generic := genericName(name)
+	for _, call := range []bool{true, false} {
+		for _, target := range branchTargets(pc, call) {
+			if target != pc && genericName(funcName(target)) == generic {
+				return target
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+// growSrc has a frame of its own, the stack check sits in its prologue
+//go:noinline
+func growSrc(n int) int {
+	var buf [1024]byte
+	buf[n%len(buf)] = byte(n)
+	return int(buf[(n*7)%len(buf)]) + n
+}
+
+// growTramp calls, it owns a morestack block too
+//go:noinline
+func growTramp(n int) int {
+	return growSink(n)
+}
+
+//go:noinline
+func growSink(n int) int {
+	return n
+}
+
+var growHookCalls int32
+
+//go:noinline
+func growHook(n int) int {
+	atomic.AddInt32(&growHookCalls, 1)
+	return growTramp(n) + 1
+}
+
+// burn eats the stack before calling growSrc, at some depth the stack check of growSrc fails
+//go:noinline
+func burn(depth, n int) int {
+	var pad [96]byte
+	pad[depth%len(pad)] = byte(depth)
+	if depth == 0 {
+		return growSrc(n)
+	}
+	ret := burn(depth-1, n)
+	if pad[depth%len(pad)] != byte(depth) {
+		panic("stack is broken")
+	}
+	return ret
+}
+
+func TestHookStackGrowth(t *testing.T) {
+	const n = 5
+	if err := AddHook(growSrc, growHook, growTramp); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHook(growSrc)
+
+	calls := int32(0)
+	for depth := 0; depth < 200; depth++ {
+		ch := make(chan int)
+		// a fresh goroutine starts with a small stack
+		go func(depth int) {
+			ch <- burn(depth, n)
+		}(depth)
+		if got := <-ch; got != n+1 {
+			t.Fatalf("depth %d: growSrc(%d) = %d, want %d", depth, n, got, n+1)
+		}
+		calls++
+	}
+	// growing the stack must not run the hook twice
+	if got := atomic.LoadInt32(&growHookCalls); got != calls {
+		t.Fatalf("hook ran %d times for %d calls", got, calls)
+	}
+}
+
+func TestResolveBranch(t *testing.T) {
+	if got, want := resolveBranch(reflect.ValueOf(callRaw).Pointer(), true), reflect.ValueOf(raw).Pointer(); got != want {
+		t.Fatalf("callRaw calls %x, want %x", got, want)
+	}
+	// only the runtime is called, nothing to hook
+	if got := resolveBranch(reflect.ValueOf(onlyPanics).Pointer(), true); got != 0 {
+		t.Fatalf("onlyPanics calls %s", funcName(got))
+	}
+}
+
+//go:noinline
+func onlyPanics(i int) int {
+	if i > 10 {
+		panic("too big")
+	}
+	return i
+}
+
+func TestResolveABIWrapper(t *testing.T) {
+	// walk the text from the runtime, wrappers of go functions called by assembly live there
+	checked := 0
+	pc := reflect.ValueOf(runtime.GC).Pointer()
+	for i := 0; i < 50000; i++ {
+		fn := runtime.FuncForPC(pc)
+		size := funcSize(pc)
+		if fn == nil || size == 0 {
+			break
+		}
+		if got := resolveABIWrapper(pc); got != pc {
+			body := runtime.FuncForPC(got)
+			if body.Name() != fn.Name() || body.Entry() != got {
+				t.Errorf("%s at %x resolves to %s at %x", fn.Name(), pc, body.Name(), got)
+			}
+			if file, _ := body.FileLine(got); file == autogenerated {
+				t.Errorf("%s at %x resolves to a wrapper", fn.Name(), pc)
+			}
+			checked++
+		}
+		pc += uintptr(size)
+	}
+	if checked == 0 {
+		t.Skip("no ABI0 wrapper, go1.16 or older")
+	}
+	t.Logf("%d ABI0 wrappers resolved", checked)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// types a manifest signature could name, a type of another package is not known at runtime
+var signatureTypes = map[string]reflect.Type{
+	"context.Context": contextType,
+	"error":           errorType,
+	"interface{}":     reflect.TypeOf((*interface{})(nil)).Elem(),
+	"any":             reflect.TypeOf((*interface{})(nil)).Elem(),
+	"unsafe.Pointer":  reflect.TypeOf(unsafe.Pointer(nil)),
+	"bool":            reflect.TypeOf(false),
+	"string":          reflect.TypeOf(""),
+	"int":             reflect.TypeOf(int(0)),
+	"int8":            reflect.TypeOf(int8(0)),
+	"int16":           reflect.TypeOf(int16(0)),
+	"int32":           reflect.TypeOf(int32(0)),
+	"rune":            reflect.TypeOf(rune(0)),
+	"int64":           reflect.TypeOf(int64(0)),
+	"uint":            reflect.TypeOf(uint(0)),
+	"uint8":           reflect.TypeOf(uint8(0)),
+	"byte":            reflect.TypeOf(byte(0)),
+	"uint16":          reflect.TypeOf(uint16(0)),
+	"uint32":          reflect.TypeOf(uint32(0)),
+	"uint64":          reflect.TypeOf(uint64(0)),
+	"uintptr":         reflect.TypeOf(uintptr(0)),
+	"float32":         reflect.TypeOf(float32(0)),
+	"float64":         reflect.TypeOf(float64(0)),
+}
+
+/**
+ * @description: split `s` at the commas out of any brackets
+ * @param {string} s
+ * @return {*}
+ */
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if strings.TrimSpace(s[start:]) != "" || len(parts) > 0 {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+/**
+ * @description: the type named by `s` in a manifest signature.
+ *  pointers, maps, channels and functions are all a pointer to the hook, they are unsafe.Pointer
+ * @param {string} s
+ * @return {*}
+ */
+func parseSignatureType(s string) (reflect.Type, error) {
+	s = strings.TrimSpace(s)
+	if t, ok := signatureTypes[s]; ok {
+		return t, nil
+	}
+	for _, prefix := range []string{"*", "map[", "chan ", "chan<-", "<-chan", "func("} {
+		if strings.HasPrefix(s, prefix) {
+			return signatureTypes["unsafe.Pointer"], nil
+		}
+	}
+	if strings.HasPrefix(s, "[]") {
+		elem, err := parseSignatureType(s[2:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	}
+	return nil, fmt.Errorf("type %q is not supported, use unsafe.Pointer or interface{} of the same shape", s)
+}
+
+/**
+ * @description: the types of a parameter list, `ctx context.Context, n int` or `context.Context, int`
+ * @param {string} list
+ * @return {*} variadic if the last is `...T`
+ */
+func parseSignatureList(list string) (types []reflect.Type, variadic bool, err error) {
+	params := splitTopLevel(list)
+	for i, param := range params {
+		param = strings.TrimSpace(param)
+		// drop the name, a type never starts with an identifier followed by a space but chan
+		if sp := strings.IndexByte(param, ' '); sp > 0 && !strings.HasPrefix(param, "chan") && !strings.ContainsAny(param[:sp], "*[(.<") {
+			param = strings.TrimSpace(param[sp+1:])
+		}
+		if strings.HasPrefix(param, "...") {
+			if i != len(params)-1 {
+				return nil, false, fmt.Errorf("%q is not the last parameter", param)
+			}
+			param, variadic = "[]"+param[3:], true
+		}
+		t, err := parseSignatureType(param)
+		if err != nil {
+			return nil, false, err
+		}
+		types = append(types, t)
+	}
+	return types, variadic, nil
+}
+
+/**
+ * @description: the function type of a manifest signature, such as
+ *  `func(unsafe.Pointer, context.Context, string, ...interface{}) (unsafe.Pointer, error)`
+ * @param {string} sig
+ * @return {*}
+ */
+func parseSignature(sig string) (reflect.Type, error) {
+	s := strings.TrimSpace(sig)
+	if !strings.HasPrefix(s, "func(") {
+		return nil, fmt.Errorf("signature %q does not start with func(", sig)
+	}
+
+	// the matching ')' of the parameters
+	depth, end := 0, -1
+	for i := len("func"); i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth--; depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return nil, fmt.Errorf("signature %q: unbalanced parentheses", sig)
+	}
+
+	in, variadic, err := parseSignatureList(s[len("func("):end])
+	if err != nil {
+		return nil, fmt.Errorf("signature %q: %s", sig, err)
+	}
+	results := strings.TrimSpace(s[end+1:])
+	if strings.HasPrefix(results, "(") && strings.HasSuffix(results, ")") {
+		results = results[1 : len(results)-1]
+	}
+	out, resultVariadic, err := parseSignatureList(results)
+	if err == nil && resultVariadic {
+		err = fmt.Errorf("variadic result")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signature %q: %s", sig, err)
+	}
+	return reflect.FuncOf(in, out, variadic), nil
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+var (
+	symbolOnce sync.Once
+	// function name -> entry, of every go function in the binary
+	symbolTable map[string]uintptr
+)
+
+/**
+ * @description: entry of the go function named `name`, such as `net/http.(*conn).serve`.
+ *  the pclntab is walked once from a function of this package, a stripped binary has it too
+ * @param {string} name
+ * @return {*} 0 if not found
+ */
+func lookupSymbol(name string) uintptr {
+	symbolOnce.Do(loadSymbols)
+	return symbolTable[name]
+}
+
+func loadSymbols() {
+	symbolTable = make(map[string]uintptr)
+	anchor := reflect.ValueOf(loadSymbols).Pointer()
+
+	// backward: the function before `entry` owns `entry-1`
+	for entry := anchor; entry != 0; {
+		addSymbol(entry)
+		fn := runtime.FuncForPC(entry - 1)
+		if fn == nil {
+			break
+		}
+		entry = fn.Entry()
+	}
+	for entry := nextFuncEntry(anchor); entry != 0; entry = nextFuncEntry(entry) {
+		addSymbol(entry)
+	}
+}
+
+// the go text is contiguous, every pc of a function maps to its entry till the next function
+func nextFuncEntry(entry uintptr) uintptr {
+	inFunc := func(pc uintptr) bool {
+		fn := runtime.FuncForPC(pc)
+		return fn != nil && fn.Entry() == entry
+	}
+
+	// gallop, then bisect the boundary in (lo, hi]
+	lo, step := entry, uintptr(funcAlign)
+	for inFunc(lo + step) {
+		lo += step
+		step *= 2
+	}
+	hi := lo + step
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if inFunc(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	if fn := runtime.FuncForPC(hi); fn == nil || fn.Entry() != hi {
+		return 0
+	}
+	return hi
+}
+
+// a go function and its ABI wrapper share the name, keep the one go callers reach
+func symbolRank(entry uintptr) int {
+	file, _ := runtime.FuncForPC(entry).FileLine(entry)
+	switch {
+	case strings.HasSuffix(file, ".s"):
+		return 0
+	case file == autogenerated:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func addSymbol(entry uintptr) {
+	name := funcName(entry)
+	if old, ok := symbolTable[name]; ok && symbolRank(old) >= symbolRank(entry) {
+		return
+	}
+	symbolTable[name] = entry
+}
+
+/**
+ * @description: `args` of the runtime _func behind fn: size of the argument frame, arguments and results
+ * @param {*runtime.Func} fn
+ * @return {*} false if it is not known
+ */
+func funcArgSize(fn *runtime.Func) (int32, bool) {
+	p := unsafe.Pointer(fn)
+	// funcinl: an inlined body at the entry
+	if *(*uint32)(p) == ^uint32(0) {
+		return 0, false
+	}
+	// go1.17-: entry uintptr; nameoff int32; args int32
+	if *(*uintptr)(p) == fn.Entry() {
+		return *(*int32)(unsafe.Pointer(uintptr(p) + unsafe.Sizeof(uintptr(0)) + 4)), true
+	}
+	// go1.18+: entryoff uint32; nameoff int32; args int32
+	return *(*int32)(unsafe.Pointer(uintptr(p) + 8)), true
+}
+
+/**
+ * @description: the function at `src` and `target` take the same argument frame.
+ *  target is compiled by the same compiler, equal signatures get equal frames
+ * @param {uintptr} src
+ * @param {uintptr} target
+ * @return {*}
+ */
+func sameArgSize(src, target uintptr) bool {
+	srcFn, targetFn := runtime.FuncForPC(src), runtime.FuncForPC(target)
+	if srcFn == nil || targetFn == nil {
+		return false
+	}
+	srcArgs, ok := funcArgSize(srcFn)
+	if !ok {
+		return true
+	}
+	targetArgs, ok := funcArgSize(targetFn)
+	if !ok {
+		return true
+	}
+	return srcArgs == targetArgs
+}
+
+/**
+ * @description: the function at `src` takes the argument frame of a function of type `typ`
+ * @param {uintptr} src
+ * @param {reflect.Type} typ
+ * @return {*}
+ */
+func argSizeMatches(src uintptr, typ reflect.Type) bool {
+	fn := runtime.FuncForPC(src)
+	if fn == nil {
+		return false
+	}
+	args, ok := funcArgSize(fn)
+	if !ok {
+		return true
+	}
+	return alignUp(int(args), ptrSize) == alignUp(argFrameSize(typ), ptrSize)
+}
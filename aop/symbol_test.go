@@ -0,0 +1,109 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// an unexported type, the hook only sees it as unsafe.Pointer
+type byNameConn struct {
+	base int64
+}
+
+//go:noinline
+func (c *byNameConn) query(a, b int64) int64 {
+	return c.base + a*b
+}
+
+//go:noinline
+func byNameTrampoline(c unsafe.Pointer, a, b int64) int64 {
+	return a - b
+}
+
+//go:noinline
+func byNameHook(c unsafe.Pointer, a, b int64) int64 {
+	return byNameTrampoline(c, a, b) + 1000
+}
+
+//go:noinline
+func byNameShortHook(c unsafe.Pointer) int64 {
+	return 0
+}
+
+const byNameQuery = "github.com/pinpoint-apm/go-aop-agent/aop.(*byNameConn).query"
+
+func TestLookupSymbol(t *testing.T) {
+	if got, want := lookupSymbol("runtime.GC"), reflect.ValueOf(runtime.GC).Pointer(); got != want {
+		t.Fatalf("runtime.GC at %x, want %x", got, want)
+	}
+	if got, want := lookupSymbol(byNameQuery), reflect.ValueOf((*byNameConn).query).Pointer(); got != want {
+		t.Fatalf("%s at %x, want %x", byNameQuery, got, want)
+	}
+	if got := lookupSymbol("no/such.pkg.Func"); got != 0 {
+		t.Fatalf("no/such.pkg.Func at %x", got)
+	}
+}
+
+func TestAddHookByName(t *testing.T) {
+	conn := &byNameConn{base: 10}
+	if got := conn.query(3, 4); got != 22 {
+		t.Fatalf("query = %d", got)
+	}
+
+	if err := AddHookByName(byNameQuery, byNameHook, byNameTrampoline); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.query(3, 4); got != 1022 {
+		t.Fatalf("hooked query = %d, want 1022", got)
+	}
+
+	found := false
+	for _, info := range Hooks() {
+		if info.Kind == HookByName && info.Source == byNameQuery {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("hook by name not listed: %v", Hooks())
+	}
+
+	UnHookByName(byNameQuery)
+	if got := conn.query(3, 4); got != 22 {
+		t.Fatalf("unhooked query = %d", got)
+	}
+}
+
+func TestAddHookByNameError(t *testing.T) {
+	if err := AddHookByName("no/such.pkg.Func", byNameHook, byNameTrampoline); !errors.Is(err, ErrSymbolNotFound) {
+		t.Fatalf("err = %v, want %v", err, ErrSymbolNotFound)
+	}
+	// the argument frame of query is larger
+	if err := AddHookByName(byNameQuery, byNameShortHook, byNameShortHook); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("err = %v, want %v", err, ErrSignatureMismatch)
+	}
+	if err := AddHookByName(byNameQuery, byNameHook, byNameShortHook); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("err = %v, want %v", err, ErrSignatureMismatch)
+	}
+	if err := AddHookByName(byNameQuery, 1, byNameTrampoline); !errors.Is(err, ErrNotFunction) {
+		t.Fatalf("err = %v, want %v", err, ErrNotFunction)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	drainMinInterval = time.Millisecond
+	drainMaxInterval = 50 * time.Millisecond
+)
+
+/**
+ * @description: remove the hook on `iSrc`, safe when other goroutines are calling it.
+ * 1. src is restored at once, new calls go to the origin function.
+ * 2. The trampoline is released when no goroutine is running in the hook function.
+ *    It is checked by the stacks of all goroutines (stop-the-world, like runtime.Stack).
+ *    A hook made by reflect.MakeFunc (AddHookLiteral, AddHookSpec, AddInterceptor) counts the
+ *    goroutines in it instead, a call entering it meanwhile runs src restored.
+ * 3. If some goroutine still stays in the hook after `timeout`, the hook is placed back
+ *    and an error is returned, nothing changed.
+ * 4. A goroutine whose stack is too deep to be printed fully is treated as busy.
+ * 5. DO NOT CALL it from the hook function itself, a hook made by reflect.MakeFunc waits for
+ *    itself till `timeout`
+ * @param {interface{}} iSrc
+ * @param {time.Duration} timeout
+ * @return {*}
+ */
+func UnHookWait(iSrc interface{}, timeout time.Duration) error {
+	src := reflect.ValueOf(iSrc)
+	if src.Kind() != reflect.Func {
+		return &HookError{Op: "UnHookWait", Func: "src", Err: ErrNotFunction}
+	}
+
+	trampolineMu.Lock()
+	addr := lookupHook(src.Pointer())
+	if addr == 0 {
+		trampolineMu.Unlock()
+		return newHookError("UnHookWait", src.Pointer(), ErrNotHooked)
+	}
+	entry := trampolineMap[addr]
+	if entry.draining {
+		trampolineMu.Unlock()
+		return newHookError("UnHookWait", addr, ErrHookBusy)
+	}
+
+	var busy func() int
+	if gate := entry.gate; gate != nil {
+		busy = func() int {
+			// the world is stopped at safe points of go code, no goroutine stays in the stub
+			runtime.Stack(make([]byte, 1), true)
+			return int(atomic.LoadInt32(&gate.running))
+		}
+	} else {
+		fn := runtime.FuncForPC(entry.target)
+		if fn == nil {
+			trampolineMu.Unlock()
+			return newHookError("UnHookWait", entry.target, ErrTargetNotFound)
+		}
+		name := fn.Name()
+		if goroutinesIn(name, false) > 0 {
+			// waiting for itself
+			trampolineMu.Unlock()
+			return newHookError("UnHookWait", entry.target, ErrHookBusy)
+		}
+		busy = func() int {
+			return goroutinesIn(name, true)
+		}
+	}
+
+	engineUnhookSrc(entry.trampoline)
+	entry.draining = true
+	if entry.gate != nil {
+		atomic.StoreInt32(&entry.gate.closed, 1)
+	}
+	trampolineMu.Unlock()
+
+	drained := waitDrained(busy, timeout)
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	entry.draining = false
+	if !drained {
+		// rollback
+		engineRehookSrc(entry.trampoline)
+		if entry.gate != nil {
+			atomic.StoreInt32(&entry.gate.closed, 0)
+		}
+		return newHookError("UnHookWait", entry.target, ErrHookBusy)
+	}
+
+	engineRelease(entry.trampoline)
+	if entry.stub != nil {
+		engineFreeStub(entry.stub)
+	}
+	if entry.contextStub != nil {
+		engineFreeStub(entry.contextStub)
+	}
+	delete(trampolineMap, addr)
+	return nil
+}
+
+/**
+ * @description: poll the goroutines until nobody is in the hook
+ * @param {func() int} busy count of the goroutines in the hook
+ * @param {time.Duration} timeout
+ * @return {*} false if timeout
+ */
+func waitDrained(busy func() int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	interval := drainMinInterval
+	for {
+		if busy() == 0 {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > drainMaxInterval {
+			interval = drainMaxInterval
+		}
+	}
+}
+
+/**
+ * @description: count the goroutines whose stack contains function `name`
+ * @param {string} name full name from runtime.FuncForPC
+ * @param {bool} all all goroutines or current goroutine only
+ * @return {*} busy count
+ */
+func goroutinesIn(name string, all bool) int {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, all)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	frame := name + "("
+	busy := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		for _, line := range strings.Split(g, "\n") {
+			if strings.HasPrefix(line, frame) || strings.HasPrefix(line, "...additional frames elided...") {
+				busy++
+				break
+			}
+		}
+	}
+	return busy
+}
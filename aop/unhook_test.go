@@ -0,0 +1,194 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//go:noinline
+//go:nosplit
+//go:norace
+func wait_foo(a, b int64) int64 {
+	x := a*7 + b
+	return x ^ 0x1234
+}
+
+//go:noinline
+//go:nosplit
+//go:norace
+func wait_foo_tramp(a, b int64) int64 {
+	x := a*9 + b
+	return x ^ 0x4321
+}
+
+var (
+	waitEntered = make(chan struct{}, 1)
+	waitRelease = make(chan struct{})
+	waitInner   func() error
+)
+
+//go:noinline
+func hook_wait_foo(a, b int64) int64 {
+	if waitInner != nil {
+		if waitInner() == nil {
+			return -1
+		}
+		return wait_foo_tramp(a, b) + 1
+	}
+	waitEntered <- struct{}{}
+	<-waitRelease
+	return wait_foo_tramp(a, b) + 1
+}
+
+const waitOrigin = (1*7 + 2) ^ 0x1234
+
+func TestUnHookWait(t *testing.T) {
+	waitRelease = make(chan struct{})
+	if err := AddHook(wait_foo, hook_wait_foo, wait_foo_tramp); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int64)
+	go func() {
+		done <- wait_foo(1, 2)
+	}()
+	<-waitEntered
+
+	// one goroutine is blocked in the hook
+	if err := UnHookWait(wait_foo, 20*time.Millisecond); err == nil {
+		t.Fatal("UnHookWait should timeout")
+	}
+	if err := AddHook(wait_foo, hook_wait_foo, wait_foo_tramp); err == nil {
+		t.Fatal("hook should be placed back after timeout")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(waitRelease)
+	}()
+	if err := UnHookWait(wait_foo, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the goroutine inside the hook still reaches the origin function
+	if ret := <-done; ret != waitOrigin+1 {
+		t.Fatalf("hooked call returns %d", ret)
+	}
+	if ret := wait_foo(1, 2); ret != waitOrigin {
+		t.Fatalf("src is still hooked: %d", ret)
+	}
+	if ret := wait_foo_tramp(1, 2); ret != (1*9+2)^0x4321 {
+		t.Fatalf("trampoline func not restored: %d", ret)
+	}
+	if err := UnHookWait(wait_foo, time.Second); err == nil {
+		t.Fatal("src is not hooked")
+	}
+
+	// memory is reused
+	for i := 0; i < 64; i++ {
+		if err := AddHook(wait_foo, hook_wait_foo, wait_foo_tramp); err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+		if err := UnHookWait(wait_foo, time.Second); err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+	}
+}
+
+func TestUnHookWaitInsideHook(t *testing.T) {
+	if err := AddHook(wait_foo, hook_wait_foo, wait_foo_tramp); err != nil {
+		t.Fatal(err)
+	}
+	waitInner = func() error {
+		return UnHookWait(wait_foo, time.Second)
+	}
+	ret := wait_foo(1, 2)
+	waitInner = nil
+	if ret == -1 {
+		t.Fatal("UnHookWait inside the hook should fail")
+	}
+	if err := UnHookWait(wait_foo, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//go:noinline
+func wait_closure_foo(a, b int64) int64 {
+	x := a*5 + b
+	return x ^ 0x0f0f
+}
+
+// an interceptor is a hook made by reflect.MakeFunc, as AddHookLiteral and AddHookSpec
+func TestUnHookWaitClosure(t *testing.T) {
+	// a goroutine stays in another function made by reflect.MakeFunc
+	parked, park := make(chan struct{}), make(chan struct{})
+	other := reflect.MakeFunc(reflect.TypeOf(func() {}), func([]reflect.Value) []reflect.Value {
+		close(parked)
+		<-park
+		return nil
+	}).Interface().(func())
+	go other()
+	defer close(park)
+	<-parked
+
+	var calls int32
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	it := &Interceptor{
+		Name: "wait",
+		Before: func(inv *Invocation) {
+			atomic.AddInt32(&calls, 1)
+			if inv.Args[0].Int() == 1 {
+				entered <- struct{}{}
+				<-release
+			}
+		},
+	}
+	if err := AddInterceptor(wait_closure_foo, it); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int64)
+	go func() {
+		done <- wait_closure_foo(1, 2)
+	}()
+	<-entered
+
+	// one goroutine is blocked in the hook
+	if err := UnHookWait(wait_closure_foo, 20*time.Millisecond); !errors.Is(err, ErrHookBusy) {
+		t.Fatalf("UnHookWait should timeout: %v", err)
+	}
+	if ret := wait_closure_foo(3, 4); ret != (3*5+4)^0x0f0f || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("hook is not placed back: %d, %d calls", ret, calls)
+	}
+
+	close(release)
+	if ret := <-done; ret != (1*5+2)^0x0f0f {
+		t.Fatalf("hooked call returns %d", ret)
+	}
+	// the goroutine in the other function does not keep the hook
+	if err := UnHookWait(wait_closure_foo, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	wait_closure_foo(3, 4)
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Fatalf("src is still hooked: %d calls", calls)
+	}
+}
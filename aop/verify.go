@@ -0,0 +1,159 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+// VerifyOnlyEnv turns on the verify only mode at startup, before any plugin hooks
+const VerifyOnlyEnv = "PINPOINT_HOOK_VERIFY_ONLY"
+
+// HookReport tells what AddHook* would patch, it is made without touching any memory
+type HookReport struct {
+	Op string
+	// symbol of the function passed as iSrc
+	Source string
+	// symbol of the function would be patched
+	Patched string
+	Target  string
+	Kind    HookKind
+	// address would be patched and the size of instructions replaced there
+	Address      uintptr
+	PatchedBytes int
+	// the instructions replaced, the first of them if there are too many
+	Instructions []string
+	// size of the replaced instructions moved into the trampoline, short branches grow
+	RelocatedBytes int
+	// the go stack check of Patched is replaced as a whole
+	StackCheck bool
+	// Target is out of the direct jmp, a forward trampoline would be placed
+	Forward bool
+	// nil: AddHook* would patch
+	Err error
+}
+
+var (
+	// under trampolineMu
+	verifyOnly    = strings.ToLower(os.Getenv(VerifyOnlyEnv)) == "true"
+	verifyReports []HookReport
+)
+
+/**
+ * @description: in the verify only mode, AddHook* checks the hook as VerifyHook and patches nothing,
+ *  returns the error it would return. The reports are listed by VerifyReports.
+ *  Run a new go version in it to see which plugins would patch safely
+ * @param {bool} on
+ * @return {*}
+ */
+func SetVerifyOnly(on bool) {
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	verifyOnly = on
+}
+
+/**
+ * @description: reports of the hooks checked in the verify only mode, in order
+ * @return {*}
+ */
+func VerifyReports() []HookReport {
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	return append([]HookReport(nil), verifyReports...)
+}
+
+/**
+ * @description: check if AddHook(iSrc, iTarget, iTrampoline_func) would patch, without patching.
+ *  The prologue of iSrc is decoded and relocated into a buffer as AddHook does
+ * @param {*} iSrc
+ * @param {*} iTarget
+ * @param {interface{}} iTrampoline_func
+ * @return {*} error AddHook would return, the report is nil if the functions are not valid
+ */
+func VerifyHook(iSrc, iTarget, iTrampoline_func interface{}) (*HookReport, error) {
+	src := reflect.ValueOf(iSrc)
+	target := reflect.ValueOf(iTarget)
+	trampoline_func := reflect.ValueOf(iTrampoline_func)
+
+	if err := checkFuncs("VerifyHook", src, target, trampoline_func); err != nil {
+		return nil, err
+	}
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	report := verifyHookLocked("VerifyHook", codePointer(resolveABIWrapper(src.Pointer())), unsafe.Pointer(target.Pointer()),
+		unsafe.Pointer(trampoline_func.Pointer()), src.Pointer(), HookDirect)
+	return report, report.Err
+}
+
+/**
+ * @description: verify the arguments of installHook. trampolineMu must be held
+ * @return {*}
+ */
+func verifyHookLocked(op string, src, target, trampolineFunc unsafe.Pointer, origin uintptr, kind HookKind) *HookReport {
+	report := &HookReport{
+		Op:      op,
+		Source:  funcName(origin),
+		Patched: funcName(uintptr(src)),
+		Target:  funcName(uintptr(target)),
+		Kind:    kind,
+		Address: uintptr(src),
+	}
+	if _, ok := trampolineMap[uintptr(src)]; ok {
+		report.Err = newHookError(op, uintptr(src), ErrAlreadyHooked)
+		return report
+	}
+
+	verified := engineVerify(src, target, trampolineFunc)
+	if verified.fault != nil {
+		report.Err = verified.fault.hookError(op)
+	}
+	report.PatchedBytes = verified.srcSize
+	report.Instructions = verified.insts
+	if verified.relocatedSize > 0 {
+		report.RelocatedBytes = verified.relocatedSize
+	}
+	report.StackCheck = verified.stackCheck
+	report.Forward = verified.forward
+	return report
+}
+
+/**
+ * @description: record the report of a hook in the verify only mode, trampolineMu must be held.
+ *  A src verified already fails as AddHook* on it fails
+ * @param {*HookReport} report
+ * @return {*}
+ */
+func recordVerifyLocked(report *HookReport) error {
+	for _, old := range verifyReports {
+		if report.Err == nil && old.Err == nil && old.Address == report.Address {
+			report.Err = newHookError(report.Op, report.Address, ErrAlreadyHooked)
+		}
+	}
+	verifyReports = append(verifyReports, *report)
+	if report.Err != nil {
+		common.Logf("verify %s failed:%s", report.Source, report.Err)
+	} else {
+		common.Logf("verify %s: %d bytes patched at %s", report.Source, report.PatchedBytes, report.Patched)
+	}
+	return report.Err
+}
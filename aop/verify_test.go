@@ -0,0 +1,102 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aop
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// codeBytes copies the first bytes of fn
+func codeBytes(fn interface{}) []byte {
+	code := (*[16]byte)(codePointer(resolveABIWrapper(reflect.ValueOf(fn).Pointer())))
+	return append([]byte(nil), code[:]...)
+}
+
+func TestVerifyHook(t *testing.T) {
+	c := regCases[1]
+	before, hooks := codeBytes(c.src), len(Hooks())
+
+	report, err := VerifyHook(c.src, c.hook, c.tramp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PatchedBytes < 4 || len(report.Instructions) == 0 || report.RelocatedBytes == 0 ||
+		report.Kind != HookDirect || report.Source != funcName(reflect.ValueOf(c.src).Pointer()) {
+		t.Fatalf("bad report %+v", *report)
+	}
+	if !bytes.Equal(before, codeBytes(c.src)) || len(Hooks()) != hooks {
+		t.Fatal("VerifyHook patched")
+	}
+	if got := c.src(1, 2); got != c.origin {
+		t.Fatalf("src = %d, want %d", got, c.origin)
+	}
+
+	if report, err := VerifyHook(c.src, fakeRaw, c.tramp); report != nil || !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("report %v, err %v", report, err)
+	}
+
+	if err := AddHook(c.src, c.hook, c.tramp); err != nil {
+		t.Fatal(err)
+	}
+	defer UnHook(c.src)
+	if report, err := VerifyHook(c.src, c.hook, c.tramp); !errors.Is(err, ErrAlreadyHooked) || report.Err != err {
+		t.Fatalf("verify a hooked src: %v", err)
+	}
+}
+
+func TestVerifyOnly(t *testing.T) {
+	SetVerifyOnly(true)
+	defer func() {
+		SetVerifyOnly(false)
+		trampolineMu.Lock()
+		verifyReports = nil
+		trampolineMu.Unlock()
+	}()
+
+	c := regCases[3]
+	before, hooks := codeBytes(c.src), len(Hooks())
+	if err := AddHook(c.src, c.hook, c.tramp); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddHook(c.src, c.hook, c.tramp); !errors.Is(err, ErrAlreadyHooked) {
+		t.Fatalf("verify twice: %v", err)
+	}
+	spec := HookSpec{Symbol: "github.com/pinpoint-apm/go-aop-agent/aop.specTrace", Signature: "func(context.Context) int64"}
+	if err := AddHookSpec(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(before, codeBytes(c.src)) || len(Hooks()) != hooks {
+		t.Fatal("patched in the verify only mode")
+	}
+	if got := c.src(1, 2); got != c.origin {
+		t.Fatalf("src = %d, want %d", got, c.origin)
+	}
+	if got := specTrace(context.Background()); got != 0 {
+		t.Fatalf("specTrace = %d", got)
+	}
+
+	reports := VerifyReports()
+	if len(reports) != 3 || reports[0].Err != nil || reports[1].Err == nil || reports[2].Err != nil ||
+		reports[0].Op != "AddHook" || reports[2].Kind != HookBySpec || reports[2].Target != "reflect.makeFuncStub" {
+		t.Fatalf("reports %+v", reports)
+	}
+}
@@ -0,0 +1,469 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#include "x86.h"
+#include "goX86asm.h"
+#include <string.h>
+
+static inline int fits_rel32(int64_t v)
+{
+    return v >= INT32_MIN && v <= INT32_MAX;
+}
+
+static inline int32_t decode_at(const uint8_t *code, int32_t size, Inst *inst)
+{
+    memset(inst, 0, sizeof(*inst));
+    if (decode((Reg *)code, size, inst, 64, false) != E_OK || inst->Len <= 0 || inst->Len > size)
+    {
+        return -1;
+    }
+    return inst->Len;
+}
+
+X86_INST_TYPE x86_inst_type(const Inst *inst, const uint8_t *raw)
+{
+    if (inst->Op == RET || inst->Op == INT || inst->Op == UD2)
+    {
+        return X86_END;
+    }
+    if (inst->PCRel == 0)
+    {
+        return X86_OTHER;
+    }
+
+    uint8_t op = raw[inst->PCRelOff - 1];
+    if (inst->PCRel == 1)
+    {
+        if (op == 0xEB)
+            return X86_JMP;
+        if ((op & 0xF0) == 0x70)
+            return X86_JCC;
+        if (op >= 0xE0 && op <= 0xE3)
+            return X86_JCXZ;
+        return X86_BAD;
+    }
+    if (inst->PCRel == 4)
+    {
+        if (op == 0xE9)
+            return X86_JMP;
+        if (op == 0xE8)
+            return X86_CALL;
+        if (inst->PCRelOff >= 2 && raw[inst->PCRelOff - 2] == 0x0F && (op & 0xF0) == 0x80)
+            return X86_JCC;
+        return X86_REL32;
+    }
+    // rel16 truncates rip in 64-bit mode
+    return X86_BAD;
+}
+
+uint64_t x86_inst_target(const Inst *inst, const uint8_t *raw, uint64_t pc)
+{
+    // rel8 from decoder is not sign-extended, read the raw bytes
+    if (inst->PCRel == 1)
+    {
+        return pc + inst->Len + (int8_t)raw[inst->PCRelOff];
+    }
+    if (inst->PCRel == 4)
+    {
+        int32_t rel;
+        memcpy(&rel, raw + inst->PCRelOff, sizeof(rel));
+        return pc + inst->Len + rel;
+    }
+    return 0;
+}
+
+// condition of jcc rel8: 0x7X, jcc rel32: 0x0F 0x8X
+static inline int32_t jcc_cond(const Inst *inst, const uint8_t *raw)
+{
+    return raw[inst->PCRelOff - 1] & 0x0F;
+}
+
+static inline int32_t place_rel32(uint8_t *out, uint64_t pc, uint64_t target)
+{
+    int32_t rel = (int32_t)(target - pc);
+    memcpy(out, &rel, sizeof(rel));
+    return sizeof(rel);
+}
+
+static int32_t place_abs_jmp(uint8_t *out, uint64_t target)
+{
+    static const uint8_t jmp[] = {0xFF, 0x25, 0x00, 0x00, 0x00, 0x00};
+    memcpy(out, jmp, sizeof(jmp));
+    memcpy(out + sizeof(jmp), &target, sizeof(target));
+    return X86_ABS_JMP_SIZE;
+}
+
+// jmp rel32 if target is in range, else jmp [rip]
+static int32_t place_jmp(uint8_t *out, uint64_t newPc, uint64_t target)
+{
+    if (fits_rel32(target - (newPc + X86_JMP_REL32_SIZE)))
+    {
+        out[0] = 0xE9;
+        place_rel32(out + 1, newPc + X86_JMP_REL32_SIZE, target);
+        return X86_JMP_REL32_SIZE;
+    }
+    return place_abs_jmp(out, target);
+}
+
+static inline int32_t jmp_size(uint64_t newPc, uint64_t target)
+{
+    return fits_rel32(target - (newPc + X86_JMP_REL32_SIZE)) ? X86_JMP_REL32_SIZE : X86_ABS_JMP_SIZE;
+}
+
+/**
+ * @brief relocate one inst to `newPc`
+ * @param target where the branch goes at the new place, redirected and mapped into the code
+ * @param retOut the return address of a call is behind the relocated code
+ * @return int32_t size written, -1: can not relocate
+ */
+static int32_t relocate_one(const Inst *inst, const uint8_t *raw, uint64_t pc, uint64_t newPc, uint64_t target, int retOut, uint8_t *out)
+{
+    int32_t len = inst->Len;
+    int32_t n = 0;
+
+    switch (x86_inst_type(inst, raw))
+    {
+    case X86_OTHER:
+        memcpy(out, raw, len);
+        return len;
+
+    case X86_REL32:
+        if (!fits_rel32(target - (newPc + len)))
+        {
+            return -1;
+        }
+        memcpy(out, raw, len);
+        place_rel32(out + inst->PCRelOff, newPc + len, target);
+        return len;
+
+    case X86_JMP:
+        return place_jmp(out, newPc, target);
+
+    case X86_JCC:
+    {
+        int32_t cond = jcc_cond(inst, raw);
+        if (fits_rel32(target - (newPc + X86_JCC_REL32_SIZE)))
+        {
+            out[0] = 0x0F;
+            out[1] = 0x80 | cond;
+            place_rel32(out + 2, newPc + X86_JCC_REL32_SIZE, target);
+            return X86_JCC_REL32_SIZE;
+        }
+        // j!cc over the absolute jmp
+        out[0] = 0x70 | (cond ^ 1);
+        out[1] = X86_ABS_JMP_SIZE;
+        return 2 + place_abs_jmp(out + 2, target);
+    }
+
+    case X86_JCXZ:
+    {
+        // jrcxz taken; jmp not_taken; taken: jmp target. prefix 0x67 selects ecx, keep it
+        n = inst->PCRelOff;
+        memcpy(out, raw, n);
+        out[n++] = 2;
+        out[n++] = 0xEB;
+        out[n] = (uint8_t)jmp_size(newPc + n + 1, target);
+        n++;
+        return n + place_jmp(out + n, newPc + n, target);
+    }
+
+    case X86_CALL:
+    {
+        uint64_t ret = pc + len;
+        if (retOut)
+        {
+            // lea rsp, [rsp-8]; mov dword [rsp], ret_lo; mov dword [rsp+4], ret_hi; jmp target
+            static const uint8_t lea[] = {0x48, 0x8D, 0x64, 0x24, 0xF8};
+            static const uint8_t movLo[] = {0xC7, 0x04, 0x24};
+            static const uint8_t movHi[] = {0xC7, 0x44, 0x24, 0x04};
+            uint32_t lo = (uint32_t)ret, hi = (uint32_t)(ret >> 32);
+            memcpy(out + n, lea, sizeof(lea)), n += sizeof(lea);
+            memcpy(out + n, movLo, sizeof(movLo)), n += sizeof(movLo);
+            memcpy(out + n, &lo, sizeof(lo)), n += sizeof(lo);
+            memcpy(out + n, movHi, sizeof(movHi)), n += sizeof(movHi);
+            memcpy(out + n, &hi, sizeof(hi)), n += sizeof(hi);
+            return n + place_jmp(out + n, newPc + n, target);
+        }
+        if (fits_rel32(target - (newPc + len)))
+        {
+            out[0] = 0xE8;
+            place_rel32(out + 1, newPc + len, target);
+            return len;
+        }
+        // call [rip+2]; jmp +8; .quad target
+        static const uint8_t call[] = {0xFF, 0x15, 0x02, 0x00, 0x00, 0x00, 0xEB, 0x08};
+        memcpy(out, call, sizeof(call));
+        memcpy(out + sizeof(call), &target, sizeof(target));
+        return sizeof(call) + sizeof(target);
+    }
+
+    default:
+        return -1;
+    }
+}
+
+int32_t x86_relocate_bound(const uint8_t *code, int32_t size)
+{
+    int32_t off = 0, bound = 0;
+    while (off < size)
+    {
+        Inst inst;
+        if (decode_at(code + off, size - off, &inst) == -1)
+        {
+            return -1;
+        }
+        switch (x86_inst_type(&inst, code + off))
+        {
+        case X86_END:
+            return bound + size - off;
+        case X86_JMP:
+            bound += X86_ABS_JMP_SIZE;
+            break;
+        case X86_JCC:
+            bound += 2 + X86_ABS_JMP_SIZE;
+            break;
+        case X86_JCXZ:
+            bound += inst.PCRelOff + 3 + X86_ABS_JMP_SIZE;
+            break;
+        case X86_CALL:
+            bound += X86_MAX_RELOC_SIZE;
+            break;
+        default:
+            bound += inst.Len;
+        }
+        off += inst.Len;
+    }
+    return bound;
+}
+
+/**
+ * @brief one pass over the code. with `out` NULL, only newOff is filled
+ * @param newOff offset of each inst at the new place, by its offset in code. -1: not an inst boundary
+ */
+static int32_t relocate_pass(const uint8_t *code, int32_t size, uint64_t pc, uint64_t newPc, uint8_t *out,
+                             uint64_t redirectFrom, uint64_t redirectTo, int32_t *newOff, int32_t *failOff)
+{
+    uint8_t tmp[X86_MAX_RELOC_SIZE];
+    int32_t off = 0, n = 0;
+
+    while (off < size)
+    {
+        Inst inst;
+        const uint8_t *raw = code + off;
+        if (decode_at(raw, size - off, &inst) == -1)
+        {
+            *failOff = off;
+            return -1;
+        }
+
+        X86_INST_TYPE type = x86_inst_type(&inst, raw);
+        if (type == X86_END)
+        {
+            // ret and the int3 padding after it, never run through
+            if (out != NULL)
+            {
+                memcpy(out + n, raw, size - off);
+            }
+            newOff[off] = n;
+            return n + size - off;
+        }
+
+        uint64_t target = x86_inst_target(&inst, raw, pc + off);
+        if (redirectFrom != 0 && target == redirectFrom)
+        {
+            target = redirectTo;
+        }
+        else if (type != X86_REL32 && target >= pc && target < pc + size)
+        {
+            // branch into the code goes to its relocated copy. the first pass does not know it, any near one does
+            int32_t to = (int32_t)(target - pc);
+            if (out != NULL && newOff[to] == -1)
+            {
+                *failOff = off;
+                return -1;
+            }
+            target = out != NULL ? newPc + newOff[to] : newPc;
+        }
+
+        newOff[off] = n;
+        int32_t len = relocate_one(&inst, raw, pc + off, newPc + n, target, pc + off + inst.Len >= pc + size, out != NULL ? out + n : tmp);
+        if (len == -1)
+        {
+            *failOff = off;
+            return -1;
+        }
+        n += len;
+        off += inst.Len;
+    }
+    return n;
+}
+
+int32_t x86_relocate(const uint8_t *code, int32_t size, uint64_t pc, uint64_t newPc, uint8_t *out,
+                     uint64_t redirectFrom, uint64_t redirectTo, int32_t *failOff)
+{
+    int32_t newOff[X86_MAX_RELOC_CODE];
+    int32_t off = 0;
+    if (failOff == NULL)
+    {
+        failOff = &off;
+    }
+    if (size > X86_MAX_RELOC_CODE)
+    {
+        *failOff = 0;
+        return -1;
+    }
+
+    for (int32_t i = 0; i < size; i++)
+    {
+        newOff[i] = -1;
+    }
+    // sizes only depend on the inst before, so the second pass lays out the same
+    if (relocate_pass(code, size, pc, newPc, NULL, redirectFrom, redirectTo, newOff, failOff) == -1)
+    {
+        return -1;
+    }
+    return relocate_pass(code, size, pc, newPc, out, redirectFrom, redirectTo, newOff, failOff);
+}
+
+int32_t x86_relocate_layout(const uint8_t *code, int32_t size, uint64_t pc, uint64_t newPc,
+                            uint64_t redirectFrom, uint64_t redirectTo, int32_t *newOff)
+{
+    int32_t failOff = 0;
+    if (size > X86_MAX_RELOC_CODE)
+    {
+        return -1;
+    }
+    for (int32_t i = 0; i < size; i++)
+    {
+        newOff[i] = -1;
+    }
+    return relocate_pass(code, size, pc, newPc, NULL, redirectFrom, redirectTo, newOff, &failOff);
+}
+
+#ifdef UTEST_X86
+#include <assert.h>
+#include <stdio.h>
+
+typedef struct
+{
+    const char *name;
+    uint8_t code[16];
+    int32_t size;
+    uint64_t pc;
+    uint64_t newPc;
+    int32_t len;
+    uint8_t want[X86_MAX_RELOC_SIZE];
+} RelocCase;
+
+#define PC 0x400000ULL
+#define NEAR (PC + 0x1000)
+#define FAR (PC + 0x100000000ULL)
+
+// little-endian bytes of a 32-bit value
+#define LE32(v) (uint8_t)(v), (uint8_t)((v) >> 8), (uint8_t)((v) >> 16), (uint8_t)((v) >> 24)
+#define LE64(v) LE32((uint64_t)(v)), LE32((uint64_t)(v) >> 32)
+// jmp [rip]; .quad
+#define ABS_JMP(v) 0xFF, 0x25, 0, 0, 0, 0, LE64(v)
+
+static const RelocCase cases[] = {
+    // mov rax, rbx
+    {"other", {0x48, 0x89, 0xD8}, 3, PC, FAR, 3, {0x48, 0x89, 0xD8}},
+    // lea rax, [rip+0x100]
+    {"lea rip", {0x48, 0x8D, 0x05, LE32(0x100)}, 7, PC, NEAR, 7, {0x48, 0x8D, 0x05, LE32(0x100 - 0x1000)}},
+    // cmp byte [rip+0x100], 0x7: imm8 behind the disp32
+    {"cmp rip imm", {0x80, 0x3D, LE32(0x100), 0x07}, 7, PC, NEAR, 7, {0x80, 0x3D, LE32(0x100 - 0x1000), 0x07}},
+    // mov rax, [rip+0x100] can not reach from 4GB away, and there is no free register
+    {"mov rip far", {0x48, 0x8B, 0x05, LE32(0x100)}, 7, PC, FAR, -1, {0}},
+    // jmp +0x10
+    {"jmp rel8", {0xEB, 0x10}, 2, PC, NEAR, 5, {0xE9, LE32(0x12 - 0x1000 - 5)}},
+    {"jmp rel8 far", {0xEB, 0x10}, 2, PC, FAR, 14, {ABS_JMP(PC + 0x12)}},
+    // jmp +0x100
+    {"jmp rel32", {0xE9, LE32(0x100)}, 5, PC, NEAR, 5, {0xE9, LE32(0x105 - 0x1000 - 5)}},
+    // jbe +0x10
+    {"jcc rel8", {0x76, 0x10}, 2, PC, NEAR, 6, {0x0F, 0x86, LE32(0x12 - 0x1000 - 6)}},
+    // jbe far: ja over the absolute jmp
+    {"jcc rel8 far", {0x76, 0x10}, 2, PC, FAR, 16, {0x77, 0x0E, ABS_JMP(PC + 0x12)}},
+    // jne +0x100
+    {"jcc rel32", {0x0F, 0x85, LE32(0x100)}, 6, PC, NEAR, 6, {0x0F, 0x85, LE32(0x106 - 0x1000 - 6)}},
+    // jrcxz +0x10: jrcxz +2; jmp +5; jmp target
+    {"jrcxz", {0xE3, 0x10}, 2, PC, NEAR, 9, {0xE3, 0x02, 0xEB, 0x05, 0xE9, LE32(0x12 - 0x1000 - 9)}},
+    // jecxz keeps the address size prefix
+    {"jecxz far", {0x67, 0xE3, 0x10}, 3, PC, FAR, 19, {0x67, 0xE3, 0x02, 0xEB, 0x0E, ABS_JMP(PC + 0x13)}},
+    // call +0x100 returns behind the code: push the origin return address
+    {"call", {0xE8, LE32(0x100)}, 5, PC, NEAR, 25, {0x48, 0x8D, 0x64, 0x24, 0xF8, 0xC7, 0x04, 0x24, LE32(PC + 5), 0xC7, 0x44, 0x24, 0x04, LE32(0), 0xE9, LE32(0x105 - 0x1000 - 25)}},
+    // call +0x100; nop: returns into the code
+    {"call in", {0xE8, LE32(0x100), 0x90}, 6, PC, NEAR, 6, {0xE8, LE32(0x105 - 0x1000 - 5), 0x90}},
+    {"call in far", {0xE8, LE32(0x100), 0x90}, 6, PC, FAR, 17, {0xFF, 0x15, 0x02, 0, 0, 0, 0xEB, 0x08, LE64(PC + 0x105), 0x90}},
+    // jne +1; nop; nop: the branch stays in the code, widened and still skipping the first nop
+    {"jcc inside", {0x75, 0x01, 0x90, 0x90}, 4, PC, FAR, 8, {0x0F, 0x85, LE32(1), 0x90, 0x90}},
+    // jmp -2: loops on itself
+    {"jmp self", {0xEB, 0xFE}, 2, PC, FAR, 5, {0xE9, LE32(-5)}},
+    // jne +1 into the middle of `mov eax, 0x90909090`
+    {"jcc mid inst", {0x75, 0x01, 0xB8, 0x90, 0x90, 0x90, 0x90}, 7, PC, FAR, -1, {0}},
+    // ret; int3 padding copied as it is
+    {"ret", {0x01, 0xD8, 0xC3, 0xCC, 0xCC}, 5, PC, FAR, 5, {0x01, 0xD8, 0xC3, 0xCC, 0xCC}},
+};
+
+static void test_relocate()
+{
+    for (unsigned i = 0; i < sizeof(cases) / sizeof(cases[0]); i++)
+    {
+        const RelocCase *c = &cases[i];
+        uint8_t out[X86_MAX_RELOC_CODE + X86_MAX_RELOC_SIZE] = {0};
+        int32_t n = x86_relocate(c->code, c->size, c->pc, c->newPc, out, 0, 0, NULL);
+        if (n != c->len || (n > 0 && memcmp(out, c->want, n) != 0))
+        {
+            fprintf(stderr, "%s: got %d bytes:", c->name, n);
+            for (int j = 0; j < n; j++)
+                fprintf(stderr, " %02X", out[j]);
+            fprintf(stderr, "\n");
+            assert(0);
+        }
+        assert(n == -1 || n <= x86_relocate_bound(c->code, c->size));
+    }
+}
+
+static void test_redirect()
+{
+    // go stack check: cmp rsp, [r14+0x10]; jbe morestack
+    const uint8_t code[] = {0x49, 0x3B, 0x66, 0x10, 0x76, 0x20};
+    uint8_t out[32] = {0};
+    int32_t failOff = -1;
+    assert(x86_relocate(code, sizeof(code), PC, NEAR, out, PC + 0x26, NEAR + 0x100, &failOff) == 10);
+    assert(out[4] == 0x0F && out[5] == 0x86);
+    int32_t rel;
+    memcpy(&rel, out + 6, sizeof(rel));
+    assert(NEAR + 10 + rel == NEAR + 0x100);
+
+    int32_t newOff[sizeof(code)];
+    assert(x86_relocate_layout(code, sizeof(code), PC, NEAR, PC + 0x26, NEAR + 0x100, newOff) == 10);
+    assert(newOff[0] == 0 && newOff[1] == -1 && newOff[4] == 4 && newOff[5] == -1);
+
+    // nop; mov rax, [rip+0x100]
+    const uint8_t bad[] = {0x90, 0x48, 0x8B, 0x05, LE32(0x100)};
+    assert(x86_relocate(bad, sizeof(bad), PC, FAR, out, 0, 0, &failOff) == -1 && failOff == 1);
+}
+
+int main()
+{
+    test_relocate();
+    test_redirect();
+    printf("x86 relocator passed\n");
+    return 0;
+}
+#endif
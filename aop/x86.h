@@ -0,0 +1,82 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+#include <stdint.h>
+#include "Inst.h"
+
+/**
+ * x86-64 relocator.
+ * Moves the backup inst of a function to run at another place,
+ * never touches code memory, so it builds and tests on any host.
+ */
+
+// jmp rel32: 0xE9 +imm32
+#define X86_JMP_REL32_SIZE 5
+// jcc rel32: 0x0F 0x8X +imm32
+#define X86_JCC_REL32_SIZE 6
+// jmp [rip]; .quad target
+#define X86_ABS_JMP_SIZE 14
+// the longest sequence one inst becomes: a call emulated by pushing its return address
+#define X86_MAX_RELOC_SIZE 34
+// the longest code x86_relocate takes
+#define X86_MAX_RELOC_CODE 64
+
+typedef enum {
+    X86_OTHER = 0, // not pc-relative, copy as it is
+    X86_REL32,     // [rip+disp32] operand, xbegin: fixed in place
+    X86_JMP,       // jmp rel8/rel32
+    X86_JCC,       // jcc rel8/rel32
+    X86_JCXZ,      // jrcxz/jecxz, loop, loope, loopne: rel8 only
+    X86_CALL,      // call rel32
+    X86_END,       // ret, int3, ud2: nothing behind it runs
+    X86_BAD,       // pc-relative, but no way to move it: rel16, unknown rel8
+} X86_INST_TYPE;
+
+X86_INST_TYPE x86_inst_type(const Inst *inst, const uint8_t *raw);
+
+/**
+ * @brief target of a pc-relative inst at `pc`, the address referenced for [rip+disp32]
+ * @return uint64_t 0: not pc-relative
+ */
+uint64_t x86_inst_target(const Inst *inst, const uint8_t *raw, uint64_t pc);
+
+/**
+ * @brief the most bytes x86_relocate writes for `code`
+ * @return int32_t -1: `code` can not be decoded
+ */
+int32_t x86_relocate_bound(const uint8_t *code, int32_t size);
+
+/**
+ * @brief rewrite `size` bytes of code from `pc` to run at `newPc`.
+ *  short branches are widened, branches out of rel32 go through an absolute jmp,
+ *  branches into the code go to the relocated inst.
+ *  a call returning behind the code pushes its origin return address, so tracebacks see the origin function
+ * @param code copy of the code at pc
+ * @param out at least x86_relocate_bound bytes
+ * @param redirectFrom branches to it go to `redirectTo`, 0: none
+ * @param failOff offset of the inst can not be moved, could be NULL
+ * @return int32_t size written, -1: can not relocate
+ */
+int32_t x86_relocate(const uint8_t *code, int32_t size, uint64_t pc, uint64_t newPc, uint8_t *out,
+                     uint64_t redirectFrom, uint64_t redirectTo, int32_t *failOff);
+
+/**
+ * @brief where each inst of `code` is in what x86_relocate writes with the same arguments
+ * @param newOff `size` entries, the offset in out of the inst at each offset in code, -1: not an inst boundary
+ * @return int32_t size x86_relocate writes, -1: can not relocate
+ */
+int32_t x86_relocate_layout(const uint8_t *code, int32_t size, uint64_t pc, uint64_t newPc,
+                            uint64_t redirectFrom, uint64_t redirectTo, int32_t *newOff);
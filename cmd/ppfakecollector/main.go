@@ -0,0 +1,89 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// ppfakecollector stands in for collector-agent, so an app traced by the agent
+// runs end to end without a pinpoint install. It keeps the span trees sent by
+// the agent, writes them to a file one json a line, and serves them by http.
+//
+//	ppfakecollector -listen tcp:127.0.0.1:9999 -http 127.0.0.1:8089 -o spans.json
+//
+// Point the agent to it by common.Pinpoint_set_collect_agent_host("tcp:127.0.0.1:9999").
+//
+//	curl 127.0.0.1:8089/spans                    # the spans received
+//	curl '127.0.0.1:8089/spans?wait=3&timeout=10s' # wait for 3 spans first
+//	curl -X DELETE 127.0.0.1:8089/spans          # forget them
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pinpoint-apm/go-aop-agent/common/collectoragent"
+)
+
+func main() {
+	listen := flag.String("listen", "tcp:127.0.0.1:9999", "host of collector-agent, tcp:host:port or unix:path")
+	httpAddr := flag.String("http", "", "address to serve the spans on /spans, e.g. 127.0.0.1:8089")
+	output := flag.String("o", "", "file to append the spans to, - is stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ppfakecollector [flags]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	srv, err := collectoragent.Listen(*listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ppfakecollector: %s\n", err)
+		os.Exit(1)
+	}
+	defer srv.Close()
+
+	if *output != "" {
+		var w io.Writer = os.Stdout
+		if *output != "-" {
+			f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ppfakecollector: %s\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			w = f
+		}
+		srv.SetOutput(w)
+	}
+
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/spans", srv)
+		go func() {
+			if err := http.ListenAndServe(*httpAddr, mux); err != nil {
+				fmt.Fprintf(os.Stderr, "ppfakecollector: %s\n", err)
+				os.Exit(1)
+			}
+		}()
+		fmt.Fprintf(os.Stderr, "ppfakecollector: spans on http://%s/spans\n", *httpAddr)
+	}
+	fmt.Fprintf(os.Stderr, "ppfakecollector: listening on %s\n", srv.Host())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
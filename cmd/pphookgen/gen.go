@@ -0,0 +1,484 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+type config struct {
+	output    string
+	before    string
+	end       string
+	exception string
+}
+
+// hookFunc is everything the template needs for one target
+type hookFunc struct {
+	FuncName   string
+	Expr       string
+	Hook       string
+	Tramp      string
+	Params     string
+	Results    string
+	Zeros      string
+	Ctx        string
+	Args       string
+	NewArgs    string
+	BeforeArgs string
+	Rets       string
+	Err        string
+}
+
+type file struct {
+	Package   string
+	Imports   [][]importSpec
+	Before    string
+	End       string
+	Exception string
+	Funcs     []*hookFunc
+}
+
+type importSpec struct {
+	Name string
+	Path string
+}
+
+// names used by the generated hook body
+var reservedNames = map[string]bool{
+	"funcName":   true,
+	"parentId":   true,
+	"err":        true,
+	"subTraceId": true,
+	"newCtx":     true,
+	"common":     true,
+	"aop":        true,
+	"context":    true,
+}
+
+/**
+ * @description: generate the source of hooks on `specs` for package under `dir`
+ * @param {string} dir
+ * @param {*config} cfg
+ * @param {[]string} specs
+ * @return {*} formatted source
+ */
+func generate(dir string, cfg *config, specs []string) ([]byte, error) {
+	l, err := newLoader(dir, filepath.Base(cfg.output))
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{
+		local:   l.local,
+		imports: map[string]string{},
+		used:    map[string]bool{},
+		hooks:   map[string]bool{},
+	}
+	g.qualifier("context")
+	g.qualifier("github.com/pinpoint-apm/go-aop-agent/aop")
+	g.qualifier("github.com/pinpoint-apm/go-aop-agent/common")
+
+	f := &file{
+		Package:   l.local.Name(),
+		Before:    cfg.before,
+		End:       cfg.end,
+		Exception: cfg.exception,
+	}
+	for _, spec := range specs {
+		pkg, fn, ptr, err := l.lookup(spec)
+		if err != nil {
+			return nil, err
+		}
+		h, err := g.hookFunc(pkg, fn, ptr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", spec, err)
+		}
+		f.Funcs = append(f.Funcs, h)
+	}
+	f.Imports = g.importGroups()
+
+	var buf bytes.Buffer
+	if err := fileTemplate.Execute(&buf, f); err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s\n%s", err, buf.Bytes())
+	}
+	return src, nil
+}
+
+type generator struct {
+	local *types.Package
+	// import path -> package name used in the generated file
+	imports map[string]string
+	used    map[string]bool
+	hooks   map[string]bool
+}
+
+func (g *generator) qualifier(path string) string {
+	if path == g.local.Path() {
+		return ""
+	}
+	if name, ok := g.imports[path]; ok {
+		return name
+	}
+
+	base := path[strings.LastIndex(path, "/")+1:]
+	if i := strings.IndexAny(base, ".-"); i >= 0 {
+		base = base[:i]
+	}
+	name := base
+	for i := 1; g.used[name] || g.local.Scope().Lookup(name) != nil; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	g.imports[path] = name
+	g.used[name] = true
+	return name
+}
+
+func (g *generator) typeString(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		return g.qualifier(p.Path())
+	})
+}
+
+func (g *generator) importGroups() [][]importSpec {
+	var std, others []importSpec
+	for path, name := range g.imports {
+		spec := importSpec{Path: path}
+		if base := path[strings.LastIndex(path, "/")+1:]; base != name {
+			spec.Name = name
+		}
+		if strings.Contains(strings.SplitN(path, "/", 2)[0], ".") {
+			others = append(others, spec)
+		} else {
+			std = append(std, spec)
+		}
+	}
+	byPath := func(specs []importSpec) {
+		sort.Slice(specs, func(i, j int) bool { return specs[i].Path < specs[j].Path })
+	}
+	byPath(std)
+	byPath(others)
+	return [][]importSpec{std, others}
+}
+
+/**
+ * @description: collect names and types of one target
+ * @param {*types.Package} pkg
+ * @param {*types.Func} fn
+ * @param {bool} ptr receiver is a pointer
+ * @return {*}
+ */
+func (g *generator) hookFunc(pkg *types.Package, fn *types.Func, ptr bool) (*hookFunc, error) {
+	sig := fn.Type().(*types.Signature)
+	for _, t := range append(tupleTypes(sig.Params()), tupleTypes(sig.Results())...) {
+		if err := g.checkExported(t); err != nil {
+			return nil, err
+		}
+		// register imports first, so no parameter shadows them
+		g.typeString(t)
+	}
+	qual := g.qualifier(pkg.Path())
+
+	h := &hookFunc{}
+	var names, paramTypes []string
+	seen := map[string]bool{}
+	addParam := func(name string, t string) {
+		if name == "" || name == "_" || reservedNames[name] || g.used[name] || seen[name] || isResultName(name) {
+			name = fmt.Sprintf("a%d", len(names))
+		}
+		for seen[name] {
+			name += "_"
+		}
+		seen[name] = true
+		names = append(names, name)
+		paramTypes = append(paramTypes, t)
+	}
+
+	if qual != "" {
+		qual += "."
+	}
+	baseName := fn.Name()
+	if recv := sig.Recv(); recv != nil {
+		named := derefNamed(recv.Type())
+		recvType := qual + named.Obj().Name()
+		h.FuncName = pkg.Path() + "." + named.Obj().Name() + "." + fn.Name()
+		h.Expr = recvType + "." + fn.Name()
+		if ptr {
+			recvType = "*" + recvType
+			h.FuncName = pkg.Path() + ".*" + named.Obj().Name() + "." + fn.Name()
+			h.Expr = "(" + recvType + ")." + fn.Name()
+		}
+		name := recv.Name()
+		if name == "" {
+			name = "recv"
+		}
+		addParam(name, recvType)
+		baseName = named.Obj().Name() + "_" + fn.Name()
+	} else {
+		h.FuncName = pkg.Path() + "." + fn.Name()
+		h.Expr = qual + fn.Name()
+	}
+	if pkg != g.local {
+		baseName = pkg.Name() + "_" + baseName
+	}
+	h.Hook = "hook_" + baseName
+	for i := 1; g.hooks[h.Hook]; i++ {
+		h.Hook = fmt.Sprintf("hook_%s%d", baseName, i)
+	}
+	g.hooks[h.Hook] = true
+	h.Tramp = h.Hook + "_trampoline"
+
+	params := sig.Params()
+	ctxIndex := -1
+	for i := 0; i < params.Len(); i++ {
+		p := params.At(i)
+		t := g.typeString(p.Type())
+		if sig.Variadic() && i == params.Len()-1 {
+			t = "..." + g.typeString(p.Type().(*types.Slice).Elem())
+		}
+		if ctxIndex == -1 && isContext(p.Type()) {
+			ctxIndex = len(names)
+		}
+		addParam(p.Name(), t)
+	}
+	if ctxIndex == -1 {
+		return nil, errors.New("no context.Context parameter to get the parent trace from")
+	}
+
+	var paramList, args, newArgs, beforeArgs []string
+	for i, name := range names {
+		paramList = append(paramList, name+" "+paramTypes[i])
+		arg := name
+		if strings.HasPrefix(paramTypes[i], "...") {
+			arg += "..."
+		}
+		args = append(args, arg)
+		if i == ctxIndex {
+			newArgs = append(newArgs, "newCtx")
+			continue
+		}
+		newArgs = append(newArgs, arg)
+		beforeArgs = append(beforeArgs, ", "+name)
+	}
+	h.Ctx = names[ctxIndex]
+	h.Params = strings.Join(paramList, ", ")
+	h.Args = strings.Join(args, ", ")
+	h.NewArgs = strings.Join(newArgs, ", ")
+	h.BeforeArgs = strings.Join(beforeArgs, "")
+
+	results := sig.Results()
+	var resultTypes, rets, zeros []string
+	for i := 0; i < results.Len(); i++ {
+		t := results.At(i).Type()
+		resultTypes = append(resultTypes, g.typeString(t))
+		rets = append(rets, fmt.Sprintf("r%d", i))
+		zeros = append(zeros, g.zero(t))
+	}
+	switch len(resultTypes) {
+	case 0:
+	case 1:
+		h.Results = resultTypes[0]
+	default:
+		h.Results = "(" + strings.Join(resultTypes, ", ") + ")"
+	}
+	h.Rets = strings.Join(rets, ", ")
+	h.Zeros = strings.Join(zeros, ", ")
+	if n := results.Len(); n > 0 && types.Identical(results.At(n-1).Type(), errorType) {
+		h.Err = rets[n-1]
+	}
+	return h, nil
+}
+
+var errorType = types.Universe.Lookup("error").Type()
+
+func isResultName(name string) bool {
+	if len(name) < 2 || name[0] != 'r' {
+		return false
+	}
+	for _, c := range name[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isContext(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	return ok && named.Obj().Pkg() != nil &&
+		named.Obj().Pkg().Path() == "context" && named.Obj().Name() == "Context"
+}
+
+func derefNamed(t types.Type) *types.Named {
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	return t.(*types.Named)
+}
+
+func tupleTypes(t *types.Tuple) []types.Type {
+	var ts []types.Type
+	for i := 0; i < t.Len(); i++ {
+		ts = append(ts, t.At(i).Type())
+	}
+	return ts
+}
+
+// the generated file can not refer to unexported types of other packages
+func (g *generator) checkExported(t types.Type) error {
+	var err error
+	var walk func(t types.Type)
+	walk = func(t types.Type) {
+		if err != nil {
+			return
+		}
+		switch t := t.(type) {
+		case *types.Named:
+			obj := t.Obj()
+			if obj.Pkg() != nil && obj.Pkg() != g.local && !obj.Exported() {
+				err = errors.New("unexported type " + obj.Pkg().Path() + "." + obj.Name())
+			}
+		case *types.Pointer:
+			walk(t.Elem())
+		case *types.Slice:
+			walk(t.Elem())
+		case *types.Array:
+			walk(t.Elem())
+		case *types.Chan:
+			walk(t.Elem())
+		case *types.Map:
+			walk(t.Key())
+			walk(t.Elem())
+		case *types.Signature:
+			for _, tt := range append(tupleTypes(t.Params()), tupleTypes(t.Results())...) {
+				walk(tt)
+			}
+		}
+	}
+	walk(t)
+	return err
+}
+
+func (g *generator) zero(t types.Type) string {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			return "false"
+		case u.Info()&types.IsString != 0:
+			return `""`
+		case u.Info()&types.IsNumeric != 0:
+			return "0"
+		default:
+			return "nil"
+		}
+	case *types.Struct, *types.Array:
+		return g.typeString(t) + "{}"
+	default:
+		return "nil"
+	}
+}
+
+var fileTemplate = template.Must(template.New("file").Parse(`// Code generated by pphookgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+{{range .}}	{{if .Name}}{{.Name}} {{end}}"{{.Path}}"
+{{end}}
+{{- end}}
+)
+
+func init() {
+	hooks := []struct {
+		name                string
+		f, hook, trampoline interface{}
+	}{
+{{- range .Funcs}}
+		{"{{.FuncName}}", {{.Expr}}, {{.Hook}}, {{.Tramp}}},
+{{- end}}
+	}
+
+	for _, h := range hooks {
+		common.Logf("try to hook " + h.name)
+		if err := aop.AddHook(h.f, h.hook, h.trampoline); err != nil {
+			common.Logf("Hook "+h.name+" failed:%s", err)
+			continue
+		}
+		common.Logf(h.name + " is hooked")
+	}
+}
+{{range .Funcs}}
+// {{.Tramp}} is replaced by the origin {{.FuncName}}
+//
+//go:noinline
+func {{.Tramp}}({{.Params}}) {{.Results}} {
+	{{- if .Results}}
+	return {{.Zeros}}
+	{{- end}}
+}
+
+// {{.Hook}} traces {{.FuncName}}
+//
+//go:noinline
+func {{.Hook}}({{.Params}}) {{.Results}} {
+	const funcName = "{{.FuncName}}"
+	if parentId, err := common.GetParentId({{.Ctx}}); err != nil {
+		common.Logf("parentId is not traceId type")
+		{{if .Results}}return {{end}}{{.Tramp}}({{.Args}})
+		{{- if not .Results}}
+		return
+		{{- end}}
+	} else {
+		if sampled, _ := common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId); sampled == common.PP_NOT_SAMPLED {
+			common.Logf("trace dropped")
+			{{if .Results}}return {{end}}{{.Tramp}}({{.Args}})
+			{{- if not .Results}}
+			return
+			{{- end}}
+		}
+
+		subTraceId := common.Pinpoint_start_trace(parentId)
+		defer common.Pinpoint_end_trace(subTraceId)
+
+		newCtx := {{$.Before}}(subTraceId, funcName, {{.Ctx}}{{.BeforeArgs}})
+		{{if .Results}}{{.Rets}} := {{end}}{{.Tramp}}({{.NewArgs}})
+		{{- if .Err}}
+		if {{.Err}} != nil {
+			{{$.Exception}}(subTraceId, funcName, &{{.Err}})
+		}
+		{{- end}}
+		{{$.End}}(subTraceId, funcName{{if .Results}}, {{.Rets}}{{end}})
+		{{- if .Results}}
+		return {{.Rets}}
+		{{- end}}
+	}
+}
+{{end}}`))
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden file")
+
+func TestGenerate(t *testing.T) {
+	cfg := &config{
+		output:    "hook_gen.go",
+		before:    "onBefore",
+		end:       "onEnd",
+		exception: "onException",
+	}
+	specs := []string{
+		"Person.Hello",
+		"(*Person).Rename",
+		"Div",
+		"Sum",
+		"Point",
+		"database/sql.(*DB).BeginTx",
+		"database/sql.(*DB).PingContext",
+	}
+
+	src, err := generate(filepath.Join("testdata", "app"), cfg, specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "hook_gen.go.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, want) {
+		t.Errorf("generated source differs from %s, run `go test -update` if it is expected\n%s", golden, src)
+	}
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	cfg := &config{output: "hook_gen.go"}
+	for _, spec := range []string{
+		"NoSuchFunc",
+		"Person.Rename",
+		"Person.NoSuchMethod",
+		"database/sql.Open",
+		"database/sql",
+	} {
+		if _, err := generate(filepath.Join("testdata", "app"), cfg, []string{spec}); err == nil {
+			t.Errorf("%s should fail", spec)
+		} else {
+			t.Log(err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// loader resolves targets against the local package and imported ones
+type loader struct {
+	dir      string
+	fset     *token.FileSet
+	importer types.ImporterFrom
+	local    *types.Package
+}
+
+/**
+ * @description: type-check the package under `dir`, `skip` (the output file) is left out,
+ *  so a stale generated file never breaks the generator
+ * @param {string} dir
+ * @param {string} skip
+ * @return {*}
+ */
+func newLoader(dir, skip string) (*loader, error) {
+	fset := token.NewFileSet()
+	l := &loader{
+		dir:      dir,
+		fset:     fset,
+		importer: importer.ForCompiler(fset, "source", nil).(types.ImporterFrom),
+	}
+
+	bp, err := build.Default.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*ast.File
+	for _, name := range append(bp.GoFiles, bp.CgoFiles...) {
+		if name == skip {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	conf := types.Config{
+		Importer:    l.importer,
+		FakeImportC: true,
+		// references into the skipped file are not our business
+		Error: func(error) {},
+	}
+	l.local, _ = conf.Check(localImportPath(dir, bp.Name), fset, files, nil)
+	return l, nil
+}
+
+func localImportPath(dir, name string) string {
+	cmd := exec.Command("go", "list", "-f", "{{.ImportPath}}", ".")
+	cmd.Dir = dir
+	if out, err := cmd.Output(); err == nil {
+		if path := strings.TrimSpace(string(out)); path != "" {
+			return path
+		}
+	}
+	return name
+}
+
+/**
+ * @description: find the function of `spec`
+ * @param {string} spec
+ * @return {*} the function, receiver is a pointer or not
+ */
+func (l *loader) lookup(spec string) (*types.Package, *types.Func, bool, error) {
+	pkg := l.local
+	rest := spec
+
+	if !l.isLocal(spec) {
+		path, r, err := splitSpec(spec)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if pkg, err = l.importer.ImportFrom(path, l.dir, 0); err != nil {
+			return nil, nil, false, err
+		}
+		rest = r
+	}
+
+	fn, ptr, err := lookupIn(pkg, rest)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("%s: %s", spec, err)
+	}
+	return pkg, fn, ptr, nil
+}
+
+func (l *loader) isLocal(spec string) bool {
+	if strings.Contains(spec, "/") {
+		return false
+	}
+	first := strings.TrimPrefix(spec, "(*")
+	if i := strings.IndexAny(first, ".)"); i >= 0 {
+		first = first[:i]
+	}
+	return l.local.Scope().Lookup(first) != nil
+}
+
+// splitSpec splits `import/path.rest`, the path ends at the first dot after the last slash
+func splitSpec(spec string) (string, string, error) {
+	slash := strings.LastIndex(spec, "/")
+	dot := strings.Index(spec[slash+1:], ".")
+	if dot < 0 {
+		return "", "", errors.New("bad target: " + spec)
+	}
+	dot += slash + 1
+	return spec[:dot], spec[dot+1:], nil
+}
+
+/**
+ * @description: find `F`, `T.M` or `(*T).M` in pkg
+ * @param {*types.Package} pkg
+ * @param {string} rest
+ * @return {*}
+ */
+func lookupIn(pkg *types.Package, rest string) (*types.Func, bool, error) {
+	ptr := false
+	if strings.HasPrefix(rest, "(*") {
+		end := strings.Index(rest, ")")
+		if end < 0 {
+			return nil, false, errors.New("bad method expression")
+		}
+		rest = rest[2:end] + rest[end+1:]
+		ptr = true
+	}
+
+	parts := strings.Split(rest, ".")
+	switch len(parts) {
+	case 1:
+		fn, ok := pkg.Scope().Lookup(parts[0]).(*types.Func)
+		if !ok {
+			return nil, false, errors.New("no such function")
+		}
+		return fn, false, nil
+	case 2:
+		tn, ok := pkg.Scope().Lookup(parts[0]).(*types.TypeName)
+		if !ok {
+			return nil, false, errors.New("no such type")
+		}
+		if types.IsInterface(tn.Type()) {
+			return nil, false, errors.New("method of interface has no body to hook")
+		}
+		var recv types.Type = tn.Type()
+		if ptr {
+			recv = types.NewPointer(recv)
+		}
+		// the method set of T has no method of *T
+		sel := types.NewMethodSet(recv).Lookup(pkg, parts[1])
+		if sel == nil {
+			return nil, false, errors.New("no such method in the method set of " + recv.String())
+		}
+		fn := sel.Obj().(*types.Func)
+		return fn, ptr, nil
+	default:
+		return nil, false, errors.New("bad target")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// pphookgen generates the trampoline, the hook and the init() registration
+// for a list of functions, so a plugin only writes the callbacks.
+//
+//	//go:generate go run github.com/pinpoint-apm/go-aop-agent/cmd/pphookgen -o hook_gen.go database/sql.(*DB).PingContext Person.TestInheritFunc
+//
+// A target is written as `import/path.Func`, `import/path.Type.Method` or
+// `import/path.(*Type).Method`. Targets without import path are looked up in
+// the package under the current directory first.
+// Every target must take a context.Context, the parent trace is read from it.
+//
+// The callbacks are supplied by the package, their names are set by
+// -before, -end and -exception:
+//
+//	func onBefore(id common.TraceIdType, funcName string, ctx context.Context, args ...interface{}) context.Context
+//	func onEnd(id common.TraceIdType, funcName string, results ...interface{})
+//	func onException(id common.TraceIdType, funcName string, err *error)
+//
+// onBefore gets all parameters except ctx, its return replaces ctx when calling
+// the origin function. onException is called when the last result is a non-nil error.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.output, "o", "pinpoint_hook_gen.go", "output file")
+	flag.StringVar(&cfg.before, "before", "onBefore", "name of the onBefore callback")
+	flag.StringVar(&cfg.end, "end", "onEnd", "name of the onEnd callback")
+	flag.StringVar(&cfg.exception, "exception", "onException", "name of the onException callback")
+	dir := flag.String("dir", ".", "directory of the package to generate into")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: pphookgen [flags] target...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	output := cfg.output
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(*dir, output)
+	}
+
+	src, err := generate(*dir, &cfg, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pphookgen: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := ioutil.WriteFile(output, src, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "pphookgen: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"context"
+	"errors"
+)
+
+type Person struct {
+	Name string
+}
+
+func (p Person) Hello(ctx context.Context, greeting string) string {
+	return greeting + " " + p.Name
+}
+
+func (p *Person) Rename(ctx context.Context, name string) {
+	p.Name = name
+}
+
+func Div(ctx context.Context, a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("divided by zero")
+	}
+	return a / b, nil
+}
+
+func Sum(ctx context.Context, err int, nums ...int) (r0 int) {
+	for _, n := range nums {
+		r0 += n
+	}
+	return r0 + err
+}
+
+func Point(_ string, ctx context.Context) (Person, [2]int, bool) {
+	return Person{}, [2]int{}, true
+}
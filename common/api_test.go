@@ -18,6 +18,8 @@ package common
 
 import (
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -62,18 +64,29 @@ func TestAgentApi(t *testing.T) {
 	Pinpoint_set_context("x", "xx", traceId3)
 
 	Pinpoint_set_context("x", "xx", traceIdRoot)
-	if Pinpoint_get_context("x", traceId3) != "xx" {
+	if v, ok := Pinpoint_get_context("x", traceId3); !ok || v != "xx" {
 		t.Log("Pinpoint_get_context traceId3 failed")
-		t.Log(Pinpoint_get_context("x", traceId3))
+		t.Log(v)
 		t.Fail()
 	}
 
-	if Pinpoint_get_context("x1", traceId3) == "xx" {
+	if v, ok := Pinpoint_get_context("x1", traceId3); ok || v != "" {
 		t.Log("Pinpoint_get_context traceId3 failed")
-		t.Log(Pinpoint_get_context("x", traceId3))
+		t.Log(v)
 		t.Fail()
 	}
 
+	// neither missing nor cut
+	long := strings.Repeat("x", 5000)
+	Pinpoint_set_context("empty", "", traceId3)
+	Pinpoint_set_context("long", long, traceId3)
+	if v, ok := Pinpoint_get_context("empty", traceId3); !ok || v != "" {
+		t.Errorf("empty is %q %v", v, ok)
+	}
+	if v, ok := Pinpoint_get_context("long", traceId3); !ok || v != long {
+		t.Errorf("%d bytes of long are found", len(v))
+	}
+
 	Pinpoint_set_int_context("intxx", 1025, traceIdRoot)
 	if v, err := Pinpoint_get_int_context("intxx", traceId3); err != nil {
 		t.Error(err)
@@ -91,7 +104,7 @@ func TestAgentApi(t *testing.T) {
 	Pinpoint_add_exception("test exception", childId)
 	Pinpoint_end_trace(childId)
 
-	if Pinpoint_get_context("x", traceId2) != "xx" {
+	if v, _ := Pinpoint_get_context("x", traceId2); v != "xx" {
 		t.Log("Pinpoint_get_context traceId2 failed")
 		t.Fail()
 	}
@@ -101,14 +114,14 @@ func TestAgentApi(t *testing.T) {
 	Pinpoint_wake_trace(traceId2)
 	Pinpoint_end_trace(traceId2)
 
-	if Pinpoint_get_context("x", traceId1) != "xx" {
+	if v, _ := Pinpoint_get_context("x", traceId1); v != "xx" {
 		t.Log("Pinpoint_get_context traceId1 failed")
 		t.Fail()
 	}
 
 	Pinpoint_end_trace(traceId1)
 
-	if Pinpoint_get_context("contextRoot", traceIdRoot) != "xx" {
+	if v, _ := Pinpoint_get_context("contextRoot", traceIdRoot); v != "xx" {
 		t.Log("Pinpoint_get_context traceIdRoot failed")
 		t.Fail()
 	}
@@ -186,6 +199,33 @@ func TestTraceLimit(t *testing.T) {
 	}
 }
 
+func TestAsyncTraceParentEnded(t *testing.T) {
+	root := Pinpoint_start_trace(ROOT_TRACE)
+	service := Pinpoint_start_trace(root)
+	repository := Pinpoint_start_trace(service)
+	fork := Pinpoint_start_async_trace(repository)
+	if fork == INVALIED_TRACE {
+		t.Fatal("start async trace failed")
+	}
+	// the nodes above an async node end before it
+	if Pinpoint_end_trace(repository) != service || Pinpoint_end_trace(service) != root {
+		t.Fatal("end_trace should return the parent")
+	}
+	if Pinpoint_end_trace(root) != ROOT_TRACE {
+		t.Fatal("end_trace of the root should return ROOT_TRACE")
+	}
+	if Pinpoint_trace_root(fork) == INVALIED_TRACE {
+		t.Fatal("the async node is ended with its root")
+	}
+	Pinpoint_add_clue(PP_INTERCEPTOR_NAME, "worker", fork, CurrentTraceLoc)
+	if Pinpoint_end_trace(fork) != repository {
+		t.Fatal("end_trace of the async node should return its parent")
+	}
+	if Pinpoint_trace_root(fork) != INVALIED_TRACE || Pinpoint_trace_root(root) != INVALIED_TRACE {
+		t.Error("the trace is not finished with the last async node")
+	}
+}
+
 func TestMissingCase(t *testing.T) {
 	Pinpoint_gen_sid()
 	Pinpoint_gen_tid()
@@ -201,8 +241,8 @@ func BenchmarkSetlong(b *testing.B) {
 		root := Pinpoint_start_trace(ROOT_TRACE)
 		child := Pinpoint_start_trace(root)
 		Pinpoint_set_context("x", "xx", child)
-		v := Pinpoint_get_context("x", child)
-		if v != "xx" {
+		v, ok := Pinpoint_get_context("x", child)
+		if !ok || v != "xx" {
 			b.Fail()
 		}
 
@@ -225,16 +265,17 @@ func BenchmarkSetlong(b *testing.B) {
 
 func Test_logger(t *testing.T) {
 	Pinpoint_enable_debug_report(true)
-	called := false
+	// the agent info is logged from its goroutine too
+	var called int32
 	fun := func(format string, a ...interface{}) {
 		fmt.Println(fmt.Sprintf(format, a...))
-		called = true
+		atomic.StoreInt32(&called, 1)
 	}
 	SetLogCallBack(fun)
 
 	root := Pinpoint_start_trace(ROOT_TRACE)
 	Pinpoint_end_trace(root)
-	if !called {
+	if atomic.LoadInt32(&called) == 0 {
 		t.Fail()
 	}
 }
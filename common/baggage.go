@@ -0,0 +1,242 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+ * Baggage is a set of key, value pairs passed along a trace across services, e.g. the tenant or
+ * the experiment of a request. A pair is the header `Pinpoint-Baggage-<key>: <value>`, the value
+ * is url escaped. The middlewares read it into the trace context, annotate the root as
+ * "baggage.<key>", and httpClient and transport send it on. Keys are in lower case.
+ */
+const (
+	// the limits of a trace, the pairs beyond are dropped
+	PP_BAGGAGE_MAX_ENTRIES = 16
+	PP_BAGGAGE_MAX_BYTES   = 2048
+)
+
+// the context value of the baggage, a map[string]string never changed once stored
+const baggageKey = "[baggage]"
+
+var baggageLimit = struct {
+	entries int32
+	bytes   int32
+}{PP_BAGGAGE_MAX_ENTRIES, PP_BAGGAGE_MAX_BYTES}
+
+// the read, copy and store of SetBaggage
+var baggageMu sync.Mutex
+
+var (
+	ErrBaggageKey   = errors.New("baggage key is not of letters, digits, '-', '_' or '.'")
+	ErrBaggageLimit = errors.New("baggage is over the limit")
+	ErrNotTraced    = errors.New("ctx is not traced")
+)
+
+/**
+ * @description: the limits of the baggage of a trace, count of pairs and bytes of keys and values
+ * @param {int32} maxEntries <0: no limit, 0: baggage is disabled
+ * @param {int32} maxBytes <0: no limit
+ * @return {*}
+ */
+func Pinpoint_set_baggage_limit(maxEntries, maxBytes int32) {
+	atomic.StoreInt32(&baggageLimit.entries, maxEntries)
+	atomic.StoreInt32(&baggageLimit.bytes, maxBytes)
+}
+
+/**
+ * @description: the baggage of the trace of ctx
+ * @param {context.Context} ctx
+ * @return {*} a copy, nil if none
+ */
+func Baggage(ctx context.Context) map[string]string {
+	baggage := SpanFromContext(ctx).baggage()
+	if len(baggage) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(baggage))
+	for key, value := range baggage {
+		copied[key] = value
+	}
+	return copied
+}
+
+/**
+ * @description: add a pair to the baggage of the trace of ctx, the calls after send it on
+ * @param {context.Context} ctx
+ * @param {string} key
+ * @param {string} value
+ * @return {*} ErrNotTraced, ErrBaggageKey or ErrBaggageLimit
+ */
+func SetBaggage(ctx context.Context, key, value string) error {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return ErrNotTraced
+	}
+	return span.setBaggage(map[string]string{key: value})
+}
+
+/**
+ * @description: read the baggage headers of a request into the trace of span
+ * @param {*Span} span the root
+ * @param {http.Header} header
+ * @return {*}
+ */
+func ReadBaggage(span *Span, header http.Header) {
+	pairs := map[string]string{}
+	for name, values := range header {
+		if key, ok := baggageHeaderKey(name); ok && len(values) > 0 {
+			pairs[key] = unescapeBaggage(values[0])
+		}
+	}
+	readBaggage(span, pairs)
+}
+
+/**
+ * @description: ReadBaggage of the headers in a map, e.g. the metadata of go-micro
+ * @param {*Span} span
+ * @param {map[string]string} header
+ * @return {*}
+ */
+func ReadBaggageMap(span *Span, header map[string]string) {
+	pairs := map[string]string{}
+	for name, value := range header {
+		if key, ok := baggageHeaderKey(name); ok {
+			pairs[key] = unescapeBaggage(value)
+		}
+	}
+	readBaggage(span, pairs)
+}
+
+/**
+ * @description: set the baggage of the trace of span into the headers of an outgoing request
+ * @param {*Span} span
+ * @param {http.Header} header
+ * @return {*}
+ */
+func WriteBaggage(span *Span, header http.Header) {
+	for key, value := range span.baggage() {
+		header.Set(PP_HEADER_PINPOINT_BAGGAGE+key, url.QueryEscape(value))
+	}
+}
+
+// the key of Pinpoint-Baggage-<key> or of HTTP_PINPOINT_BAGGAGE_<KEY>
+func baggageHeaderKey(name string) (string, bool) {
+	for _, prefix := range []string{PP_HEADER_PINPOINT_BAGGAGE, PP_HTTP_PINPOINT_BAGGAGE} {
+		if len(name) > len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+			return strings.ToLower(name[len(prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// a value not escaped is taken as it is
+func unescapeBaggage(value string) string {
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
+
+func readBaggage(span *Span, pairs map[string]string) {
+	if len(pairs) == 0 {
+		return
+	}
+	if err := span.setBaggage(pairs); err != nil {
+		Logf("baggage of the request: %s", err)
+	}
+}
+
+func (span *Span) baggage() map[string]string {
+	value, _ := span.ContextValue(baggageKey)
+	baggage, _ := value.(map[string]string)
+	return baggage
+}
+
+// setBaggage adds the pairs in the order of keys, the ones over the limit are dropped
+func (span *Span) setBaggage(pairs map[string]string) error {
+	if span == nil {
+		return ErrNotTraced
+	}
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	maxEntries := int(atomic.LoadInt32(&baggageLimit.entries))
+	maxBytes := int(atomic.LoadInt32(&baggageLimit.bytes))
+
+	baggageMu.Lock()
+	defer baggageMu.Unlock()
+	old := span.baggage()
+	baggage := make(map[string]string, len(old)+len(pairs))
+	size := 0
+	for key, value := range old {
+		baggage[key] = value
+		size += len(key) + len(value)
+	}
+
+	var err error
+	root := span.Root()
+	for _, key := range keys {
+		value := pairs[key]
+		key = strings.ToLower(key)
+		if !validBaggageKey(key) {
+			err = ErrBaggageKey
+			continue
+		}
+		newSize := size + len(key) + len(value)
+		oldValue, found := baggage[key]
+		if found {
+			newSize -= len(key) + len(oldValue)
+		} else if maxEntries >= 0 && len(baggage) >= maxEntries {
+			err = ErrBaggageLimit
+			continue
+		}
+		if maxBytes >= 0 && newSize > maxBytes {
+			err = ErrBaggageLimit
+			continue
+		}
+		baggage[key] = value
+		size = newSize
+		root.SetAnnotation(PP_BAGGAGE+"."+key, value)
+	}
+	span.SetContextValue(baggageKey, baggage)
+	return err
+}
+
+func validBaggageKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBaggage(t *testing.T) {
+	traces := recordTraces(t)
+
+	root := StartSpan("/checkout")
+	ReadBaggage(root, http.Header{
+		"Pinpoint-Baggage-Tenant": {"7"},
+		"Pinpoint-Baggage-Exp":    {"checkout%20b"},
+		"Pinpoint-Traceid":        {"tid"},
+	})
+	ctx := ContextWithSpan(context.Background(), root)
+	if err := SetBaggage(ctx, "User", "tom"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"tenant": "7", "exp": "checkout b", "user": "tom"}
+	if got := Baggage(ctx); !reflect.DeepEqual(got, want) {
+		t.Errorf("baggage %v, want %v", got, want)
+	}
+	Baggage(ctx)["tenant"] = "8"
+	if err := SetBaggage(ctx, "tenant id", "7"); err != ErrBaggageKey {
+		t.Errorf("a key with a space: %v", err)
+	}
+	if err := SetBaggage(context.Background(), "user", "tom"); err != ErrNotTraced || Baggage(context.Background()) != nil {
+		t.Errorf("baggage out of a trace: %v", err)
+	}
+
+	// sent on by the span events, read back by the next service
+	child := root.Child("client")
+	header := http.Header{}
+	WriteBaggage(child, header)
+	if header.Get("Pinpoint-Baggage-Exp") != "checkout+b" || len(header) != 3 {
+		t.Errorf("headers %v", header)
+	}
+	child.End()
+	root.End()
+
+	next := StartSpan("/pay")
+	ReadBaggage(next, header)
+	if got := Baggage(ContextWithSpan(ctx, next)); !reflect.DeepEqual(got, want) {
+		t.Errorf("baggage of the next service %v, want %v", got, want)
+	}
+	next.End()
+
+	rec := (*traces)[0]
+	for _, clue := range []string{"baggage.tenant:7", "baggage.exp:checkout b", "baggage.user:tom"} {
+		found := false
+		for _, c := range rec.ClueList {
+			found = found || c == clue
+		}
+		if !found {
+			t.Errorf("%q not in the annotations %q", clue, rec.ClueList)
+		}
+	}
+}
+
+func TestBaggageMap(t *testing.T) {
+	recordTraces(t)
+
+	header := PinTransactionHeader{Url: "/user", Baggage: map[string]string{"tenant": "7"}}
+	var got map[string]string
+	PinTranscation(&header, func(ctx context.Context) error {
+		ReadBaggageMap(SpanFromContext(ctx), map[string]string{
+			"HTTP_PINPOINT_BAGGAGE_EXP": "b",
+			"Pinpoint-Traceid":          "tid",
+		})
+		got = Baggage(ctx)
+		return nil
+	}, context.Background())
+	if want := map[string]string{"tenant": "7", "exp": "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("baggage %v, want %v", got, want)
+	}
+}
+
+func TestBaggageLimit(t *testing.T) {
+	recordTraces(t)
+	Pinpoint_set_baggage_limit(2, 16)
+	defer Pinpoint_set_baggage_limit(PP_BAGGAGE_MAX_ENTRIES, PP_BAGGAGE_MAX_BYTES)
+
+	root := StartSpan("/checkout")
+	defer root.End()
+	ctx := ContextWithSpan(context.Background(), root)
+	// the pairs over the limit are dropped in the order of keys
+	ReadBaggage(root, http.Header{
+		"Pinpoint-Baggage-A": {"1"},
+		"Pinpoint-Baggage-B": {"2"},
+		"Pinpoint-Baggage-C": {"3"},
+	})
+	if err := SetBaggage(ctx, "d", "4"); err != ErrBaggageLimit {
+		t.Errorf("a pair over the count: %v", err)
+	}
+	if err := SetBaggage(ctx, "b", "22"); err != nil {
+		t.Errorf("replace a pair: %v", err)
+	}
+	if err := SetBaggage(ctx, "a", strings.Repeat("1", 16)); err != ErrBaggageLimit {
+		t.Errorf("a pair over the bytes: %v", err)
+	}
+	if got, want := Baggage(ctx), map[string]string{"a": "1", "b": "22"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("baggage %v, want %v", got, want)
+	}
+
+	Pinpoint_set_baggage_limit(0, -1)
+	if err := SetBaggage(ContextWithSpan(ctx, StartSpan("/disabled")), "a", "1"); err != ErrBaggageLimit {
+		t.Errorf("baggage is not disabled: %v", err)
+	}
+}
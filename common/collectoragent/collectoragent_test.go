@@ -0,0 +1,166 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package collectoragent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFrame(t *testing.T) {
+	frame := EncodeFrame(ReqUpdateSpan, []byte(`{}`))
+	if !bytes.Equal(frame, []byte{0, 0, 0, 1, 0, 0, 0, 2, '{', '}'}) {
+		t.Fatalf("frame % X", frame)
+	}
+	typ, body, err := ReadFrame(bytes.NewReader(frame))
+	if err != nil || typ != ReqUpdateSpan || string(body) != "{}" {
+		t.Fatalf("%d %s %v", typ, body, err)
+	}
+	if _, _, err := ReadFrame(bytes.NewReader([]byte{0, 0, 0, 1, 0xFF, 0, 0, 0})); err != ErrBadFrame {
+		t.Errorf("err %v", err)
+	}
+
+	for host, want := range map[string]string{
+		"tcp:127.0.0.1:9999":       "tcp 127.0.0.1:9999",
+		"unix:/tmp/collector.sock": "unix /tmp/collector.sock",
+		"127.0.0.1:9999":           "",
+		"udp:127.0.0.1:9999":       "",
+		"unix:":                    "",
+	} {
+		network, address, err := ParseHost(host)
+		if (err == nil) != (want != "") || (err == nil && network+" "+address != want) {
+			t.Errorf("%s: %s %s %v", host, network, address, err)
+		}
+	}
+}
+
+// syncBuffer is written by the goroutine of a connection
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServer(t *testing.T) {
+	srv, err := Listen("tcp:127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if !strings.HasPrefix(srv.Host(), "tcp:127.0.0.1:") || strings.HasSuffix(srv.Host(), ":0") {
+		t.Fatalf("host %s", srv.Host())
+	}
+	var out syncBuffer
+	srv.SetOutput(&out)
+
+	network, address, _ := ParseHost(srv.Host())
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	typ, body, err := ReadFrame(conn)
+	var info map[string]string
+	if err != nil || typ != RespAgentInfo || json.Unmarshal(body, &info) != nil || info["time"] == "" {
+		t.Fatalf("agent info %d %s %v", typ, body, err)
+	}
+
+	conn.Write(EncodeFrame(ReqUpdateSpan, []byte(`{"name":"/index", "calls":[{"name":"sql"}]}`)))
+	// only spans are kept
+	conn.Write(EncodeFrame(RespAgentInfo, []byte(`{}`)))
+	conn.Write(EncodeFrame(ReqUpdateSpan, []byte(`{"name":"/login"}`)))
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "?wait=2&timeout=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spans []Span
+	json.NewDecoder(resp.Body).Decode(&spans)
+	resp.Body.Close()
+	if len(spans) != 2 || spans[0]["name"] != "/index" || spans[1]["name"] != "/login" {
+		t.Fatalf("spans %v", spans)
+	}
+	if calls, _ := spans[0]["calls"].([]interface{}); len(calls) != 1 {
+		t.Fatalf("calls %v", spans[0]["calls"])
+	}
+	if got := out.String(); got != "{\"name\":\"/index\",\"calls\":[{\"name\":\"sql\"}]}\n{\"name\":\"/login\"}\n" {
+		t.Errorf("output %q", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL, nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete %v %v", resp, err)
+	}
+	if spans, err := srv.Wait(1, 10*time.Millisecond); err == nil || len(spans) != 0 {
+		t.Errorf("spans after reset %v %v", spans, err)
+	}
+
+	// a broken agent is disconnected, the others go on
+	conn.Write(EncodeFrame(ReqUpdateSpan, []byte(`not json`)))
+	if _, _, err := ReadFrame(conn); err == nil {
+		t.Error("broken agent should be disconnected")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv, err := Listen("tcp:127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, address, _ := ParseHost(srv.Host())
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ReadFrame(conn)
+
+	// connected agents do not keep it open
+	done := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs on a connected agent")
+	}
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Error("still listening after Close")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package collectoragent
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+/**
+ * The protocol of collector-agent, the same as TransLayer of pinpoint_common.
+ * Every message is a frame: type and length of the body in uint32 network byte order, then the body.
+ *  REQ_UPDATE_SPAN(ReqUpdateSpan): agent -> collector-agent, the json of a span tree
+ *  RESPONSE_AGENT_INFO(RespAgentInfo): collector-agent -> agent, json of the agent info
+ */
+
+const (
+	RespAgentInfo = 0
+	ReqUpdateSpan = 1
+
+	FrameHeaderSize = 8
+	// a larger frame is not from collector-agent
+	MaxFrameSize = 16 << 20
+)
+
+var ErrBadFrame = errors.New("bad collector-agent frame")
+
+/**
+ * @description: a frame of collector-agent
+ * @param {uint32} typ ReqUpdateSpan or RespAgentInfo
+ * @param {[]byte} body
+ * @return {*}
+ */
+func EncodeFrame(typ uint32, body []byte) []byte {
+	frame := make([]byte, FrameHeaderSize, FrameHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame, typ)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(body)))
+	return append(frame, body...)
+}
+
+/**
+ * @description: read a frame of collector-agent
+ * @param {io.Reader} r
+ * @return {*} type and body of the frame
+ */
+func ReadFrame(r io.Reader) (uint32, []byte, error) {
+	var header [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > MaxFrameSize {
+		return 0, nil, ErrBadFrame
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header[:4]), body, nil
+}
+
+/**
+ * @description: parse the host of collector-agent, as Pinpoint_set_collect_agent_host takes it
+ * @param {string} host tcp:dev.collector:9999 or unix:/tmp/collector.sock
+ * @return {*} network and address for net.Dial
+ */
+func ParseHost(host string) (string, string, error) {
+	i := strings.IndexByte(host, ':')
+	if i < 0 {
+		return "", "", errors.New("collector-agent host must be tcp:host:port or unix:path")
+	}
+	network, address := host[:i], host[i+1:]
+	if (network != "tcp" && network != "unix") || address == "" {
+		return "", "", errors.New("collector-agent host must be tcp:host:port or unix:path")
+	}
+	return network, address, nil
+}
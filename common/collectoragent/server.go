@@ -0,0 +1,275 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package collectoragent speaks the protocol between an agent and collector-agent.
+// Server stands in for collector-agent in tests, it keeps the span trees sent
+// to it instead of passing them to the pinpoint collector.
+//
+//	srv, _ := collectoragent.Listen("tcp:127.0.0.1:0")
+//	defer srv.Close()
+//	common.Pinpoint_set_collect_agent_host(srv.Host())
+//	...
+//	spans, err := srv.Wait(1, 5*time.Second)
+package collectoragent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span is the json of a span tree sent by the agent
+type Span map[string]interface{}
+
+// Server is a stand-in of collector-agent
+type Server struct {
+	ln   net.Listener
+	host string
+
+	mu    sync.Mutex
+	spans []Span
+	// closed and renewed on every span, Wait selects on it
+	arrived chan struct{}
+	out     io.Writer
+	conns   map[net.Conn]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+/**
+ * @description: listen as collector-agent
+ * @param {string} host tcp:127.0.0.1:9999 or unix:/tmp/collector.sock, port 0 picks a free one
+ * @return {*}
+ */
+func Listen(host string) (*Server, error) {
+	network, address, err := ParseHost(host)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:      ln,
+		host:    network + ":" + ln.Addr().String(),
+		arrived: make(chan struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+/**
+ * @description: the host to pass to Pinpoint_set_collect_agent_host
+ * @param {*}
+ * @return {string}
+ */
+func (s *Server) Host() string {
+	return s.host
+}
+
+/**
+ * @description: write every span received from now on to `w`, one json a line
+ * @param {io.Writer} w nil stops it
+ * @return {*}
+ */
+func (s *Server) SetOutput(w io.Writer) {
+	s.mu.Lock()
+	s.out = w
+	s.mu.Unlock()
+}
+
+/**
+ * @description: the spans received, in the order they arrived
+ * @param {*}
+ * @return {[]Span}
+ */
+func (s *Server) Spans() []Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Span(nil), s.spans...)
+}
+
+/**
+ * @description: forget the spans received
+ * @param {*}
+ * @return {*}
+ */
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.spans = nil
+	s.mu.Unlock()
+}
+
+/**
+ * @description: wait until `n` spans are received
+ * @param {int} n
+ * @param {time.Duration} timeout
+ * @return {*} the spans received, an error if they are less than `n` at the timeout
+ */
+func (s *Server) Wait(n int, timeout time.Duration) ([]Span, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		spans, arrived := append([]Span(nil), s.spans...), s.arrived
+		s.mu.Unlock()
+		if len(spans) >= n {
+			return spans, nil
+		}
+		select {
+		case <-arrived:
+		case <-timer.C:
+			return spans, fmt.Errorf("%d spans received in %s, want %d", len(spans), timeout, n)
+		}
+	}
+}
+
+/**
+ * @description: GET returns the spans received as a json array,
+ *  GET ?wait=N&timeout=5s waits for N spans first, DELETE forgets them.
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		spans := s.Spans()
+		if wait := r.FormValue("wait"); wait != "" {
+			n, err := strconv.Atoi(wait)
+			if err != nil {
+				http.Error(w, "wait must be a number", http.StatusBadRequest)
+				return
+			}
+			timeout := 5 * time.Second
+			if v := r.FormValue("timeout"); v != "" {
+				if timeout, err = time.ParseDuration(v); err != nil {
+					http.Error(w, "timeout must be a duration", http.StatusBadRequest)
+					return
+				}
+			}
+			if spans, err = s.Wait(n, timeout); err != nil {
+				http.Error(w, err.Error(), http.StatusRequestTimeout)
+				return
+			}
+		}
+		if spans == nil {
+			spans = []Span{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(spans)
+	case http.MethodDelete:
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/**
+ * @description: stop listening and close the connections of agents
+ * @param {*}
+ * @return {error}
+ */
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve an agent: tell it the agent info, then read its spans till it is gone
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	info := fmt.Sprintf(`{"time":"%d","id":"ppfakecollector","name":"ppfakecollector"}`, time.Now().UnixNano()/int64(time.Millisecond))
+	if _, err := conn.Write(EncodeFrame(RespAgentInfo, []byte(info))); err != nil {
+		return
+	}
+	for {
+		typ, body, err := ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if typ != ReqUpdateSpan {
+			continue
+		}
+		var span Span
+		if err := json.Unmarshal(body, &span); err != nil {
+			// not a span tree, the agent is broken
+			return
+		}
+		s.add(span, body)
+	}
+}
+
+func (s *Server) add(span Span, raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans = append(s.spans, span)
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+	if s.out != nil {
+		var line bytes.Buffer
+		json.Compact(&line, raw)
+		line.WriteByte('\n')
+		s.out.Write(line.Bytes())
+	}
+}
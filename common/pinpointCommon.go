@@ -16,14 +16,12 @@
 
 package common
 
-// #cgo pkg-config: pinpoint_common
-// #include <pinpoint_common/common.h>
-// #include <string.h>
-// static NodeID pinpoint_start_trace_opt(NodeID parentId, const char *opt1 , const char* opt2 ){
-// return  pinpoint_start_traceV1(parentId,opt1,opt2,NULL);
-// }
-// void pin_log_msg_cb(char *);
-import "C"
+/**
+ * The recorder keeps the trace tree behind the Pinpoint_* functions and sends it to collector-agent.
+ * recorder_cgo.go: libpinpoint_common by cgo.
+ * recorder_purego.go: the go recorder for `CGO_ENABLED=0` or `-tags pinpoint_purego`, no libpinpoint_common needed.
+ */
+
 import (
 	"context"
 	"errors"
@@ -31,19 +29,17 @@ import (
 	"math/rand"
 	"os"
 	"strings"
-	"unsafe"
+	"sync/atomic"
 )
 
-// type TraceIdType int32
-
 /////////////////////////////////////////
-// type LocationType int32
-type LocationType C.E_NODE_LOC
-type TraceIdType C.NodeID
+// the same as E_NODE_LOC and NodeID of pinpoint_common
+type LocationType int32
+type TraceIdType int32
 
 const (
-	CurrentTraceLoc LocationType = C.E_LOC_CURRENT
-	RootTraceLoc    LocationType = C.E_LOC_ROOT
+	CurrentTraceLoc LocationType = 0
+	RootTraceLoc    LocationType = 1
 )
 
 /////////////////////////////////////////
@@ -74,6 +70,11 @@ const (
 	PP_HEADER_PINPOINT_SAMPLED = "Pinpoint-Sampled"
 	PP_HTTP_PINPOINT_SAMPLED   = "HTTP_PINPOINT_SAMPLED"
 
+	// prefixes of the baggage headers, Pinpoint-Baggage-<key>
+	PP_HEADER_PINPOINT_BAGGAGE = "Pinpoint-Baggage-"
+	PP_HTTP_PINPOINT_BAGGAGE   = "HTTP_PINPOINT_BAGGAGE_"
+	PP_BAGGAGE                 = "baggage"
+
 	PP_DESTINATION      = "dst"
 	PP_INTERCEPTOR_NAME = "name"
 	PP_APP_NAME         = "appname"
@@ -103,6 +104,7 @@ const (
 	PP_RETURN      = "14"
 	GOLANG         = "1800"
 	PP_METHOD_CALL = "1801"
+	PP_ASYNC       = "100"
 	PP_CELERY      = "1702"
 
 	PP_REMOTE_METHOD = "9401"
@@ -148,28 +150,19 @@ var (
 
 type LogCallBack func(format string, v ...interface{})
 
-var logCallBack LogCallBack = nil //log.Printf
+// LogCallBack, nil => drop everything. logs come from the goroutines of the recorder too
+var logCallBack atomic.Value
 
 var ignoreUrls = map[string]bool{}
 
 func init() {
-	C.global_agent_info.agent_type = C.int(1800)
-	C.global_agent_info.trace_limit = C.long(-1)
 	Appname = "notset"
 	Appid = "notset"
 }
 
 func Logf(format string, v ...interface{}) {
-	if logCallBack != nil {
-		logCallBack(format, v...)
-	}
-}
-
-//export pin_log_msg_cb
-func pin_log_msg_cb(c *C.char) {
-
-	if logCallBack != nil {
-		logCallBack(C.GoString(c))
+	if callback := loadLogCallBack(); callback != nil {
+		callback(format, v...)
 	}
 }
 
@@ -181,233 +174,13 @@ func pin_log_msg_cb(c *C.char) {
  * @return {*}
  */
 func SetLogCallBack(callback func(format string, v ...interface{})) {
-	logCallBack = callback
-	C.register_error_cb(C.log_msg_cb(C.pin_log_msg_cb))
-}
-
-/**
- * @description: For Debug, trace the pinpoint
- * @param {bool} enable
- * @return {*}
- */
-func Pinpoint_enable_debug_report(enable bool) {
-	if enable {
-		Logf("enable debug report")
-		C.global_agent_info.inter_flag |= C.uchar(1)
-	} else {
-		C.global_agent_info.inter_flag &= C.uchar(0xFE)
-	}
-}
-
-/**
- * @description: unittest only
- * @param {*}
- * @return {*}
- */
-func Pinpoint_enable_utest() {
-	C.global_agent_info.inter_flag |= C.uchar(0x4)
+	logCallBack.Store(LogCallBack(callback))
+	registerLogCallBack()
 }
 
-/**
- * @description: set trace_limit.
- * @param {int32} limitPerSec times per second.(-1 means no limit)
- * @return {*}
- */
-func Pinpoint_set_trace_limit(limitPerSec int32) {
-	C.global_agent_info.trace_limit = C.long(limitPerSec)
-}
-
-/**
- * @description:  Set collector-agent host
- * @param {string} host: tcp:dev.collector:9999
- * @return {*}
- */
-func Pinpoint_set_collect_agent_host(host string) {
-	cstr := C.CString(host)
-	defer C.free(unsafe.Pointer(cstr))
-
-	C.strncpy((*C.char)(&C.global_agent_info.co_host[0]), (*C.char)(cstr), C.ulong(256))
-}
-
-/**
- * @description: Create an new trace tree(id=-1) or add a new trace into current trace tree (id>0)
- * @param {TraceIdType} id
- * @return {*}
- */
-func Pinpoint_start_trace(id TraceIdType) TraceIdType {
-	return TraceIdType(C.pinpoint_start_trace(C.NodeID(id)))
-}
-
-/**
- * @description: Create an new trace from parent with specified options
-	options only allow :
-		TraceMinTimeMs:23
-		TraceOnlyException
- * @param {TraceIdType} id
- * @return {*}
-*/
-func Pinpoint_start_trace_opt(id TraceIdType, opt ...string) TraceIdType {
-	// endOpt := (char*)0
-	switch len(opt) {
-	case 0:
-		return TraceIdType(C.pinpoint_start_trace_opt(C.NodeID(id), nil, nil))
-	case 1:
-		opt := C.CString(opt[0])
-		defer C.free(unsafe.Pointer(opt))
-		return TraceIdType(C.pinpoint_start_trace_opt(C.NodeID(id), opt, nil))
-	case 2:
-		opt1 := C.CString(opt[0])
-		defer C.free(unsafe.Pointer(opt1))
-		op2 := C.CString(opt[1])
-		defer C.free(unsafe.Pointer(op2))
-		return TraceIdType(C.pinpoint_start_trace_opt(C.NodeID(id), opt1, op2))
-	// case 3:
-	// 	opt1 := C.CString(opt[0])
-	// 	defer C.free(unsafe.Pointer(opt1))
-	// 	opt2 := C.CString(opt[1])
-	// 	defer C.free(unsafe.Pointer(opt2))
-	// 	opt3 := C.CString(opt[2])
-	// 	defer C.free(unsafe.Pointer(opt3))
-	// 	return TraceIdType(C.pinpoint_start_traceV1(C.NodeID(id), opt1, opt2, opt3, endOpt))
-	default:
-		panic("maximun 3 parameters")
-	}
-}
-
-/**
- * @description: add exception information into current trace
- * @param {TraceIdType} id
-
- * @return {*}
- */
-func Pinpoint_add_exception(expMsg string, id TraceIdType) {
-	exp := C.CString(expMsg)
-	defer C.free(unsafe.Pointer(exp))
-	C.pinpoint_add_exception(C.NodeID(id), exp)
-}
-
-func Pinpoint_wake_trace(id TraceIdType) error {
-	if C.pinpoint_wake_trace(C.NodeID(id)) != 0 {
-		return errors.New("wake trace failed")
-	}
-	return nil
-}
-
-/**
- * @description: End trace node(id) or trace tree(If current id the root node)
- * @param {TraceIdType} id
- * @return {*}
- */
-func Pinpoint_end_trace(id TraceIdType) TraceIdType {
-	return TraceIdType(C.pinpoint_end_trace(C.NodeID(id)))
-}
-
-/**
-* @description: Attach some information on current trace node
-* @param {TraceIdType} id: trace node identifier
-* @param {string} key
-* @param {string} value
-* @return {*}
- */
-func Pinpoint_add_clue(key, value string, id TraceIdType, loc LocationType) {
-	ckey := C.CString(key)
-	cvalue := C.CString(value)
-	defer C.free(unsafe.Pointer(ckey))
-	defer C.free(unsafe.Pointer(cvalue))
-	C.pinpoint_add_clue(C.NodeID(id), ckey, cvalue, C.E_NODE_LOC(C.E_LOC_CURRENT))
-}
-
-/**
- * @description: check current trace node is root node or not
- * @param {TraceIdType} id
- * @return {*}
- */
-func Pinpoint_trace_is_root(id TraceIdType) bool {
-	if C.pinpoint_trace_is_root(C.NodeID(id)) == 1 {
-		return true
-	} else {
-		return false
-	}
-}
-
-/**
- * @description: Store some information on current trace tree.
- * context will be free when trace tree end.
- * @param {*} key
- * @param {string} value
- * @param {TraceIdType} id
- * @return {*}
- */
-func Pinpoint_set_context(key, value string, id TraceIdType) {
-	ckey := C.CString(key)
-	cvalue := C.CString(value)
-	defer C.free(unsafe.Pointer(ckey))
-	defer C.free(unsafe.Pointer(cvalue))
-	C.pinpoint_set_context_key(C.NodeID(id), ckey, cvalue)
-
-}
-
-/**
- * @description: Get current trace tree context by key
- * @param {string} key
- * @param {TraceIdType} id
- * @return {*} "" if not exist! So DO NOT set "" into context.
- */
-func Pinpoint_get_context(key string, id TraceIdType) string {
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
-	// buf := make([]byte, 1024)
-	pbuf := C.CString(string(make([]byte, 1024)))
-	defer C.free(unsafe.Pointer(pbuf))
-	len := C.pinpoint_get_context_key(C.NodeID(id), ckey, pbuf, 1024)
-	if len <= 0 {
-		return ""
-	} else {
-		return C.GoStringN(pbuf, len)
-	}
-}
-
-func Pinpoint_set_int_context(key string, value int64, id TraceIdType) {
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
-	C.pinpoint_set_context_long(C.NodeID(id), ckey, C.long(value))
-}
-
-func Pinpoint_get_int_context(key string, id TraceIdType) (int64, error) {
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
-	var value C.long
-
-	if C.pinpoint_get_context_long(C.NodeID(id), ckey, &value) == 0 {
-		return int64(value), nil
-	} else {
-		return 0, errors.New("not found")
-	}
-}
-
-/**
- * @description:  The same as `Pinpoint_add_clue`. API for add annotation.
- * @param {*} key
- * @param {string} value
- * @param {TraceIdType} id
- * @param {LocationType} loc
- * @return {*}
- */
-func Pinpoint_add_clues(key, value string, id TraceIdType, loc LocationType) {
-	ckey := C.CString(key)
-	cvalue := C.CString(value)
-	defer C.free(unsafe.Pointer(ckey))
-	defer C.free(unsafe.Pointer(cvalue))
-	C.pinpoint_add_clues(C.NodeID(id), ckey, cvalue, C.E_NODE_LOC(C.E_LOC_CURRENT))
-}
-
-/**
- * @description: An unique id per host
- * @param {*}
- * @return {*}
- */
-func Pinpoint_unique_id() int64 {
-	return int64(C.generate_unique_id())
+func loadLogCallBack() LogCallBack {
+	callback, _ := logCallBack.Load().(LogCallBack)
+	return callback
 }
 
 /**
@@ -429,55 +202,6 @@ func Pinpoint_gen_tid() string {
 	return fmt.Sprintf("%s^%d^%d", Appid, Pinpoint_start_time(), Pinpoint_unique_id())
 }
 
-/**
- * @description: Pinpoint-web doesn't know which span is error until you tell him.
- * @param {*} emsg
- * @param {string} error_filename
- * @param {uint32} error_lineno
- * @param {TraceIdType} id
- * @return {*}
- */
-func Pinpoint_mark_error(emsg, error_filename string, error_lineno uint32, id TraceIdType) {
-	msg := C.CString(emsg)
-	defer C.free(unsafe.Pointer(msg))
-	file_name := C.CString(error_filename)
-	defer C.free(unsafe.Pointer(file_name))
-	lineno := C.uint(error_lineno)
-	C.catch_error(C.NodeID(id), msg, file_name, lineno)
-}
-
-/**
- * @description: Agent first run time
- * @param {*}
- * @return {*}
- */
-func Pinpoint_start_time() int64 {
-	return int64(C.pinpoint_start_time())
-}
-
-/**
- * @description: Drop current trace tree(trace id).
- *  A dropped trace tree will not send to pinpoint-collector
- * @param {TraceIdType} id
- * @return {*}
- */
-func Pinpoint_drop_trace(id TraceIdType) {
-	C.mark_current_trace_status(C.NodeID(id), C.int(C.E_TRACE_BLOCK))
-}
-
-/**
- * @description: Check sample speed is reached the limit or not.
- * @param {*}
- * @return {*} true: current trace should be dropped. false: not limited
- */
-func Pinpoint_tracelimit() bool {
-	if C.check_tracelimit(-1) == 1 {
-		return true
-	} else {
-		return false
-	}
-}
-
 /**
  * @description: get parent id ctx from context.Context
  * @param {context.Context} ctx
@@ -535,21 +259,3 @@ func AgentIsDisabled() bool {
 	}
 }
 
-/**
- * @description: print the internal status message
- *
- */
-func ShowAgentStatus() {
-	C.show_status()
-}
-
-func Prerequisite() bool {
-	version := C.GoString(C.pinpoint_agent_version())
-	return version >= "0.4.20"
-}
-
-func init() {
-	if !Prerequisite() {
-		panic("prerequisite not met")
-	}
-}
@@ -0,0 +1,313 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pptest records the traces of the code under test in memory instead of collector-agent,
+// and asserts on the span trees: their clues, contexts, exceptions and error marks.
+//
+//	func TestQuery(t *testing.T) {
+//		r := pptest.Start(t)
+//		ctx, end := r.StartTrace(context.Background(), "TestQuery")
+//		db.QueryContext(ctx, "select 1")
+//		end()
+//		r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_MYSQL, common.PP_SQL_FORMAT, "select 1")
+//	}
+//
+// The recorder is global, tests using it must not run in parallel.
+package pptest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+// Recorder keeps the traces finished since Start
+type Recorder struct {
+	t      testing.TB
+	mu     sync.Mutex
+	traces []*common.RecordedNode
+}
+
+/**
+ * @description: record the traces in memory till the test ends
+ * @param {testing.TB} t
+ * @return {*}
+ */
+func Start(t testing.TB) *Recorder {
+	r := &Recorder{t: t}
+	t.Cleanup(common.UseRecorder(r.record))
+	return r
+}
+
+func (r *Recorder) record(root *common.RecordedNode) {
+	r.mu.Lock()
+	r.traces = append(r.traces, root)
+	r.mu.Unlock()
+}
+
+/**
+ * @description: the finished traces, dropped ones too
+ * @param {*}
+ * @return {*}
+ */
+func (r *Recorder) Traces() []*common.RecordedNode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*common.RecordedNode(nil), r.traces...)
+}
+
+// Reset forgets the traces finished
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.traces = nil
+	r.mu.Unlock()
+}
+
+/**
+ * @description: start a sampled root as the middlewares do, hooks called with the ctx returned
+ *  record into it
+ * @param {context.Context} ctx
+ * @param {string} name
+ * @return {*} ctx of the trace and the func ending it
+ */
+func (r *Recorder) StartTrace(ctx context.Context, name string) (context.Context, func()) {
+	id := common.Pinpoint_start_trace(common.ROOT_TRACE)
+	common.Pinpoint_add_clue(common.PP_INTERCEPTOR_NAME, name, id, common.CurrentTraceLoc)
+	common.Pinpoint_add_clue(common.PP_SERVER_TYPE, common.GOLANG, id, common.CurrentTraceLoc)
+	common.Pinpoint_set_context(common.PP_HEADER_PINPOINT_SAMPLED, common.PP_SAMPLED, id)
+	return context.WithValue(ctx, common.TRACE_ID, id), func() {
+		common.Pinpoint_end_trace(id)
+	}
+}
+
+/**
+ * @description: the only trace finished, the test fails if there is not exactly one
+ * @param {*}
+ * @return {*}
+ */
+func (r *Recorder) Trace() *common.RecordedNode {
+	r.t.Helper()
+	traces := r.Traces()
+	if len(traces) != 1 {
+		r.t.Fatalf("%d traces finished, want 1:\n%s", len(traces), dumpAll(traces))
+	}
+	return traces[0]
+}
+
+/**
+ * @description: a child of `parent` having the clues, the test fails if there is none
+ * @param {*common.RecordedNode} parent
+ * @param {...string} kv key, value pairs
+ * @return {*}
+ */
+func (r *Recorder) AssertChild(parent *common.RecordedNode, kv ...string) *common.RecordedNode {
+	r.t.Helper()
+	r.checkPairs(kv)
+	for _, child := range parent.Children {
+		if Has(child, kv...) {
+			return child
+		}
+	}
+	r.t.Fatalf("no child of %d has %s:\n%s", parent.Id, pairs(kv), Dump(parent.Root()))
+	return nil
+}
+
+/**
+ * @description: a child of the root of the only trace having the clues,
+ *  e.g. r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_MYSQL, common.PP_SQL_FORMAT, query)
+ * @param {...string} kv key, value pairs
+ * @return {*}
+ */
+func (r *Recorder) AssertChildOfRoot(kv ...string) *common.RecordedNode {
+	r.t.Helper()
+	return r.AssertChild(r.Trace(), kv...)
+}
+
+/**
+ * @description: a node having the clues in the tree of `root`, the test fails if there is none
+ * @param {*common.RecordedNode} root
+ * @param {...string} kv key, value pairs
+ * @return {*}
+ */
+func (r *Recorder) AssertNode(root *common.RecordedNode, kv ...string) *common.RecordedNode {
+	r.t.Helper()
+	r.checkPairs(kv)
+	if node := Find(root, kv...); node != nil {
+		return node
+	}
+	r.t.Fatalf("no node has %s:\n%s", pairs(kv), Dump(root))
+	return nil
+}
+
+/**
+ * @description: the exception of `node` by Pinpoint_add_exception or PP_ADD_EXCEPTION clue
+ * @param {*common.RecordedNode} node
+ * @param {string} msg
+ * @return {*}
+ */
+func (r *Recorder) AssertException(node *common.RecordedNode, msg string) {
+	r.t.Helper()
+	if got, ok := node.Clues[common.PP_ADD_EXCEPTION]; !ok || got != msg {
+		r.t.Fatalf("exception of %d is %q, want %q:\n%s", node.Id, got, msg, Dump(node.Root()))
+	}
+}
+
+/**
+ * @description: the error marked by Pinpoint_mark_error on the trace of `node`
+ * @param {*common.RecordedNode} node
+ * @param {string} msg
+ * @return {*}
+ */
+func (r *Recorder) AssertError(node *common.RecordedNode, msg string) {
+	r.t.Helper()
+	root := node.Root()
+	if root.Error == nil || root.Error.Msg != msg {
+		r.t.Fatalf("error of trace %d is %+v, want %q", root.Id, root.Error, msg)
+	}
+}
+
+/**
+ * @description: the trace context of `node` by Pinpoint_set_context or Pinpoint_set_int_context
+ * @param {*common.RecordedNode} node
+ * @param {string} key
+ * @param {interface{}} value string or int64
+ * @return {*}
+ */
+func (r *Recorder) AssertContext(node *common.RecordedNode, key string, value interface{}) {
+	r.t.Helper()
+	if got, ok := node.Root().Context[key]; !ok || got != value {
+		r.t.Fatalf("context %s is %#v, want %#v", key, got, value)
+	}
+}
+
+/**
+ * @description: the value of `node`'s trace by Pinpoint_set_context_value, compared by reflect.DeepEqual
+ * @param {*common.RecordedNode} node
+ * @param {string} key
+ * @param {interface{}} value
+ * @return {*}
+ */
+func (r *Recorder) AssertValue(node *common.RecordedNode, key string, value interface{}) {
+	r.t.Helper()
+	if got, ok := node.Root().Values[key]; !ok || !reflect.DeepEqual(got, value) {
+		r.t.Fatalf("value %s is %#v, want %#v", key, got, value)
+	}
+}
+
+func (r *Recorder) checkPairs(kv []string) {
+	r.t.Helper()
+	if len(kv)%2 != 0 {
+		r.t.Fatalf("clues must be key, value pairs: %q", kv)
+	}
+}
+
+/**
+ * @description: `node` has every key, value pair in Clues or ClueList
+ * @param {*common.RecordedNode} node
+ * @param {...string} kv key, value pairs
+ * @return {*}
+ */
+func Has(node *common.RecordedNode, kv ...string) bool {
+	for i := 0; i+1 < len(kv); i += 2 {
+		if value, ok := node.Clues[kv[i]]; ok && value == kv[i+1] {
+			continue
+		}
+		if !hasClue(node.ClueList, kv[i]+":"+kv[i+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasClue(list []string, clue string) bool {
+	for _, c := range list {
+		if c == clue {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * @description: the first node having the clues in the tree of `root`, root itself included
+ * @param {*common.RecordedNode} root
+ * @param {...string} kv key, value pairs
+ * @return {*} nil if not found
+ */
+func Find(root *common.RecordedNode, kv ...string) *common.RecordedNode {
+	if Has(root, kv...) {
+		return root
+	}
+	for _, child := range root.Children {
+		if node := Find(child, kv...); node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+/**
+ * @description: the tree of `root` as text, for the failure messages
+ * @param {*common.RecordedNode} root
+ * @return {*}
+ */
+func Dump(root *common.RecordedNode) string {
+	var b strings.Builder
+	dump(&b, root, 0)
+	return b.String()
+}
+
+func dump(b *strings.Builder, node *common.RecordedNode, depth int) {
+	indent := strings.Repeat("  ", depth)
+	fmt.Fprintf(b, "%s- %d %v", indent, node.Id, node.Clues)
+	if len(node.ClueList) > 0 {
+		fmt.Fprintf(b, " clues:%q", node.ClueList)
+	}
+	if node.Error != nil {
+		fmt.Fprintf(b, " error:%+v", *node.Error)
+	}
+	if node.Dropped {
+		b.WriteString(" dropped")
+	}
+	if node.Async {
+		b.WriteString(" async")
+	}
+	b.WriteByte('\n')
+	for _, child := range node.Children {
+		dump(b, child, depth+1)
+	}
+}
+
+func dumpAll(traces []*common.RecordedNode) string {
+	var b strings.Builder
+	for _, root := range traces {
+		dump(&b, root, 0)
+	}
+	return b.String()
+}
+
+func pairs(kv []string) string {
+	var parts []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, kv[i]+"="+kv[i+1])
+	}
+	return strings.Join(parts, " and ")
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+)
+
+func TestTranscation(t *testing.T) {
+	r := Start(t)
+
+	header := common.PinTransactionHeader{Url: "/user", Host: "localhost", RemoteAddr: "127.0.0.1"}
+	common.PinTranscation(&header, func(ctx context.Context) error {
+		_, end := common.PinFuncOnce(ctx, "loadUser", 7)
+		end(nil, "tom")
+		for i := 0; i < 3; i++ {
+			_, end = common.PinFuncSum(ctx, "cache")
+			end(nil)
+		}
+		common.SpanFromContext(ctx).SetContextValue("user", []string{"tom", "7"})
+		_, end = common.PinHttpClientFunc(ctx, "get", "http://api.local/user/7", nil)
+		err := errors.New("503")
+		end(&err)
+		return errors.New("user not found")
+	}, context.Background())
+
+	root := r.Trace()
+	if !Has(root, common.PP_REQ_URI, "/user", common.PP_SERVER_TYPE, common.GOLANG) {
+		t.Fatalf("root:\n%s", Dump(root))
+	}
+	r.AssertError(root, "user not found")
+	if e := root.Error; e.File != "trace.go" || e.Line != 0 {
+		t.Errorf("error at %s:%d", e.File, e.Line)
+	}
+	r.AssertContext(root, common.PP_HEADER_PINPOINT_SAMPLED, common.PP_SAMPLED)
+	r.AssertValue(root, "user", []string{"tom", "7"})
+
+	r.AssertChildOfRoot(common.PP_INTERCEPTOR_NAME, "loadUser", common.PP_ARGS, "7", common.PP_RETURN, "tom")
+	// the calls of PinFuncSum are one node
+	sum := r.AssertChildOfRoot(common.PP_INTERCEPTOR_NAME, "[sum]cache")
+	r.AssertContext(sum, "[sum]cache", int64(sum.Id))
+	client := r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_REMOTE_METHOD, common.PP_DESTINATION, "api.local")
+	r.AssertException(client, "503")
+	if len(root.Children) != 3 {
+		t.Errorf("root:\n%s", Dump(root))
+	}
+}
+
+func TestNestedAndDropped(t *testing.T) {
+	r := Start(t)
+
+	ctx, end := r.StartTrace(context.Background(), "TestNestedAndDropped")
+	ctx1, end1 := common.PinFuncOnce(ctx, "outer")
+	_, end2 := common.PinFuncOnce(ctx1, "inner")
+	end2(nil)
+	end1(nil)
+	end()
+
+	root := r.Trace()
+	outer := r.AssertChild(root, common.PP_INTERCEPTOR_NAME, "outer")
+	r.AssertChild(outer, common.PP_INTERCEPTOR_NAME, "inner")
+	if inner := r.AssertNode(root, common.PP_INTERCEPTOR_NAME, "inner"); inner.Parent != outer || inner.Root() != root {
+		t.Errorf("inner is not under outer:\n%s", Dump(root))
+	}
+	if Find(root, common.PP_INTERCEPTOR_NAME, "missing") != nil {
+		t.Error("found a missing node")
+	}
+
+	// a dropped trace is recorded, it is not sent
+	r.Reset()
+	id := common.Pinpoint_start_trace(common.ROOT_TRACE)
+	common.Pinpoint_drop_trace(id)
+	common.Pinpoint_end_trace(id)
+	if traces := r.Traces(); len(traces) != 1 || !traces[0].Dropped {
+		t.Fatalf("traces:\n%s", dumpAll(traces))
+	}
+}
+
+func TestFork(t *testing.T) {
+	r := Start(t)
+
+	ctx, end := r.StartTrace(context.Background(), "TestFork")
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		fctx, done := common.Fork(ctx)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer done()
+			<-release
+			_, end := common.PinFuncOnce(fctx, fmt.Sprintf("worker%d", i))
+			end(nil)
+		}(i)
+	}
+	end()
+	// the workers outlive the root, the trace waits for them
+	if traces := r.Traces(); len(traces) != 0 {
+		t.Fatalf("finished before the async nodes:\n%s", dumpAll(traces))
+	}
+	close(release)
+	wg.Wait()
+
+	root := r.Trace()
+	if len(root.Children) != 3 {
+		t.Fatalf("root:\n%s", Dump(root))
+	}
+	for i := 0; i < 3; i++ {
+		worker := r.AssertNode(root, common.PP_INTERCEPTOR_NAME, fmt.Sprintf("worker%d", i))
+		fork := worker.Parent
+		if !fork.Async || fork.Parent != root || !Has(fork, common.PP_SERVER_TYPE, common.PP_ASYNC) {
+			t.Errorf("worker%d is not under an async node:\n%s", i, Dump(root))
+		}
+	}
+
+	// out of a trace it does nothing
+	r.Reset()
+	fctx, done := common.Fork(context.Background())
+	done()
+	if fctx != context.Background() || len(r.Traces()) != 0 {
+		t.Error("forked without a trace")
+	}
+}
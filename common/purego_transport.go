@@ -0,0 +1,139 @@
+//go:build !cgo || pinpoint_purego
+// +build !cgo pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pinpoint-apm/go-aop-agent/common/collectoragent"
+)
+
+const (
+	// spans waiting for the connection, more are dropped
+	maxPendingSpans = 1024
+	dialTimeout     = time.Second
+	writeTimeout    = 3 * time.Second
+	// no dialing after a failure in it, spans are dropped meanwhile
+	redialInterval = 3 * time.Second
+)
+
+// spanSender writes spans to collector-agent in a goroutine, Pinpoint_end_trace never waits on it
+type spanSender struct {
+	mu       sync.Mutex
+	host     string
+	spans    chan []byte
+	start    sync.Once
+	conn     net.Conn
+	connHost string
+	dialAt   time.Time
+	sent     uint64
+	dropped  uint64
+}
+
+var collector = newSpanSender()
+
+func newSpanSender() *spanSender {
+	return &spanSender{spans: make(chan []byte, maxPendingSpans)}
+}
+
+func (s *spanSender) setHost(host string) {
+	s.mu.Lock()
+	s.host = host
+	s.mu.Unlock()
+}
+
+func (s *spanSender) stats() (uint64, uint64) {
+	return atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.dropped)
+}
+
+func (s *spanSender) send(span []byte) {
+	s.start.Do(func() { go s.loop() })
+	select {
+	case s.spans <- span:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		debugf("collector-agent is slow, a span is dropped")
+	}
+}
+
+func (s *spanSender) loop() {
+	for span := range s.spans {
+		if err := s.write(collectoragent.EncodeFrame(collectoragent.ReqUpdateSpan, span)); err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+			debugf("send span to collector-agent failed:%s", err)
+			continue
+		}
+		atomic.AddUint64(&s.sent, 1)
+	}
+}
+
+// write a frame, connects to the host first if it is changed or the connection is broken
+func (s *spanSender) write(frame []byte) error {
+	s.mu.Lock()
+	host := s.host
+	s.mu.Unlock()
+
+	if s.conn != nil && s.connHost != host {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn == nil {
+		if time.Since(s.dialAt) < redialInterval && s.connHost == host {
+			return errors.New("collector-agent is not connected")
+		}
+		s.dialAt, s.connHost = time.Now(), host
+		network, address, err := collectoragent.ParseHost(host)
+		if err != nil {
+			return err
+		}
+		conn, err := net.DialTimeout(network, address, dialTimeout)
+		if err != nil {
+			return err
+		}
+		debugf("collector-agent %s is connected", host)
+		s.conn = conn
+		go drainAgentInfo(conn)
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := s.conn.Write(frame); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// collector-agent tells the agent info after connected, nothing in it is needed
+func drainAgentInfo(conn net.Conn) {
+	for {
+		typ, body, err := collectoragent.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if typ == collectoragent.RespAgentInfo {
+			debugf("agent info from collector-agent:%s", body)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * traceRecorder is the trace tree behind the Pinpoint_* functions of a trace:
+ *  cgoRecorder of recorder_cgo.go, pinpoint_common
+ *  *traceTree of tracetree.go, in go. recorder_purego.go sends it to collector-agent,
+ *   UseRecorder hands it to tests
+ */
+type traceRecorder interface {
+	startTrace(parentId TraceIdType, opt []string) TraceIdType
+	startAsyncTrace(parentId TraceIdType) TraceIdType
+	endTrace(id TraceIdType) TraceIdType
+	wakeTrace(id TraceIdType) error
+	isRoot(id TraceIdType) bool
+	rootOf(id TraceIdType) TraceIdType
+	addClue(id TraceIdType, key, value string, loc LocationType)
+	addClues(id TraceIdType, key, value string, loc LocationType)
+	addException(id TraceIdType, msg string)
+	markError(id TraceIdType, msg, file string, line uint32)
+	dropTrace(id TraceIdType)
+	setContext(id TraceIdType, key, value string)
+	getContext(id TraceIdType, key string) (string, bool)
+	setIntContext(id TraceIdType, key string, value int64)
+	getIntContext(id TraceIdType, key string) (int64, error)
+	setValue(id TraceIdType, key string, value interface{})
+	getValue(id TraceIdType, key string) (interface{}, bool)
+}
+
+// an atomic.Value needs the same concrete type
+type recorderHolder struct {
+	traceRecorder
+}
+
+var recorder atomic.Value
+
+func setRecorder(r traceRecorder) traceRecorder {
+	old, _ := recorder.Load().(recorderHolder)
+	recorder.Store(recorderHolder{r})
+	return old.traceRecorder
+}
+
+func currentRecorder() traceRecorder {
+	return recorder.Load().(recorderHolder).traceRecorder
+}
+
+// RecordedError is the error marked by Pinpoint_mark_error
+type RecordedError struct {
+	Msg  string `json:"msg"`
+	File string `json:"file"`
+	Line uint32 `json:"line"`
+}
+
+// RecordedNode is a node of a trace handed to the callback of UseRecorder
+type RecordedNode struct {
+	Id       TraceIdType
+	Parent   *RecordedNode
+	Children []*RecordedNode
+	Start    time.Time
+	// the sum of every run, a node woke up by Pinpoint_wake_trace runs again
+	Elapsed time.Duration
+	// by Pinpoint_add_clue and Pinpoint_add_exception(PP_ADD_EXCEPTION)
+	Clues map[string]string
+	// by Pinpoint_add_clues, "key:value"
+	ClueList []string
+	// root only: Pinpoint_mark_error, the trace context(string or int64) and Pinpoint_drop_trace
+	Error   *RecordedError
+	Context map[string]interface{}
+	// root only: Pinpoint_set_context_value
+	Values  map[string]interface{}
+	Dropped bool
+	// started by Fork, it may end after its parent
+	Async bool
+}
+
+// Root is the root of the trace of node
+func (node *RecordedNode) Root() *RecordedNode {
+	for node.Parent != nil {
+		node = node.Parent
+	}
+	return node
+}
+
+/**
+ * @description: trace by a go trace tree in memory, the finished trees are handed to `record`
+ *  instead of collector-agent. For tests, see common/pptest.
+ *  traces started before are not in the new tree, call it before any trace.
+ * @param {func(root *RecordedNode)} record called in Pinpoint_end_trace of every root, or of the last
+ *  async node ending after it. Nodes not meeting the options of Pinpoint_start_trace_opt are not in
+ *  the tree, as they are not sent
+ * @return {*} restore the recorder before
+ */
+func UseRecorder(record func(root *RecordedNode)) (restore func()) {
+	old := setRecorder(newTraceTree(func(root *traceNode) {
+		record(root.record(nil))
+	}))
+	return func() {
+		setRecorder(old)
+	}
+}
+
+/**
+ * @description: Create an new trace tree(id=-1) or add a new trace into current trace tree (id>0)
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_start_trace(id TraceIdType) TraceIdType {
+	return currentRecorder().startTrace(id, nil)
+}
+
+/**
+ * @description: Create an new trace from parent with specified options
+ *  options only allow :
+ *   TraceMinTimeMs:23
+ *   TraceOnlyException
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_start_trace_opt(id TraceIdType, opt ...string) TraceIdType {
+	if len(opt) > 2 {
+		panic("maximun 3 parameters")
+	}
+	return currentRecorder().startTrace(id, opt)
+}
+
+/**
+ * @description: Create an async trace node from parent, it may end after the parent.
+ *  The trace tree is finished when the root and all its async nodes end. With pinpoint_common
+ *  the async node is a root of its own instead, sent as a span of the same transaction.
+ * @param {TraceIdType} id parent, not ROOT_TRACE
+ * @return {*}
+ */
+func Pinpoint_start_async_trace(id TraceIdType) TraceIdType {
+	return currentRecorder().startAsyncTrace(id)
+}
+
+/**
+ * @description: End trace node(id) or trace tree(If current id the root node)
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_end_trace(id TraceIdType) TraceIdType {
+	return currentRecorder().endTrace(id)
+}
+
+func Pinpoint_wake_trace(id TraceIdType) error {
+	return currentRecorder().wakeTrace(id)
+}
+
+/**
+ * @description: check current trace node is root node or not
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_trace_is_root(id TraceIdType) bool {
+	return currentRecorder().isRoot(id)
+}
+
+/**
+ * @description: the root node of the trace tree id is in
+ * @param {TraceIdType} id
+ * @return {*} INVALIED_TRACE if id is not a running node
+ */
+func Pinpoint_trace_root(id TraceIdType) TraceIdType {
+	return currentRecorder().rootOf(id)
+}
+
+/**
+* @description: Attach some information on current trace node, or on the root node by RootTraceLoc
+* @param {TraceIdType} id: trace node identifier
+* @param {string} key
+* @param {string} value
+* @param {LocationType} loc: CurrentTraceLoc or RootTraceLoc
+* @return {*}
+ */
+func Pinpoint_add_clue(key, value string, id TraceIdType, loc LocationType) {
+	currentRecorder().addClue(id, key, value, loc)
+}
+
+/**
+ * @description:  The same as `Pinpoint_add_clue`. API for add annotation.
+ * @param {*} key
+ * @param {string} value
+ * @param {TraceIdType} id
+ * @param {LocationType} loc
+ * @return {*}
+ */
+func Pinpoint_add_clues(key, value string, id TraceIdType, loc LocationType) {
+	currentRecorder().addClues(id, key, value, loc)
+}
+
+/**
+ * @description: add exception information into current trace
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_add_exception(expMsg string, id TraceIdType) {
+	currentRecorder().addException(id, expMsg)
+}
+
+/**
+ * @description: Pinpoint-web doesn't know which span is error until you tell him.
+ * @param {*} emsg
+ * @param {string} error_filename
+ * @param {uint32} error_lineno
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_mark_error(emsg, error_filename string, error_lineno uint32, id TraceIdType) {
+	currentRecorder().markError(id, emsg, error_filename, error_lineno)
+}
+
+/**
+ * @description: Drop current trace tree(trace id).
+ *  A dropped trace tree will not send to pinpoint-collector
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_drop_trace(id TraceIdType) {
+	currentRecorder().dropTrace(id)
+}
+
+/**
+ * @description: Store some information on current trace tree.
+ * context will be free when trace tree end.
+ * @param {*} key
+ * @param {string} value
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_set_context(key, value string, id TraceIdType) {
+	currentRecorder().setContext(id, key, value)
+}
+
+/**
+ * @description: Get current trace tree context by key
+ * @param {string} key
+ * @param {TraceIdType} id
+ * @return {*} the value, false if the key is not set
+ */
+func Pinpoint_get_context(key string, id TraceIdType) (string, bool) {
+	return currentRecorder().getContext(id, key)
+}
+
+func Pinpoint_set_int_context(key string, value int64, id TraceIdType) {
+	currentRecorder().setIntContext(id, key, value)
+}
+
+func Pinpoint_get_int_context(key string, id TraceIdType) (int64, error) {
+	return currentRecorder().getIntContext(id, key)
+}
+
+/**
+ * @description: Store a go value on current trace tree, a string of any length, a []byte or a map.
+ * It is kept in go till the trace tree ends, apart from Pinpoint_set_context: the same key of both is two values.
+ * @param {string} key
+ * @param {interface{}} value
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func Pinpoint_set_context_value(key string, value interface{}, id TraceIdType) {
+	currentRecorder().setValue(id, key, value)
+}
+
+/**
+ * @description: Get a value of Pinpoint_set_context_value
+ * @param {string} key
+ * @param {TraceIdType} id
+ * @return {*} false if the key is not set, "" or nil set is found
+ */
+func Pinpoint_get_context_value(key string, id TraceIdType) (interface{}, bool) {
+	return currentRecorder().getValue(id, key)
+}
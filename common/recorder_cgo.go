@@ -0,0 +1,421 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+// #cgo pkg-config: pinpoint_common
+// #include <pinpoint_common/common.h>
+// #include <string.h>
+// static NodeID pinpoint_start_trace_opt(NodeID parentId, const char *opt1 , const char* opt2 ){
+// return  pinpoint_start_traceV1(parentId,opt1,opt2,NULL);
+// }
+// void pin_log_msg_cb(char *);
+import "C"
+import (
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+func init() {
+	C.global_agent_info.agent_type = C.int(agentType)
+	C.global_agent_info.trace_limit = C.long(-1)
+	setRecorder(cgoRecorder{})
+}
+
+// the go trace tree of UseRecorder logs as pinpoint_common
+func debugf(format string, v ...interface{}) {
+	if C.global_agent_info.inter_flag&1 != 0 {
+		Logf(format, v...)
+	}
+}
+
+func registerLogCallBack() {
+	C.register_error_cb(C.log_msg_cb(C.pin_log_msg_cb))
+}
+
+//export pin_log_msg_cb
+func pin_log_msg_cb(c *C.char) {
+
+	if callback := loadLogCallBack(); callback != nil {
+		callback(C.GoString(c))
+	}
+}
+
+/**
+ * @description: For Debug, trace the pinpoint
+ * @param {bool} enable
+ * @return {*}
+ */
+func Pinpoint_enable_debug_report(enable bool) {
+	if enable {
+		Logf("enable debug report")
+		C.global_agent_info.inter_flag |= C.uchar(1)
+	} else {
+		C.global_agent_info.inter_flag &= C.uchar(0xFE)
+	}
+}
+
+/**
+ * @description: unittest only
+ * @param {*}
+ * @return {*}
+ */
+func Pinpoint_enable_utest() {
+	C.global_agent_info.inter_flag |= C.uchar(0x4)
+}
+
+// unittest only, pinpoint_common sends the spans to co_host when it is off
+func disableUtest() {
+	C.global_agent_info.inter_flag &= C.uchar(0xFB)
+}
+
+/**
+ * @description: set trace_limit.
+ * @param {int32} limitPerSec times per second.(-1 means no limit)
+ * @return {*}
+ */
+func Pinpoint_set_trace_limit(limitPerSec int32) {
+	C.global_agent_info.trace_limit = C.long(limitPerSec)
+}
+
+/**
+ * @description:  Set collector-agent host
+ * @param {string} host: tcp:dev.collector:9999
+ * @return {*}
+ */
+func Pinpoint_set_collect_agent_host(host string) {
+	cstr := C.CString(host)
+	defer C.free(unsafe.Pointer(cstr))
+
+	C.strncpy((*C.char)(&C.global_agent_info.co_host[0]), (*C.char)(cstr), C.ulong(256))
+}
+
+/**
+ * @description: An unique id per host
+ * @param {*}
+ * @return {*}
+ */
+func Pinpoint_unique_id() int64 {
+	return int64(C.generate_unique_id())
+}
+
+/**
+ * @description: Agent first run time
+ * @param {*}
+ * @return {*}
+ */
+func Pinpoint_start_time() int64 {
+	return int64(C.pinpoint_start_time())
+}
+
+/**
+ * @description: Check sample speed is reached the limit or not.
+ * @param {*}
+ * @return {*} true: current trace should be dropped. false: not limited
+ */
+func Pinpoint_tracelimit() bool {
+	if C.check_tracelimit(-1) == 1 {
+		return true
+	} else {
+		return false
+	}
+}
+
+/**
+ * @description: print the internal status message
+ *
+ */
+func ShowAgentStatus() {
+	C.show_status()
+}
+
+func Prerequisite() bool {
+	version := C.GoString(C.pinpoint_agent_version())
+	return version >= "0.4.20"
+}
+
+func init() {
+	if !Prerequisite() {
+		panic("prerequisite not met")
+	}
+}
+
+// cgoRecorder is the trace tree of pinpoint_common
+type cgoRecorder struct{}
+
+/**
+ * pinpoint_common has no async node, an async node is started as a root of its own.
+ * It is linked to its parent by the transaction id and the span ids, so the parent and
+ * its root end on time and the async node is sent as a span of the same transaction.
+ */
+var cgoForks = struct {
+	sync.Mutex
+	// async node -> its parent, the parent is returned on ending it
+	parent map[TraceIdType]TraceIdType
+}{
+	parent: map[TraceIdType]TraceIdType{},
+}
+
+// every root keeps its id in the context, rootOf needs it
+const rootIdKey = "[root]"
+
+func (r cgoRecorder) startTrace(parentId TraceIdType, opt []string) TraceIdType {
+	id := r.startCTrace(parentId, opt)
+	if id != INVALIED_TRACE && parentId == ROOT_TRACE {
+		r.setIntContext(id, rootIdKey, int64(id))
+	}
+	return id
+}
+
+func (cgoRecorder) startCTrace(parentId TraceIdType, opt []string) TraceIdType {
+	// endOpt := (char*)0
+	switch len(opt) {
+	case 0:
+		return TraceIdType(C.pinpoint_start_trace(C.NodeID(parentId)))
+	case 1:
+		opt := C.CString(opt[0])
+		defer C.free(unsafe.Pointer(opt))
+		return TraceIdType(C.pinpoint_start_trace_opt(C.NodeID(parentId), opt, nil))
+	case 2:
+		opt1 := C.CString(opt[0])
+		defer C.free(unsafe.Pointer(opt1))
+		op2 := C.CString(opt[1])
+		defer C.free(unsafe.Pointer(op2))
+		return TraceIdType(C.pinpoint_start_trace_opt(C.NodeID(parentId), opt1, op2))
+	default:
+		panic("maximun 3 parameters")
+	}
+}
+
+func (r cgoRecorder) startAsyncTrace(parentId TraceIdType) TraceIdType {
+	root := r.rootOf(parentId)
+	if root == INVALIED_TRACE || !r.isRoot(root) {
+		return INVALIED_TRACE
+	}
+	id := TraceIdType(C.pinpoint_start_trace(C.NodeID(ROOT_TRACE)))
+	if id == INVALIED_TRACE {
+		return id
+	}
+	r.setIntContext(id, rootIdKey, int64(id))
+	r.linkAsync(parentId, id)
+	copyValues(root, id)
+	cgoForks.Lock()
+	cgoForks.parent[id] = parentId
+	cgoForks.Unlock()
+	return id
+}
+
+/**
+ * @description: link the span of async node id to the span of parentId, as a remote call does
+ * @param {TraceIdType} parentId
+ * @param {TraceIdType} id
+ * @return {*}
+ */
+func (r cgoRecorder) linkAsync(parentId, id TraceIdType) {
+	tid, ok := r.getContext(parentId, PP_TRANSCATION_ID)
+	if !ok {
+		// not in a transaction, nothing to link to
+		return
+	}
+	sid := Pinpoint_gen_sid()
+	r.addClue(id, PP_APP_NAME, Appname, CurrentTraceLoc)
+	r.addClue(id, PP_APP_ID, Appid, CurrentTraceLoc)
+	r.addClue(id, PP_TRANSCATION_ID, tid, CurrentTraceLoc)
+	r.setContext(id, PP_TRANSCATION_ID, tid)
+	r.addClue(id, PP_SPAN_ID, sid, CurrentTraceLoc)
+	r.setContext(id, PP_SPAN_ID, sid)
+	if psid, ok := r.getContext(parentId, PP_SPAN_ID); ok {
+		r.addClue(id, PP_PARENT_SPAN_ID, psid, CurrentTraceLoc)
+	}
+	r.addClue(parentId, PP_NEXT_SPAN_ID, sid, CurrentTraceLoc)
+}
+
+func (cgoRecorder) endTrace(id TraceIdType) TraceIdType {
+	cgoForks.Lock()
+	parent, async := cgoForks.parent[id]
+	delete(cgoForks.parent, id)
+	cgoForks.Unlock()
+	ended := endCTrace(id)
+	if async && ended == ROOT_TRACE {
+		return parent
+	}
+	return ended
+}
+
+func endCTrace(id TraceIdType) TraceIdType {
+	parent := TraceIdType(C.pinpoint_end_trace(C.NodeID(id)))
+	if parent == ROOT_TRACE {
+		releaseValues(id)
+	}
+	return parent
+}
+
+/**
+ * the values of Pinpoint_set_context_value, pinpoint_common keeps strings only.
+ * They are kept by the root id till pinpoint_common ends the root
+ */
+var cgoValues = struct {
+	sync.Mutex
+	roots map[TraceIdType]map[string]interface{}
+}{
+	roots: map[TraceIdType]map[string]interface{}{},
+}
+
+// an async node starts with the values of the root of its parent
+func copyValues(from, to TraceIdType) {
+	cgoValues.Lock()
+	defer cgoValues.Unlock()
+	if values, ok := cgoValues.roots[from]; ok {
+		copied := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			copied[key] = value
+		}
+		cgoValues.roots[to] = copied
+	}
+}
+
+func releaseValues(root TraceIdType) {
+	cgoValues.Lock()
+	delete(cgoValues.roots, root)
+	cgoValues.Unlock()
+}
+
+func (r cgoRecorder) setValue(id TraceIdType, key string, value interface{}) {
+	// rootOf under the lock: a root ended is released after, or not found
+	cgoValues.Lock()
+	defer cgoValues.Unlock()
+	root := r.rootOf(id)
+	if root == INVALIED_TRACE {
+		return
+	}
+	values := cgoValues.roots[root]
+	if values == nil {
+		values = map[string]interface{}{}
+		cgoValues.roots[root] = values
+	}
+	values[key] = value
+}
+
+func (r cgoRecorder) getValue(id TraceIdType, key string) (interface{}, bool) {
+	root := r.rootOf(id)
+	if root == INVALIED_TRACE {
+		return nil, false
+	}
+	cgoValues.Lock()
+	defer cgoValues.Unlock()
+	value, found := cgoValues.roots[root][key]
+	return value, found
+}
+
+func (cgoRecorder) wakeTrace(id TraceIdType) error {
+	if C.pinpoint_wake_trace(C.NodeID(id)) != 0 {
+		return errors.New("wake trace failed")
+	}
+	return nil
+}
+
+func (cgoRecorder) isRoot(id TraceIdType) bool {
+	return C.pinpoint_trace_is_root(C.NodeID(id)) == 1
+}
+
+func (r cgoRecorder) rootOf(id TraceIdType) TraceIdType {
+	root, err := r.getIntContext(id, rootIdKey)
+	if err != nil {
+		return INVALIED_TRACE
+	}
+	return TraceIdType(root)
+}
+
+func (cgoRecorder) addClue(id TraceIdType, key, value string, loc LocationType) {
+	ckey := C.CString(key)
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(ckey))
+	defer C.free(unsafe.Pointer(cvalue))
+	C.pinpoint_add_clue(C.NodeID(id), ckey, cvalue, C.E_NODE_LOC(loc))
+}
+
+func (cgoRecorder) addClues(id TraceIdType, key, value string, loc LocationType) {
+	ckey := C.CString(key)
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(ckey))
+	defer C.free(unsafe.Pointer(cvalue))
+	C.pinpoint_add_clues(C.NodeID(id), ckey, cvalue, C.E_NODE_LOC(loc))
+}
+
+func (cgoRecorder) addException(id TraceIdType, msg string) {
+	exp := C.CString(msg)
+	defer C.free(unsafe.Pointer(exp))
+	C.pinpoint_add_exception(C.NodeID(id), exp)
+}
+
+func (cgoRecorder) markError(id TraceIdType, msg, file string, line uint32) {
+	cmsg := C.CString(msg)
+	defer C.free(unsafe.Pointer(cmsg))
+	file_name := C.CString(file)
+	defer C.free(unsafe.Pointer(file_name))
+	C.catch_error(C.NodeID(id), cmsg, file_name, C.uint(line))
+}
+
+func (cgoRecorder) dropTrace(id TraceIdType) {
+	C.mark_current_trace_status(C.NodeID(id), C.int(C.E_TRACE_BLOCK))
+}
+
+func (cgoRecorder) setContext(id TraceIdType, key, value string) {
+	ckey := C.CString(key)
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(ckey))
+	defer C.free(unsafe.Pointer(cvalue))
+	C.pinpoint_set_context_key(C.NodeID(id), ckey, cvalue)
+}
+
+func (cgoRecorder) getContext(id TraceIdType, key string) (string, bool) {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	// a value filling the buffer may be cut, it is read again in a larger one
+	for size := 1024; ; size *= 2 {
+		pbuf := (*C.char)(C.malloc(C.size_t(size)))
+		n := int(C.pinpoint_get_context_key(C.NodeID(id), ckey, pbuf, C.int(size)))
+		if n < size {
+			var value string
+			if n > 0 {
+				value = C.GoStringN(pbuf, C.int(n))
+			}
+			C.free(unsafe.Pointer(pbuf))
+			return value, n >= 0
+		}
+		C.free(unsafe.Pointer(pbuf))
+	}
+}
+
+func (cgoRecorder) setIntContext(id TraceIdType, key string, value int64) {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	C.pinpoint_set_context_long(C.NodeID(id), ckey, C.long(value))
+}
+
+func (cgoRecorder) getIntContext(id TraceIdType, key string) (int64, error) {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	var value C.long
+	if C.pinpoint_get_context_long(C.NodeID(id), ckey, &value) != 0 {
+		return 0, errors.New("not found")
+	}
+	return int64(value), nil
+}
@@ -0,0 +1,169 @@
+//go:build cgo && !pinpoint_purego
+// +build cgo,!pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pinpoint-apm/go-aop-agent/common/collectoragent"
+)
+
+func TestCgoAsyncTrace(t *testing.T) {
+	root := Pinpoint_start_trace(ROOT_TRACE)
+	child := Pinpoint_start_trace(root)
+	Pinpoint_set_context_value("tenant", "7", root)
+	fork := Pinpoint_start_async_trace(child)
+	if fork == INVALIED_TRACE {
+		t.Fatal("start async trace failed")
+	}
+	// a root of its own in C, with the values of the root of its parent
+	if !Pinpoint_trace_is_root(fork) || Pinpoint_trace_root(fork) != fork {
+		t.Fatal("the async node is not a root in C")
+	}
+	if value, ok := Pinpoint_get_context_value("tenant", fork); !ok || value != "7" {
+		t.Errorf("tenant is %v", value)
+	}
+	// an async node under an async node
+	worker := Pinpoint_start_async_trace(fork)
+	if worker == INVALIED_TRACE {
+		t.Fatal("start async trace failed")
+	}
+	Pinpoint_end_trace(child)
+	if Pinpoint_end_trace(root) != ROOT_TRACE {
+		t.Fatal("end_trace of the root should return ROOT_TRACE")
+	}
+	// not held by its async nodes
+	if Pinpoint_trace_is_root(root) {
+		t.Fatal("the root is not ended on time")
+	}
+	if Pinpoint_start_async_trace(child) != INVALIED_TRACE {
+		t.Error("started an async node on an ended trace")
+	}
+	if Pinpoint_end_trace(fork) != child || Pinpoint_end_trace(worker) != fork {
+		t.Fatal("end_trace should return the parent")
+	}
+	if Pinpoint_start_async_trace(ROOT_TRACE) != INVALIED_TRACE {
+		t.Error("started an async node without parent")
+	}
+
+	cgoForks.Lock()
+	defer cgoForks.Unlock()
+	if len(cgoForks.parent) != 0 {
+		t.Errorf("async nodes are left: %v", cgoForks.parent)
+	}
+	cgoValues.Lock()
+	defer cgoValues.Unlock()
+	if _, ok := cgoValues.roots[fork]; ok {
+		t.Error("values are not released with the async node")
+	}
+}
+
+func TestCgoAsyncTraceSpan(t *testing.T) {
+	srv, err := collectoragent.Listen("unix:" + filepath.Join(t.TempDir(), "collector.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Pinpoint_set_collect_agent_host(srv.Host())
+	disableUtest()
+	t.Cleanup(func() {
+		Pinpoint_enable_utest()
+		srv.Close()
+	})
+
+	header := &PinTransactionHeader{Url: "/fork", Host: "localhost", RemoteAddr: "127.0.0.1"}
+	done := make(chan struct{})
+	PinTranscation(header, func(ctx context.Context) error {
+		fctx, end := Fork(ctx)
+		go func() {
+			defer close(done)
+			defer end()
+			SpanFromContext(fctx).SetClue(PP_INTERCEPTOR_NAME, "worker")
+			time.Sleep(300 * time.Millisecond)
+		}()
+		return nil
+	}, context.Background())
+
+	// the root is sent without waiting for the async node
+	spans, err := srv.Wait(1, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := spans[0]
+	if elapsed := root["E"].(float64); elapsed >= 300 {
+		t.Errorf("elapsed of the root %v ms", elapsed)
+	}
+	<-done
+	spans, err = srv.Wait(2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	async := spans[1]
+	if async[PP_SERVER_TYPE] != PP_ASYNC || async[PP_TRANSCATION_ID] != root[PP_TRANSCATION_ID] {
+		t.Fatalf("async span %v of %v", async, root)
+	}
+	if async[PP_PARENT_SPAN_ID] != root[PP_SPAN_ID] || async[PP_SPAN_ID] == root[PP_SPAN_ID] {
+		t.Errorf("async span %v is not linked to %v", async, root)
+	}
+	if elapsed := async["E"].(float64); elapsed < 300 {
+		t.Errorf("elapsed of the async node %v ms", elapsed)
+	}
+}
+
+func TestCgoTraceRoot(t *testing.T) {
+	root := Pinpoint_start_trace(ROOT_TRACE)
+	child := Pinpoint_start_trace(root)
+	if Pinpoint_trace_root(child) != root || Pinpoint_trace_root(root) != root {
+		t.Error("root of the trace is not found")
+	}
+	// handed to pinpoint_common as E_LOC_ROOT
+	Pinpoint_add_clue("user", "tom", child, RootTraceLoc)
+	Pinpoint_end_trace(child)
+	Pinpoint_end_trace(root)
+	if Pinpoint_trace_root(root) != INVALIED_TRACE {
+		t.Error("root of an ended trace")
+	}
+}
+
+func TestCgoContextValue(t *testing.T) {
+	root := Pinpoint_start_trace(ROOT_TRACE)
+	child := Pinpoint_start_trace(root)
+	Pinpoint_set_context_value("empty", "", child)
+	Pinpoint_set_context_value("baggage", map[string]string{"tenant": "7"}, child)
+	if value, ok := Pinpoint_get_context_value("empty", root); !ok || value != "" {
+		t.Error("an empty string is not found")
+	}
+	if value, ok := Pinpoint_get_context_value("baggage", root); !ok || value.(map[string]string)["tenant"] != "7" {
+		t.Errorf("baggage is %v", value)
+	}
+	if _, ok := Pinpoint_get_context_value("missing", child); ok {
+		t.Error("a missing key is found")
+	}
+	Pinpoint_end_trace(child)
+	Pinpoint_end_trace(root)
+
+	cgoValues.Lock()
+	defer cgoValues.Unlock()
+	if _, ok := cgoValues.roots[root]; ok {
+		t.Error("values are not released with the root")
+	}
+}
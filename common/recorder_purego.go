@@ -0,0 +1,200 @@
+//go:build !cgo || pinpoint_purego
+// +build !cgo pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * The go recorder: global_agent_info of pinpoint_common in go, and a traceTree sending the
+ * finished traces to collector-agent.
+ */
+
+const (
+	// inter_flag of global_agent_info
+	debugReportFlag = 0x1
+	utestFlag       = 0x4
+)
+
+// global_agent_info
+var agentInfo = struct {
+	interFlag  uint32
+	traceLimit int64
+	startTime  int64
+}{
+	traceLimit: -1,
+	startTime:  time.Now().Unix(),
+}
+
+var (
+	// the traces sent to collector-agent
+	goTree = newTraceTree(sendTrace)
+
+	uniqueId    int64
+	limitMu     sync.Mutex
+	limitSecond int64
+	limitCount  int64
+)
+
+func init() {
+	setRecorder(goTree)
+}
+
+func debugf(format string, v ...interface{}) {
+	if atomic.LoadUint32(&agentInfo.interFlag)&debugReportFlag != 0 {
+		Logf(format, v...)
+	}
+}
+
+// go logs by Logf, nothing to register
+func registerLogCallBack() {}
+
+func sendTrace(root *traceNode) {
+	if root.dropped || !root.meetsOptions() {
+		debugf("trace %d is dropped", root.id)
+		return
+	}
+	span, err := json.Marshal(root.toSpan())
+	if err != nil {
+		debugf("trace %d is dropped:%s", root.id, err)
+		return
+	}
+	if atomic.LoadUint32(&agentInfo.interFlag)&utestFlag != 0 {
+		debugf("trace %d: %s", root.id, span)
+		return
+	}
+	collector.send(span)
+}
+
+/**
+ * @description: For Debug, trace the pinpoint
+ * @param {bool} enable
+ * @return {*}
+ */
+func Pinpoint_enable_debug_report(enable bool) {
+	if enable {
+		Logf("enable debug report")
+		setInterFlag(debugReportFlag, true)
+	} else {
+		setInterFlag(debugReportFlag, false)
+	}
+}
+
+/**
+ * @description: unittest only. spans are logged instead of sent
+ * @param {*}
+ * @return {*}
+ */
+func Pinpoint_enable_utest() {
+	setInterFlag(utestFlag, true)
+}
+
+func setInterFlag(flag uint32, on bool) {
+	for {
+		old := atomic.LoadUint32(&agentInfo.interFlag)
+		flags := old &^ flag
+		if on {
+			flags |= flag
+		}
+		if atomic.CompareAndSwapUint32(&agentInfo.interFlag, old, flags) {
+			return
+		}
+	}
+}
+
+/**
+ * @description: set trace_limit.
+ * @param {int32} limitPerSec times per second.(-1 means no limit)
+ * @return {*}
+ */
+func Pinpoint_set_trace_limit(limitPerSec int32) {
+	atomic.StoreInt64(&agentInfo.traceLimit, int64(limitPerSec))
+}
+
+/**
+ * @description:  Set collector-agent host
+ * @param {string} host: tcp:dev.collector:9999 or unix:/tmp/collector.sock
+ * @return {*}
+ */
+func Pinpoint_set_collect_agent_host(host string) {
+	collector.setHost(host)
+}
+
+/**
+ * @description: An unique id per process
+ * @param {*}
+ * @return {*}
+ */
+func Pinpoint_unique_id() int64 {
+	return atomic.AddInt64(&uniqueId, 1) - 1
+}
+
+/**
+ * @description: Agent first run time
+ * @param {*}
+ * @return {*}
+ */
+func Pinpoint_start_time() int64 {
+	return agentInfo.startTime
+}
+
+/**
+ * @description: Check sample speed is reached the limit or not.
+ * @param {*}
+ * @return {*} true: current trace should be dropped. false: not limited
+ */
+func Pinpoint_tracelimit() bool {
+	limit := atomic.LoadInt64(&agentInfo.traceLimit)
+	if limit < 0 {
+		return false
+	} else if limit == 0 {
+		return true
+	}
+
+	now := time.Now().Unix()
+	limitMu.Lock()
+	defer limitMu.Unlock()
+	if now != limitSecond {
+		limitSecond, limitCount = now, 0
+	}
+	limitCount++
+	return limitCount > limit
+}
+
+/**
+ * @description: print the internal status message
+ *
+ */
+func ShowAgentStatus() {
+	goTree.mu.Lock()
+	live := len(goTree.nodes)
+	goTree.mu.Unlock()
+	sent, dropped := collector.stats()
+	Logf("pinpoint go recorder: %d nodes alive, %d spans sent, %d spans dropped", live, sent, dropped)
+}
+
+// no libpinpoint_common to check
+func Prerequisite() bool {
+	return true
+}
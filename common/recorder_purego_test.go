@@ -0,0 +1,154 @@
+//go:build !cgo || pinpoint_purego
+// +build !cgo pinpoint_purego
+
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pinpoint-apm/go-aop-agent/common/collectoragent"
+)
+
+// collectorAgent listens on a unix socket as collector-agent, spans are sent to it till the test ends
+func collectorAgent(t *testing.T) *collectoragent.Server {
+	srv, err := collectoragent.Listen("unix:" + filepath.Join(t.TempDir(), "collector.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sender logs in its goroutines, keep them off the log callback of other tests
+	debug := atomic.LoadUint32(&agentInfo.interFlag)&debugReportFlag != 0
+	setInterFlag(debugReportFlag, false)
+	setInterFlag(utestFlag, false)
+	Pinpoint_set_collect_agent_host(srv.Host())
+
+	t.Cleanup(func() {
+		srv.Close()
+		setInterFlag(utestFlag, true)
+		setInterFlag(debugReportFlag, debug)
+	})
+	return srv
+}
+
+func receiveSpan(t *testing.T, srv *collectoragent.Server) map[string]interface{} {
+	spans, err := srv.Wait(1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spans[0]
+}
+
+func TestRecorderSpanTree(t *testing.T) {
+	srv := collectorAgent(t)
+
+	// a dropped trace is never sent
+	dropped := Pinpoint_start_trace(ROOT_TRACE)
+	Pinpoint_drop_trace(dropped)
+	Pinpoint_end_trace(dropped)
+
+	root := Pinpoint_start_trace(ROOT_TRACE)
+	Pinpoint_add_clue(PP_SERVER_TYPE, GOLANG, root, CurrentTraceLoc)
+	child := Pinpoint_start_trace(root)
+	Pinpoint_add_clue(PP_SERVER_TYPE, PP_MYSQL, child, CurrentTraceLoc)
+	Pinpoint_add_clues(PP_SQL_FORMAT, "select 1", child, CurrentTraceLoc)
+	Pinpoint_add_exception("timeout", child)
+	// not sent: shorter than TraceMinTimeMs
+	quick := Pinpoint_start_trace_opt(child, "TraceMinTimeMs:1000")
+	if Pinpoint_end_trace(quick) != child || Pinpoint_end_trace(child) != root {
+		t.Fatal("end_trace should return the parent")
+	}
+	Pinpoint_mark_error("panic", "trace.go", 12, child)
+	if Pinpoint_end_trace(root) != ROOT_TRACE {
+		t.Fatal("end_trace of the root should return ROOT_TRACE")
+	}
+	if Pinpoint_trace_is_root(root) || Pinpoint_wake_trace(child) == nil {
+		t.Fatal("nodes should be freed with the root")
+	}
+
+	span := receiveSpan(t, srv)
+	if span[PP_SERVER_TYPE] != GOLANG || span[PP_AGENT_TYPE] != float64(1800) || span[spanStartKey] == nil {
+		t.Fatalf("span %v", span)
+	}
+	if err, _ := span[spanErrorKey].(map[string]interface{}); err["msg"] != "panic" || err["line"] != float64(12) {
+		t.Fatalf("ERR %v", span[spanErrorKey])
+	}
+	calls, _ := span[spanCallsKey].([]interface{})
+	if len(calls) != 1 {
+		t.Fatalf("calls %v", span[spanCallsKey])
+	}
+	event := calls[0].(map[string]interface{})
+	if event[PP_SERVER_TYPE] != PP_MYSQL || event[PP_ADD_EXCEPTION] != "timeout" || event[spanCallsKey] != nil {
+		t.Fatalf("event %v", event)
+	}
+	if clues, _ := event[spanCluesKey].([]interface{}); len(clues) != 1 || clues[0] != PP_SQL_FORMAT+":select 1" {
+		t.Fatalf("clues %v", event[spanCluesKey])
+	}
+}
+
+func TestRecorderWakeTrace(t *testing.T) {
+	srv := collectorAgent(t)
+
+	root := Pinpoint_start_trace(ROOT_TRACE)
+	sum := Pinpoint_start_trace(root)
+	time.Sleep(20 * time.Millisecond)
+	Pinpoint_end_trace(sum)
+	time.Sleep(50 * time.Millisecond)
+	if err := Pinpoint_wake_trace(sum); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	Pinpoint_end_trace(sum)
+	Pinpoint_end_trace(root)
+
+	// elapsed time of a node is the sum of its runs
+	event := receiveSpan(t, srv)[spanCallsKey].([]interface{})[0].(map[string]interface{})
+	if elapsed := event[spanElapsedKey].(float64); elapsed < 40 || elapsed >= 70 {
+		t.Errorf("elapsed %v ms", elapsed)
+	}
+}
+
+func TestRecorderAsyncTrace(t *testing.T) {
+	srv := collectorAgent(t)
+
+	root := Pinpoint_start_trace(ROOT_TRACE)
+	fork := Pinpoint_start_async_trace(root)
+	if Pinpoint_end_trace(root) != ROOT_TRACE {
+		t.Fatal("end_trace of the root should return ROOT_TRACE")
+	}
+	// the trace is held till its async node ends
+	if Pinpoint_trace_root(fork) != root {
+		t.Fatal("the trace is finished before its async node")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(srv.Spans()) != 0 {
+		t.Fatal("the trace is sent before its async node ends")
+	}
+	Pinpoint_end_trace(fork)
+
+	span := receiveSpan(t, srv)
+	if elapsed := span[spanElapsedKey].(float64); elapsed >= 50 {
+		t.Errorf("elapsed of the root %v ms", elapsed)
+	}
+	async := span[spanCallsKey].([]interface{})[0].(map[string]interface{})
+	if elapsed := async[spanElapsedKey].(float64); elapsed < 50 {
+		t.Errorf("elapsed of the async node %v ms", elapsed)
+	}
+}
@@ -0,0 +1,343 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"context"
+	"runtime"
+)
+
+/**
+ * Span is a node of a trace: the span of a request, or a span event under it.
+ * It is the id of the node in the trace tree, the Pinpoint_* functions work on the same tree.
+ * Every method does nothing on a nil *Span, so a plugin needs one check:
+ *   span := common.SpanFromContext(ctx).Child("*redis.Client.Get")
+ *   if span == nil { // not traced or not sampled
+ *   	return call(ctx)
+ *   }
+ *   defer span.End()
+ */
+type Span struct {
+	id TraceIdType
+}
+
+/**
+ * @description: start a trace, the span of a request. It is sampled until Drop
+ * @param {string} name
+ * @return {*} nil if the trace can not be started
+ */
+func StartSpan(name string) *Span {
+	id := Pinpoint_start_trace(ROOT_TRACE)
+	if id == TraceIdType(INVALIED_TRACE) {
+		return nil
+	}
+	span := &Span{id: id}
+	span.SetClue(PP_INTERCEPTOR_NAME, name)
+	span.SetContext(PP_HEADER_PINPOINT_SAMPLED, PP_SAMPLED)
+	return span
+}
+
+/**
+ * @description: the span of the node in ctx
+ * @param {context.Context} ctx
+ * @return {*} nil if ctx is not traced
+ */
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	if id, ok := ctx.Value(TRACE_ID).(TraceIdType); ok && id != TraceIdType(INVALIED_TRACE) {
+		return &Span{id: id}
+	}
+	return nil
+}
+
+/**
+ * @description: ctx carrying the span, calls with it trace under the span
+ * @param {context.Context} ctx
+ * @param {*Span} span nil returns ctx
+ * @return {*}
+ */
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, TRACE_ID, span.id)
+}
+
+/**
+ * @description: id of the node for the Pinpoint_* functions
+ * @param {*}
+ * @return {*} INVALIED_TRACE on nil
+ */
+func (span *Span) Id() TraceIdType {
+	if span == nil {
+		return TraceIdType(INVALIED_TRACE)
+	}
+	return span.id
+}
+
+/**
+ * @description: start a span event under the span
+ * @param {string} name PP_INTERCEPTOR_NAME of it
+ * @param {...string} opt options of Pinpoint_start_trace_opt
+ * @return {*} nil if the trace is not sampled
+ */
+func (span *Span) Child(name string, opt ...string) *Span {
+	if !span.Sampled() {
+		return nil
+	}
+	var id TraceIdType
+	if len(opt) == 0 {
+		id = Pinpoint_start_trace(span.id)
+	} else {
+		id = Pinpoint_start_trace_opt(span.id, opt...)
+	}
+	if id == TraceIdType(INVALIED_TRACE) {
+		return nil
+	}
+	child := &Span{id: id}
+	child.SetClue(PP_INTERCEPTOR_NAME, name)
+	return child
+}
+
+/**
+ * @description: the span of the request the span is in, e.g. to tag the request
+ *  with the user id found by a repository deep in the call chain:
+ *   common.SpanFromContext(ctx).Root().SetAnnotation("user.id", id)
+ * @param {*}
+ * @return {*} nil if the span is not running
+ */
+func (span *Span) Root() *Span {
+	if span == nil {
+		return nil
+	}
+	root := Pinpoint_trace_root(span.id)
+	if root == TraceIdType(INVALIED_TRACE) {
+		return nil
+	}
+	return &Span{id: root}
+}
+
+/**
+ * @description: end the span, the trace is sent when its root ends
+ * @param {*}
+ * @return {*}
+ */
+func (span *Span) End() {
+	if span != nil {
+		Pinpoint_end_trace(span.id)
+	}
+}
+
+/**
+ * @description: the trace is sampled, it is not dropped by Drop or the parent
+ * @param {*}
+ * @return {bool}
+ */
+func (span *Span) Sampled() bool {
+	if span == nil {
+		return false
+	}
+	sampled, _ := span.GetContext(PP_HEADER_PINPOINT_SAMPLED)
+	return sampled != PP_NOT_SAMPLED
+}
+
+/**
+ * @description: the trace is not sent, and no span event is started in it
+ * @param {*}
+ * @return {*}
+ */
+func (span *Span) Drop() {
+	if span != nil {
+		Pinpoint_drop_trace(span.id)
+		span.SetContext(PP_HEADER_PINPOINT_SAMPLED, PP_NOT_SAMPLED)
+	}
+}
+
+/**
+ * @description: an attribute of the span, e.g. PP_REQ_URI
+ * @param {string} key
+ * @param {string} value
+ * @return {*}
+ */
+func (span *Span) SetClue(key, value string) {
+	if span != nil {
+		Pinpoint_add_clue(key, value, span.id, CurrentTraceLoc)
+	}
+}
+
+/**
+ * @description: an annotation of the span, e.g. PP_ARGS or PP_HTTP_STATUS_CODE
+ * @param {string} key
+ * @param {string} value
+ * @return {*}
+ */
+func (span *Span) SetAnnotation(key, value string) {
+	if span != nil {
+		Pinpoint_add_clues(key, value, span.id, CurrentTraceLoc)
+	}
+}
+
+// SetDestination sets the host or database called, PP_DESTINATION
+func (span *Span) SetDestination(destination string) {
+	span.SetClue(PP_DESTINATION, destination)
+}
+
+// SetServiceType sets PP_SERVER_TYPE, e.g. PP_MYSQL
+func (span *Span) SetServiceType(serviceType string) {
+	span.SetClue(PP_SERVER_TYPE, serviceType)
+}
+
+// SetSQL sets the sql executed, PP_SQL_FORMAT
+func (span *Span) SetSQL(sql string) {
+	span.SetClue(PP_SQL_FORMAT, sql)
+}
+
+/**
+ * @description: an exception in the span, the trace is not marked as failed
+ * @param {string} msg
+ * @return {*}
+ */
+func (span *Span) SetException(msg string) {
+	if span != nil {
+		Pinpoint_add_exception(msg, span.id)
+	}
+}
+
+/**
+ * @description: mark the trace as failed, at the file and line of the caller
+ * @param {string} msg
+ * @return {*}
+ */
+func (span *Span) MarkError(msg string) {
+	if span != nil {
+		_, file, line, _ := runtime.Caller(1)
+		Pinpoint_mark_error(msg, file, uint32(line), span.id)
+	}
+}
+
+/**
+ * @description: err as the exception of the span, and the trace is marked as failed
+ * @param {error} err nil does nothing
+ * @return {*}
+ */
+func (span *Span) RecordError(err error) {
+	if span != nil && err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		span.RecordErrorAt(err, file, line)
+	}
+}
+
+/**
+ * @description: RecordError at a location other than the caller, e.g. the application frame
+ *  calling the function a plugin wraps
+ * @param {error} err nil does nothing
+ * @param {string} file
+ * @param {int} line
+ * @return {*}
+ */
+func (span *Span) RecordErrorAt(err error, file string, line int) {
+	if span != nil && err != nil {
+		Pinpoint_add_exception(err.Error(), span.id)
+		Pinpoint_mark_error(err.Error(), file, uint32(line), span.id)
+	}
+}
+
+/**
+ * @description: a value in the context of the trace, shared by all its spans
+ * @param {string} key
+ * @param {string} value
+ * @return {*}
+ */
+func (span *Span) SetContext(key, value string) {
+	if span != nil {
+		Pinpoint_set_context(key, value, span.id)
+	}
+}
+
+/**
+ * @description: a value set by SetContext on any span of the trace
+ * @param {string} key
+ * @return {*} the value, false if not found
+ */
+func (span *Span) GetContext(key string) (string, bool) {
+	if span == nil {
+		return "", false
+	}
+	return Pinpoint_get_context(key, span.id)
+}
+
+/**
+ * @description: a go value in the context of the trace, of any type or size, e.g. a map.
+ *  It is kept in go, apart from SetContext
+ * @param {string} key
+ * @param {interface{}} value
+ * @return {*}
+ */
+func (span *Span) SetContextValue(key string, value interface{}) {
+	if span != nil {
+		Pinpoint_set_context_value(key, value, span.id)
+	}
+}
+
+/**
+ * @description: a value set by SetContextValue on any span of the trace
+ * @param {string} key
+ * @return {*} false if the key is not set
+ */
+func (span *Span) ContextValue(key string) (interface{}, bool) {
+	if span == nil {
+		return nil, false
+	}
+	return Pinpoint_get_context_value(key, span.id)
+}
+
+// SetContextString stores a string of any length, "" included
+func (span *Span) SetContextString(key, value string) {
+	span.SetContextValue(key, value)
+}
+
+/**
+ * @description: a string of SetContextString
+ * @param {string} key
+ * @return {*} false if the key is not set or is not a string
+ */
+func (span *Span) ContextString(key string) (string, bool) {
+	value, found := span.ContextValue(key)
+	s, ok := value.(string)
+	return s, found && ok
+}
+
+// SetContextBytes stores a copy of value
+func (span *Span) SetContextBytes(key string, value []byte) {
+	span.SetContextValue(key, append([]byte{}, value...))
+}
+
+/**
+ * @description: a copy of the bytes of SetContextBytes
+ * @param {string} key
+ * @return {*} false if the key is not set or is not a []byte
+ */
+func (span *Span) ContextBytes(key string) ([]byte, bool) {
+	value, found := span.ContextValue(key)
+	b, ok := value.([]byte)
+	if !found || !ok {
+		return nil, false
+	}
+	return append([]byte{}, b...), true
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// recordTraces records the traces of a test in a go trace tree
+func recordTraces(t *testing.T) *[]*RecordedNode {
+	var traces []*RecordedNode
+	t.Cleanup(UseRecorder(func(root *RecordedNode) {
+		traces = append(traces, root)
+	}))
+	return &traces
+}
+
+func TestSpan(t *testing.T) {
+	traces := recordTraces(t)
+
+	root := StartSpan("/user")
+	ctx := ContextWithSpan(context.Background(), root)
+	span := SpanFromContext(ctx).Child("query")
+	span.SetServiceType(PP_MYSQL)
+	span.SetDestination("db:3306")
+	span.SetSQL("select 1")
+	span.SetAnnotation(PP_ARGS, "7")
+	span.RecordError(errors.New("timeout"))
+	if sampled, _ := span.GetContext(PP_HEADER_PINPOINT_SAMPLED); sampled != PP_SAMPLED {
+		t.Error("the context of the trace is not shared")
+	}
+	span.End()
+	root.End()
+
+	if len(*traces) != 1 {
+		t.Fatalf("%d traces", len(*traces))
+	}
+	rec := (*traces)[0]
+	if rec.Id != root.Id() || rec.Clues[PP_INTERCEPTOR_NAME] != "/user" || len(rec.Children) != 1 {
+		t.Fatalf("root %+v", rec)
+	}
+	child := rec.Children[0]
+	for key, value := range map[string]string{
+		PP_INTERCEPTOR_NAME: "query",
+		PP_SERVER_TYPE:      PP_MYSQL,
+		PP_DESTINATION:      "db:3306",
+		PP_SQL_FORMAT:       "select 1",
+		PP_ADD_EXCEPTION:    "timeout",
+	} {
+		if child.Clues[key] != value {
+			t.Errorf("%s is %q, want %q", key, child.Clues[key], value)
+		}
+	}
+	if len(child.ClueList) != 1 || child.ClueList[0] != PP_ARGS+":7" {
+		t.Errorf("annotations %q", child.ClueList)
+	}
+	if rec.Error == nil || rec.Error.Msg != "timeout" || !strings.HasSuffix(rec.Error.File, "span_test.go") || rec.Error.Line == 0 {
+		t.Errorf("error %+v", rec.Error)
+	}
+}
+
+func TestSpanDropped(t *testing.T) {
+	traces := recordTraces(t)
+
+	root := StartSpan("/health")
+	root.Drop()
+	if root.Sampled() || root.Child("query") != nil {
+		t.Error("started a span event in a dropped trace")
+	}
+	root.End()
+	if len(*traces) != 1 || !(*traces)[0].Dropped {
+		t.Errorf("traces %v", *traces)
+	}
+
+	// nothing is traced without a span
+	var none *Span
+	if SpanFromContext(context.Background()) != nil || none.Child("query") != nil || none.Sampled() {
+		t.Error("a span out of a trace")
+	}
+	none.SetClue(PP_DESTINATION, "db")
+	none.RecordError(errors.New("timeout"))
+	none.End()
+	if ctx := context.Background(); ContextWithSpan(ctx, none) != ctx || none.Id() != INVALIED_TRACE {
+		t.Error("nil span changed ctx")
+	}
+}
+
+func TestSpanRoot(t *testing.T) {
+	traces := recordTraces(t)
+
+	root := StartSpan("/order")
+	ctx := ContextWithSpan(context.Background(), root)
+	service := SpanFromContext(ctx).Child("service")
+	repository := service.Child("repository")
+	// found deep in the call chain, it tags the request
+	repository.Root().SetAnnotation("tenant", "7")
+	Pinpoint_add_clue("user", "tom", repository.Id(), RootTraceLoc)
+	Pinpoint_add_clues(PP_ARGS, "1", repository.Id(), CurrentTraceLoc)
+	if repository.Root().Id() != root.Id() || root.Root().Id() != root.Id() {
+		t.Error("Root is not the span of the request")
+	}
+	repository.End()
+	service.End()
+	root.End()
+
+	var none *Span
+	if none.Root() != nil || repository.Root() != nil {
+		t.Error("Root of a span not running")
+	}
+
+	if len(*traces) != 1 {
+		t.Fatalf("%d traces", len(*traces))
+	}
+	rec := (*traces)[0]
+	if rec.Clues["user"] != "tom" || len(rec.ClueList) != 1 || rec.ClueList[0] != "tenant:7" {
+		t.Errorf("root clues %v annotations %q", rec.Clues, rec.ClueList)
+	}
+	node := rec.Children[0].Children[0]
+	if node.Clues["user"] != "" || len(node.ClueList) != 1 || node.ClueList[0] != PP_ARGS+":1" {
+		t.Errorf("repository clues %v annotations %q", node.Clues, node.ClueList)
+	}
+}
+
+func TestSpanContextValue(t *testing.T) {
+	traces := recordTraces(t)
+
+	root := StartSpan("/order")
+	repository := root.Child("repository")
+	url := "/order?items=" + strings.Repeat("7,", 2048)
+	repository.SetContextString("url", url)
+	root.SetContextString("coupon", "")
+	raw := []byte("tom")
+	repository.SetContextBytes("user", raw)
+	raw[0] = 'j'
+	root.SetContextValue("baggage", map[string]string{"tenant": "7"})
+
+	if got, ok := root.ContextString("url"); !ok || got != url {
+		t.Errorf("url of %d bytes is lost", len(url))
+	}
+	if got, ok := repository.ContextString("coupon"); !ok || got != "" {
+		t.Error("an empty string is not found")
+	}
+	if _, ok := repository.ContextString("missing"); ok {
+		t.Error("a missing key is found")
+	}
+	if user, ok := root.ContextBytes("user"); !ok || string(user) != "tom" {
+		t.Errorf("user is %q", user)
+	} else {
+		user[0] = 'j'
+	}
+	if user, _ := root.ContextBytes("user"); string(user) != "tom" {
+		t.Errorf("user is changed to %q", user)
+	}
+	if value, ok := repository.ContextValue("baggage"); !ok || value.(map[string]string)["tenant"] != "7" {
+		t.Errorf("baggage is %v", value)
+	}
+	if _, ok := root.ContextString("baggage"); ok {
+		t.Error("a map is taken as a string")
+	}
+	if _, ok := root.GetContext("url"); ok {
+		t.Error("values are apart from the strings of SetContext")
+	}
+	repository.End()
+	root.End()
+
+	if _, ok := root.ContextValue("url"); ok {
+		t.Error("a value outlived its trace")
+	}
+	if len(*traces) != 1 || (*traces)[0].Values["url"] != url {
+		t.Errorf("values are not recorded")
+	}
+}
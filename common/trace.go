@@ -19,6 +19,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"sync"
 )
 
 type PinTransactionHeader struct {
@@ -29,7 +30,9 @@ type PinTransactionHeader struct {
 	ParentName string
 	ParentHost string
 	ParentTid  string
-	Err        error
+	// the baggage of the request, e.g. of the Pinpoint-Baggage-<key> headers
+	Baggage map[string]string
+	Err     error
 }
 
 type DeferFunc func(*error, ...interface{})
@@ -46,38 +49,35 @@ func PinFuncSum(ctx context.Context, name string, args ...interface{}) (context.
 		return ctx, emptyPinFunc
 	}
 
-	if parentId, err := GetParentId(ctx); err != nil ||
-		Pinpoint_get_context(PP_HEADER_PINPOINT_SAMPLED, parentId) == PP_NOT_SAMPLED {
+	parent := SpanFromContext(ctx)
+	if !parent.Sampled() {
 		return ctx, emptyPinFunc
+	}
+
+	var span *Span
+	nctx := ctx
+	key := "[sum]" + name
+	if v, err := Pinpoint_get_int_context(key, parent.Id()); err == nil {
+		// found v
+		span = &Span{id: TraceIdType(v)}
+		Pinpoint_wake_trace(span.id)
 	} else {
-		var id TraceIdType
-		var nctx context.Context
-		key := "[sum]" + name
-		if v, err := Pinpoint_get_int_context(key, parentId); err == nil {
-			// found v
-			id = TraceIdType(v)
-			Pinpoint_wake_trace(id)
-			nctx = ctx
-		} else {
-			id = Pinpoint_start_trace(parentId)
-			if id == TraceIdType(-1) {
-				return ctx, emptyPinFunc
-			}
-			Pinpoint_set_int_context(key, int64(id), id)
-			nctx = context.WithValue(ctx, TRACE_ID, id)
-			Pinpoint_add_clue(PP_SERVER_TYPE, PP_METHOD_CALL, id, CurrentTraceLoc)
-			Pinpoint_add_clue(PP_INTERCEPTOR_NAME, key, id, CurrentTraceLoc)
+		if span = parent.Child(key); span == nil {
+			return ctx, emptyPinFunc
 		}
+		Pinpoint_set_int_context(key, int64(span.id), span.id)
+		nctx = ContextWithSpan(ctx, span)
+		span.SetServiceType(PP_METHOD_CALL)
+	}
 
-		deferfunc := func(err *error, ret ...interface{}) {
-			if err != nil && *err != nil {
-				Pinpoint_add_clue(PP_ADD_EXCEPTION, (*err).Error(), id, CurrentTraceLoc)
-			}
-
-			Pinpoint_end_trace(id)
+	deferfunc := func(err *error, ret ...interface{}) {
+		if err != nil && *err != nil {
+			span.SetException((*err).Error())
 		}
-		return nctx, deferfunc
+
+		span.End()
 	}
+	return nctx, deferfunc
 }
 
 /**
@@ -89,38 +89,56 @@ func PinFuncOnce(ctx context.Context, name string, args ...interface{}) (context
 		return ctx, emptyPinFunc
 	}
 
-	if parentId, err := GetParentId(ctx); err != nil ||
-		Pinpoint_get_context(PP_HEADER_PINPOINT_SAMPLED, parentId) == PP_NOT_SAMPLED {
+	span := SpanFromContext(ctx).Child(name)
+	if span == nil {
 		return ctx, emptyPinFunc
-	} else {
+	}
+	span.SetServiceType(PP_METHOD_CALL)
+	span.SetAnnotation(PP_ARGS, fmt.Sprint(args...))
 
-		id := Pinpoint_start_trace(parentId)
-		if id == TraceIdType(-1) {
-			return ctx, emptyPinFunc
-		}
-		nctx := context.WithValue(ctx, TRACE_ID, id)
-		addClueFunc := func(key, value string) {
-			Pinpoint_add_clue(key, value, id, CurrentTraceLoc)
+	deferfunc := func(err *error, ret ...interface{}) {
+		if err != nil && *err != nil {
+			span.SetException((*err).Error())
 		}
-		addClueSFunc := func(key, value string) {
-			Pinpoint_add_clues(key, value, id, CurrentTraceLoc)
+
+		if len(ret) > 0 {
+			span.SetAnnotation(PP_RETURN, fmt.Sprint(ret...))
 		}
-		addClueFunc(PP_SERVER_TYPE, PP_METHOD_CALL)
-		addClueFunc(PP_INTERCEPTOR_NAME, name)
-		addClueSFunc(PP_ARGS, fmt.Sprint(args...))
 
-		deferfunc := func(err *error, ret ...interface{}) {
-			if err != nil && *err != nil {
-				addClueFunc(PP_ADD_EXCEPTION, (*err).Error())
-			}
+		span.End()
+	}
+	return ContextWithSpan(ctx, span), deferfunc
+}
 
-			if len(ret) > 0 {
-				addClueSFunc(PP_RETURN, fmt.Sprint(ret...))
-			}
+/**
+ * Fork starts an async node under the node of ctx for a goroutine, it may end after its parent.
+ * The async node is sent once the returned func is called, so call it when the goroutine is done. The context keeps the deadline and cancel of ctx.
+ *   fctx, done := common.Fork(ctx)
+ *   go func() {
+ *   	defer done()
+ *   	worker(fctx)
+ *   }()
+ */
+func Fork(ctx context.Context) (context.Context, func()) {
+	if AgentIsDisabled() {
+		return ctx, func() {}
+	}
 
-			Pinpoint_end_trace(id)
-		}
-		return nctx, deferfunc
+	parent := SpanFromContext(ctx)
+	if !parent.Sampled() {
+		return ctx, func() {}
+	}
+	id := Pinpoint_start_async_trace(parent.Id())
+	if id == INVALIED_TRACE {
+		return ctx, func() {}
+	}
+	span := &Span{id: id}
+	span.SetServiceType(PP_ASYNC)
+	span.SetClue(PP_INTERCEPTOR_NAME, "Asynchronous Invocation")
+
+	var once sync.Once
+	return ContextWithSpan(ctx, span), func() {
+		once.Do(span.End)
 	}
 }
 
@@ -135,70 +153,65 @@ func PinTranscation(header *PinTransactionHeader, pile FuncPile, parentCtx conte
 		pile(parentCtx)
 	} else {
 
-		id := Pinpoint_start_trace(ROOT_TRACE)
+		span := StartSpan("pinpoint middleware")
 
 		newCtx, cancel := context.WithCancel(parentCtx)
 		defer cancel()
 		//note: update context
-		pinctx := context.WithValue(newCtx, TRACE_ID, id)
-
-		addClueFunc := func(key, value string) {
-			Pinpoint_add_clue(key, value, id, CurrentTraceLoc)
-		}
+		pinctx := ContextWithSpan(newCtx, span)
 
 		sid := Pinpoint_gen_sid()
-		addClueFunc(PP_SPAN_ID, sid)
-		Pinpoint_set_context(PP_SPAN_ID, sid, id)
+		span.SetClue(PP_SPAN_ID, sid)
+		span.SetContext(PP_SPAN_ID, sid)
 
-		addClueFunc(PP_APP_NAME, Appname)
-		addClueFunc(PP_APP_ID, Appid)
-		addClueFunc(PP_INTERCEPTOR_NAME, "pinpoint middleware")
+		span.SetClue(PP_APP_NAME, Appname)
+		span.SetClue(PP_APP_ID, Appid)
 
-		addClueFunc(PP_REQ_URI, header.Url)
-		addClueFunc(PP_REQ_SERVER, header.Host)
-		addClueFunc(PP_REQ_CLIENT, header.RemoteAddr)
-		addClueFunc(PP_SERVER_TYPE, GOLANG)
-		Pinpoint_set_context(PP_HEADER_PINPOINT_SAMPLED, "s1", id)
+		span.SetClue(PP_REQ_URI, header.Url)
+		span.SetClue(PP_REQ_SERVER, header.Host)
+		span.SetClue(PP_REQ_CLIENT, header.RemoteAddr)
+		span.SetServiceType(GOLANG)
 
 		if header.ParentType != "" {
-			addClueFunc(PP_PARENT_TYPE, header.ParentType)
+			span.SetClue(PP_PARENT_TYPE, header.ParentType)
 		}
 
 		if header.ParentName != "" {
-			addClueFunc(PP_PARENT_NAME, header.ParentName)
+			span.SetClue(PP_PARENT_NAME, header.ParentName)
 		}
 
 		if header.ParentHost != "" {
-			addClueFunc(PP_PARENT_HOST, header.ParentHost)
+			span.SetClue(PP_PARENT_HOST, header.ParentHost)
 		}
 
 		var tid string
 
 		if header.ParentTid != "" {
 			tid = header.ParentTid
-			addClueFunc(PP_PARENT_SPAN_ID, tid)
-			addClueFunc(PP_NEXT_SPAN_ID, sid)
+			span.SetClue(PP_PARENT_SPAN_ID, tid)
+			span.SetClue(PP_NEXT_SPAN_ID, sid)
 		} else {
 			tid = GenerateTid()
 		}
 
-		addClueFunc(PP_TRANSCATION_ID, tid)
-		Pinpoint_set_context(PP_TRANSCATION_ID, tid, id)
+		span.SetClue(PP_TRANSCATION_ID, tid)
+		span.SetContext(PP_TRANSCATION_ID, tid)
+		readBaggage(span, header.Baggage)
 		// end transcation
 		catchPanic := true
 		defer func() {
 			if catchPanic {
-				Pinpoint_mark_error("PinpointMiddleWare found a panic! o_o ....", "", 0, id)
+				Pinpoint_mark_error("PinpointMiddleWare found a panic! o_o ....", "", 0, span.Id())
 			}
-			Pinpoint_end_trace(id)
+			span.End()
 		}()
 
 		err := pile(pinctx)
 		catchPanic = false
 		if err != nil {
-			Pinpoint_mark_error(err.Error(), "trace.go", 0, id)
+			Pinpoint_mark_error(err.Error(), "trace.go", 0, span.Id())
 		} else if header.Err != nil {
-			Pinpoint_mark_error(header.Err.Error(), "trace.go", 0, id)
+			Pinpoint_mark_error(header.Err.Error(), "trace.go", 0, span.Id())
 		}
 	}
 
@@ -213,47 +226,26 @@ func PinHttpClientFunc(ctx context.Context, name, remoteUrl string, option []str
 		return ctx, emptyPinFunc
 	}
 
-	if parentId, err := GetParentId(ctx); err != nil ||
-		Pinpoint_get_context(PP_HEADER_PINPOINT_SAMPLED, parentId) == PP_NOT_SAMPLED {
+	span := SpanFromContext(ctx).Child(name, option...)
+	if span == nil {
 		return ctx, emptyPinFunc
-	} else {
-		var id TraceIdType
-		if option == nil {
-			id = Pinpoint_start_trace(parentId)
-		} else {
-			id = Pinpoint_start_trace_opt(parentId, option...)
-		}
+	}
+	span.SetServiceType(PP_REMOTE_METHOD)
+	span.SetAnnotation(PP_HTTP_URL, remoteUrl)
+	if u, err := url.Parse(remoteUrl); err == nil {
+		span.SetDestination(u.Host)
+	}
 
-		if id == TraceIdType(-1) {
-			return ctx, emptyPinFunc
+	deferfunc := func(err *error, ret ...interface{}) {
+		if err != nil && *err != nil {
+			span.SetException((*err).Error())
 		}
 
-		nctx := context.WithValue(ctx, TRACE_ID, id)
-		addClueFunc := func(key, value string) {
-			Pinpoint_add_clue(key, value, id, CurrentTraceLoc)
-		}
-		addClueSFunc := func(key, value string) {
-			Pinpoint_add_clues(key, value, id, CurrentTraceLoc)
-		}
-		addClueFunc(PP_SERVER_TYPE, PP_REMOTE_METHOD)
-		addClueFunc(PP_INTERCEPTOR_NAME, name)
-		addClueSFunc(PP_HTTP_URL, remoteUrl)
-		u, err := url.Parse(remoteUrl)
-		if err == nil {
-			addClueFunc(PP_DESTINATION, u.Host)
+		if len(ret) > 0 {
+			span.SetAnnotation(PP_RETURN, fmt.Sprint(ret...))
 		}
 
-		deferfunc := func(err *error, ret ...interface{}) {
-			if err != nil && *err != nil {
-				Pinpoint_add_exception((*err).Error(), id)
-			}
-
-			if len(ret) > 0 {
-				addClueSFunc(PP_RETURN, fmt.Sprint(ret...))
-			}
-
-			Pinpoint_end_trace(id)
-		}
-		return nctx, deferfunc
+		span.End()
 	}
+	return ContextWithSpan(ctx, span), deferfunc
 }
@@ -0,0 +1,429 @@
+/*
+ * Copyright 2021 NAVER Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * The trace tree of pinpoint_common in go.
+ * A trace is a tree of nodes, the root is the span and the others are span events.
+ * Every node lives in `nodes` until its root ends, then the tree is handed to `finish`.
+ * An async node(Fork) may outlive its parent: a root ended with async nodes open is
+ * handed to `finish` when the last of them ends.
+ */
+
+const (
+	// FT of a span, the same as GOLANG
+	agentType = 1800
+
+	// options of Pinpoint_start_trace_opt
+	optTraceMinTimeMs     = "TraceMinTimeMs:"
+	optTraceOnlyException = "TraceOnlyException"
+
+	// keys of a span in the json
+	spanStartKey   = "S"
+	spanElapsedKey = "E"
+	spanCluesKey   = "clues"
+	spanCallsKey   = "calls"
+	spanErrorKey   = "ERR"
+)
+
+type traceNode struct {
+	id       TraceIdType
+	parent   *traceNode
+	root     *traceNode
+	children []*traceNode
+	// the first start, a node woke up goes on counting its elapsed time
+	start    time.Time
+	runStart time.Time
+	elapsed  time.Duration
+	running  bool
+	// annotations by Pinpoint_add_clue, and "key:value" by Pinpoint_add_clues
+	clues     map[string]string
+	clueList  []string
+	exception bool
+	// options, a node not meeting them is not sent
+	minTime       time.Duration
+	onlyException bool
+	// started by Pinpoint_start_async_trace
+	async bool
+	// an async node or a root ended, still in `nodes` till the trace is finished
+	ended bool
+	// root only
+	errMark *RecordedError
+	context map[string]interface{}
+	values  map[string]interface{}
+	dropped bool
+	// async nodes not ended
+	forks int
+}
+
+type traceTree struct {
+	mu     sync.Mutex
+	nodes  map[TraceIdType]*traceNode
+	lastId TraceIdType
+	// called with the root after the trace ends, out of mu
+	finish func(root *traceNode)
+}
+
+func newTraceTree(finish func(root *traceNode)) *traceTree {
+	return &traceTree{nodes: map[TraceIdType]*traceNode{}, finish: finish}
+}
+
+// a free id, under mu
+func (tree *traceTree) newNodeId() TraceIdType {
+	for {
+		tree.lastId++
+		if tree.lastId <= ROOT_TRACE {
+			tree.lastId = ROOT_TRACE + 1
+		}
+		if _, used := tree.nodes[tree.lastId]; !used {
+			return tree.lastId
+		}
+	}
+}
+
+func (tree *traceTree) startTrace(parentId TraceIdType, opt []string) TraceIdType {
+	return tree.start(parentId, opt, false)
+}
+
+func (tree *traceTree) startAsyncTrace(parentId TraceIdType) TraceIdType {
+	if parentId == ROOT_TRACE {
+		debugf("start async trace failed: no parent")
+		return INVALIED_TRACE
+	}
+	return tree.start(parentId, nil, true)
+}
+
+func (tree *traceTree) start(parentId TraceIdType, opt []string, async bool) TraceIdType {
+	now := time.Now()
+	tree.mu.Lock()
+	var parent *traceNode
+	if parentId != ROOT_TRACE {
+		if parent = tree.nodes[parentId]; parent == nil || parent.ended {
+			tree.mu.Unlock()
+			debugf("start trace on %d failed: no such node", parentId)
+			return INVALIED_TRACE
+		}
+	}
+
+	node := &traceNode{
+		id:       tree.newNodeId(),
+		parent:   parent,
+		start:    now,
+		runStart: now,
+		running:  true,
+		clues:    map[string]string{},
+		async:    async,
+	}
+	if parent == nil {
+		node.root = node
+		node.context = map[string]interface{}{}
+	} else {
+		node.root = parent.root
+		parent.children = append(parent.children, node)
+		if async {
+			node.root.forks++
+		}
+	}
+	for _, o := range opt {
+		if strings.HasPrefix(o, optTraceMinTimeMs) {
+			if ms, err := strconv.Atoi(o[len(optTraceMinTimeMs):]); err == nil {
+				node.minTime = time.Duration(ms) * time.Millisecond
+			}
+		} else if o == optTraceOnlyException {
+			node.onlyException = true
+		}
+	}
+	tree.nodes[node.id] = node
+	tree.mu.Unlock()
+
+	debugf("start trace %d on %d", node.id, parentId)
+	return node.id
+}
+
+// withNode runs `fn` on the node `id` under mu, false if there is no such node
+func (tree *traceTree) withNode(id TraceIdType, fn func(node *traceNode)) bool {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	node := tree.nodes[id]
+	if node == nil {
+		return false
+	}
+	fn(node)
+	return true
+}
+
+func (node *traceNode) stop(now time.Time) {
+	if node.running {
+		node.elapsed += now.Sub(node.runStart)
+		node.running = false
+	}
+}
+
+func (tree *traceTree) endTrace(id TraceIdType) TraceIdType {
+	now := time.Now()
+	tree.mu.Lock()
+	node := tree.nodes[id]
+	if node == nil || node.ended {
+		tree.mu.Unlock()
+		debugf("end trace %d failed: no such node", id)
+		return INVALIED_TRACE
+	}
+
+	node.stop(now)
+	root := node.root
+	if node.async {
+		node.ended = true
+		root.forks--
+		if root.ended && root.forks == 0 {
+			// the last async node finishes the trace its root ended
+			tree.endNodes(root, now)
+			tree.mu.Unlock()
+			debugf("end async trace %d, the trace is finished", id)
+			tree.finish(root)
+			return node.parent.id
+		}
+	}
+	if node.parent != nil {
+		tree.mu.Unlock()
+		debugf("end trace %d", id)
+		return node.parent.id
+	}
+
+	if root.forks > 0 {
+		// the root is ended with the nodes not async, the async ones go on
+		root.ended = true
+		stopNodes(root, now)
+		tree.mu.Unlock()
+		debugf("end trace %d, the trace is finished after %d async nodes", id, root.forks)
+		return ROOT_TRACE
+	}
+
+	// the root ends the tree, nodes still running end with it
+	tree.endNodes(node, now)
+	tree.mu.Unlock()
+
+	debugf("end trace %d, the trace is finished", id)
+	tree.finish(node)
+	return ROOT_TRACE
+}
+
+// stop the nodes under `node` except async ones, under mu
+func stopNodes(node *traceNode, now time.Time) {
+	node.stop(now)
+	for _, child := range node.children {
+		if !child.async {
+			stopNodes(child, now)
+		}
+	}
+}
+
+// under mu
+func (tree *traceTree) endNodes(node *traceNode, now time.Time) {
+	node.stop(now)
+	delete(tree.nodes, node.id)
+	for _, child := range node.children {
+		tree.endNodes(child, now)
+	}
+}
+
+func (tree *traceTree) wakeTrace(id TraceIdType) error {
+	now := time.Now()
+	if !tree.withNode(id, func(node *traceNode) {
+		if !node.running {
+			node.runStart = now
+			node.running = true
+		}
+	}) {
+		return errors.New("wake trace failed")
+	}
+	return nil
+}
+
+func (tree *traceTree) isRoot(id TraceIdType) bool {
+	isRoot := false
+	tree.withNode(id, func(node *traceNode) {
+		isRoot = node.parent == nil
+	})
+	return isRoot
+}
+
+func (node *traceNode) at(loc LocationType) *traceNode {
+	if loc == RootTraceLoc {
+		return node.root
+	}
+	return node
+}
+
+func (tree *traceTree) rootOf(id TraceIdType) TraceIdType {
+	root := TraceIdType(INVALIED_TRACE)
+	tree.withNode(id, func(node *traceNode) {
+		root = node.root.id
+	})
+	return root
+}
+
+func (tree *traceTree) addClue(id TraceIdType, key, value string, loc LocationType) {
+	tree.withNode(id, func(node *traceNode) {
+		node.at(loc).clues[key] = value
+	})
+}
+
+func (tree *traceTree) addClues(id TraceIdType, key, value string, loc LocationType) {
+	tree.withNode(id, func(node *traceNode) {
+		node = node.at(loc)
+		node.clueList = append(node.clueList, key+":"+value)
+	})
+}
+
+func (tree *traceTree) addException(id TraceIdType, msg string) {
+	tree.withNode(id, func(node *traceNode) {
+		node.clues[PP_ADD_EXCEPTION] = msg
+		node.exception = true
+	})
+}
+
+func (tree *traceTree) markError(id TraceIdType, msg, file string, line uint32) {
+	tree.withNode(id, func(node *traceNode) {
+		node.exception = true
+		node.root.errMark = &RecordedError{Msg: msg, File: file, Line: line}
+	})
+}
+
+func (tree *traceTree) dropTrace(id TraceIdType) {
+	tree.withNode(id, func(node *traceNode) {
+		node.root.dropped = true
+	})
+}
+
+func (tree *traceTree) setContext(id TraceIdType, key, value string) {
+	tree.withNode(id, func(node *traceNode) {
+		node.root.context[key] = value
+	})
+}
+
+func (tree *traceTree) getContext(id TraceIdType, key string) (string, bool) {
+	var value string
+	var found bool
+	tree.withNode(id, func(node *traceNode) {
+		value, found = node.root.context[key].(string)
+	})
+	return value, found
+}
+
+func (tree *traceTree) setIntContext(id TraceIdType, key string, value int64) {
+	tree.withNode(id, func(node *traceNode) {
+		node.root.context[key] = value
+	})
+}
+
+func (tree *traceTree) getIntContext(id TraceIdType, key string) (int64, error) {
+	var value int64
+	found := false
+	tree.withNode(id, func(node *traceNode) {
+		value, found = node.root.context[key].(int64)
+	})
+	if !found {
+		return 0, errors.New("not found")
+	}
+	return value, nil
+}
+
+func (tree *traceTree) setValue(id TraceIdType, key string, value interface{}) {
+	tree.withNode(id, func(node *traceNode) {
+		if node.root.values == nil {
+			node.root.values = map[string]interface{}{}
+		}
+		node.root.values[key] = value
+	})
+}
+
+func (tree *traceTree) getValue(id TraceIdType, key string) (interface{}, bool) {
+	var value interface{}
+	found := false
+	tree.withNode(id, func(node *traceNode) {
+		value, found = node.root.values[key]
+	})
+	return value, found
+}
+
+func (node *traceNode) meetsOptions() bool {
+	if node.minTime > 0 && node.elapsed < node.minTime {
+		return false
+	}
+	return !node.onlyException || node.exception
+}
+
+// the json of collector-agent: annotations, S/E in ms, clues and the children in calls
+func (node *traceNode) toSpan() map[string]interface{} {
+	span := make(map[string]interface{}, len(node.clues)+6)
+	for key, value := range node.clues {
+		span[key] = value
+	}
+	span[spanStartKey] = node.start.UnixNano() / int64(time.Millisecond)
+	span[spanElapsedKey] = int64(node.elapsed / time.Millisecond)
+	if node.parent == nil {
+		span[PP_AGENT_TYPE] = agentType
+	}
+	if node.errMark != nil {
+		span[spanErrorKey] = node.errMark
+	}
+	if len(node.clueList) > 0 {
+		span[spanCluesKey] = node.clueList
+	}
+
+	var calls []interface{}
+	for _, child := range node.children {
+		if child.meetsOptions() {
+			calls = append(calls, child.toSpan())
+		}
+	}
+	if len(calls) > 0 {
+		span[spanCallsKey] = calls
+	}
+	return span
+}
+
+// a copy for UseRecorder, the trace is finished and nobody writes it
+func (node *traceNode) record(parent *RecordedNode) *RecordedNode {
+	rec := &RecordedNode{
+		Id:       node.id,
+		Parent:   parent,
+		Start:    node.start,
+		Elapsed:  node.elapsed,
+		Clues:    node.clues,
+		ClueList: node.clueList,
+		Error:    node.errMark,
+		Context:  node.context,
+		Values:   node.values,
+		Dropped:  node.dropped,
+		Async:    node.async,
+	}
+	for _, child := range node.children {
+		if child.meetsOptions() {
+			rec.Children = append(rec.Children, child.record(rec))
+		}
+	}
+	return rec
+}
@@ -1,3 +1,5 @@
 module github.com/pinpoint-apm/go-aop-agent
 
 go 1.16
+
+require golang.org/x/arch v0.0.0-20210727222714-28578f966459
@@ -17,81 +17,63 @@
 package httpClient
 
 import (
-	"context"
 	"net/http"
 
 	"github.com/pinpoint-apm/go-aop-agent/aop"
 	"github.com/pinpoint-apm/go-aop-agent/common"
 )
 
-func generatePinpointHeader(id common.TraceIdType, req *http.Request) {
+func generatePinpointHeader(span *common.Span, req *http.Request) {
 	common.Logf("generatePinpointHeader")
 	req.Header.Set(common.PP_HEADER_PINPOINT_PAPPTYPE, common.GOLANG)
 	req.Header.Set(common.PP_HEADER_PINPOINT_PAPPNAME, common.Appname)
 	req.Header.Set("Pinpoint-Flags", "0")
 	req.Header.Set(common.PP_HEADER_PINPOINT_HOST, req.URL.Host)
-	if tid := common.Pinpoint_get_context(common.PP_TRANSCATION_ID, id); tid != "" {
+	if tid, ok := span.GetContext(common.PP_TRANSCATION_ID); ok {
 		req.Header.Set(common.PP_HEADER_PINPOINT_TRACEID, tid)
 	}
 
-	if sid := common.Pinpoint_get_context(common.PP_SPAN_ID, id); sid != "" {
+	if sid, ok := span.GetContext(common.PP_SPAN_ID); ok {
 		req.Header.Set(common.PP_HEADER_PINPOINT_PSPANID, sid)
 	}
 
 	nextSid := common.Pinpoint_gen_sid()
 
-	common.Pinpoint_set_context(common.PP_NEXT_SPAN_ID, nextSid, id)
+	span.SetContext(common.PP_NEXT_SPAN_ID, nextSid)
 	req.Header.Set(common.PP_HEADER_PINPOINT_SPANID, nextSid)
+	common.WriteBaggage(span, req.Header)
 }
 
-func onBefore_Do(parentId common.TraceIdType, c *http.Client, req *http.Request) (common.TraceIdType, *http.Request) {
+func onBefore_Do(span *common.Span, c *http.Client, req *http.Request) *http.Request {
 	common.Logf("call onBefore_Do")
-	id := common.Pinpoint_start_trace(parentId)
 
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueSFunc := func(key, value string) {
-		common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueFunc(common.PP_INTERCEPTOR_NAME, "*http.Client.Do")
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_REMOTE_METHOD)
-	addClueSFunc(common.PP_HTTP_URL, req.URL.String())
-	addClueFunc(common.PP_DESTINATION, req.URL.Host)
+	span.SetServiceType(common.PP_REMOTE_METHOD)
+	span.SetAnnotation(common.PP_HTTP_URL, req.URL.String())
+	span.SetDestination(req.URL.Host)
 	// add pinpoint header
-	generatePinpointHeader(id, req)
+	generatePinpointHeader(span, req)
 
 	// return a wrapped request
-	ctx := context.WithValue(req.Context(), common.TRACE_ID, id)
-	return id, (*req).WithContext(ctx)
+	return req.WithContext(common.ContextWithSpan(req.Context(), span))
 }
 
-func onEnd_Do(id common.TraceIdType, response *http.Response, err *error) {
+func onEnd_Do(span *common.Span, response *http.Response, err *error) {
 	common.Logf("call onEnd_Do")
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
 
-	addClueSFunc := func(key, value string) {
-		common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-	}
-
-	if value := common.Pinpoint_get_context(common.PP_NEXT_SPAN_ID, id); value != "" {
-		addClueFunc(common.PP_NEXT_SPAN_ID, value)
+	if value, ok := span.GetContext(common.PP_NEXT_SPAN_ID); ok {
+		span.SetClue(common.PP_NEXT_SPAN_ID, value)
 	}
 
 	if response != nil {
-		addClueSFunc(common.PP_HTTP_STATUS_CODE, response.Status)
+		span.SetAnnotation(common.PP_HTTP_STATUS_CODE, response.Status)
 
 		if response.StatusCode >= http.StatusBadRequest {
-			//common.Pinpoint_mark_error("response code:"+response.Status, "clientDo.go", 0, id)
-			addClueFunc(common.PP_ADD_EXCEPTION, "response status:"+response.Status)
+			//span.MarkError("response code:" + response.Status)
+			span.SetException("response status:" + response.Status)
 		}
 	}
 
-	common.Pinpoint_end_trace(id)
+	span.End()
 }
 
 //go:noinline
@@ -117,24 +99,24 @@ func hook_Do_trampoline(c *http.Client, req *http.Request) (*http.Response, erro
 
 //go:noinline
 func hook_Do(c *http.Client, req *http.Request) (*http.Response, error) {
-	ctx := req.Context()
-	if id, err := common.GetParentId(ctx); err != nil {
+	parent := common.SpanFromContext(req.Context())
+	if parent == nil {
 		common.Logf("parentId is not traceId type. client.Do dropped")
 		return hook_Do_trampoline(c, req)
-	} else {
-		// trace limited
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, id) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			req.Header.Set(common.PP_HEADER_PINPOINT_SAMPLED, common.PP_NOT_SAMPLED)
-			return hook_Do_trampoline(c, req)
-		}
-
-		subId, pinpointReq := onBefore_Do(id, c, req)
-		response, err := hook_Do_trampoline(c, pinpointReq)
-		onEnd_Do(subId, response, &err)
-		return response, err
+	}
+	// trace limited
+	if !parent.Sampled() {
+		common.Logf("trace dropped")
+		req.Header.Set(common.PP_HEADER_PINPOINT_SAMPLED, common.PP_NOT_SAMPLED)
+		common.WriteBaggage(parent, req.Header)
+		return hook_Do_trampoline(c, req)
 	}
 
+	span := parent.Child("*http.Client.Do")
+	pinpointReq := onBefore_Do(span, c, req)
+	response, err := hook_Do_trampoline(c, pinpointReq)
+	onEnd_Do(span, response, &err)
+	return response, err
 }
 
 func hook_client_Do() {
@@ -31,27 +31,20 @@ func init() {
 
 //go:noinline
 func hook_writeMessages(writer *kafka.Writer, ctx context.Context, msgs ...kafka.Message) error {
-	funcName := "kafka.Writer.WriteMessages"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child("kafka.Writer.WriteMessages")
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_writeMessages_trampoline(writer, ctx, msgs...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_writeMessages_trampoline(writer, ctx, msgs...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
+	}
+	defer span.End()
 
-		newCtx := writeMessages_onBefore(subTraceId, funcName, writer, ctx, msgs...)
-		err := hook_writeMessages_trampoline(writer, newCtx, msgs...)
-		if err != nil {
-			onException(subTraceId, &err)
-		}
-		commitMessages_onEnd(subTraceId, err)
-		return err
+	newCtx := writeMessages_onBefore(span, writer, ctx, msgs...)
+	err := hook_writeMessages_trampoline(writer, newCtx, msgs...)
+	if err != nil {
+		onException(span, err)
 	}
+	commitMessages_onEnd(span, err)
+	return err
 }
 
 //go:noinline
@@ -61,28 +54,20 @@ func hook_writeMessages_trampoline(writer *kafka.Writer, ctx context.Context, ms
 
 //go:noinline
 func hook_commitMessages(reader *kafka.Reader, ctx context.Context, msgs ...kafka.Message) error {
-	funcName := "kafka.Reader.CommitMessages"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child("kafka.Reader.CommitMessages")
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_commitMessages_trampoline(reader, ctx, msgs...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_commitMessages_trampoline(reader, ctx, msgs...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		newCtx := commitMessages_onBefore(subTraceId, funcName, reader, ctx, msgs...)
-		err := hook_commitMessages_trampoline(reader, newCtx, msgs...)
-		if err != nil {
-			onException(subTraceId, &err)
-		}
-		commitMessages_onEnd(subTraceId, err)
-		return err
 	}
+	defer span.End()
 
+	newCtx := commitMessages_onBefore(span, reader, ctx, msgs...)
+	err := hook_commitMessages_trampoline(reader, newCtx, msgs...)
+	if err != nil {
+		onException(span, err)
+	}
+	commitMessages_onEnd(span, err)
+	return err
 }
 
 //go:noinline
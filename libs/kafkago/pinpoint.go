@@ -30,56 +30,33 @@ func get_func_name(i interface{}) string {
 	return string(name)
 }
 
-func commitMessages_onBefore(id common.TraceIdType, funcName string, reader *kafka.Reader, ctx context.Context, msgs ...kafka.Message) context.Context {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueSFunc := func(key, value string) {
-		common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-	}
-	addClueFunc(common.PP_INTERCEPTOR_NAME, funcName)
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_METHOD_CALL)
+func commitMessages_onBefore(span *common.Span, reader *kafka.Reader, ctx context.Context, msgs ...kafka.Message) context.Context {
+	span.SetServiceType(common.PP_METHOD_CALL)
 	if len(msgs) > 0 {
-		addClueSFunc(common.PP_ARGS, fmt.Sprintf("commitMessages:%d ...", msgs[0].Offset))
+		span.SetAnnotation(common.PP_ARGS, fmt.Sprintf("commitMessages:%d ...", msgs[0].Offset))
 	}
 
-	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-	return newCtx
+	return common.ContextWithSpan(ctx, span)
 }
 
-func writeMessages_onBefore(id common.TraceIdType, funcName string, writer *kafka.Writer, ctx context.Context, mesg ...kafka.Message) context.Context {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueSFunc := func(key, value string) {
-		common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-	}
-	addClueFunc(common.PP_INTERCEPTOR_NAME, funcName)
-
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_KAFKA)
+func writeMessages_onBefore(span *common.Span, writer *kafka.Writer, ctx context.Context, mesg ...kafka.Message) context.Context {
+	span.SetServiceType(common.PP_KAFKA)
 
 	if len(writer.Topic) > 0 {
-		addClueSFunc(common.PP_KAFKA_TOPIC, writer.Topic)
+		span.SetAnnotation(common.PP_KAFKA_TOPIC, writer.Topic)
 	}
-	addClueFunc(common.PP_DESTINATION, writer.Addr.String())
+	span.SetDestination(writer.Addr.String())
 	// note: pinpoint-web can not show args,so use return
-	addClueSFunc(common.PP_RETURN, fmt.Sprintf("writeMessages:[%d] ...", len(mesg)))
+	span.SetAnnotation(common.PP_RETURN, fmt.Sprintf("writeMessages:[%d] ...", len(mesg)))
 
-	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-	return newCtx
+	return common.ContextWithSpan(ctx, span)
 }
 
-func commitMessages_onEnd(id common.TraceIdType, err error) {
-	// addClueSFunc := func(key, value string) {
-	// 	common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-	// }
-
-	// addClueSFunc(common.PP_RETURN, fmt.Sprint(res))
+func commitMessages_onEnd(span *common.Span, err error) {
+	// span.SetAnnotation(common.PP_RETURN, fmt.Sprint(res))
 }
 
-func onException(id common.TraceIdType, err *error) {
+func onException(span *common.Span, err error) {
 	common.Logf("call onException")
-	common.Pinpoint_add_exception(fmt.Sprint(*err), id)
+	span.SetException(err.Error())
 }
@@ -34,25 +34,19 @@ func hook_trampoline_update(coll *mongo.Collection, ctx context.Context, filter
 func hook_update(coll *mongo.Collection, ctx context.Context, filter interface{},
 	update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
 	const stub = "*mongo.Collection.FindOneAndUpdate"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_update(coll, ctx, filter, update, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_update(coll, ctx, filter, update, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call onBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		res := hook_trampoline_update(coll, *newCtx, filter, update, opts...)
-		common.Logf("call onEnd %s ", stub)
-		onEnd(subTraceId, err)
-		return res
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result := hook_trampoline_update(coll, newCtx, filter, update, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	onEndResult(span, result)
+	return result
 }
 
 //go:noinline
@@ -65,25 +59,19 @@ func hook_trampoline_delete(coll *mongo.Collection, ctx context.Context, filter
 func hook_delete(coll *mongo.Collection, ctx context.Context, filter interface{},
 	opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
 	const stub = "*mongo.Collection.FindOneAndDelete"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_delete(coll, ctx, filter, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_delete(coll, ctx, filter, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call onBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		res := hook_trampoline_delete(coll, *newCtx, filter, opts...)
-		common.Logf("call onEnd %s ", stub)
-		onEnd(subTraceId, err)
-		return res
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result := hook_trampoline_delete(coll, newCtx, filter, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	onEndResult(span, result)
+	return result
 }
 
 //go:noinline
@@ -95,28 +83,20 @@ func hook_trampoline_replace(coll *mongo.Collection, ctx context.Context, filter
 //go:noinline
 func hook_replace(coll *mongo.Collection, ctx context.Context, filter interface{},
 	replacement interface{}, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
-
 	const stub = "*mongo.Collection.FindOneAndReplace"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_replace(coll, ctx, filter, replacement, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_replace(coll, ctx, filter, replacement, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call onBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		res := hook_trampoline_replace(coll, *newCtx, filter, replacement, opts...)
-		common.Logf("call onEnd %s ", stub)
-		onEnd(subTraceId, err)
-		return res
 	}
-
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result := hook_trampoline_replace(coll, newCtx, filter, replacement, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	onEndResult(span, result)
+	return result
 }
 
 //go:noinline
@@ -126,26 +106,20 @@ func hook_trampoline_insertone(coll *mongo.Collection, ctx context.Context, docu
 
 //go:noinline
 func hook_insertone(coll *mongo.Collection, ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
-	var stub = "*mongo.Collection.InsertOne"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	const stub = "*mongo.Collection.InsertOne"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_insertone(coll, ctx, document, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_insertone(coll, ctx, document, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call onBefore %s ", stub)
-		newCtx := insertOneOnBefore(stub, subTraceId, coll, ctx, document, opts...)
-		res, err := hook_trampoline_insertone(coll, *newCtx, document, opts...)
-		common.Logf("call onEnd %s ", stub)
-		insertOneOnEnd(subTraceId, res, err)
-		return res, err
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := insertOneOnBefore(span, coll, ctx, document, opts...)
+	result, err := hook_trampoline_insertone(coll, newCtx, document, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	insertOneOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
@@ -157,26 +131,20 @@ func hook_trampoline_find(coll *mongo.Collection, ctx context.Context, filter in
 //go:noinline
 func hook_find(coll *mongo.Collection, ctx context.Context, filter interface{},
 	opts ...*options.FindOptions) (*mongo.Cursor, error) {
-	var stub = "*mongo.Collection.Find"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	const stub = "*mongo.Collection.Find"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_find(coll, ctx, filter, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_find(coll, ctx, filter, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-		// debug.PrintStack()
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := findOnBefore(stub, subTraceId, coll, ctx, filter)
-		cursor, result := hook_trampoline_find(coll, *newCtx, filter, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		findOnEnd(subTraceId, cursor, result)
-		return cursor, result
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := findOnBefore(span, coll, ctx, filter)
+	result, err := hook_trampoline_find(coll, newCtx, filter, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	findOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
@@ -188,211 +156,174 @@ func hook_trampoline_findone(coll *mongo.Collection, ctx context.Context, filter
 //go:noinline
 func hook_findone(coll *mongo.Collection, ctx context.Context, filter interface{},
 	opts ...*options.FindOneOptions) *mongo.SingleResult {
-	var stub = "*mongo.Collection.FindOne"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	const stub = "*mongo.Collection.FindOne"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_findone(coll, ctx, filter, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_findone(coll, ctx, filter, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := findOnBefore(stub, subTraceId, coll, ctx, filter)
-		result := hook_trampoline_findone(coll, *newCtx, filter, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		onEndResult(subTraceId, result)
-		return result
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := findOnBefore(span, coll, ctx, filter)
+	result := hook_trampoline_findone(coll, newCtx, filter, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	onEndResult(span, result)
+	return result
+}
+
+//go:noinline
+func hook_trampoline_insertmany(coll *mongo.Collection, ctx context.Context, documents []interface{},
+	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return nil, nil
 }
 
 //go:noinline
 func hook_insertmany(coll *mongo.Collection, ctx context.Context, documents []interface{},
 	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
-	var stub = "*mongo.Collection.InsertMany"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	const stub = "*mongo.Collection.InsertMany"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_insertmany(coll, ctx, documents, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_insertmany(coll, ctx, documents, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		result, err := hook_trampoline_insertmany(coll, *newCtx, documents, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		insertManyOnEnd(subTraceId, result, err)
-		return result, err
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_insertmany(coll, newCtx, documents, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	insertManyOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
-func hook_trampoline_insertmany(coll *mongo.Collection, ctx context.Context, documents []interface{},
-	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+func hook_trampoline_updateone(coll *mongo.Collection, ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
 	return nil, nil
 }
 
 //go:noinline
 func hook_updateone(coll *mongo.Collection, ctx context.Context, filter interface{}, update interface{},
 	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
-	var stub = "*mongo.Collection.UpdateOne"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	const stub = "*mongo.Collection.UpdateOne"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_updateone(coll, ctx, filter, update, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_updateone(coll, ctx, filter, update, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		result, err := hook_trampoline_updateone(coll, *newCtx, filter, update, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		updateOneOnEnd(subTraceId, result, err)
-		return result, err
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_updateone(coll, newCtx, filter, update, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	updateOneOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
-func hook_trampoline_updateone(coll *mongo.Collection, ctx context.Context, filter interface{}, update interface{},
+func hook_trampoline_updatebyid(coll *mongo.Collection, ctx context.Context, id interface{}, update interface{},
 	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
 	return nil, nil
 }
 
 //go:noinline
-func hook_trampoline_updatebyid(coll *mongo.Collection, ctx context.Context, id interface{}, update interface{},
+func hook_updatebyid(coll *mongo.Collection, ctx context.Context, id interface{}, update interface{},
 	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
-	return nil, nil
+	const stub = "*mongo.Collection.UpdateByID"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
+		return hook_trampoline_updatebyid(coll, ctx, id, update, opts...)
+	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_updatebyid(coll, newCtx, id, update, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	updateOneOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
-func hook_updatebyid(coll *mongo.Collection, ctx context.Context, id interface{}, update interface{},
+func hook_trampoline_updatebmany(coll *mongo.Collection, ctx context.Context, filter interface{}, update interface{},
 	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
-	var stub = "*mongo.Collection.UpdateByID"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
-		return hook_trampoline_updateone(coll, ctx, id, update, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_updateone(coll, ctx, id, update, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		result, err := hook_trampoline_updateone(coll, *newCtx, id, update, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		updateOneOnEnd(subTraceId, result, err)
-		return result, err
-	}
+	return nil, nil
 }
 
 //go:noinline
 func hook_updatebmany(coll *mongo.Collection, ctx context.Context, filter interface{}, update interface{},
 	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
-	var stub = "*mongo.Collection.UpdateMany"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	const stub = "*mongo.Collection.UpdateMany"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_updatebmany(coll, ctx, filter, update, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_updatebmany(coll, ctx, filter, update, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		result, err := hook_trampoline_updatebmany(coll, *newCtx, filter, update, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		updateOneOnEnd(subTraceId, result, err)
-		return result, err
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_updatebmany(coll, newCtx, filter, update, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	updateOneOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
-func hook_trampoline_updatebmany(coll *mongo.Collection, ctx context.Context, filter interface{}, update interface{},
-	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+func hook_trampoline_replaceone(coll *mongo.Collection, ctx context.Context, filter interface{},
+	replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
 	return nil, nil
 }
 
 //go:noinline
 func hook_replaceone(coll *mongo.Collection, ctx context.Context, filter interface{},
 	replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
-	var stub = "*mongo.Collection.ReplaceOne"
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	const stub = "*mongo.Collection.ReplaceOne"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_trampoline_replaceone(coll, ctx, filter, replacement, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_trampoline_replaceone(coll, ctx, filter, replacement, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		result, err := hook_trampoline_replaceone(coll, *newCtx, filter, replacement, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		updateOneOnEnd(subTraceId, result, err)
-		return result, err
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_replaceone(coll, newCtx, filter, replacement, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	updateOneOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
-func hook_trampoline_replaceone(coll *mongo.Collection, ctx context.Context, filter interface{},
-	replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+func hook_trampoline_deleteone(coll *mongo.Collection, ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
 	return nil, nil
 }
 
 //go:noinline
-func hook_trampoline_deleteone(coll *mongo.Collection, ctx context.Context, filter interface{},
+func hook_deleteone(coll *mongo.Collection, ctx context.Context, filter interface{},
 	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-	var stub = "*mongo.Collection.DeleteOne"
-	trampline := hook_deleteone
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
-		return trampline(coll, ctx, filter, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return trampline(coll, ctx, filter, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		result, err := trampline(coll, *newCtx, filter, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		deleteOnEnd(subTraceId, result, err)
-		return result, err
+	const stub = "*mongo.Collection.DeleteOne"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
+		return hook_trampoline_deleteone(coll, ctx, filter, opts...)
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_deleteone(coll, newCtx, filter, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	deleteOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
-func hook_deleteone(coll *mongo.Collection, ctx context.Context, filter interface{},
+func hook_trampoline_deletemany(coll *mongo.Collection, ctx context.Context, filter interface{},
 	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
 	return nil, nil
 }
@@ -400,91 +331,64 @@ func hook_deleteone(coll *mongo.Collection, ctx context.Context, filter interfac
 //go:noinline
 func hook_deletemany(coll *mongo.Collection, ctx context.Context, filter interface{},
 	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-	var stub = "*mongo.Collection.DeleteMany"
-	trampline := hook_trampoline_deletemany
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
-		return trampline(coll, ctx, filter, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return trampline(coll, ctx, filter, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		result, err := trampline(coll, *newCtx, filter, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		deleteOnEnd(subTraceId, result, err)
-		return result, err
+	const stub = "*mongo.Collection.DeleteMany"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
+		return hook_trampoline_deletemany(coll, ctx, filter, opts...)
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_deletemany(coll, newCtx, filter, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	deleteOnEnd(span, result, err)
+	return result, err
 }
 
 //go:noinline
-func hook_trampoline_deletemany(coll *mongo.Collection, ctx context.Context, filter interface{},
-	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-	return nil, nil
+func hook_trampoline_drop(coll *mongo.Collection, ctx context.Context) error {
+	return nil
 }
 
 //go:noinline
 func hook_drop(coll *mongo.Collection, ctx context.Context) error {
-	var stub = "*mongo.Collection.Drop"
-	trampline := hook_trampoline_drop
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
-		return trampline(coll, ctx)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return trampline(coll, ctx)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		err := trampline(coll, *newCtx)
-		common.Logf("call OnEnd %s ", stub)
-		onEnd(subTraceId, err)
-		return err
+	const stub = "*mongo.Collection.Drop"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
+		return hook_trampoline_drop(coll, ctx)
 	}
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	err := hook_trampoline_drop(coll, newCtx)
+	common.Logf("call OnEnd %s ", stub)
+	onEnd(span, err)
+	return err
 }
 
 //go:noinline
-func hook_trampoline_drop(coll *mongo.Collection, ctx context.Context) error {
-	return nil
+func hook_trampoline_countdocments(coll *mongo.Collection, ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return 0, nil
 }
 
 //go:noinline
 func hook_countdocments(coll *mongo.Collection, ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
-	var stub = "*mongo.Collection.CountDocuments"
-	trampline := hook_trampoline_countdocments
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
-		return trampline(coll, ctx, filter, opts...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return trampline(coll, ctx, filter, opts...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		common.Logf("call OnBefore %s ", stub)
-		newCtx := onBefore(stub, subTraceId, coll, ctx)
-		val, err := trampline(coll, *newCtx, filter, opts...)
-		common.Logf("call OnEnd %s ", stub)
-		countOnEnd(subTraceId, val, err)
-		return val, err
+	const stub = "*mongo.Collection.CountDocuments"
+	span := common.SpanFromContext(ctx).Child(stub)
+	if span == nil {
+		common.Logf("not traced or trace dropped")
+		return hook_trampoline_countdocments(coll, ctx, filter, opts...)
 	}
-}
-
-//go:noinline
-func hook_trampoline_countdocments(coll *mongo.Collection, ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
-	return 0, nil
+	defer span.End()
+
+	common.Logf("call OnBefore %s ", stub)
+	newCtx := onBefore(span, coll, ctx)
+	result, err := hook_trampoline_countdocments(coll, newCtx, filter, opts...)
+	common.Logf("call OnEnd %s ", stub)
+	countOnEnd(span, result, err)
+	return result, err
 }
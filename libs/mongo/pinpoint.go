@@ -25,155 +25,70 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func insertOneOnBefore(stub string, id common.TraceIdType, coll *mongo.Collection, ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) *context.Context {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueFunc(common.PP_INTERCEPTOR_NAME, stub)
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_MONGDB_EXE_QUERY)
-	addClueFunc(common.PP_DESTINATION, coll.Database().Name())
-
-	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-	return &newCtx
+func insertOneOnBefore(span *common.Span, coll *mongo.Collection, ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) context.Context {
+	return onBefore(span, coll, ctx)
 }
 
-func insertOneOnEnd(id common.TraceIdType, res *mongo.InsertOneResult, err error) {
-
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
+func insertOneOnEnd(span *common.Span, res *mongo.InsertOneResult, err error) {
 	if err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
+		span.SetException(err.Error())
 		return
 	}
 
 	insertId := fmt.Sprintf("%s", res.InsertedID)
-	addClueFunc(common.PP_RETURN, insertId)
+	span.SetAnnotation(common.PP_RETURN, insertId)
 }
 
-func findOnBefore(stub string, id common.TraceIdType, coll *mongo.Collection, ctx context.Context, filter interface{}) *context.Context {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	// addCluesFunc := func(key, value string) {
-	// 	common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-	// }
-
-	addClueFunc(common.PP_INTERCEPTOR_NAME, stub)
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_MONGDB_EXE_QUERY)
-	addClueFunc(common.PP_DESTINATION, coll.Database().Name())
-
+func findOnBefore(span *common.Span, coll *mongo.Collection, ctx context.Context, filter interface{}) context.Context {
 	// if bs, ok := filter.([]byte); ok {
 	// 	// Slight optimization so we'll just use MarshalBSON and not go through the codec machinery.
 	// 	args := fmt.Sprint("%s", bson.Raw(bs))
-	// 	addCluesFunc(common.PP_ARGS, args)
+	// 	span.SetAnnotation(common.PP_ARGS, args)
 	// }
 
-	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-	return &newCtx
+	return onBefore(span, coll, ctx)
 }
 
-func findOnEnd(id common.TraceIdType, cursor *mongo.Cursor, err error) {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	if err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
-		return
-	}
-
+func findOnEnd(span *common.Span, cursor *mongo.Cursor, err error) {
+	onEnd(span, err)
 }
 
-func onBefore(stub string, id common.TraceIdType, coll *mongo.Collection, ctx context.Context) *context.Context {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueFunc(common.PP_INTERCEPTOR_NAME, stub)
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_MONGDB_EXE_QUERY)
-	addClueFunc(common.PP_DESTINATION, coll.Database().Name())
+func onBefore(span *common.Span, coll *mongo.Collection, ctx context.Context) context.Context {
+	span.SetServiceType(common.PP_MONGDB_EXE_QUERY)
+	span.SetDestination(coll.Database().Name())
 
-	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-	return &newCtx
+	return common.ContextWithSpan(ctx, span)
 }
 
-func onEnd(id common.TraceIdType, err error) {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
+func onEnd(span *common.Span, err error) {
 	if err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
-		return
+		span.SetException(err.Error())
 	}
 }
 
-func countOnEnd(id common.TraceIdType, val int64, err error) {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
+func countOnEnd(span *common.Span, val int64, err error) {
 	if err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
+		span.SetException(err.Error())
 		return
 	}
 	count := fmt.Sprintf("%d", val)
-	addClueFunc(common.PP_RETURN, count)
+	span.SetAnnotation(common.PP_RETURN, count)
 }
 
-func onEndResult(id common.TraceIdType, result *mongo.SingleResult) {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-	if err := result.Err(); err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
-		return
+func onEndResult(span *common.Span, result *mongo.SingleResult) {
+	if result != nil {
+		onEnd(span, result.Err())
 	}
 }
 
-// func insertManyOnBefore(stub string, id common.TraceIdType, coll *mongo.Collection, ctx context.Context) *context.Context {
-// 	addClueFunc := func(key, value string) {
-// 		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-// 	}
-
-// 	addClueFunc(common.PP_INTERCEPTOR_NAME, stub)
-// 	addClueFunc(common.PP_SERVER_TYPE, common.PP_MONGDB_EXE_QUERY)
-// 	addClueFunc(common.PP_DESTINATION, coll.Database().Name())
-
-// 	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-// 	return &newCtx
-// }
-
-func insertManyOnEnd(id common.TraceIdType, result *mongo.InsertManyResult, err error) {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-	if err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
-		return
-	}
+func insertManyOnEnd(span *common.Span, result *mongo.InsertManyResult, err error) {
+	onEnd(span, err)
 }
 
-func updateOneOnEnd(id common.TraceIdType, result *mongo.UpdateResult, err error) {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-	if err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
-		return
-	}
+func updateOneOnEnd(span *common.Span, result *mongo.UpdateResult, err error) {
+	onEnd(span, err)
 }
 
-func deleteOnEnd(id common.TraceIdType, result *mongo.DeleteResult, err error) {
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-	if err != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, err.Error())
-		return
-	}
+func deleteOnEnd(span *common.Span, result *mongo.DeleteResult, err error) {
+	onEnd(span, err)
 }
@@ -37,44 +37,31 @@ type ppRedisHook struct {
 	Addr string
 }
 
+// spanKey holds the span of a command between BeforeProcess and AfterProcess,
+// a command skipped by BeforeProcess must not end the span of its caller
+type spanKey struct{}
+
 func (p *ppRedisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
 	common.Logf("call onBefore")
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type. Dropped")
+	span := common.SpanFromContext(ctx).Child(cmd.Name())
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return ctx, nil
-	} else {
-		id := common.Pinpoint_start_trace(parentId)
-
-		addClueFunc := func(key, value string) {
-			common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-		}
-
-		// addClueSFunc := func(key, value string) {
-		// 	common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-		// }
+	}
 
-		addClueFunc(common.PP_INTERCEPTOR_NAME, cmd.Name())
-		addClueFunc(common.PP_SERVER_TYPE, common.PP_REDIS)
-		addClueFunc(common.PP_DESTINATION, p.Addr)
-		// addClueSFunc(common.PP_ARGS, cmd.String())
+	span.SetServiceType(common.PP_REDIS)
+	span.SetDestination(p.Addr)
+	// span.SetAnnotation(common.PP_ARGS, cmd.String())
 
-		newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-		return newCtx, nil
-	}
+	newCtx := context.WithValue(common.ContextWithSpan(ctx, span), spanKey{}, span)
+	return newCtx, nil
 }
 
 func (p *ppRedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
-	id, err := common.GetParentId(ctx)
-	if err != nil {
-		common.Logf("parentId is not traceId type. Dropped")
+	span, _ := ctx.Value(spanKey{}).(*common.Span)
+	if span == nil {
 		return nil
 	}
-	addClueSFunc := func(key, value string) {
-		common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-	}
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
 
 	if cmd.Name() == "eval" {
 		var keys string
@@ -86,7 +73,7 @@ func (p *ppRedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
 			keys += fmt.Sprintf(" %d:%v ", i, arg)
 		}
 
-		addClueSFunc(common.PP_RETURN, keys)
+		span.SetAnnotation(common.PP_RETURN, keys)
 	} else { // maximum is 100
 		cmdStr := cmd.String()
 		cmdSize := len(cmdStr)
@@ -94,55 +81,44 @@ func (p *ppRedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
 			cmdSize = 100
 		}
 
-		addClueSFunc(common.PP_RETURN, cmdStr[:cmdSize])
+		span.SetAnnotation(common.PP_RETURN, cmdStr[:cmdSize])
 	}
 
 	if cmd.Err() != nil {
-		addClueFunc(common.PP_ADD_EXCEPTION, cmd.Err().Error())
-		common.Pinpoint_mark_error(cmd.Err().Error(), fmt.Sprint(cmd.Args()[0]), 0, id)
+		span.RecordError(cmd.Err())
 	}
-	common.Pinpoint_end_trace(id)
+	span.End()
 	return nil
 }
 
 func (p *ppRedisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
 	common.Logf("call BeforeProcessPipeline")
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type. Dropped")
+	span := common.SpanFromContext(ctx).Child("(*redis).Pipeline")
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return ctx, nil
-	} else {
-		id := common.Pinpoint_start_trace(parentId)
-
-		addClueFunc := func(key, value string) {
-			common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-		}
+	}
 
-		addClueFunc(common.PP_INTERCEPTOR_NAME, "(*redis).Pipeline")
-		addClueFunc(common.PP_SERVER_TYPE, common.PP_REDIS)
-		addClueFunc(common.PP_DESTINATION, p.Addr)
+	span.SetServiceType(common.PP_REDIS)
+	span.SetDestination(p.Addr)
 
-		newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-		return newCtx, nil
-	}
+	newCtx := context.WithValue(common.ContextWithSpan(ctx, span), spanKey{}, span)
+	return newCtx, nil
 }
 
 func (p *ppRedisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
-	id, err := common.GetParentId(ctx)
-	if err != nil {
-		common.Logf("parentId is not traceId type. Dropped")
+	span, _ := ctx.Value(spanKey{}).(*common.Span)
+	if span == nil {
 		return nil
 	}
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
+
 	for _, cmd := range cmds {
 		if cmd.Err() != nil {
-			addClueFunc(common.PP_ADD_EXCEPTION, cmd.Err().Error())
-			common.Pinpoint_mark_error(cmd.Err().Error(), "pipeline", 0, id)
+			span.RecordError(cmd.Err())
 			break // only catch the first error
 		}
 	}
-	common.Pinpoint_end_trace(id)
+	span.End()
 	return nil
 }
 
@@ -17,9 +17,44 @@
 package redisv8
 
 import (
+	"context"
+	"strings"
 	"testing"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+	"github.com/pinpoint-apm/go-aop-agent/common/pptest"
 )
 
 func TestHook(t *testing.T) {
-	// just call init
+	r := pptest.Start(t)
+	// nobody listens on port 1, every command fails at once
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+
+	ctx, end := r.StartTrace(context.Background(), "TestHook")
+	err := client.Get(ctx, "user:7").Err()
+	if err == nil {
+		t.Fatal("get should fail")
+	}
+	_, pipeErr := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "user:7", "tom", 0)
+		return nil
+	})
+	if pipeErr == nil {
+		t.Fatal("pipeline should fail")
+	}
+	end()
+
+	get := r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_REDIS, common.PP_INTERCEPTOR_NAME, "get",
+		common.PP_DESTINATION, "redis:127.0.0.1:1(0)")
+	r.AssertException(get, err.Error())
+	r.AssertError(get, err.Error())
+	pipe := r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_REDIS, common.PP_INTERCEPTOR_NAME, "(*redis).Pipeline")
+	r.AssertException(pipe, pipeErr.Error())
+	// the error is marked where the hook found it
+	if e := pipe.Root().Error; !strings.HasSuffix(e.File, "hookAndTrampoline.go") || e.Line == 0 {
+		t.Errorf("error at %s:%d", e.File, e.Line)
+	}
 }
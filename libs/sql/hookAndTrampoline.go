@@ -60,27 +60,19 @@ func hook_query_trampoline(db *sql.DB, ctx context.Context, query string, args .
 
 //go:noinline
 func hook_query(db *sql.DB, ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
-	funcName := get_func_name((*sql.DB).QueryContext)
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child(get_func_name((*sql.DB).QueryContext))
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_query_trampoline(db, ctx, query, args...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_query_trampoline(db, ctx, query, args...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		newCtx := onBefore(subTraceId, funcName, db, ctx, query, args...)
-		res, err := hook_query_trampoline(db, *newCtx, query, args...)
-		if err != nil {
-			onException(subTraceId, &err)
-		}
-		queryonEnd(subTraceId, res)
-		return res, err
 	}
+	defer span.End()
+
+	newCtx := onBefore(span, db, ctx, query, args...)
+	res, err := hook_query_trampoline(db, newCtx, query, args...)
+	if err != nil {
+		onException(span, err)
+	}
+	return res, err
 }
 
 /////////////////////sql.DB.ExecContext///////////////////////////
@@ -91,27 +83,19 @@ func hook_exec_trampoline(db *sql.DB, ctx context.Context, query string, args ..
 
 //go:noinline
 func hook_exec(db *sql.DB, ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
-	funcName := get_func_name((*sql.DB).ExecContext)
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child(get_func_name((*sql.DB).ExecContext))
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_exec_trampoline(db, ctx, query, args...)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_exec_trampoline(db, ctx, query, args...)
-		}
-
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		newCtx := onBefore(subTraceId, funcName, db, ctx, query, args...)
-		res, err := hook_exec_trampoline(db, *newCtx, query, args...)
-		if err != nil {
-			onException(subTraceId, &err)
-		}
-		execonEnd(subTraceId, res)
-		return res, err
 	}
+	defer span.End()
+
+	newCtx := onBefore(span, db, ctx, query, args...)
+	res, err := hook_exec_trampoline(db, newCtx, query, args...)
+	if err != nil {
+		onException(span, err)
+	}
+	return res, err
 }
 
 /////////////////////sql.DB.PingContext///////////////////////////
@@ -122,24 +106,17 @@ func hook_ping_trampoline(db *sql.DB, ctx context.Context) error {
 
 //go:noinline
 func hook_ping(db *sql.DB, ctx context.Context) error {
-	funcName := get_func_name((*sql.DB).PingContext)
-	if parentId, err := common.GetParentId(ctx); err != nil {
-		common.Logf("parentId is not traceId type")
+	span := common.SpanFromContext(ctx).Child(get_func_name((*sql.DB).PingContext))
+	if span == nil {
+		common.Logf("not traced or trace dropped")
 		return hook_ping_trampoline(db, ctx)
-	} else {
-		if common.Pinpoint_get_context(common.PP_HEADER_PINPOINT_SAMPLED, parentId) == common.PP_NOT_SAMPLED {
-			common.Logf("trace dropped")
-			return hook_ping_trampoline(db, ctx)
-		}
-		subTraceId := common.Pinpoint_start_trace(parentId)
-		defer common.Pinpoint_end_trace(subTraceId)
-
-		newCtx := pingonBefore(subTraceId, funcName, db, ctx)
-		err := hook_ping_trampoline(db, *newCtx)
-		if err != nil {
-			onException(subTraceId, &err)
-		}
-		pingonEnd(subTraceId, &err)
-		return err
 	}
+	defer span.End()
+
+	newCtx := pingonBefore(span, db, ctx)
+	err := hook_ping_trampoline(db, newCtx)
+	if err != nil {
+		onException(span, err)
+	}
+	return err
 }
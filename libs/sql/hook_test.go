@@ -17,9 +17,108 @@
 package sql
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"runtime"
 	"testing"
+
+	"github.com/pinpoint-apm/go-aop-agent/common"
+	"github.com/pinpoint-apm/go-aop-agent/common/pptest"
 )
 
+// fakeDriver answers every query with no rows, the query "fail" fails
+type fakeDriver struct{}
+
+type fakeConn struct{}
+
+type fakeStmt struct {
+	query string
+}
+
+type fakeRows struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{}, nil }
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{query}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transaction") }
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.query == "fail" {
+		return nil, errors.New("syntax error")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.query == "fail" {
+		return nil, errors.New("syntax error")
+	}
+	return fakeRows{}, nil
+}
+
+func (fakeRows) Columns() []string              { return []string{"id"} }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("pptest", fakeDriver{})
+}
+
 func TestHook(t *testing.T) {
-	// just call init
+	r := pptest.Start(t)
+	db, err := sql.Open("pptest", "user:password@tcp(127.0.0.1:3306)/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, end := r.StartTrace(context.Background(), "TestHook")
+	if err := db.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.QueryContext(ctx, "select id from user where name = ?", "tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	_, file, line, _ := runtime.Caller(0)
+	if _, err := db.ExecContext(ctx, "fail"); err == nil {
+		t.Fatal("exec should fail")
+	}
+	end()
+
+	r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_MYSQL, common.PP_DESTINATION, "127.0.0.1:3306",
+		common.PP_INTERCEPTOR_NAME, "database/sql.*DB.PingContext")
+	r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_MYSQL, common.PP_SQL_FORMAT, "select id from user where name = ?")
+	failed := r.AssertChildOfRoot(common.PP_SERVER_TYPE, common.PP_MYSQL, common.PP_SQL_FORMAT, "fail")
+	r.AssertException(failed, "syntax error")
+	r.AssertError(failed, "syntax error")
+	// at the application, not in the hook
+	if e := r.Trace().Error; e.File != file || int(e.Line) != line+1 {
+		t.Errorf("error at %s:%d, want %s:%d", e.File, e.Line, file, line+1)
+	}
+}
+
+func TestNotTraced(t *testing.T) {
+	r := pptest.Start(t)
+	db, err := sql.Open("pptest", "user:password@tcp(127.0.0.1:3306)/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// no trace in ctx, nothing recorded
+	if _, err := db.ExecContext(context.Background(), "delete from user"); err != nil {
+		t.Fatal(err)
+	}
+	if traces := r.Traces(); len(traces) != 0 {
+		t.Fatalf("%d traces recorded", len(traces))
+	}
 }
@@ -19,64 +19,63 @@ package sql
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"reflect"
 	"runtime"
+	"strings"
 
 	"github.com/pinpoint-apm/go-aop-agent/aop"
 	"github.com/pinpoint-apm/go-aop-agent/common"
 )
 
-func onBefore(id common.TraceIdType, funcName string, db *sql.DB, ctx context.Context, query string, args ...interface{}) *context.Context {
+func onBefore(span *common.Span, db *sql.DB, ctx context.Context, query string, args ...interface{}) context.Context {
 	common.Logf("call onBefore")
 
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueFunc(common.PP_INTERCEPTOR_NAME, funcName)
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_MYSQL)
-	addClueFunc(common.PP_DESTINATION, gethost(DBMap[db].dataSourceName))
-	addClueFunc(common.PP_SQL_FORMAT, query)
+	span.SetServiceType(common.PP_MYSQL)
+	span.SetDestination(gethost(DBMap[db].dataSourceName))
+	span.SetSQL(query)
 
-	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-	return &newCtx
+	return common.ContextWithSpan(ctx, span)
 }
 
-func pingonBefore(id common.TraceIdType, funcName string, db *sql.DB, ctx context.Context) *context.Context {
+func pingonBefore(span *common.Span, db *sql.DB, ctx context.Context) context.Context {
 	common.Logf("call onBefore")
 
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-	}
-
-	addClueFunc(common.PP_INTERCEPTOR_NAME, funcName)
-	addClueFunc(common.PP_SERVER_TYPE, common.PP_MYSQL)
-	addClueFunc(common.PP_DESTINATION, gethost(DBMap[db].dataSourceName))
+	span.SetServiceType(common.PP_MYSQL)
+	span.SetDestination(gethost(DBMap[db].dataSourceName))
 
-	newCtx := context.WithValue(ctx, common.TRACE_ID, id)
-	return &newCtx
+	return common.ContextWithSpan(ctx, span)
 }
 
-func queryonEnd(id common.TraceIdType, res *sql.Rows) {
-
-}
-
-func execonEnd(id common.TraceIdType, res sql.Result) {
-
+func onException(span *common.Span, err error) {
+	common.Logf("call onException")
+	file, line := callerOfDB()
+	span.RecordErrorAt(err, file, line)
 }
 
-func pingonEnd(id common.TraceIdType, err *error) {
-
-}
+// the hooks of this package, named hook_*
+var hookPrefix = reflect.TypeOf(DSN{}).PkgPath() + ".hook_"
 
-func onException(id common.TraceIdType, err *error) {
-	common.Logf("call onException")
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
+/**
+ * @description: the application frame calling database/sql, the first one above the hook
+ *  which is not in database/sql
+ * @param {*}
+ * @return {*} file and line, "" if not found
+ */
+func callerOfDB() (string, int) {
+	pc := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(2, pc)])
+	hooked := false
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, hookPrefix) {
+			hooked = true
+		} else if hooked && !strings.HasPrefix(frame.Function, "database/sql.") {
+			return frame.File, frame.Line
+		}
+		if !more {
+			return "", 0
+		}
 	}
-	addClueFunc(common.PP_ADD_EXCEPTION, fmt.Sprint(*err))
-	common.Pinpoint_mark_error(fmt.Sprint(*err), "", 0, id)
 }
 
 func hook_common_func(f interface{}, hook_f interface{}, hook_f_trampoline interface{}) {
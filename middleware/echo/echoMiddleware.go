@@ -17,7 +17,6 @@
 package echo
 
 import (
-	"context"
 	"net/http"
 	"strconv"
 
@@ -40,44 +39,35 @@ func PinpointMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
 			return next(c)
 		}
 
-		id := common.Pinpoint_start_trace(common.ROOT_TRACE)
-		addClueFunc := func(key, value string) {
-			common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-		}
-
-		addCluesFunc := func(key, value string) {
-			common.Pinpoint_add_clues(key, value, id, common.CurrentTraceLoc)
-		}
+		span := common.StartSpan("echo middleware request")
 		catchPanic := true
 		defer func() {
 			if c.Response() != nil {
-				common.Pinpoint_add_clues(common.PP_HTTP_STATUS_CODE, strconv.Itoa(c.Response().Status), id, common.CurrentTraceLoc)
+				span.SetAnnotation(common.PP_HTTP_STATUS_CODE, strconv.Itoa(c.Response().Status))
 
 				if c.Response().Status >= http.StatusBadRequest {
-					common.Pinpoint_mark_error("request failed", "PinpointMiddleWare", 0, id)
+					span.MarkError("request failed")
 				}
 			}
 
 			if catchPanic {
-				common.Pinpoint_mark_error("PinpointMiddleWare found a panic! o_o ....", "", 0, id)
+				span.MarkError("PinpointMiddleWare found a panic! o_o ....")
 			}
 
-			common.Pinpoint_end_trace(id)
+			span.End()
 		}()
 
-		nCtx := context.WithValue(c.Request().Context(), common.TRACE_ID, id)
+		nCtx := common.ContextWithSpan(c.Request().Context(), span)
 		nReq := c.Request().WithContext(nCtx)
 
-		// common.Logf("start trace:%d", id)
-		addClueFunc(common.PP_APP_NAME, common.Appname)
-		addClueFunc(common.PP_APP_ID, common.Appid)
-		addClueFunc(common.PP_INTERCEPTOR_NAME, "echo middleware request")
+		span.SetClue(common.PP_APP_NAME, common.Appname)
+		span.SetClue(common.PP_APP_ID, common.Appid)
 
-		addClueFunc(common.PP_REQ_URI, url)
-		addClueFunc(common.PP_REQ_SERVER, c.Request().Host)
-		addClueFunc(common.PP_REQ_CLIENT, c.Request().RemoteAddr)
-		addClueFunc(common.PP_SERVER_TYPE, common.GOLANG)
-		common.Pinpoint_set_context(common.PP_SERVER_TYPE, common.GOLANG, id)
+		span.SetClue(common.PP_REQ_URI, url)
+		span.SetClue(common.PP_REQ_SERVER, c.Request().Host)
+		span.SetClue(common.PP_REQ_CLIENT, c.Request().RemoteAddr)
+		span.SetServiceType(common.GOLANG)
+		span.SetContext(common.PP_SERVER_TYPE, common.GOLANG)
 
 		var sid string
 		if value := c.Request().Header.Get(common.PP_HEADER_PINPOINT_SPANID); value != "" {
@@ -86,8 +76,8 @@ func PinpointMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
 			sid = common.Pinpoint_gen_sid()
 		}
 
-		addClueFunc(common.PP_SPAN_ID, sid)
-		common.Pinpoint_set_context(common.PP_SPAN_ID, sid, id)
+		span.SetClue(common.PP_SPAN_ID, sid)
+		span.SetContext(common.PP_SPAN_ID, sid)
 
 		var tid string
 		if value := c.Request().Header.Get(common.PP_HTTP_PINPOINT_TRACEID); value != "" {
@@ -98,61 +88,60 @@ func PinpointMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
 			tid = common.Pinpoint_gen_tid()
 		}
 
-		addClueFunc(common.PP_TRANSCATION_ID, tid)
-		common.Pinpoint_set_context(common.PP_TRANSCATION_ID, tid, id)
+		span.SetClue(common.PP_TRANSCATION_ID, tid)
+		span.SetContext(common.PP_TRANSCATION_ID, tid)
 
 		if value := c.Request().Header.Get(common.PP_HTTP_PINPOINT_PAPPTYPE); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_TYPE, value, id)
-			addClueFunc(common.PP_PARENT_TYPE, value)
+			span.SetContext(common.PP_PARENT_TYPE, value)
+			span.SetClue(common.PP_PARENT_TYPE, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HEADER_PINPOINT_PAPPTYPE); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_TYPE, value, id)
-			addClueFunc(common.PP_PARENT_TYPE, value)
+			span.SetContext(common.PP_PARENT_TYPE, value)
+			span.SetClue(common.PP_PARENT_TYPE, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HTTP_PINPOINT_HOST); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_HOST, value, id)
-			addClueFunc(common.PP_PARENT_HOST, value)
+			span.SetContext(common.PP_PARENT_HOST, value)
+			span.SetClue(common.PP_PARENT_HOST, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HEADER_PINPOINT_HOST); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_HOST, value, id)
-			addClueFunc(common.PP_PARENT_HOST, value)
+			span.SetContext(common.PP_PARENT_HOST, value)
+			span.SetClue(common.PP_PARENT_HOST, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HTTP_PINPOINT_PSPANID); value != "" {
-			addClueFunc(common.PP_PARENT_SPAN_ID, value)
+			span.SetClue(common.PP_PARENT_SPAN_ID, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HEADER_PINPOINT_PSPANID); value != "" {
-			addClueFunc(common.PP_PARENT_SPAN_ID, value)
+			span.SetClue(common.PP_PARENT_SPAN_ID, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HEADER_PINPOINT_PAPPNAME); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_NAME, value, id)
-			addClueFunc(common.PP_PARENT_NAME, value)
+			span.SetContext(common.PP_PARENT_NAME, value)
+			span.SetClue(common.PP_PARENT_NAME, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HTTP_PINPOINT_PAPPNAME); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_NAME, value, id)
-			addClueFunc(common.PP_PARENT_NAME, value)
+			span.SetContext(common.PP_PARENT_NAME, value)
+			span.SetClue(common.PP_PARENT_NAME, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HEADER_NGINX_PROXY); value != "" {
-			addClueFunc(common.PP_NGINX_PROXY, value)
+			span.SetClue(common.PP_NGINX_PROXY, value)
 		}
 
 		if value := c.Request().Header.Get(common.PP_HEADER_APACHE_PROXY); value != "" {
-			addClueFunc(common.PP_APACHE_PROXY, value)
+			span.SetClue(common.PP_APACHE_PROXY, value)
 		}
-		common.Pinpoint_set_context(common.PP_HEADER_PINPOINT_SAMPLED, "s1", id)
+		common.ReadBaggage(span, c.Request().Header)
 
 		if value := c.Request().Header.Get(common.PP_HTTP_PINPOINT_SAMPLED); value == common.PP_NOT_SAMPLED || common.Pinpoint_tracelimit() {
-			common.Pinpoint_drop_trace(id)
-			common.Pinpoint_set_context(common.PP_HEADER_PINPOINT_SAMPLED, "s0", id)
+			span.Drop()
 		}
-		addCluesFunc(common.PP_HTTP_METHOD, c.Request().Method)
+		span.SetAnnotation(common.PP_HTTP_METHOD, c.Request().Method)
 		c.SetRequest(nReq)
 		err = next(c)
 		catchPanic = false
@@ -164,8 +153,6 @@ func PinpointErrorHandler(originHandler func(e error, c echo.Context)) func(e er
 
 	return func(e error, c echo.Context) {
 		originHandler(e, c)
-		if id, err := common.GetParentId(c.Request().Context()); err == nil {
-			common.Pinpoint_mark_error(e.Error(), "", 0, id)
-		}
+		common.SpanFromContext(c.Request().Context()).MarkError(e.Error())
 	}
 }
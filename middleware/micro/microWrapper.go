@@ -9,36 +9,29 @@ import (
 )
 
 func pinpointMiddleware(ctx context.Context, req server.Request, rsp interface{}, originFn server.HandlerFunc) error {
-	traceId := common.Pinpoint_start_trace(common.ROOT_TRACE)
-	addClueFunc := func(key, value string) {
-		common.Pinpoint_add_clue(key, value, traceId, common.CurrentTraceLoc)
-	}
-	addCluesFunc := func(key, value string) {
-		common.Pinpoint_add_clues(key, value, traceId, common.CurrentTraceLoc)
-	}
+	span := common.StartSpan("echo middleware request")
 
 	catchPanic := true
 	defer func() {
 		if catchPanic {
-			common.Pinpoint_mark_error("PinpointHandle found a panic! o_o ....", "", 0, traceId)
+			span.MarkError("PinpointHandle found a panic! o_o ....")
 		}
-		common.Pinpoint_end_trace(traceId)
+		span.End()
 	}()
 
-	addClueFunc(common.PP_APP_NAME, common.Appname)
-	addClueFunc(common.PP_APP_ID, common.Appid)
-	addClueFunc(common.PP_INTERCEPTOR_NAME, "echo middleware request")
+	span.SetClue(common.PP_APP_NAME, common.Appname)
+	span.SetClue(common.PP_APP_ID, common.Appid)
 
-	addClueFunc(common.PP_REQ_URI, req.Service())
-	addClueFunc(common.PP_REQ_SERVER, req.Service())
+	span.SetClue(common.PP_REQ_URI, req.Service())
+	span.SetClue(common.PP_REQ_SERVER, req.Service())
 
 	if p, ok := peer.FromContext(ctx); ok {
 		//https://github.com/asim/go-micro/commit/d8e998ad85feac9288dd34dfb2dd75ce66bde6f4
-		addClueFunc(common.PP_REQ_CLIENT, p.Addr.String())
+		span.SetClue(common.PP_REQ_CLIENT, p.Addr.String())
 	}
 
-	addClueFunc(common.PP_SERVER_TYPE, common.GOLANG)
-	common.Pinpoint_set_context(common.PP_SERVER_TYPE, common.GOLANG, traceId)
+	span.SetServiceType(common.GOLANG)
+	span.SetContext(common.PP_SERVER_TYPE, common.GOLANG)
 
 	header := req.Header()
 	var sid string
@@ -48,8 +41,8 @@ func pinpointMiddleware(ctx context.Context, req server.Request, rsp interface{}
 		sid = common.Pinpoint_gen_sid()
 	}
 
-	addClueFunc(common.PP_SPAN_ID, sid)
-	common.Pinpoint_set_context(common.PP_SPAN_ID, sid, traceId)
+	span.SetClue(common.PP_SPAN_ID, sid)
+	span.SetContext(common.PP_SPAN_ID, sid)
 
 	var tid string
 	if value, OK := header[common.PP_HTTP_PINPOINT_TRACEID]; OK {
@@ -59,64 +52,63 @@ func pinpointMiddleware(ctx context.Context, req server.Request, rsp interface{}
 	} else {
 		tid = common.Pinpoint_gen_tid()
 	}
-	addClueFunc(common.PP_TRANSCATION_ID, tid)
-	common.Pinpoint_set_context(common.PP_TRANSCATION_ID, tid, traceId)
+	span.SetClue(common.PP_TRANSCATION_ID, tid)
+	span.SetContext(common.PP_TRANSCATION_ID, tid)
 
 	if value, OK := header[common.PP_HTTP_PINPOINT_PAPPTYPE]; OK {
-		common.Pinpoint_set_context(common.PP_PARENT_TYPE, value, traceId)
-		addClueFunc(common.PP_PARENT_TYPE, value)
+		span.SetContext(common.PP_PARENT_TYPE, value)
+		span.SetClue(common.PP_PARENT_TYPE, value)
 	}
 
 	if value, OK := header[common.PP_HEADER_PINPOINT_PAPPTYPE]; OK {
-		common.Pinpoint_set_context(common.PP_PARENT_TYPE, value, traceId)
-		addClueFunc(common.PP_PARENT_TYPE, value)
+		span.SetContext(common.PP_PARENT_TYPE, value)
+		span.SetClue(common.PP_PARENT_TYPE, value)
 	}
 
 	if value, OK := header[common.PP_HTTP_PINPOINT_HOST]; OK {
-		common.Pinpoint_set_context(common.PP_PARENT_HOST, value, traceId)
-		addClueFunc(common.PP_PARENT_HOST, value)
+		span.SetContext(common.PP_PARENT_HOST, value)
+		span.SetClue(common.PP_PARENT_HOST, value)
 	}
 
 	if value, ok := header[common.PP_HEADER_PINPOINT_HOST]; ok {
-		common.Pinpoint_set_context(common.PP_PARENT_HOST, value, traceId)
-		addClueFunc(common.PP_PARENT_HOST, value)
+		span.SetContext(common.PP_PARENT_HOST, value)
+		span.SetClue(common.PP_PARENT_HOST, value)
 	}
 
 	if value, ok := header[common.PP_HTTP_PINPOINT_PSPANID]; ok {
-		addClueFunc(common.PP_PARENT_SPAN_ID, value)
+		span.SetClue(common.PP_PARENT_SPAN_ID, value)
 	}
 
 	if value, ok := header[common.PP_HEADER_PINPOINT_PSPANID]; ok {
-		addClueFunc(common.PP_PARENT_SPAN_ID, value)
+		span.SetClue(common.PP_PARENT_SPAN_ID, value)
 	}
 
 	if value, ok := header[common.PP_HEADER_PINPOINT_PAPPNAME]; ok {
-		common.Pinpoint_set_context(common.PP_PARENT_NAME, value, traceId)
-		addClueFunc(common.PP_PARENT_NAME, value)
+		span.SetContext(common.PP_PARENT_NAME, value)
+		span.SetClue(common.PP_PARENT_NAME, value)
 	}
 
 	if value, ok := header[common.PP_HTTP_PINPOINT_PAPPNAME]; ok {
-		common.Pinpoint_set_context(common.PP_PARENT_NAME, value, traceId)
-		addClueFunc(common.PP_PARENT_NAME, value)
+		span.SetContext(common.PP_PARENT_NAME, value)
+		span.SetClue(common.PP_PARENT_NAME, value)
 	}
 
 	if value, ok := header[common.PP_HEADER_NGINX_PROXY]; ok {
-		addClueFunc(common.PP_NGINX_PROXY, value)
+		span.SetClue(common.PP_NGINX_PROXY, value)
 	}
 
 	if value, ok := header[common.PP_HEADER_APACHE_PROXY]; ok {
-		addClueFunc(common.PP_APACHE_PROXY, value)
+		span.SetClue(common.PP_APACHE_PROXY, value)
 	}
-	common.Pinpoint_set_context(common.PP_HEADER_PINPOINT_SAMPLED, "s1", traceId)
+	common.ReadBaggageMap(span, header)
 
 	if value, ok := header[common.PP_HTTP_PINPOINT_SAMPLED]; ok && (value == common.PP_NOT_SAMPLED || common.Pinpoint_tracelimit()) {
-		common.Pinpoint_drop_trace(traceId)
-		common.Pinpoint_set_context(common.PP_HEADER_PINPOINT_SAMPLED, "s0", traceId)
+		span.Drop()
 	}
-	addCluesFunc(common.PP_HTTP_METHOD, "9162")
+	span.SetAnnotation(common.PP_HTTP_METHOD, "9162")
 
 	// update context
-	nCtx := context.WithValue(ctx, common.TRACE_ID, traceId)
+	nCtx := common.ContextWithSpan(ctx, span)
 	err := originFn(nCtx, req, rsp)
 	catchPanic = false
 	return err
@@ -17,7 +17,6 @@
 package mux
 
 import (
-	"context"
 	"net/http"
 	"strconv"
 
@@ -52,34 +51,27 @@ func PinpointMuxMiddleWare(next http.Handler) http.Handler {
 		// Call the next handler, which can be another middleware in the chain, or the final handler.
 		pp := wrapperResponseWriter(w)
 		// start trace
-		id := common.Pinpoint_start_trace(common.ROOT_TRACE)
-		addClueFunc := func(key, value string) {
-			common.Pinpoint_add_clue(key, value, id, common.CurrentTraceLoc)
-		}
+		span := common.StartSpan("mux middleware request")
 		// end trace
 		defer func() {
 			if pp != nil {
-				common.Pinpoint_add_clues(common.PP_HTTP_STATUS_CODE, strconv.Itoa(pp.statusCode), id, common.CurrentTraceLoc)
+				span.SetAnnotation(common.PP_HTTP_STATUS_CODE, strconv.Itoa(pp.statusCode))
 			}
-			common.Pinpoint_end_trace(id)
-			// common.Logf("end trace:%d", id)
+			span.End()
 		}()
 
-		nCtx := context.WithValue(r.Context(), common.TRACE_ID, id)
-		pinpointRequest := r.WithContext(nCtx)
+		pinpointRequest := r.WithContext(common.ContextWithSpan(r.Context(), span))
 
-		// common.Logf("start trace:%d", id)
-		addClueFunc(common.PP_APP_NAME, common.Appname)
-		addClueFunc(common.PP_APP_ID, common.Appid)
-		addClueFunc(common.PP_INTERCEPTOR_NAME, "mux middleware request")
+		span.SetClue(common.PP_APP_NAME, common.Appname)
+		span.SetClue(common.PP_APP_ID, common.Appid)
 
-		addClueFunc(common.PP_REQ_URI, pinpointRequest.RequestURI)
-		addClueFunc(common.PP_REQ_SERVER, pinpointRequest.Host)
-		addClueFunc(common.PP_REQ_CLIENT, pinpointRequest.RemoteAddr)
-		addClueFunc(common.PP_SERVER_TYPE, common.GOLANG)
-		common.Pinpoint_set_context(common.PP_SERVER_TYPE, common.GOLANG, id)
+		span.SetClue(common.PP_REQ_URI, pinpointRequest.RequestURI)
+		span.SetClue(common.PP_REQ_SERVER, pinpointRequest.Host)
+		span.SetClue(common.PP_REQ_CLIENT, pinpointRequest.RemoteAddr)
+		span.SetServiceType(common.GOLANG)
+		span.SetContext(common.PP_SERVER_TYPE, common.GOLANG)
 		if value := pinpointRequest.Header.Get(common.PP_HTTP_PINPOINT_PSPANID); value != "" {
-			addClueFunc(common.PP_PARENT_SPAN_ID, value)
+			span.SetClue(common.PP_PARENT_SPAN_ID, value)
 		}
 		var sid string
 		if value := pinpointRequest.Header.Get(common.PP_HTTP_PINPOINT_SPANID); value != "" {
@@ -89,8 +81,8 @@ func PinpointMuxMiddleWare(next http.Handler) http.Handler {
 		} else {
 			sid = common.Pinpoint_gen_sid()
 		}
-		addClueFunc(common.PP_SPAN_ID, sid)
-		common.Pinpoint_set_context(common.PP_SPAN_ID, sid, id)
+		span.SetClue(common.PP_SPAN_ID, sid)
+		span.SetContext(common.PP_SPAN_ID, sid)
 
 		var tid string
 		if value := pinpointRequest.Header.Get(common.PP_HTTP_PINPOINT_TRACEID); value != "" {
@@ -100,51 +92,51 @@ func PinpointMuxMiddleWare(next http.Handler) http.Handler {
 		} else {
 			tid = common.Pinpoint_gen_tid()
 		}
-		addClueFunc(common.PP_TRANSCATION_ID, tid)
-		common.Pinpoint_set_context(common.PP_TRANSCATION_ID, tid, id)
+		span.SetClue(common.PP_TRANSCATION_ID, tid)
+		span.SetContext(common.PP_TRANSCATION_ID, tid)
 
 		if value := pinpointRequest.Header.Get(common.PP_HTTP_PINPOINT_PAPPNAME); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_NAME, value, id)
-			addClueFunc(common.PP_PARENT_NAME, value)
+			span.SetContext(common.PP_PARENT_NAME, value)
+			span.SetClue(common.PP_PARENT_NAME, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HTTP_PINPOINT_PAPPTYPE); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_TYPE, value, id)
-			addClueFunc(common.PP_PARENT_TYPE, value)
+			span.SetContext(common.PP_PARENT_TYPE, value)
+			span.SetClue(common.PP_PARENT_TYPE, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HTTP_PINPOINT_HOST); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_HOST, value, id)
-			addClueFunc(common.PP_PARENT_HOST, value)
+			span.SetContext(common.PP_PARENT_HOST, value)
+			span.SetClue(common.PP_PARENT_HOST, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HEADER_PINPOINT_PSPANID); value != "" {
-			addClueFunc(common.PP_PARENT_SPAN_ID, value)
+			span.SetClue(common.PP_PARENT_SPAN_ID, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HEADER_PINPOINT_PAPPNAME); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_NAME, value, id)
-			addClueFunc(common.PP_PARENT_NAME, value)
+			span.SetContext(common.PP_PARENT_NAME, value)
+			span.SetClue(common.PP_PARENT_NAME, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HEADER_PINPOINT_PAPPTYPE); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_TYPE, value, id)
-			addClueFunc(common.PP_PARENT_TYPE, value)
+			span.SetContext(common.PP_PARENT_TYPE, value)
+			span.SetClue(common.PP_PARENT_TYPE, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HEADER_PINPOINT_HOST); value != "" {
-			common.Pinpoint_set_context(common.PP_PARENT_HOST, value, id)
-			addClueFunc(common.PP_PARENT_HOST, value)
+			span.SetContext(common.PP_PARENT_HOST, value)
+			span.SetClue(common.PP_PARENT_HOST, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HEADER_NGINX_PROXY); value != "" {
-			addClueFunc(common.PP_NGINX_PROXY, value)
+			span.SetClue(common.PP_NGINX_PROXY, value)
 		}
 
 		if value := pinpointRequest.Header.Get(common.PP_HEADER_APACHE_PROXY); value != "" {
-			addClueFunc(common.PP_APACHE_PROXY, value)
+			span.SetClue(common.PP_APACHE_PROXY, value)
 		}
-		common.Pinpoint_set_context(common.PP_HEADER_PINPOINT_SAMPLED, "s1", id)
+		common.ReadBaggage(span, pinpointRequest.Header)
 
 		dropCurTrace := false
 
@@ -157,11 +149,10 @@ func PinpointMuxMiddleWare(next http.Handler) http.Handler {
 		}
 
 		if dropCurTrace {
-			common.Pinpoint_drop_trace(id)
-			common.Pinpoint_set_context(common.PP_HEADER_PINPOINT_SAMPLED, "s0", id)
+			span.Drop()
 		}
 
-		addClueFunc(common.PP_HTTP_METHOD, pinpointRequest.Method)
+		span.SetClue(common.PP_HTTP_METHOD, pinpointRequest.Method)
 		next.ServeHTTP(pp, pinpointRequest)
 
 	})